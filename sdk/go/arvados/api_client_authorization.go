@@ -8,5 +8,11 @@ type APIClientAuthorization struct {
 
 // APIClientAuthorizationList is an arvados#apiClientAuthorizationList resource.
 type APIClientAuthorizationList struct {
-	Items []APIClientAuthorization `json:"items"`
+	Items          []APIClientAuthorization `json:"items"`
+	ItemsAvailable int                      `json:"items_available"`
+	Offset         int                      `json:"offset"`
+	Limit          int                      `json:"limit"`
 }
+
+func (APIClientAuthorization) resourceName() string     { return "api_client_authorization" }
+func (APIClientAuthorizationList) resourceName() string { return "api_client_authorization" }
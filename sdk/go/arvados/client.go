@@ -1,6 +1,7 @@
 package arvados
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -41,6 +42,16 @@ type Client struct {
 	// callers who use a Client to initialize an
 	// arvadosclient.ArvadosClient.)
 	KeepServiceURIs []string
+
+	// Policy for retrying requests that fail with a network
+	// error or a transient HTTP error (see RetryPolicy). If nil,
+	// requests are not retried.
+	RetryPolicy *RetryPolicy
+
+	// Context used for requests made by this client, unless
+	// overridden by a *Context method or a request that already
+	// has a non-default context. See WithContext.
+	ctx context.Context
 }
 
 // The default http.Client used by a Client with Insecure==true and
@@ -63,20 +74,84 @@ func NewClientFromEnv() *Client {
 	if s := os.Getenv("ARVADOS_KEEP_SERVICES"); s != "" {
 		svcs = strings.Split(s, " ")
 	}
+	policy := DefaultRetryPolicy
 	return &Client{
 		APIHost:         os.Getenv("ARVADOS_API_HOST"),
 		AuthToken:       os.Getenv("ARVADOS_API_TOKEN"),
 		Insecure:        os.Getenv("ARVADOS_API_HOST_INSECURE") != "",
 		KeepServiceURIs: svcs,
+		RetryPolicy:     &policy,
+	}
+}
+
+// WithContext returns a copy of the client that uses the given
+// context for all requests, including those made by convenience
+// methods like Get, List, and NewListIterator. Requests are aborted
+// when ctx is cancelled or its deadline expires.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+func (c *Client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
 	}
+	return c.ctx
 }
 
 // Do adds authentication headers and then calls (*http.Client)Do().
+//
+// If the client was created by WithContext and req does not already
+// have a context, the client's context is attached to req.
+//
+// If c.RetryPolicy is not nil, failed requests are retried according
+// to the policy. Network errors are retried only for idempotent
+// methods (not POST), and a request with a body is retried only if
+// the body can be replayed (see http.Request.GetBody). When retries
+// are exhausted, the last response or error is returned.
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if c.ctx != nil && req.Context() == context.Background() {
+		req = req.WithContext(c.ctx)
+	}
 	if c.AuthToken != "" {
 		req.Header.Add("Authorization", "OAuth2 "+c.AuthToken)
 	}
-	return c.httpClient().Do(req)
+	if id := RequestIDFromContext(req.Context()); id != "" && req.Header.Get(HeaderRequestID) == "" {
+		req.Header.Set(HeaderRequestID, id)
+	}
+	policy := c.RetryPolicy
+	if policy == nil || (req.Body != nil && req.GetBody == nil) {
+		return c.httpClient().Do(req)
+	}
+	var resp *http.Response
+	var err error
+	for retrier := policy.Start(req.Context()); retrier.Next(); {
+		if resp != nil {
+			// Discard the previous attempt's response.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			resp = nil
+		}
+		if retrier.Attempts() > 1 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = c.httpClient().Do(req)
+		if err != nil {
+			if req.Context().Err() != nil || req.Method == "POST" {
+				return nil, err
+			}
+			continue
+		}
+		if !policy.Retryable(resp.StatusCode) {
+			return resp, nil
+		}
+		retrier.SetRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return resp, err
 }
 
 // DoAndDecode performs req and unmarshals the response (which must be
@@ -160,11 +235,20 @@ func anythingToValues(params interface{}) (url.Values, error) {
 //
 // path must not contain a query string.
 func (c *Client) RequestAndDecode(dst interface{}, method, path string, body io.Reader, params interface{}) error {
+	return c.RequestAndDecodeContext(c.context(), dst, method, path, body, params)
+}
+
+// RequestAndDecodeContext is like RequestAndDecode, but the request
+// is aborted (and an error returned) if ctx is cancelled or its
+// deadline expires before the response has been received and
+// decoded.
+func (c *Client) RequestAndDecodeContext(ctx context.Context, dst interface{}, method, path string, body io.Reader, params interface{}) error {
 	urlString := c.apiURL(path)
 	urlValues, err := anythingToValues(params)
 	if err != nil {
 		return err
 	}
+	formEncoded := false
 	if (method == "GET" || body != nil) && urlValues != nil {
 		// FIXME: what if params don't fit in URL
 		u, err := url.Parse(urlString)
@@ -173,11 +257,18 @@ func (c *Client) RequestAndDecode(dst interface{}, method, path string, body io.
 		}
 		u.RawQuery = urlValues.Encode()
 		urlString = u.String()
+	} else if urlValues != nil {
+		body = strings.NewReader(urlValues.Encode())
+		formEncoded = true
 	}
 	req, err := http.NewRequest(method, urlString, body)
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
+	if formEncoded {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
 	return c.DoAndDecode(dst, req)
 }
 
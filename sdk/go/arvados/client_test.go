@@ -2,12 +2,14 @@ package arvados
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"sync"
 	"testing"
+	"time"
 )
 
 type stubTransport struct {
@@ -83,6 +85,35 @@ func TestCurrentUser(t *testing.T) {
 	}
 }
 
+// blockingTransport waits for each request's context to be done,
+// then returns the context's error.
+type blockingTransport struct{}
+
+func (stub *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestRequestContextCancel(t *testing.T) {
+	t.Parallel()
+	c := &Client{
+		Client:  &http.Client{Transport: &blockingTransport{}},
+		APIHost: "zzzzz.arvadosapi.com",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.RequestAndDecodeContext(ctx, nil, "GET", "arvados/v1/users/current", nil, nil); err == nil {
+		t.Error("got nil error, expected context deadline error")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	var u User
+	if err := c.WithContext(ctx).Get(&u, "zzzzz-tpzed-000000000000000"); err == nil {
+		t.Error("got nil error, expected context cancelled error")
+	}
+}
+
 func TestAnythingToValues(t *testing.T) {
 	type testCase struct {
 		in interface{}
@@ -6,7 +6,7 @@ import (
 	"strings"
 	"time"
 
-	"git.curoverse.com/arvados.git/sdk/go/manifest"
+	"git.curoverse.com/arvados.git/sdk/go/keeplocator"
 )
 
 // Collection is an arvados#collection resource.
@@ -39,15 +39,12 @@ func (c *Collection) SizedDigests() ([]SizedDigest, error) {
 			return nil, fmt.Errorf("Invalid stream (<3 tokens): %q", line)
 		}
 		for _, token := range tokens[1:] {
-			if !manifest.LocatorPattern.MatchString(token) {
+			loc, err := keeplocator.Parse(token)
+			if err != nil || loc.Size < 0 {
 				// FIXME: ensure it's a file token
 				break
 			}
-			// FIXME: shouldn't assume 32 char hash
-			if i := strings.IndexRune(token[33:], '+'); i >= 0 {
-				token = token[:33+i]
-			}
-			sds = append(sds, SizedDigest(token))
+			sds = append(sds, SizedDigest(keeplocator.Locator{Hash: loc.Hash, Size: loc.Size}.String()))
 		}
 	}
 	return sds, scanner.Err()
@@ -60,3 +57,6 @@ type CollectionList struct {
 	Offset         int          `json:"offset"`
 	Limit          int          `json:"limit"`
 }
+
+func (Collection) resourceName() string     { return "collection" }
+func (CollectionList) resourceName() string { return "collection" }
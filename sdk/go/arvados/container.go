@@ -43,6 +43,9 @@ type ContainerList struct {
 	Limit          int         `json:"limit"`
 }
 
+func (Container) resourceName() string     { return "container" }
+func (ContainerList) resourceName() string { return "container" }
+
 // ContainerState is a string corresponding to a valid Container state.
 type ContainerState string
 
@@ -0,0 +1,48 @@
+package arvados
+
+import "time"
+
+// ContainerRequest is an arvados#containerRequest resource.
+type ContainerRequest struct {
+	UUID                    string                 `json:"uuid,omitempty"`
+	OwnerUUID               string                 `json:"owner_uuid,omitempty"`
+	CreatedAt               *time.Time             `json:"created_at,omitempty"`
+	ModifiedAt              *time.Time             `json:"modified_at,omitempty"`
+	Name                    string                 `json:"name,omitempty"`
+	Description             string                 `json:"description,omitempty"`
+	Properties              map[string]interface{} `json:"properties,omitempty"`
+	State                   ContainerRequestState  `json:"state,omitempty"`
+	RequestingContainerUUID string                 `json:"requesting_container_uuid,omitempty"`
+	ContainerUUID           string                 `json:"container_uuid,omitempty"`
+	ContainerCountMax       int                    `json:"container_count_max,omitempty"`
+	Mounts                  map[string]Mount       `json:"mounts,omitempty"`
+	RuntimeConstraints      RuntimeConstraints     `json:"runtime_constraints"`
+	ContainerImage          string                 `json:"container_image,omitempty"`
+	Environment             map[string]string      `json:"environment,omitempty"`
+	Cwd                     string                 `json:"cwd,omitempty"`
+	Command                 []string               `json:"command,omitempty"`
+	OutputPath              string                 `json:"output_path,omitempty"`
+	Priority                int                    `json:"priority"`
+	ExpiresAt               *time.Time             `json:"expires_at,omitempty"`
+}
+
+// ContainerRequestList is an arvados#containerRequestList resource.
+type ContainerRequestList struct {
+	Items          []ContainerRequest `json:"items"`
+	ItemsAvailable int                `json:"items_available"`
+	Offset         int                `json:"offset"`
+	Limit          int                `json:"limit"`
+}
+
+func (ContainerRequest) resourceName() string     { return "container_request" }
+func (ContainerRequestList) resourceName() string { return "container_request" }
+
+// ContainerRequestState is a string corresponding to a valid
+// ContainerRequest state.
+type ContainerRequestState string
+
+const (
+	ContainerRequestStateUncommitted = ContainerRequestState("Uncommitted")
+	ContainerRequestStateCommitted   = ContainerRequestState("Committed")
+	ContainerRequestStateFinal       = ContainerRequestState("Final")
+)
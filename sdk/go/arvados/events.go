@@ -0,0 +1,310 @@
+package arvados
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrNoEventBus is returned by (*EventStream)Err() if the API
+// server's discovery document does not advertise a websocket URL.
+var ErrNoEventBus = errors.New("API server does not provide a websocket event bus")
+
+// Delays between attempts to reconnect to the event bus after a
+// connection fails or drops.
+var eventReconnectPolicy = RetryPolicy{
+	BaseDelay: time.Second,
+	MaxDelay:  time.Minute,
+	Jitter:    0.5,
+}
+
+// An Event is a notification from the event bus that an object has
+// been created, updated, or deleted. It is a Log record, plus the
+// kind of the affected object (e.g., "arvados#container").
+type Event struct {
+	Log
+	ObjectKind string `json:"object_kind,omitempty"`
+}
+
+// OldAttributes decodes the attributes the object had before the
+// event into dst (e.g., a *Container).
+func (e *Event) OldAttributes(dst interface{}) error {
+	return e.decodeProperty("old_attributes", dst)
+}
+
+// NewAttributes decodes the attributes the object had after the
+// event into dst (e.g., a *Container).
+func (e *Event) NewAttributes(dst interface{}) error {
+	return e.decodeProperty("new_attributes", dst)
+}
+
+func (e *Event) decodeProperty(key string, dst interface{}) error {
+	attrs, ok := e.Properties[key]
+	if !ok || attrs == nil {
+		return fmt.Errorf("event %d has no %s", e.ID, key)
+	}
+	buf, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, dst)
+}
+
+// An EventFilter selects which events an EventStream receives. Each
+// non-empty field restricts the events to those matching one of the
+// given values; an empty EventFilter selects all events the client
+// is permitted to see.
+type EventFilter struct {
+	// UUIDs of the objects of interest.
+	ObjectUUIDs []string
+
+	// Event types, e.g., "create", "update", "delete".
+	EventTypes []string
+
+	// Object kinds, e.g., "arvados#container".
+	ObjectKinds []string
+}
+
+// Filters returns the EventFilter in the form used by the event
+// bus's subscribe method.
+func (f EventFilter) Filters() []Filter {
+	filters := []Filter{}
+	if len(f.ObjectUUIDs) > 0 {
+		filters = append(filters, Filter{"object_uuid", "in", f.ObjectUUIDs})
+	}
+	if len(f.EventTypes) > 0 {
+		filters = append(filters, Filter{"event_type", "in", f.EventTypes})
+	}
+	if len(f.ObjectKinds) > 0 {
+		filters = append(filters, Filter{"object_uuid", "is_a", f.ObjectKinds})
+	}
+	return filters
+}
+
+// An EventStream delivers events from the Arvados websocket event
+// bus. See (*Client)Subscribe.
+type EventStream struct {
+	// Events matching the stream's filter, in order. C is closed
+	// when the stream is closed, its context is done, or an
+	// unrecoverable error occurs (see Err).
+	C <-chan Event
+
+	client  *Client
+	filters []Filter
+	events  chan Event
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mtx    sync.Mutex
+	lastID uint64
+	err    error
+}
+
+// Subscribe connects to the API server's websocket event bus and
+// returns an EventStream that delivers the events selected by
+// filter.
+//
+// If lastLogID is non-zero, events with IDs greater than lastLogID
+// that occurred before the subscription started are delivered
+// first. If the connection drops, the stream reconnects and resumes
+// from the last event it delivered, so no events are missed or
+// repeated.
+//
+// The caller should call Close when finished with the stream, or
+// cancel ctx.
+func (c *Client) Subscribe(ctx context.Context, filter EventFilter, lastLogID uint64) *EventStream {
+	ctx, cancel := context.WithCancel(ctx)
+	events := make(chan Event)
+	s := &EventStream{
+		C:       events,
+		client:  c,
+		filters: filter.Filters(),
+		events:  events,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		lastID:  lastLogID,
+	}
+	go s.run()
+	return s
+}
+
+// Close disconnects from the event bus and closes C.
+func (s *EventStream) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Err returns the error that caused C to be closed, or nil if the
+// stream was closed by the caller.
+func (s *EventStream) Err() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.err
+}
+
+// LastLogID returns the ID of the last event delivered on C. It can
+// be passed to Subscribe to resume a stream later.
+func (s *EventStream) LastLogID() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lastID
+}
+
+// An eventBusError is a non-200 status message from the event bus.
+type eventBusError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func (e *eventBusError) Error() string {
+	return fmt.Sprintf("event bus: %d %s", e.Status, e.Message)
+}
+
+// permanent returns true if reconnecting would not help, e.g., the
+// token is invalid or the filters are not allowed.
+func (e *eventBusError) permanent() bool {
+	return e.Status >= 400 && e.Status < 500
+}
+
+func (s *EventStream) run() {
+	defer close(s.done)
+	defer close(s.events)
+	defer s.cancel()
+	var wsURL string
+	failures := 0
+	for {
+		var err error
+		if wsURL == "" {
+			wsURL, err = s.websocketURL()
+		}
+		if err == nil {
+			err = s.session(wsURL, func() { failures = 0 })
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		if ebe, ok := err.(*eventBusError); err == ErrNoEventBus || ok && ebe.permanent() {
+			s.mtx.Lock()
+			s.err = err
+			s.mtx.Unlock()
+			return
+		}
+		failures++
+		delay := eventReconnectPolicy.Delay(failures)
+		if j := eventReconnectPolicy.Jitter; j > 0 {
+			delay -= time.Duration(rand.Float64() * j * float64(delay))
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (s *EventStream) websocketURL() (string, error) {
+	var dd struct {
+		WebsocketURL interface{} `json:"websocketUrl"`
+	}
+	err := s.client.RequestAndDecodeContext(s.ctx, &dd, "GET", "discovery/v1/apis/arvados/v1/rest", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	// websocketUrl is absent (or false, in some versions) if
+	// the API server has no event bus.
+	wsURL, ok := dd.WebsocketURL.(string)
+	if !ok || wsURL == "" {
+		return "", ErrNoEventBus
+	}
+	return wsURL, nil
+}
+
+// session connects to the event bus, subscribes, and delivers
+// events until the connection fails or the stream's context is
+// done. It calls subscribed when the subscription is confirmed.
+func (s *EventStream) session(wsURL string, subscribed func()) error {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("api_token", s.client.AuthToken)
+	u.RawQuery = q.Encode()
+	config, err := websocket.NewConfig(u.String(), "https://"+s.client.APIHost)
+	if err != nil {
+		return err
+	}
+	if s.client.Insecure {
+		config.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblock Receive when the context is done.
+	sessionDone := make(chan struct{})
+	defer close(sessionDone)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			conn.Close()
+		case <-sessionDone:
+		}
+	}()
+
+	sub := map[string]interface{}{
+		"method":  "subscribe",
+		"filters": s.filters,
+	}
+	if lastID := s.LastLogID(); lastID > 0 {
+		sub["last_log_id"] = lastID
+	}
+	if err := websocket.JSON.Send(conn, sub); err != nil {
+		return err
+	}
+
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(conn, &msg); err != nil {
+			return err
+		}
+		var status eventBusError
+		if err := json.Unmarshal(msg, &status); err != nil {
+			return err
+		}
+		if status.Status == 200 {
+			subscribed()
+			continue
+		} else if status.Status != 0 {
+			return &status
+		}
+		var ev Event
+		if err := json.Unmarshal(msg, &ev); err != nil {
+			return err
+		}
+		if ev.ID == 0 || ev.ID <= s.LastLogID() {
+			// Not an event, or already delivered
+			// before reconnecting.
+			continue
+		}
+		select {
+		case s.events <- ev:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+		s.mtx.Lock()
+		s.lastID = ev.ID
+		s.mtx.Unlock()
+	}
+}
@@ -0,0 +1,206 @@
+package arvados
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubEventBus is a websocket event bus that sends a fixed list of
+// events to each subscriber, starting after the subscriber's
+// last_log_id, then hangs up after sending perSession events.
+type stubEventBus struct {
+	token      string
+	events     []Event
+	perSession int
+
+	mtx        sync.Mutex
+	lastLogIDs []uint64
+}
+
+func (bus *stubEventBus) handle(conn *websocket.Conn) {
+	defer conn.Close()
+	if conn.Request().FormValue("api_token") != bus.token {
+		websocket.JSON.Send(conn, map[string]interface{}{"status": 401, "message": "Valid API token required"})
+		return
+	}
+	var sub struct {
+		Method    string          `json:"method"`
+		Filters   json.RawMessage `json:"filters"`
+		LastLogID uint64          `json:"last_log_id"`
+	}
+	if err := websocket.JSON.Receive(conn, &sub); err != nil || sub.Method != "subscribe" {
+		return
+	}
+	bus.mtx.Lock()
+	bus.lastLogIDs = append(bus.lastLogIDs, sub.LastLogID)
+	bus.mtx.Unlock()
+	websocket.JSON.Send(conn, map[string]interface{}{"status": 200, "message": "subscribe ok"})
+	sent := 0
+	for _, ev := range bus.events {
+		// Resend the last event the client has already
+		// seen; the client should skip it.
+		if ev.ID+1 <= sub.LastLogID {
+			continue
+		}
+		if sent >= bus.perSession {
+			return
+		}
+		websocket.JSON.Send(conn, ev)
+		if ev.ID > sub.LastLogID {
+			sent++
+		}
+	}
+	// Stay connected until the client hangs up.
+	var ignored interface{}
+	websocket.JSON.Receive(conn, &ignored)
+}
+
+func newStubEventBusServer(bus *stubEventBus, advertise bool) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewTLSServer(mux)
+	mux.HandleFunc("/discovery/v1/apis/arvados/v1/rest", func(w http.ResponseWriter, req *http.Request) {
+		dd := map[string]interface{}{"websocketUrl": false}
+		if advertise {
+			dd["websocketUrl"] = strings.Replace(srv.URL, "https:", "wss:", 1) + "/websocket"
+		}
+		json.NewEncoder(w).Encode(dd)
+	})
+	mux.Handle("/websocket", websocket.Handler(bus.handle))
+	return srv
+}
+
+func TestEventStreamReconnect(t *testing.T) {
+	defer func(orig time.Duration) { eventReconnectPolicy.BaseDelay = orig }(eventReconnectPolicy.BaseDelay)
+	eventReconnectPolicy.BaseDelay = time.Millisecond
+
+	bus := &stubEventBus{token: "xyzzy", perSession: 2}
+	for id := uint64(1); id <= 5; id++ {
+		bus.events = append(bus.events, Event{
+			Log: Log{
+				ID:         id,
+				ObjectUUID: "zzzzz-dz642-queuedcontainer",
+				EventType:  "update",
+				Properties: map[string]interface{}{
+					"new_attributes": map[string]interface{}{"priority": id},
+				},
+			},
+			ObjectKind: "arvados#container",
+		})
+	}
+	srv := newStubEventBusServer(bus, true)
+	defer srv.Close()
+
+	c := &Client{APIHost: srv.Listener.Addr().String(), AuthToken: "xyzzy", Insecure: true}
+	stream := c.Subscribe(context.Background(), EventFilter{ObjectKinds: []string{"arvados#container"}}, 0)
+	defer stream.Close()
+	for expect := uint64(1); expect <= 5; expect++ {
+		select {
+		case ev := <-stream.C:
+			if ev.ID != expect {
+				t.Fatalf("got event %d, expected %d", ev.ID, expect)
+			}
+			if ev.ObjectKind != "arvados#container" {
+				t.Errorf("got ObjectKind %q", ev.ObjectKind)
+			}
+			var ctr Container
+			if err := ev.NewAttributes(&ctr); err != nil {
+				t.Fatal(err)
+			} else if ctr.Priority != int(expect) {
+				t.Errorf("got priority %d, expected %d", ctr.Priority, expect)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event %d", expect)
+		}
+	}
+	if id := stream.LastLogID(); id != 5 {
+		t.Errorf("got LastLogID %d, expected 5", id)
+	}
+	bus.mtx.Lock()
+	defer bus.mtx.Unlock()
+	if fmt.Sprint(bus.lastLogIDs[:3]) != "[0 2 4]" {
+		t.Errorf("got last_log_id sequence %v, expected [0 2 4 ...]", bus.lastLogIDs)
+	}
+}
+
+func TestEventStreamClose(t *testing.T) {
+	bus := &stubEventBus{token: "xyzzy"}
+	srv := newStubEventBusServer(bus, true)
+	defer srv.Close()
+
+	c := &Client{APIHost: srv.Listener.Addr().String(), AuthToken: "xyzzy", Insecure: true}
+	stream := c.Subscribe(context.Background(), EventFilter{}, 0)
+	done := make(chan struct{})
+	go func() {
+		stream.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	if _, ok := <-stream.C; ok {
+		t.Error("C is not closed")
+	}
+	if err := stream.Err(); err != nil {
+		t.Errorf("got error %v after Close", err)
+	}
+}
+
+func TestEventStreamErrors(t *testing.T) {
+	for _, trial := range []struct {
+		token     string
+		advertise bool
+		check     func(error) bool
+	}{
+		{"bogus", true, func(err error) bool {
+			ebe, ok := err.(*eventBusError)
+			return ok && ebe.Status == 401
+		}},
+		{"xyzzy", false, func(err error) bool { return err == ErrNoEventBus }},
+	} {
+		srv := newStubEventBusServer(&stubEventBus{token: "xyzzy"}, trial.advertise)
+		c := &Client{APIHost: srv.Listener.Addr().String(), AuthToken: trial.token, Insecure: true}
+		stream := c.Subscribe(context.Background(), EventFilter{}, 0)
+		select {
+		case ev, ok := <-stream.C:
+			if ok {
+				t.Errorf("unexpected event %+v", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("timed out waiting for C to close")
+		}
+		if err := stream.Err(); !trial.check(err) {
+			t.Errorf("token %q, advertise %v: unexpected error %v", trial.token, trial.advertise, err)
+		}
+		stream.Close()
+		srv.Close()
+	}
+}
+
+func TestEventFilterFilters(t *testing.T) {
+	f := EventFilter{
+		ObjectUUIDs: []string{"zzzzz-dz642-queuedcontainer"},
+		EventTypes:  []string{"update"},
+		ObjectKinds: []string{"arvados#container"},
+	}
+	buf, err := json.Marshal(f.Filters())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `[["object_uuid","in",["zzzzz-dz642-queuedcontainer"]],["event_type","in",["update"]],["object_uuid","is_a",["arvados#container"]]]`
+	if string(buf) != expect {
+		t.Errorf("got %s, expected %s", buf, expect)
+	}
+	if buf, _ := json.Marshal(EventFilter{}.Filters()); string(buf) != "[]" {
+		t.Errorf("empty filter: got %s", buf)
+	}
+}
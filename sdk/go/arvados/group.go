@@ -0,0 +1,25 @@
+package arvados
+
+import "time"
+
+// Group is an arvados#group resource.
+type Group struct {
+	UUID        string     `json:"uuid,omitempty"`
+	OwnerUUID   string     `json:"owner_uuid,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	ModifiedAt  *time.Time `json:"modified_at,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	Description string     `json:"description,omitempty"`
+	GroupClass  string     `json:"group_class,omitempty"`
+}
+
+// GroupList is an arvados#groupList resource.
+type GroupList struct {
+	Items          []Group `json:"items"`
+	ItemsAvailable int     `json:"items_available"`
+	Offset         int     `json:"offset"`
+	Limit          int     `json:"limit"`
+}
+
+func (Group) resourceName() string     { return "group" }
+func (GroupList) resourceName() string { return "group" }
@@ -2,6 +2,7 @@ package arvados
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -26,6 +27,9 @@ type KeepServiceList struct {
 	Limit          int           `json:"limit"`
 }
 
+func (KeepService) resourceName() string     { return "keep_service" }
+func (KeepServiceList) resourceName() string { return "keep_service" }
+
 // KeepServiceIndexEntry is what a keep service's index response tells
 // us about a stored block.
 type KeepServiceIndexEntry struct {
@@ -76,11 +80,18 @@ func (s *KeepService) String() string {
 // Index returns an unsorted list of blocks that can be retrieved from
 // this server.
 func (s *KeepService) Index(c *Client, prefix string) ([]KeepServiceIndexEntry, error) {
+	return s.IndexContext(c.context(), c, prefix)
+}
+
+// IndexContext is like Index, but the request is aborted if ctx is
+// cancelled or its deadline expires.
+func (s *KeepService) IndexContext(ctx context.Context, c *Client, prefix string) ([]KeepServiceIndexEntry, error) {
 	url := s.url("index/" + prefix)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("NewRequest(%v): %v", url, err)
 	}
+	req = req.WithContext(ctx)
 	resp, err := c.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("Do(%v): %v", url, err)
@@ -0,0 +1,29 @@
+package arvados
+
+import "time"
+
+// Link is an arvados#link resource.
+type Link struct {
+	UUID       string                 `json:"uuid,omitempty"`
+	OwnerUUID  string                 `json:"owner_uuid,omitempty"`
+	CreatedAt  *time.Time             `json:"created_at,omitempty"`
+	ModifiedAt *time.Time             `json:"modified_at,omitempty"`
+	LinkClass  string                 `json:"link_class,omitempty"`
+	Name       string                 `json:"name,omitempty"`
+	HeadUUID   string                 `json:"head_uuid,omitempty"`
+	HeadKind   string                 `json:"head_kind,omitempty"`
+	TailUUID   string                 `json:"tail_uuid,omitempty"`
+	TailKind   string                 `json:"tail_kind,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+// LinkList is an arvados#linkList resource.
+type LinkList struct {
+	Items          []Link `json:"items"`
+	ItemsAvailable int    `json:"items_available"`
+	Offset         int    `json:"offset"`
+	Limit          int    `json:"limit"`
+}
+
+func (Link) resourceName() string     { return "link" }
+func (LinkList) resourceName() string { return "link" }
@@ -0,0 +1,167 @@
+package arvados
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// A ListIterator retrieves all resources of a given type that match
+// a set of filters, fetching as many pages as needed.
+//
+// Pages are retrieved in (modified_at, uuid) order using keyset
+// pagination rather than offsets, so concurrent inserts and updates
+// cannot cause items to be skipped or repeated. (An item that is
+// modified during iteration may be returned again with its new
+// modified_at timestamp.)
+//
+//	var coll arvados.Collection
+//	iter := client.NewListIterator(&coll, arvados.ResourceListParams{
+//		Filters: []arvados.Filter{{"owner_uuid", "=", projectUUID}},
+//	})
+//	for iter.Next() {
+//		fmt.Println(coll.UUID)
+//	}
+//	if err := iter.Err(); err != nil {
+//		...
+//	}
+type ListIterator struct {
+	client *Client
+	dst    Resource
+	path   string
+	params ResourceListParams
+
+	page []json.RawMessage
+
+	// (modified_at, uuid) of the last item returned by Next.
+	lastModifiedAt *time.Time
+	lastUUID       string
+
+	// The most recent query returned all of its matching items.
+	exhausted bool
+	// The most recent query was for the remaining items having
+	// modified_at == lastModifiedAt.
+	sameTimestamp bool
+
+	started bool
+	err     error
+}
+
+// NewListIterator returns a ListIterator that unmarshals each
+// resource matching params into dst, which must be a pointer to a
+// resource type like *Collection.
+//
+// params.Filters and params.Limit (used as the page size) are
+// respected. params.Offset and params.Order are ignored. If
+// params.Select is given, "uuid" and "modified_at" are added to it
+// as needed.
+func (c *Client) NewListIterator(dst Resource, params ResourceListParams) *ListIterator {
+	it := &ListIterator{
+		client: c,
+		dst:    dst,
+		path:   resourcePath(dst),
+		params: params,
+	}
+	if v := reflect.ValueOf(dst); v.Kind() != reflect.Ptr || v.IsNil() {
+		it.err = fmt.Errorf("NewListIterator: destination must be a non-nil pointer, not %T", dst)
+	}
+	if len(params.Select) > 0 {
+		it.params.Select = append([]string(nil), params.Select...)
+		for _, attr := range []string{"uuid", "modified_at"} {
+			if !stringInSlice(attr, it.params.Select) {
+				it.params.Select = append(it.params.Select, attr)
+			}
+		}
+	}
+	return it
+}
+
+// Next unmarshals the next resource into the destination given to
+// NewListIterator, and returns true. If there are no more resources,
+// or an error occurs, it returns false.
+func (it *ListIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || (it.started && it.exhausted && !it.sameTimestamp) {
+			return false
+		}
+		it.err = it.fetch()
+	}
+	item := it.page[0]
+	it.page = it.page[1:]
+
+	var key struct {
+		UUID       string     `json:"uuid"`
+		ModifiedAt *time.Time `json:"modified_at"`
+	}
+	if err := json.Unmarshal(item, &key); err != nil {
+		it.err = err
+		return false
+	}
+	if key.ModifiedAt == nil {
+		it.err = fmt.Errorf("%s: item %q has no modified_at timestamp, cannot continue paging", it.path, key.UUID)
+		return false
+	}
+	it.lastModifiedAt, it.lastUUID = key.ModifiedAt, key.UUID
+
+	v := reflect.ValueOf(it.dst).Elem()
+	v.Set(reflect.Zero(v.Type()))
+	if err := json.Unmarshal(item, it.dst); err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+// Err returns the error, if any, that caused Next to return false.
+func (it *ListIterator) Err() error {
+	return it.err
+}
+
+// fetch retrieves the next page of results.
+func (it *ListIterator) fetch() error {
+	params := it.params
+	params.Offset = 0
+	params.Order = "modified_at, uuid"
+	params.Filters = append([]Filter(nil), it.params.Filters...)
+	switch {
+	case !it.started:
+		// First page: no keyset filters.
+	case !it.exhausted:
+		// There are more items after the last one we saw,
+		// possibly including some with the same timestamp:
+		// get those first, in uuid order.
+		it.sameTimestamp = true
+		params.Order = "uuid"
+		params.Filters = append(params.Filters,
+			Filter{Attr: "modified_at", Operator: "=", Operand: *it.lastModifiedAt},
+			Filter{Attr: "uuid", Operator: ">", Operand: it.lastUUID})
+	default:
+		// We have seen everything with modified_at <=
+		// lastModifiedAt.
+		it.sameTimestamp = false
+		params.Filters = append(params.Filters,
+			Filter{Attr: "modified_at", Operator: ">", Operand: *it.lastModifiedAt})
+	}
+	var page struct {
+		Items          []json.RawMessage `json:"items"`
+		ItemsAvailable int               `json:"items_available"`
+	}
+	err := it.client.RequestAndDecode(&page, "GET", it.path, nil, params)
+	if err != nil {
+		return err
+	}
+	it.started = true
+	it.page = page.Items
+	it.exhausted = len(page.Items) == 0 || len(page.Items) >= page.ItemsAvailable
+	return nil
+}
+
+func stringInSlice(s string, slice []string) bool {
+	for _, x := range slice {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
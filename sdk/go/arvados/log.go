@@ -0,0 +1,29 @@
+package arvados
+
+import "time"
+
+// Log is an arvados#log resource.
+type Log struct {
+	ID              uint64                 `json:"id,omitempty"`
+	UUID            string                 `json:"uuid,omitempty"`
+	OwnerUUID       string                 `json:"owner_uuid,omitempty"`
+	CreatedAt       *time.Time             `json:"created_at,omitempty"`
+	ModifiedAt      *time.Time             `json:"modified_at,omitempty"`
+	ObjectUUID      string                 `json:"object_uuid,omitempty"`
+	ObjectOwnerUUID string                 `json:"object_owner_uuid,omitempty"`
+	EventType       string                 `json:"event_type,omitempty"`
+	EventAt         *time.Time             `json:"event_at,omitempty"`
+	Summary         string                 `json:"summary,omitempty"`
+	Properties      map[string]interface{} `json:"properties,omitempty"`
+}
+
+// LogList is an arvados#logList resource.
+type LogList struct {
+	Items          []Log `json:"items"`
+	ItemsAvailable int   `json:"items_available"`
+	Offset         int   `json:"offset"`
+	Limit          int   `json:"limit"`
+}
+
+func (Log) resourceName() string     { return "log" }
+func (LogList) resourceName() string { return "log" }
@@ -0,0 +1,32 @@
+package arvados
+
+import "time"
+
+// Node is an arvados#node resource.
+type Node struct {
+	UUID              string                 `json:"uuid,omitempty"`
+	OwnerUUID         string                 `json:"owner_uuid,omitempty"`
+	CreatedAt         *time.Time             `json:"created_at,omitempty"`
+	ModifiedAt        *time.Time             `json:"modified_at,omitempty"`
+	Hostname          string                 `json:"hostname,omitempty"`
+	Domain            string                 `json:"domain,omitempty"`
+	IPAddress         string                 `json:"ip_address,omitempty"`
+	SlotNumber        *int                   `json:"slot_number,omitempty"`
+	JobUUID           string                 `json:"job_uuid,omitempty"`
+	CrunchWorkerState string                 `json:"crunch_worker_state,omitempty"`
+	FirstPingAt       *time.Time             `json:"first_ping_at,omitempty"`
+	LastPingAt        *time.Time             `json:"last_ping_at,omitempty"`
+	Info              map[string]interface{} `json:"info,omitempty"`
+	Properties        map[string]interface{} `json:"properties,omitempty"`
+}
+
+// NodeList is an arvados#nodeList resource.
+type NodeList struct {
+	Items          []Node `json:"items"`
+	ItemsAvailable int    `json:"items_available"`
+	Offset         int    `json:"offset"`
+	Limit          int    `json:"limit"`
+}
+
+func (Node) resourceName() string     { return "node" }
+func (NodeList) resourceName() string { return "node" }
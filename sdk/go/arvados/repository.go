@@ -0,0 +1,25 @@
+package arvados
+
+import "time"
+
+// Repository is an arvados#repository resource.
+type Repository struct {
+	UUID       string     `json:"uuid,omitempty"`
+	OwnerUUID  string     `json:"owner_uuid,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	ModifiedAt *time.Time `json:"modified_at,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	FetchURL   string     `json:"fetch_url,omitempty"`
+	PushURL    string     `json:"push_url,omitempty"`
+}
+
+// RepositoryList is an arvados#repositoryList resource.
+type RepositoryList struct {
+	Items          []Repository `json:"items"`
+	ItemsAvailable int          `json:"items_available"`
+	Offset         int          `json:"offset"`
+	Limit          int          `json:"limit"`
+}
+
+func (Repository) resourceName() string     { return "repository" }
+func (RepositoryList) resourceName() string { return "repository" }
@@ -0,0 +1,23 @@
+package arvados
+
+import "context"
+
+// HeaderRequestID is the HTTP header that identifies a request as it
+// passes from one Arvados service to another.
+const HeaderRequestID = "X-Request-Id"
+
+type contextKeyRequestID struct{}
+
+// ContextWithRequestID returns a copy of ctx carrying the given
+// request ID. Client and keepclient.KeepClient send it in the
+// X-Request-Id header of outgoing requests made with that context.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKeyRequestID{}, id)
+}
+
+// RequestIDFromContext returns the request ID stored in ctx by
+// ContextWithRequestID, or "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKeyRequestID{}).(string)
+	return id
+}
@@ -0,0 +1,83 @@
+package arvados
+
+import (
+	"errors"
+	"strings"
+)
+
+// A Resource is an Arvados resource type (like Collection) or list
+// type (like CollectionList) that can be used with the generic Get,
+// List, Create, Update, Delete, and NewListIterator methods.
+type Resource interface {
+	// resourceName returns the singular name of the resource
+	// type, as used in API parameters, e.g., "container_request".
+	resourceName() string
+}
+
+// ErrMissingUUID is returned by Get, Update, and Delete when called
+// with an empty UUID. Without this check, the resulting request would
+// be misinterpreted by the API server as a List request.
+var ErrMissingUUID = errors.New("missing UUID")
+
+// resourcePath returns the API path for the given resource type,
+// e.g., "arvados/v1/repositories".
+func resourcePath(r Resource) string {
+	name := r.resourceName()
+	if strings.HasSuffix(name, "y") {
+		name = name[:len(name)-1] + "ie"
+	}
+	return "arvados/v1/" + name + "s"
+}
+
+// Get retrieves the resource with the given UUID and unmarshals it
+// into dst. The resource type is determined by the type of dst.
+//
+//	var grp arvados.Group
+//	err := client.Get(&grp, "zzzzz-j7d0g-012345678901234")
+func (c *Client) Get(dst Resource, uuid string) error {
+	if uuid == "" {
+		return ErrMissingUUID
+	}
+	return c.RequestAndDecode(dst, "GET", resourcePath(dst)+"/"+uuid, nil, nil)
+}
+
+// List retrieves a single page of resources matching params and
+// unmarshals it into dst, which should be a list type like
+// *GroupList. Use NewListIterator to retrieve all matching resources
+// regardless of page size.
+func (c *Client) List(dst Resource, params ResourceListParams) error {
+	return c.RequestAndDecode(dst, "GET", resourcePath(dst), nil, params)
+}
+
+// Create creates a new resource with the given attributes, and
+// unmarshals the resulting record into dst.
+//
+//	var link arvados.Link
+//	err := client.Create(&link, map[string]interface{}{
+//		"link_class": "tag",
+//		"name":       "foo",
+//		"head_uuid":  collectionUUID,
+//	})
+func (c *Client) Create(dst Resource, attrs map[string]interface{}) error {
+	params := map[string]interface{}{dst.resourceName(): attrs}
+	return c.RequestAndDecode(dst, "POST", resourcePath(dst), nil, params)
+}
+
+// Update changes the given attributes of an existing resource, and
+// unmarshals the resulting record into dst.
+func (c *Client) Update(dst Resource, uuid string, attrs map[string]interface{}) error {
+	if uuid == "" {
+		return ErrMissingUUID
+	}
+	params := map[string]interface{}{dst.resourceName(): attrs}
+	return c.RequestAndDecode(dst, "PUT", resourcePath(dst)+"/"+uuid, nil, params)
+}
+
+// Delete deletes the resource with the given UUID, and unmarshals
+// the deleted record into dst.
+func (c *Client) Delete(dst Resource, uuid string) error {
+	if uuid == "" {
+		return ErrMissingUUID
+	}
+	return c.RequestAndDecode(dst, "DELETE", resourcePath(dst)+"/"+uuid, nil, nil)
+}
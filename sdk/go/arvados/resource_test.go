@@ -0,0 +1,237 @@
+package arvados
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handlerTransport is an HTTP transport that sends all requests to
+// an http.Handler.
+type handlerTransport struct {
+	http.Handler
+}
+
+func (ht handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	ht.ServeHTTP(w, req)
+	return &http.Response{
+		StatusCode: w.Code,
+		Status:     fmt.Sprintf("%d %s", w.Code, http.StatusText(w.Code)),
+		Header:     w.HeaderMap,
+		Body:       ioutil.NopCloser(w.Body),
+		Request:    req,
+	}, nil
+}
+
+func TestResourcePath(t *testing.T) {
+	for _, tc := range []struct {
+		r      Resource
+		expect string
+	}{
+		{Collection{}, "arvados/v1/collections"},
+		{&ContainerRequest{}, "arvados/v1/container_requests"},
+		{RepositoryList{}, "arvados/v1/repositories"},
+		{&VirtualMachine{}, "arvados/v1/virtual_machines"},
+		{APIClientAuthorization{}, "arvados/v1/api_client_authorizations"},
+	} {
+		if got := resourcePath(tc.r); got != tc.expect {
+			t.Errorf("%T: got %q, expected %q", tc.r, got, tc.expect)
+		}
+	}
+}
+
+func TestCreateAndGet(t *testing.T) {
+	t.Parallel()
+	var reqs []*http.Request
+	c := &Client{
+		Client: &http.Client{Transport: handlerTransport{http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.ParseForm()
+			reqs = append(reqs, req)
+			switch {
+			case req.Method == "POST" && req.URL.Path == "/arvados/v1/groups":
+				var attrs map[string]interface{}
+				json.Unmarshal([]byte(req.PostForm.Get("group")), &attrs)
+				fmt.Fprintf(w, `{"uuid":"zzzzz-j7d0g-012340123401234","name":%q}`, attrs["name"])
+			case req.Method == "GET" && req.URL.Path == "/arvados/v1/groups/zzzzz-j7d0g-012340123401234":
+				w.Write([]byte(`{"uuid":"zzzzz-j7d0g-012340123401234","name":"foo","group_class":"project"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		})}},
+		APIHost:   "zzzzz.arvadosapi.com",
+		AuthToken: "xyzzy",
+	}
+
+	var grp Group
+	if err := c.Create(&grp, map[string]interface{}{"name": "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if grp.Name != "foo" || grp.UUID != "zzzzz-j7d0g-012340123401234" {
+		t.Errorf("got %+v", grp)
+	}
+
+	grp = Group{}
+	if err := c.Get(&grp, "zzzzz-j7d0g-012340123401234"); err != nil {
+		t.Fatal(err)
+	}
+	if grp.GroupClass != "project" {
+		t.Errorf("got %+v", grp)
+	}
+
+	if err := c.Get(&grp, ""); err != ErrMissingUUID {
+		t.Errorf("got err %v, expected ErrMissingUUID", err)
+	}
+	if err := c.Delete(&Link{}, "zzzzz-o0j2j-012340123401234"); err == nil {
+		t.Error("expected error for 404 response")
+	}
+	if len(reqs) != 3 {
+		t.Errorf("got %d requests, expected 3", len(reqs))
+	}
+}
+
+// stubLogServer serves the logs list API from a fixed set of logs,
+// applying the filters used by ListIterator.
+type stubLogServer struct {
+	logs     []Log
+	requests int
+}
+
+func (s *stubLogServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.requests++
+	req.ParseForm()
+	var filters [][]interface{}
+	json.Unmarshal([]byte(req.Form.Get("filters")), &filters)
+	var limit int
+	fmt.Sscan(req.Form.Get("limit"), &limit)
+	var matched []Log
+	for _, l := range s.logs {
+		ok := true
+		for _, f := range filters {
+			attr, op := f[0].(string), f[1].(string)
+			switch attr {
+			case "modified_at":
+				t, _ := time.Parse(time.RFC3339Nano, f[2].(string))
+				switch op {
+				case "=":
+					ok = ok && l.ModifiedAt.Equal(t)
+				case ">":
+					ok = ok && l.ModifiedAt.After(t)
+				}
+			case "uuid":
+				ok = ok && l.UUID > f[2].(string)
+			case "event_type":
+				ok = ok && l.EventType == f[2].(string)
+			}
+		}
+		if ok {
+			matched = append(matched, l)
+		}
+	}
+	sort.Sort(logsByKey{matched, req.Form.Get("order") == "uuid"})
+	page := LogList{Items: matched, ItemsAvailable: len(matched)}
+	if limit > 0 && limit < len(matched) {
+		page.Items = matched[:limit]
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// logsByKey sorts logs by (modified_at, uuid), or just uuid.
+type logsByKey struct {
+	logs     []Log
+	uuidOnly bool
+}
+
+func (lk logsByKey) Len() int      { return len(lk.logs) }
+func (lk logsByKey) Swap(i, j int) { lk.logs[i], lk.logs[j] = lk.logs[j], lk.logs[i] }
+func (lk logsByKey) Less(i, j int) bool {
+	a, b := lk.logs[i], lk.logs[j]
+	if lk.uuidOnly || a.ModifiedAt.Equal(*b.ModifiedAt) {
+		return a.UUID < b.UUID
+	}
+	return a.ModifiedAt.Before(*b.ModifiedAt)
+}
+
+func TestListIterator(t *testing.T) {
+	t.Parallel()
+	t0 := time.Date(2016, 11, 1, 0, 0, 0, 0, time.UTC)
+	stub := &stubLogServer{}
+	for i := 0; i < 25; i++ {
+		// Many logs share the same timestamp, so some pages
+		// contain nothing but a single timestamp.
+		mtime := t0.Add(time.Duration(i/7) * time.Second)
+		stub.logs = append(stub.logs, Log{
+			UUID:       fmt.Sprintf("zzzzz-57u5n-%015d", 100-i),
+			ModifiedAt: &mtime,
+			EventType:  []string{"create", "update"}[i%2],
+		})
+	}
+	c := &Client{
+		Client:  &http.Client{Transport: handlerTransport{stub}},
+		APIHost: "zzzzz.arvadosapi.com",
+	}
+	for _, pageSize := range []int{1, 3, 7, 100} {
+		for _, filters := range [][]Filter{nil, {{Attr: "event_type", Operator: "=", Operand: "update"}}} {
+			expect := map[string]bool{}
+			for _, l := range stub.logs {
+				if filters == nil || l.EventType == "update" {
+					expect[l.UUID] = true
+				}
+			}
+			limit := pageSize
+			var l Log
+			iter := c.NewListIterator(&l, ResourceListParams{Limit: &limit, Filters: filters})
+			seen := map[string]bool{}
+			for iter.Next() {
+				if seen[l.UUID] {
+					t.Errorf("pageSize %d: saw %q twice", pageSize, l.UUID)
+				}
+				seen[l.UUID] = true
+				if filters != nil && l.EventType != "update" {
+					t.Errorf("pageSize %d: filter not applied: %+v", pageSize, l)
+				}
+			}
+			if err := iter.Err(); err != nil {
+				t.Fatalf("pageSize %d: %s", pageSize, err)
+			}
+			if len(seen) != len(expect) {
+				t.Errorf("pageSize %d, filters %v: got %d items, expected %d", pageSize, filters, len(seen), len(expect))
+			}
+		}
+	}
+}
+
+func TestListIteratorSelect(t *testing.T) {
+	var reqs []*http.Request
+	c := &Client{
+		Client: &http.Client{Transport: handlerTransport{http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.ParseForm()
+			reqs = append(reqs, req)
+			w.Write([]byte(`{"items":[],"items_available":0}`))
+		})}},
+		APIHost: "zzzzz.arvadosapi.com",
+	}
+	var coll Collection
+	iter := c.NewListIterator(&coll, ResourceListParams{Select: []string{"portable_data_hash"}})
+	for iter.Next() {
+		t.Error("got unexpected item")
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, expected 1", len(reqs))
+	}
+	sel := reqs[0].Form.Get("select")
+	for _, attr := range []string{"portable_data_hash", "uuid", "modified_at"} {
+		if !strings.Contains(sel, `"`+attr+`"`) {
+			t.Errorf("select %q is missing %q", sel, attr)
+		}
+	}
+}
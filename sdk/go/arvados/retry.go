@@ -0,0 +1,197 @@
+package arvados
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A RetryPolicy determines whether and when a failed API or Keep
+// call should be retried.
+//
+// Delays between attempts grow exponentially, starting at BaseDelay
+// and doubling after each attempt, up to MaxDelay. If the server
+// sends a Retry-After header, the delay is at least that long (but
+// still no longer than MaxDelay).
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first one. Zero
+	// means 1 (i.e., no retries).
+	MaxAttempts int
+
+	// Delay before the first retry.
+	BaseDelay time.Duration
+
+	// Maximum delay between attempts. Zero means no limit.
+	MaxDelay time.Duration
+
+	// Fraction of each delay (between 0 and 1) to randomize, so
+	// many clients that fail at the same time don't all retry at
+	// the same time. With Jitter=0.5, a 4s delay becomes a random
+	// delay between 2s and 4s.
+	Jitter float64
+
+	// Maximum total time to spend on a single call, including
+	// all attempts and delays. Zero means no limit. A retry is
+	// not attempted if waiting for it would exceed the budget.
+	Budget time.Duration
+
+	// RetryableStatus returns true if a response with the given
+	// HTTP status code indicates a transient error that is worth
+	// retrying. If nil, DefaultRetryableStatus is used.
+	RetryableStatus func(int) bool
+}
+
+// DefaultRetryPolicy is a reasonable policy for API calls made by
+// long-running services.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+	Jitter:      0.5,
+	Budget:      5 * time.Minute,
+}
+
+// DefaultRetryableStatus returns true for status codes that indicate
+// a timeout, overload, or temporary server-side failure: 408, 429,
+// 500, 502, 503, and 504.
+func DefaultRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Retryable returns true if the policy considers the given HTTP
+// status code to be a transient error.
+func (p *RetryPolicy) Retryable(code int) bool {
+	if p.RetryableStatus == nil {
+		return DefaultRetryableStatus(code)
+	}
+	return p.RetryableStatus(code)
+}
+
+// Delay returns the time to wait before the given retry (1 for the
+// first retry, 2 for the second, etc.), without jitter or Retry-After
+// adjustments.
+func (p *RetryPolicy) Delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d > 0; i++ {
+		d *= 2
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// Start returns a Retrier that tracks the attempts of a single call.
+//
+//	r := policy.Start(ctx)
+//	for r.Next() {
+//		resp, err = client.Do(req)
+//		if err == nil && !policy.Retryable(resp.StatusCode) {
+//			break
+//		}
+//		if resp != nil {
+//			r.SetRetryAfter(resp.Header.Get("Retry-After"))
+//		}
+//	}
+func (p *RetryPolicy) Start(ctx context.Context) *Retrier {
+	return &Retrier{policy: p, ctx: ctx, start: time.Now()}
+}
+
+// A Retrier waits between the attempts of a single call, according
+// to a RetryPolicy.
+type Retrier struct {
+	policy     *RetryPolicy
+	ctx        context.Context
+	start      time.Time
+	attempts   int
+	retryAfter time.Duration
+}
+
+// Next returns true when it is time to make the next attempt. The
+// first call returns true immediately. Subsequent calls wait for the
+// appropriate delay, then return true -- unless the maximum number of
+// attempts has been reached, the delay would exceed the policy's
+// budget, or the context is done, in which case Next returns false
+// without waiting.
+func (r *Retrier) Next() bool {
+	if r.attempts == 0 {
+		r.attempts++
+		return true
+	}
+	if r.attempts >= r.policy.MaxAttempts || r.ctx.Err() != nil {
+		return false
+	}
+	d := r.policy.Delay(r.attempts)
+	if j := r.policy.Jitter; j > 0 && d > 0 {
+		d -= time.Duration(rand.Float64() * j * float64(d))
+	}
+	if r.retryAfter > d {
+		d = r.retryAfter
+		if max := r.policy.MaxDelay; max > 0 && d > max {
+			d = max
+		}
+	}
+	r.retryAfter = 0
+	if b := r.policy.Budget; b > 0 && time.Since(r.start)+d > b {
+		return false
+	}
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-r.ctx.Done():
+			return false
+		case <-timer.C:
+		}
+	}
+	r.attempts++
+	return true
+}
+
+// Attempts returns the number of attempts started so far.
+func (r *Retrier) Attempts() int {
+	return r.attempts
+}
+
+// SetRetryAfter ensures the next delay is at least as long as the
+// given Retry-After response header value. Both the delay-seconds
+// and HTTP-date forms are accepted. An empty or invalid value has no
+// effect.
+func (r *Retrier) SetRetryAfter(value string) {
+	d := parseRetryAfter(value)
+	if d > r.retryAfter {
+		r.retryAfter = d
+	}
+}
+
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package arvados
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	for retry, expect := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  8 * time.Second,
+		5:  10 * time.Second,
+		50: 10 * time.Second,
+	} {
+		if got := p.Delay(retry); got != expect {
+			t.Errorf("retry %d: got %v, expected %v", retry, got, expect)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for s, expect := range map[string]time.Duration{
+		"":      0,
+		"3":     3 * time.Second,
+		"-3":    0,
+		"bogus": 0,
+		time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat): 0,
+	} {
+		if got := parseRetryAfter(s); got != expect {
+			t.Errorf("%q: got %v, expected %v", s, got, expect)
+		}
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(future); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("%q: got %v, expected ~1h", future, got)
+	}
+}
+
+func TestRetrierAttempts(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, Jitter: 0.5}
+	r := p.Start(context.Background())
+	n := 0
+	for r.Next() {
+		n++
+	}
+	if n != 4 || r.Attempts() != 4 {
+		t.Errorf("got %d attempts (Attempts()=%d), expected 4", n, r.Attempts())
+	}
+}
+
+func TestRetrierBudget(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 100, BaseDelay: 20 * time.Millisecond, Budget: 100 * time.Millisecond}
+	t0 := time.Now()
+	r := p.Start(context.Background())
+	for r.Next() {
+	}
+	if elapsed := time.Since(t0); elapsed > 100*time.Millisecond {
+		t.Errorf("exceeded budget: %v", elapsed)
+	}
+	if r.Attempts() != 3 {
+		t.Errorf("got %d attempts, expected 3", r.Attempts())
+	}
+}
+
+func TestRetrierRetryAfter(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 2, MaxDelay: 50 * time.Millisecond}
+	r := p.Start(context.Background())
+	r.Next()
+	r.SetRetryAfter("1")
+	t0 := time.Now()
+	if !r.Next() {
+		t.Fatal("expected second attempt")
+	}
+	// Retry-After is 1s, but MaxDelay is 50ms.
+	if elapsed := time.Since(t0); elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("waited %v, expected ~50ms", elapsed)
+	}
+}
+
+func TestRetrierContextCancel(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 2, BaseDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := p.Start(ctx)
+	r.Next()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if r.Next() {
+		t.Error("Next returned true after context was cancelled")
+	}
+}
+
+// flakyTransport responds 503 with Retry-After: 0 until it has
+// received failures requests, then 200.
+type flakyTransport struct {
+	stubTransport
+	failures int
+	mtx      sync.Mutex
+}
+
+func (ft *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ft.mtx.Lock()
+	fail := ft.failures > 0
+	ft.failures--
+	ft.mtx.Unlock()
+	resp, err := ft.stubTransport.RoundTrip(req)
+	if fail {
+		resp.StatusCode, resp.Status = 503, "503 Service Unavailable"
+		resp.Header = http.Header{"Retry-After": {"0"}}
+	}
+	return resp, err
+}
+
+func TestClientRetry(t *testing.T) {
+	t.Parallel()
+	ft := &flakyTransport{
+		stubTransport: stubTransport{Responses: map[string]string{
+			"/arvados/v1/users/current": `{"uuid":"zzzzz-tpzed-000000000000000"}`,
+		}},
+		failures: 2,
+	}
+	c := &Client{
+		Client:      &http.Client{Transport: ft},
+		APIHost:     "zzzzz.arvadosapi.com",
+		RetryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	}
+	u, err := c.CurrentUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.UUID != "zzzzz-tpzed-000000000000000" {
+		t.Errorf("got %+v", u)
+	}
+	if len(ft.Requests) != 3 {
+		t.Errorf("got %d requests, expected 3", len(ft.Requests))
+	}
+
+	ft.failures = 3
+	ft.Requests = nil
+	if _, err := c.CurrentUser(); err == nil {
+		t.Error("got nil error after exhausting retries")
+	}
+	if len(ft.Requests) != 3 {
+		t.Errorf("got %d requests, expected 3", len(ft.Requests))
+	}
+}
@@ -8,6 +8,17 @@ type User struct {
 	Username string `json:"username,omitempty"`
 }
 
+// UserList is an arvados#userList resource.
+type UserList struct {
+	Items          []User `json:"items"`
+	ItemsAvailable int    `json:"items_available"`
+	Offset         int    `json:"offset"`
+	Limit          int    `json:"limit"`
+}
+
+func (User) resourceName() string     { return "user" }
+func (UserList) resourceName() string { return "user" }
+
 // CurrentUser calls arvados.v1.users.current, and returns the User
 // record corresponding to this client's credentials.
 func (c *Client) CurrentUser() (User, error) {
@@ -0,0 +1,23 @@
+package arvados
+
+import "time"
+
+// VirtualMachine is an arvados#virtualMachine resource.
+type VirtualMachine struct {
+	UUID       string     `json:"uuid,omitempty"`
+	OwnerUUID  string     `json:"owner_uuid,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	ModifiedAt *time.Time `json:"modified_at,omitempty"`
+	Hostname   string     `json:"hostname,omitempty"`
+}
+
+// VirtualMachineList is an arvados#virtualMachineList resource.
+type VirtualMachineList struct {
+	Items          []VirtualMachine `json:"items"`
+	ItemsAvailable int              `json:"items_available"`
+	Offset         int              `json:"offset"`
+	Limit          int              `json:"limit"`
+}
+
+func (VirtualMachine) resourceName() string     { return "virtual_machine" }
+func (VirtualMachineList) resourceName() string { return "virtual_machine" }
@@ -4,6 +4,7 @@ package arvadosclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -15,6 +16,9 @@ import (
 	"regexp"
 	"strings"
 	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/trace"
 )
 
 type StringMatcher func(string) bool
@@ -32,8 +36,15 @@ var ErrInvalidArgument = errors.New("Invalid argument")
 // such failures by always using a new or recently active socket.
 var MaxIdleConnectionDuration = 30 * time.Second
 
+// RetryDelay is the delay before the first retry, when the
+// ArvadosClient's RetryPolicy is nil. Subsequent delays grow
+// exponentially, up to MaxRetryDelay.
 var RetryDelay = 2 * time.Second
 
+// MaxRetryDelay is the maximum delay between retries, when the
+// ArvadosClient's RetryPolicy is nil.
+var MaxRetryDelay = 30 * time.Second
+
 // Indicates an error that was returned by the API server.
 type APIServerError struct {
 	// Address of server returning error, of the form "host:port".
@@ -99,6 +110,10 @@ type ArvadosClient struct {
 
 	// Number of retries
 	Retries int
+
+	// Retry policy. If nil, a policy is derived from Retries,
+	// RetryDelay and MaxRetryDelay.
+	RetryPolicy *arvados.RetryPolicy
 }
 
 // MakeArvadosClient creates a new ArvadosClient using the standard
@@ -147,6 +162,21 @@ func MakeArvadosClient() (ac ArvadosClient, err error) {
 // CallRaw is the same as Call() but returns a Reader that reads the
 // response body, instead of taking an output object.
 func (c ArvadosClient) CallRaw(method string, resourceType string, uuid string, action string, parameters Dict) (reader io.ReadCloser, err error) {
+	return c.CallRawContext(context.Background(), method, resourceType, uuid, action, parameters)
+}
+
+// CallRawContext is the same as CallRaw, but the request (including
+// any retries) is abandoned if ctx is cancelled or its deadline
+// expires.
+func (c ArvadosClient) CallRawContext(ctx context.Context, method string, resourceType string, uuid string, action string, parameters Dict) (reader io.ReadCloser, err error) {
+	ctx, span := trace.StartChild(ctx, "arvadosclient."+method)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	span.SetAttribute("resource_type", resourceType)
+	span.SetAttribute("action", action)
+
 	scheme := c.Scheme
 	if scheme == "" {
 		scheme = "https"
@@ -201,7 +231,8 @@ func (c ArvadosClient) CallRaw(method string, resourceType string, uuid string,
 	var req *http.Request
 	var resp *http.Response
 
-	for attempt := 0; attempt <= c.Retries; attempt++ {
+	policy := c.retryPolicy()
+	for retrier := policy.Start(ctx); retrier.Next(); {
 		if method == "GET" || method == "HEAD" {
 			u.RawQuery = vals.Encode()
 			if req, err = http.NewRequest(method, u.String(), nil); err != nil {
@@ -213,17 +244,23 @@ func (c ArvadosClient) CallRaw(method string, resourceType string, uuid string,
 			}
 			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 		}
+		req = req.WithContext(ctx)
 
 		// Add api token header
 		req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", c.ApiToken))
 		if c.External {
 			req.Header.Add("X-External-Client", "1")
 		}
+		if id := arvados.RequestIDFromContext(ctx); id != "" {
+			req.Header.Set(arvados.HeaderRequestID, id)
+		}
+		trace.Inject(ctx, req.Header)
 
 		resp, err = c.Client.Do(req)
 		if err != nil {
-			if retryable {
-				time.Sleep(RetryDelay)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			} else if retryable {
 				continue
 			} else {
 				return nil, err
@@ -236,21 +273,51 @@ func (c ArvadosClient) CallRaw(method string, resourceType string, uuid string,
 
 		defer resp.Body.Close()
 
-		switch resp.StatusCode {
-		case 408, 409, 422, 423, 500, 502, 503, 504:
-			time.Sleep(RetryDelay)
+		if policy.Retryable(resp.StatusCode) {
+			retrier.SetRetryAfter(resp.Header.Get("Retry-After"))
 			continue
-		default:
-			return nil, newAPIServerError(c.ApiServer, resp)
 		}
+		return nil, newAPIServerError(c.ApiServer, resp)
 	}
 
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if resp != nil {
 		return nil, newAPIServerError(c.ApiServer, resp)
 	}
 	return nil, err
 }
 
+// retryPolicy returns the RetryPolicy to use for API calls.
+func (c ArvadosClient) retryPolicy() *arvados.RetryPolicy {
+	var policy arvados.RetryPolicy
+	if c.RetryPolicy != nil {
+		policy = *c.RetryPolicy
+	} else {
+		policy = arvados.RetryPolicy{
+			MaxAttempts: c.Retries + 1,
+			BaseDelay:   RetryDelay,
+			MaxDelay:    MaxRetryDelay,
+			Jitter:      0.5,
+		}
+	}
+	if policy.RetryableStatus == nil {
+		policy.RetryableStatus = retryableStatus
+	}
+	return &policy
+}
+
+// retryableStatus returns true if an API response with the given
+// status code might succeed if the request is repeated.
+func retryableStatus(code int) bool {
+	switch code {
+	case 408, 409, 422, 423, 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
 func newAPIServerError(ServerAddress string, resp *http.Response) APIServerError {
 
 	ase := APIServerError{
@@ -293,7 +360,14 @@ func newAPIServerError(ServerAddress string, resp *http.Response) APIServerError
 // API responds with a non-successful HTTP status, or an error occurs
 // parsing the response body.
 func (c ArvadosClient) Call(method, resourceType, uuid, action string, parameters Dict, output interface{}) error {
-	reader, err := c.CallRaw(method, resourceType, uuid, action, parameters)
+	return c.CallContext(context.Background(), method, resourceType, uuid, action, parameters, output)
+}
+
+// CallContext is the same as Call, but the API call is abandoned
+// (and ctx.Err() returned) if ctx is cancelled or its deadline
+// expires.
+func (c ArvadosClient) CallContext(ctx context.Context, method, resourceType, uuid, action string, parameters Dict, output interface{}) error {
+	reader, err := c.CallRawContext(ctx, method, resourceType, uuid, action, parameters)
 	if reader != nil {
 		defer reader.Close()
 	}
@@ -312,21 +386,41 @@ func (c ArvadosClient) Call(method, resourceType, uuid, action string, parameter
 
 // Create a new resource. See Call for argument descriptions.
 func (c ArvadosClient) Create(resourceType string, parameters Dict, output interface{}) error {
-	return c.Call("POST", resourceType, "", "", parameters, output)
+	return c.CreateContext(context.Background(), resourceType, parameters, output)
+}
+
+// CreateContext is the same as Create, but uses the given context.
+func (c ArvadosClient) CreateContext(ctx context.Context, resourceType string, parameters Dict, output interface{}) error {
+	return c.CallContext(ctx, "POST", resourceType, "", "", parameters, output)
 }
 
 // Delete a resource. See Call for argument descriptions.
 func (c ArvadosClient) Delete(resource string, uuid string, parameters Dict, output interface{}) (err error) {
-	return c.Call("DELETE", resource, uuid, "", parameters, output)
+	return c.DeleteContext(context.Background(), resource, uuid, parameters, output)
+}
+
+// DeleteContext is the same as Delete, but uses the given context.
+func (c ArvadosClient) DeleteContext(ctx context.Context, resource string, uuid string, parameters Dict, output interface{}) (err error) {
+	return c.CallContext(ctx, "DELETE", resource, uuid, "", parameters, output)
 }
 
 // Modify attributes of a resource. See Call for argument descriptions.
 func (c ArvadosClient) Update(resourceType string, uuid string, parameters Dict, output interface{}) (err error) {
-	return c.Call("PUT", resourceType, uuid, "", parameters, output)
+	return c.UpdateContext(context.Background(), resourceType, uuid, parameters, output)
+}
+
+// UpdateContext is the same as Update, but uses the given context.
+func (c ArvadosClient) UpdateContext(ctx context.Context, resourceType string, uuid string, parameters Dict, output interface{}) (err error) {
+	return c.CallContext(ctx, "PUT", resourceType, uuid, "", parameters, output)
 }
 
 // Get a resource. See Call for argument descriptions.
 func (c ArvadosClient) Get(resourceType string, uuid string, parameters Dict, output interface{}) (err error) {
+	return c.GetContext(context.Background(), resourceType, uuid, parameters, output)
+}
+
+// GetContext is the same as Get, but uses the given context.
+func (c ArvadosClient) GetContext(ctx context.Context, resourceType string, uuid string, parameters Dict, output interface{}) (err error) {
 	if !UUIDMatch(uuid) && !(resourceType == "collections" && PDHMatch(uuid)) {
 		// No object has uuid == "": there is no need to make
 		// an API call. Furthermore, the HTTP request for such
@@ -334,12 +428,17 @@ func (c ArvadosClient) Get(resourceType string, uuid string, parameters Dict, ou
 		// is liable to be misinterpreted as the List API.
 		return ErrInvalidArgument
 	}
-	return c.Call("GET", resourceType, uuid, "", parameters, output)
+	return c.CallContext(ctx, "GET", resourceType, uuid, "", parameters, output)
 }
 
 // List resources of a given type. See Call for argument descriptions.
 func (c ArvadosClient) List(resource string, parameters Dict, output interface{}) (err error) {
-	return c.Call("GET", resource, "", "", parameters, output)
+	return c.ListContext(context.Background(), resource, parameters, output)
+}
+
+// ListContext is the same as List, but uses the given context.
+func (c ArvadosClient) ListContext(ctx context.Context, resource string, parameters Dict, output interface{}) (err error) {
+	return c.CallContext(ctx, "GET", resource, "", "", parameters, output)
 }
 
 const API_DISCOVERY_RESOURCE = "discovery/v1/apis/arvados/v1/rest"
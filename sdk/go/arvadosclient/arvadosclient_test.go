@@ -1,7 +1,9 @@
 package arvadosclient
 
 import (
+	"context"
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
 	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
 	. "gopkg.in/check.v1"
 	"net"
@@ -384,3 +386,26 @@ func (s *MockArvadosServerSuite) TestWithRetries(c *C) {
 		}
 	}
 }
+
+func (s *MockArvadosServerSuite) TestRequestIDFromContext(c *C) {
+	ids := make(chan string, 1)
+	api, err := RunFakeArvadosServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		ids <- req.Header.Get("X-Request-Id")
+		resp.Write([]byte(`{"ok":"ok"}`))
+	}))
+	c.Assert(err, IsNil)
+	defer api.listener.Close()
+
+	arv := ArvadosClient{
+		Scheme:      "http",
+		ApiServer:   api.url,
+		ApiToken:    "abc123",
+		ApiInsecure: true,
+		Client:      &http.Client{Transport: &http.Transport{}},
+	}
+	ctx := arvados.ContextWithRequestID(context.Background(), "req-abcdefghij")
+	getback := make(Dict)
+	err = arv.GetContext(ctx, "collections", "zzzzz-4zz18-znfnqtbbv4spc3w", nil, &getback)
+	c.Check(err, IsNil)
+	c.Check(<-ids, Equals, "req-abcdefghij")
+}
@@ -0,0 +1,284 @@
+// Package auditlog records who accessed which data, for services
+// like keep-web and keepproxy that serve data to clients.
+//
+// Events are buffered in memory and written to a Sink (a file of JSON
+// lines, or Arvados log records) by a background goroutine, so a
+// slow sink does not slow down every request.
+//
+// By default, if the sink fails or the buffer fills up, events are
+// dropped (and the problem is logged). In "fail closed" mode, Ready
+// returns an error instead, and services refuse to serve data until
+// the audit log is working again. Log never waits: an event can
+// still be dropped in fail-closed mode if the buffer fills up between
+// Ready and Log, but a failing sink never blocks request handlers.
+package auditlog
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// An Event records one access to stored data.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"`
+	Method  string    `json:"method"`
+	Status  int       `json:"status"`
+
+	// The user whose token was used, if known.
+	UserUUID string `json:"user_uuid,omitempty"`
+
+	// The collection accessed (keep-web), and the path of the
+	// file or directory within it -- or, for a resumable upload
+	// (keepproxy), the upload's URL path.
+	CollectionUUID   string `json:"collection_uuid,omitempty"`
+	PortableDataHash string `json:"portable_data_hash,omitempty"`
+	Path             string `json:"path,omitempty"`
+
+	// The block accessed (keepproxy).
+	Locator string `json:"locator,omitempty"`
+
+	// The Range header sent by the client, if any, and the number
+	// of bytes actually sent (GET) or received (PUT).
+	Range string `json:"range,omitempty"`
+	Bytes int64  `json:"bytes"`
+
+	RemoteAddr string `json:"remote_addr"`
+	UserAgent  string `json:"user_agent,omitempty"`
+}
+
+// A Sink stores audit events.
+type Sink interface {
+	// Write stores the given events, and returns the number of
+	// events stored. If it returns an error, the rest of the
+	// events will be written again later.
+	Write([]Event) (int, error)
+}
+
+// ErrBufferFull is returned by Ready (in fail-closed mode) when the
+// sink is not keeping up with new events.
+var ErrBufferFull = errors.New("audit log buffer is full")
+
+// DefaultRetryInterval is the time between attempts to write events
+// after a sink error.
+var DefaultRetryInterval = 5 * time.Second
+
+// maxBatch is the maximum number of events passed to a single
+// Sink.Write call.
+const maxBatch = 1000
+
+// A Logger buffers events and writes them to a Sink.
+type Logger struct {
+	sink          Sink
+	failClosed    bool
+	retryInterval time.Duration
+	events        chan Event
+	closing       chan struct{}
+	done          chan struct{}
+
+	mtx     sync.Mutex
+	err     error // error from the last write attempt
+	dropped int64
+}
+
+// NewLogger returns a Logger that buffers up to bufferSize events
+// before they are written to sink.
+func NewLogger(sink Sink, bufferSize int, failClosed bool) *Logger {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	l := &Logger{
+		sink:          sink,
+		failClosed:    failClosed,
+		retryInterval: DefaultRetryInterval,
+		events:        make(chan Event, bufferSize),
+		closing:       make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Ready returns a non-nil error if the Logger is in fail-closed mode
+// and cannot currently accept events, because the sink is failing or
+// the buffer is full. Services should check Ready before serving data
+// to a client.
+//
+// It is safe to call Ready on a nil Logger.
+func (l *Logger) Ready() error {
+	if l == nil || !l.failClosed {
+		return nil
+	}
+	l.mtx.Lock()
+	err := l.err
+	l.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(l.events) >= cap(l.events) {
+		return ErrBufferFull
+	}
+	return nil
+}
+
+// Log adds an event to the buffer. If ev.Time is zero, the current
+// time is used. If the buffer is full, the event is dropped (see
+// Dropped).
+//
+// Services should not log requests that were refused because Ready
+// returned an error.
+//
+// It is safe to call Log on a nil Logger.
+func (l *Logger) Log(ev Event) {
+	if l == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	select {
+	case l.events <- ev:
+	default:
+		l.mtx.Lock()
+		l.dropped++
+		dropped := l.dropped
+		l.mtx.Unlock()
+		log.Printf("audit log buffer is full, dropped event (%d dropped so far)", dropped)
+	}
+}
+
+// Dropped returns the number of events dropped because the buffer was
+// full.
+func (l *Logger) Dropped() int64 {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.dropped
+}
+
+// Close writes all buffered events to the sink (trying once more if a
+// write fails) and stops the Logger. It returns the error from the
+// last write attempt, if any. Log must not be called after Close.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	close(l.closing)
+	<-l.done
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.err
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	var batch []Event
+	for {
+		if len(batch) == 0 {
+			select {
+			case ev := <-l.events:
+				batch = append(batch, ev)
+			case <-l.closing:
+				if batch = l.drain(batch); len(batch) > 0 {
+					l.write(batch)
+				}
+				return
+			}
+		}
+		batch = l.write(l.drain(batch))
+		if len(batch) == 0 {
+			continue
+		}
+		select {
+		case <-time.After(l.retryInterval):
+		case <-l.closing:
+			// One last try.
+			l.write(l.drain(batch))
+			return
+		}
+	}
+}
+
+// drain adds buffered events to batch, up to maxBatch, without
+// waiting.
+func (l *Logger) drain(batch []Event) []Event {
+	for len(batch) < maxBatch {
+		select {
+		case ev := <-l.events:
+			batch = append(batch, ev)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// write sends a batch to the sink, and returns the events that were
+// not written.
+func (l *Logger) write(batch []Event) []Event {
+	n, err := l.sink.Write(batch)
+	l.mtx.Lock()
+	l.err = err
+	l.mtx.Unlock()
+	if err != nil {
+		log.Printf("error writing %d audit log events: %v", len(batch)-n, err)
+	}
+	return batch[n:]
+}
+
+// Config holds command line options for an audit Logger.
+type Config struct {
+	// Append JSON lines to this file...
+	File string
+	// ...or create Arvados log records via the API.
+	API bool
+	// Number of events to buffer.
+	BufferSize int
+	// Refuse to serve data when events cannot be recorded.
+	FailClosed bool
+}
+
+// AddFlags adds command line flags for the configuration fields to
+// the given FlagSet, using the given prefix, like "audit-log-".
+func (cfg *Config) AddFlags(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&cfg.File, prefix+"file", "",
+		"Append a JSON line to this file for each data access. Cannot be combined with -"+prefix+"api.")
+	fs.BoolVar(&cfg.API, prefix+"api", false,
+		"Create an Arvados log record for each data access, using the ARVADOS_API_TOKEN environment variable.")
+	fs.IntVar(&cfg.BufferSize, prefix+"buffer", 10000,
+		"Number of audit log events to hold in memory while waiting to write them.")
+	fs.BoolVar(&cfg.FailClosed, prefix+"fail-closed", false,
+		"Refuse to serve data when audit log events cannot be written. Otherwise, events are dropped.")
+}
+
+// Enabled returns true if the configuration has a File or API
+// destination.
+func (cfg *Config) Enabled() bool {
+	return cfg.File != "" || cfg.API
+}
+
+// NewLogger returns a Logger for the given configuration, or nil if
+// the configuration is not Enabled. If cfg.API is true, client is used
+// to create log records.
+func (cfg *Config) NewLogger(client *arvados.Client) (*Logger, error) {
+	var sink Sink
+	switch {
+	case cfg.File != "" && cfg.API:
+		return nil, errors.New("audit log: cannot write to both a file and the API")
+	case cfg.File != "":
+		fs, err := NewFileSink(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		sink = fs
+	case cfg.API:
+		sink = &APISink{Client: client}
+	default:
+		return nil, nil
+	}
+	return NewLogger(sink, cfg.BufferSize, cfg.FailClosed), nil
+}
@@ -0,0 +1,232 @@
+package auditlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	. "gopkg.in/check.v1"
+)
+
+// Gocheck boilerplate
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&LoggerSuite{})
+
+type LoggerSuite struct{}
+
+// stubSink stores events in memory, and fails when told to.
+type stubSink struct {
+	mtx    sync.Mutex
+	events []Event
+	fail   bool
+	wrote  chan struct{}
+}
+
+func (ss *stubSink) Write(events []Event) (int, error) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	defer func() {
+		select {
+		case ss.wrote <- struct{}{}:
+		default:
+		}
+	}()
+	if ss.fail {
+		return 0, errors.New("stub failure")
+	}
+	ss.events = append(ss.events, events...)
+	return len(events), nil
+}
+
+func (ss *stubSink) setFail(fail bool) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	ss.fail = fail
+}
+
+func (ss *stubSink) count() int {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return len(ss.events)
+}
+
+func (s *LoggerSuite) TestNilLogger(c *C) {
+	var l *Logger
+	c.Check(l.Ready(), IsNil)
+	l.Log(Event{})
+	c.Check(l.Close(), IsNil)
+}
+
+func (s *LoggerSuite) TestLogAndClose(c *C) {
+	sink := &stubSink{wrote: make(chan struct{}, 1)}
+	l := NewLogger(sink, 10, false)
+	for i := 0; i < 5; i++ {
+		l.Log(Event{Service: "test", Bytes: int64(i)})
+	}
+	c.Check(l.Close(), IsNil)
+	c.Assert(sink.count(), Equals, 5)
+	for i, ev := range sink.events {
+		c.Check(ev.Bytes, Equals, int64(i))
+		c.Check(ev.Time.IsZero(), Equals, false)
+	}
+}
+
+func (s *LoggerSuite) TestFailOpen(c *C) {
+	sink := &stubSink{fail: true, wrote: make(chan struct{}, 1)}
+	l := NewLogger(sink, 2, false)
+	// Don't retry until Close.
+	l.retryInterval = time.Hour
+	l.Log(Event{})
+	<-sink.wrote
+	c.Check(l.Ready(), IsNil)
+	for i := 0; i < 5; i++ {
+		l.Log(Event{})
+	}
+	c.Check(l.Dropped(), Equals, int64(3))
+
+	sink.setFail(false)
+	c.Check(l.Close(), IsNil)
+	c.Check(sink.count(), Equals, 3)
+}
+
+func (s *LoggerSuite) TestFailClosed(c *C) {
+	sink := &stubSink{fail: true, wrote: make(chan struct{}, 1)}
+	l := NewLogger(sink, 10, true)
+	l.retryInterval = time.Millisecond
+	c.Check(l.Ready(), IsNil)
+	l.Log(Event{Path: "foo"})
+	for deadline := time.Now().Add(5 * time.Second); l.Ready() == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(l.Ready(), NotNil)
+
+	// When the sink recovers, the held events are written, and
+	// the logger is ready again.
+	sink.setFail(false)
+	for deadline := time.Now().Add(5 * time.Second); l.Ready() != nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(l.Ready(), IsNil)
+	c.Check(l.Close(), IsNil)
+	c.Assert(sink.count(), Equals, 1)
+	c.Check(sink.events[0].Path, Equals, "foo")
+	c.Check(l.Dropped(), Equals, int64(0))
+}
+
+func (s *LoggerSuite) TestFailClosedDoesNotBlock(c *C) {
+	sink := &stubSink{fail: true, wrote: make(chan struct{}, 1)}
+	l := NewLogger(sink, 2, true)
+	l.retryInterval = time.Hour
+	l.Log(Event{})
+	<-sink.wrote
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			l.Log(Event{})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("Log blocked")
+	}
+	c.Check(l.Ready(), NotNil)
+	c.Check(l.Dropped(), Equals, int64(3))
+
+	sink.setFail(false)
+	c.Check(l.Close(), IsNil)
+	c.Check(sink.count(), Equals, 3)
+}
+
+func (s *LoggerSuite) TestFileSink(c *C) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	cfg := Config{File: path, BufferSize: 10}
+	l, err := cfg.NewLogger(nil)
+	c.Assert(err, IsNil)
+	l.Log(Event{Service: "keep-web", UserUUID: "zzzzz-tpzed-000000000000000", Path: "foo/bar.txt", Bytes: 3})
+	l.Log(Event{Service: "keepproxy", Locator: "acbd18db4cc2f85cedef654fccc4a4d8+3"})
+	c.Check(l.Close(), IsNil)
+
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		c.Check(json.Unmarshal(scanner.Bytes(), &line), IsNil)
+		lines = append(lines, line)
+	}
+	c.Assert(lines, HasLen, 2)
+	c.Check(lines[0]["user_uuid"], Equals, "zzzzz-tpzed-000000000000000")
+	c.Check(lines[0]["path"], Equals, "foo/bar.txt")
+	c.Check(lines[1]["locator"], Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3")
+	_, ok := lines[1]["path"]
+	c.Check(ok, Equals, false)
+}
+
+func (s *LoggerSuite) TestAPISink(c *C) {
+	var mtx sync.Mutex
+	var created []map[string]interface{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, Equals, "POST")
+		c.Check(req.URL.Path, Equals, "/arvados/v1/logs")
+		c.Check(req.Header.Get("Authorization"), Equals, "OAuth2 xyzzy")
+		var attrs map[string]interface{}
+		c.Check(json.Unmarshal([]byte(req.FormValue("log")), &attrs), IsNil)
+		mtx.Lock()
+		created = append(created, attrs)
+		mtx.Unlock()
+		w.Write([]byte(`{"uuid":"zzzzz-57u5n-000000000000000"}`))
+	}))
+	defer srv.Close()
+	client := &arvados.Client{
+		APIHost:   strings.TrimPrefix(srv.URL, "https://"),
+		AuthToken: "xyzzy",
+		Insecure:  true,
+	}
+
+	cfg := Config{API: true, BufferSize: 10}
+	l, err := cfg.NewLogger(client)
+	c.Assert(err, IsNil)
+	l.Log(Event{Service: "keep-web", Method: "GET", CollectionUUID: "zzzzz-4zz18-000000000000000", PortableDataHash: "d41d8cd98f00b204e9800998ecf8427e+0", Path: "foo"})
+	c.Check(l.Close(), IsNil)
+
+	c.Assert(created, HasLen, 1)
+	c.Check(created[0]["event_type"], Equals, "data_access")
+	c.Check(created[0]["object_uuid"], Equals, "zzzzz-4zz18-000000000000000")
+	c.Check(created[0]["summary"], Equals, "keep-web GET d41d8cd98f00b204e9800998ecf8427e+0/foo")
+	props, _ := created[0]["properties"].(map[string]interface{})
+	c.Check(props["path"], Equals, "foo")
+}
+
+func (s *LoggerSuite) TestConfig(c *C) {
+	l, err := (&Config{}).NewLogger(nil)
+	c.Check(l, IsNil)
+	c.Check(err, IsNil)
+	_, err = (&Config{File: "/dev/null", API: true}).NewLogger(nil)
+	c.Check(err, NotNil)
+	_, err = (&Config{File: "/nonexistent/audit.log"}).NewLogger(nil)
+	c.Check(err, NotNil)
+}
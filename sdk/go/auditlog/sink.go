@@ -0,0 +1,84 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// A FileSink appends events to a file, one JSON object per line.
+type FileSink struct {
+	mtx sync.Mutex
+	f   *os.File
+}
+
+// NewFileSink opens (or creates) the given file for appending.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %v", err)
+	}
+	return &FileSink{f: f}, nil
+}
+
+// Write implements Sink. Events are written with a single write
+// call, and synced to disk before Write returns.
+func (fs *FileSink) Write(events []Event) (int, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return i, err
+		}
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if _, err := fs.f.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := fs.f.Sync(); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// An APISink creates an Arvados log record for each event, with
+// event_type "data_access". The record's object_uuid is the
+// collection UUID (if known), and its properties are the fields of
+// the event.
+type APISink struct {
+	Client *arvados.Client
+}
+
+// Write implements Sink.
+func (as *APISink) Write(events []Event) (int, error) {
+	for i, ev := range events {
+		var props map[string]interface{}
+		buf, err := json.Marshal(ev)
+		if err == nil {
+			err = json.Unmarshal(buf, &props)
+		}
+		if err != nil {
+			return i, err
+		}
+		summary := fmt.Sprintf("%s %s %s", ev.Service, ev.Method, ev.Locator)
+		if ev.Locator == "" {
+			summary = fmt.Sprintf("%s %s %s/%s", ev.Service, ev.Method, ev.PortableDataHash, ev.Path)
+		}
+		err = as.Client.Create(&arvados.Log{}, map[string]interface{}{
+			"event_type":  "data_access",
+			"event_at":    ev.Time,
+			"object_uuid": ev.CollectionUUID,
+			"summary":     summary,
+			"properties":  props,
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(events), nil
+}
@@ -3,9 +3,9 @@ package blockdigest
 
 import (
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/keeplocator"
 	"regexp"
 	"strconv"
-	"strings"
 )
 
 var LocatorPattern = regexp.MustCompile(
@@ -58,32 +58,29 @@ func FromString(s string) (dig BlockDigest, err error) {
 }
 
 func IsBlockLocator(s string) bool {
-	return LocatorPattern.MatchString(s)
+	_, err := ParseBlockLocator(s)
+	return err == nil
 }
 
+// ParseBlockLocator parses a locator that has a size hint. See
+// keeplocator.Parse for the accepted syntax.
 func ParseBlockLocator(s string) (b BlockLocator, err error) {
-	if !LocatorPattern.MatchString(s) {
-		err = fmt.Errorf("String \"%s\" does not match BlockLocator pattern "+
-			"\"%s\".",
-			s,
-			LocatorPattern.String())
-	} else {
-		tokens := strings.Split(s, "+")
-		var blockSize int64
-		var blockDigest BlockDigest
-		// We expect both of the following to succeed since LocatorPattern
-		// restricts the strings appropriately.
-		blockDigest, err = FromString(tokens[0])
-		if err != nil {
-			return
-		}
-		blockSize, err = strconv.ParseInt(tokens[1], 10, 0)
-		if err != nil {
-			return
-		}
-		b.Digest = blockDigest
-		b.Size = int(blockSize)
-		b.Hints = tokens[2:]
+	loc, err := keeplocator.Parse(s)
+	if err == nil && loc.Size < 0 {
+		err = keeplocator.ErrInvalidLocator
+	}
+	if err != nil {
+		err = fmt.Errorf("String \"%s\" is not a valid block locator: %s", s, err)
+		return
+	}
+	b.Digest, err = FromString(loc.Hash)
+	if err != nil {
+		return
+	}
+	b.Size = loc.Size
+	b.Hints = make([]string, len(loc.Hints))
+	for i, h := range loc.Hints {
+		b.Hints[i] = h.String()
 	}
 	return
 }
@@ -4,6 +4,7 @@
 package dispatch
 
 import (
+	"context"
 	"git.curoverse.com/arvados.git/sdk/go/arvados"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"log"
@@ -44,6 +45,13 @@ type Dispatcher struct {
 	// Amount of time to wait between polling for updates.
 	PollInterval time.Duration
 
+	// If true, also subscribe to container events from the
+	// Arvados websocket event bus, so priority changes and
+	// cancellations are handled as soon as they happen instead of
+	// at the next poll. Polling continues regardless, so nothing
+	// is missed if the event bus is unavailable.
+	UseEventBus bool
+
 	// Channel used to signal that RunDispatcher loop should exit.
 	DoneProcessing chan struct{}
 
@@ -94,10 +102,12 @@ func (dispatcher *Dispatcher) checkMine(c arvados.Container, update bool) bool {
 	return false
 }
 
-func (dispatcher *Dispatcher) getContainers(params arvadosclient.Dict, touched map[string]bool) {
+func (dispatcher *Dispatcher) getContainers(ctx context.Context, params arvadosclient.Dict, touched map[string]bool) {
 	var containers arvados.ContainerList
-	err := dispatcher.Arv.List("containers", params, &containers)
-	if err != nil {
+	err := dispatcher.Arv.ListContext(ctx, "containers", params, &containers)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return
+	} else if err != nil {
 		log.Printf("Error getting list of containers: %q", err)
 		return
 	}
@@ -114,7 +124,7 @@ func (dispatcher *Dispatcher) getContainers(params arvadosclient.Dict, touched m
 	}
 }
 
-func (dispatcher *Dispatcher) pollContainers() {
+func (dispatcher *Dispatcher) pollContainers(ctx context.Context) {
 	ticker := time.NewTicker(dispatcher.PollInterval)
 
 	paramsQ := arvadosclient.Dict{
@@ -125,12 +135,29 @@ func (dispatcher *Dispatcher) pollContainers() {
 		"filters": [][]interface{}{{"locked_by_uuid", "=", dispatcher.Auth.UUID}},
 		"limit":   "1000"}
 
+	// events stays nil (i.e., never ready) unless the event bus is
+	// in use.
+	var events <-chan arvados.Event
+	var stream *arvados.EventStream
+	if dispatcher.UseEventBus {
+		stream = dispatcher.subscribe(ctx)
+		defer stream.Close()
+		events = stream.C
+	}
+
 	for {
 		select {
+		case ev, ok := <-events:
+			if !ok {
+				log.Printf("Event bus subscription ended (%v), relying on polling", stream.Err())
+				events = nil
+				continue
+			}
+			dispatcher.handleEvent(ev)
 		case <-ticker.C:
 			touched := make(map[string]bool)
-			dispatcher.getContainers(paramsQ, touched)
-			dispatcher.getContainers(paramsP, touched)
+			dispatcher.getContainers(ctx, paramsQ, touched)
+			dispatcher.getContainers(ctx, paramsP, touched)
 			dispatcher.mineMutex.Lock()
 			var monitored []string
 			for k := range dispatcher.mineMap {
@@ -140,17 +167,51 @@ func (dispatcher *Dispatcher) pollContainers() {
 			}
 			dispatcher.mineMutex.Unlock()
 			if monitored != nil {
-				dispatcher.getContainers(arvadosclient.Dict{
+				dispatcher.getContainers(ctx, arvadosclient.Dict{
 					"filters": [][]interface{}{{"uuid", "in", monitored}}}, touched)
 			}
 		case <-dispatcher.DoneProcessing:
 			close(dispatcher.containers)
 			ticker.Stop()
 			return
+		case <-ctx.Done():
+			close(dispatcher.containers)
+			ticker.Stop()
+			return
 		}
 	}
 }
 
+// subscribe starts listening for container events on the websocket
+// event bus.
+func (dispatcher *Dispatcher) subscribe(ctx context.Context) *arvados.EventStream {
+	client := &arvados.Client{
+		APIHost:   dispatcher.Arv.ApiServer,
+		AuthToken: dispatcher.Arv.ApiToken,
+		Insecure:  dispatcher.Arv.ApiInsecure,
+	}
+	return client.Subscribe(ctx, arvados.EventFilter{
+		EventTypes:  []string{"create", "update"},
+		ObjectKinds: []string{"arvados#container"},
+	}, 0)
+}
+
+// handleEvent passes the updated container record from a container
+// event to handleUpdate, if the container is one this dispatcher
+// would pick up when polling: i.e., it is queued with non-zero
+// priority, or this dispatcher is already monitoring it.
+func (dispatcher *Dispatcher) handleEvent(ev arvados.Event) {
+	var container arvados.Container
+	if err := ev.NewAttributes(&container); err != nil {
+		log.Printf("Error decoding container event %d: %v", ev.ID, err)
+		return
+	}
+	container.UUID = ev.ObjectUUID
+	if (container.State == Queued && container.Priority > 0) || dispatcher.checkMine(container, false) {
+		dispatcher.containers <- container
+	}
+}
+
 func (dispatcher *Dispatcher) handleUpdate(container arvados.Container) {
 	if container.State == Queued && dispatcher.checkMine(container, false) {
 		// If we previously started the job, something failed, and it
@@ -207,7 +268,14 @@ func (dispatcher *Dispatcher) UpdateState(uuid string, newState arvados.Containe
 // on the dispatcher.DoneProcessing channel.  It also installs a signal handler
 // to terminate gracefully on SIGINT, SIGTERM or SIGQUIT.
 func (dispatcher *Dispatcher) RunDispatcher() (err error) {
-	err = dispatcher.Arv.Call("GET", "api_client_authorizations", "", "current", nil, &dispatcher.Auth)
+	return dispatcher.RunDispatcherContext(context.Background())
+}
+
+// RunDispatcherContext is the same as RunDispatcher, but the main
+// loop also exits when ctx is cancelled or its deadline expires. Any
+// API calls made by the polling loop at that time are abandoned.
+func (dispatcher *Dispatcher) RunDispatcherContext(ctx context.Context) (err error) {
+	err = dispatcher.Arv.CallContext(ctx, "GET", "api_client_authorizations", "", "current", nil, &dispatcher.Auth)
 	if err != nil {
 		log.Printf("Error getting my token UUID: %v", err)
 		return
@@ -230,7 +298,7 @@ func (dispatcher *Dispatcher) RunDispatcher() (err error) {
 	defer close(sigChan)
 	defer signal.Stop(sigChan)
 
-	go dispatcher.pollContainers()
+	go dispatcher.pollContainers(ctx)
 	for container := range dispatcher.containers {
 		dispatcher.handleUpdate(container)
 	}
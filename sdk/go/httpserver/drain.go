@@ -0,0 +1,104 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Drain shuts down the server gracefully.
+//
+// First, the health check (see HealthCheckPath) starts reporting
+// that the server is draining, while requests are still accepted as
+// usual, for the given delay. This gives load balancers time to take
+// the server out of rotation. Then the server stops accepting
+// connections, and waits up to timeout for requests in progress to
+// finish.
+//
+// Drain returns when the server has stopped. Wait does not return
+// until draining is finished, either.
+func (srv *Server) Drain(delay, timeout time.Duration) error {
+	atomic.StoreInt32(&srv.draining, 1)
+	time.Sleep(delay)
+	srv.SetKeepAlivesEnabled(false)
+	if timeout <= 0 {
+		timeout = 1
+	}
+	atomic.StoreInt64(&srv.drainTimeout, int64(timeout))
+	return srv.Close()
+}
+
+// Draining returns true if Drain has been called.
+func (srv *Server) Draining() bool {
+	return atomic.LoadInt32(&srv.draining) != 0
+}
+
+// DrainOnSignal arranges for Drain(delay, timeout) to be called when
+// the process receives one of the given signals (SIGTERM or SIGINT,
+// if none are given) while the server is running.
+func (srv *Server) DrainOnSignal(delay, timeout time.Duration, sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case sig := <-ch:
+			log.Printf("caught signal %v, draining (delay %v, timeout %v)", sig, delay, timeout)
+			srv.Drain(delay, timeout)
+		case <-srv.done:
+		}
+	}()
+}
+
+// trackRequests returns a handler that serves the health check, and
+// counts requests in progress so Drain can wait for them.
+func (srv *Server) trackRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if srv.HealthCheckPath != "" && r.URL.Path == srv.HealthCheckPath {
+			srv.serveHealthCheck(w)
+			return
+		}
+		atomic.AddInt64(&srv.inflight, 1)
+		defer atomic.AddInt64(&srv.inflight, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (srv *Server) serveHealthCheck(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	health := "OK"
+	if srv.Draining() {
+		health = "DRAINING"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"health":   health,
+		"requests": atomic.LoadInt64(&srv.inflight),
+	})
+}
+
+// waitForRequests waits until no requests are in progress, or the
+// timeout expires.
+func (srv *Server) waitForRequests(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		n := atomic.LoadInt64(&srv.inflight)
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("drain timeout expired with %d requests in progress", n)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,122 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func startDrainTestServer(t *testing.T, h http.Handler) *Server {
+	srv := &Server{
+		Server:          http.Server{Handler: h},
+		Addr:            "127.0.0.1:0",
+		HealthCheckPath: "/_health/ping",
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func getHealth(t *testing.T, srv *Server) (int, string) {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + srv.Addr + "/_health/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var health struct{ Health string }
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, health.Health
+}
+
+func TestDrain(t *testing.T) {
+	inHandler := make(chan struct{})
+	release := make(chan struct{})
+	srv := startDrainTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first half, "))
+		w.(http.Flusher).Flush()
+		inHandler <- struct{}{}
+		<-release
+		w.Write([]byte("second half"))
+	}))
+	if code, health := getHealth(t, srv); code != http.StatusOK || health != "OK" {
+		t.Fatalf("got %d %q before draining", code, health)
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result)
+	go func() {
+		resp, err := http.Get("http://" + srv.Addr + "/")
+		if err != nil {
+			got <- result{"", err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		got <- result{string(body), err}
+	}()
+	<-inHandler
+
+	drained := make(chan error)
+	go func() {
+		drained <- srv.Drain(200*time.Millisecond, 10*time.Second)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if code, health := getHealth(t, srv); code != http.StatusServiceUnavailable || health != "DRAINING" {
+		t.Errorf("got %d %q while draining", code, health)
+	}
+
+	// After the delay, new connections are refused, but the
+	// request in progress isn't interrupted.
+	time.Sleep(300 * time.Millisecond)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	if _, err := client.Get("http://" + srv.Addr + "/_health/ping"); err == nil {
+		t.Error("new connection succeeded after drain delay")
+	}
+	select {
+	case <-drained:
+		t.Fatal("Drain returned while a request was in progress")
+	default:
+	}
+	close(release)
+	if r := <-got; r.err != nil || r.body != "first half, second half" {
+		t.Errorf("got %q, %v", r.body, r.err)
+	}
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain did not return")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	inHandler := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv := startDrainTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- struct{}{}
+		<-release
+	}))
+	go http.Get("http://" + srv.Addr + "/")
+	<-inHandler
+
+	t0 := time.Now()
+	srv.Drain(0, 100*time.Millisecond)
+	if elapsed := time.Since(t0); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("Drain returned after %v", elapsed)
+	}
+	if err := srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +16,21 @@ type Server struct {
 	running  bool
 	listener *net.TCPListener
 	wantDown bool
+
+	// If TLS is enabled (see TLSConfig.Enabled), Start loads the
+	// TLS configuration and serves HTTPS instead of HTTP.
+	TLS *TLSConfig
+
+	// If HealthCheckPath is not empty, requests for that path get
+	// a health report instead of being passed to Handler (see
+	// Drain).
+	HealthCheckPath string
+
+	stopTLSWatch func()
+	done         chan struct{}
+	draining     int32
+	drainTimeout int64
+	inflight     int64
 }
 
 // Start is essentially (*http.Server)ListenAndServe() with two more
@@ -25,6 +41,11 @@ type Server struct {
 // makes it possible to shut down gracefully on SIGTERM without
 // killing active connections.
 func (srv *Server) Start() error {
+	if srv.TLS.Enabled() {
+		if err := srv.TLS.Load(); err != nil {
+			return err
+		}
+	}
 	addr, err := net.ResolveTCPAddr("tcp", srv.Addr)
 	if err != nil {
 		return err
@@ -34,15 +55,30 @@ func (srv *Server) Start() error {
 		return err
 	}
 	srv.Addr = srv.listener.Addr().String()
+	var ln net.Listener = tcpKeepAliveListener{srv.listener}
+	if srv.TLS.Enabled() {
+		ln = srv.TLS.NewListener(ln)
+		srv.Handler = srv.TLS.Handler(srv.Handler)
+		srv.stopTLSWatch = srv.TLS.WatchSIGHUP()
+	}
+	srv.Handler = srv.trackRequests(srv.Handler)
 
 	mutex := &sync.RWMutex{}
 	srv.cond = sync.NewCond(mutex.RLocker())
 	srv.running = true
+	srv.done = make(chan struct{})
 	go func() {
-		err = srv.Serve(tcpKeepAliveListener{srv.listener})
+		err = srv.Serve(ln)
 		if !srv.wantDown {
 			srv.err = err
 		}
+		if srv.stopTLSWatch != nil {
+			srv.stopTLSWatch()
+		}
+		if timeout := atomic.LoadInt64(&srv.drainTimeout); timeout > 0 {
+			srv.waitForRequests(time.Duration(timeout))
+		}
+		close(srv.done)
 		mutex.Lock()
 		srv.running = false
 		srv.cond.Broadcast()
@@ -0,0 +1,302 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// HeaderRequestID is the header that carries the request ID.
+const HeaderRequestID = arvados.HeaderRequestID
+
+// Number of characters of a client's token to include in log
+// entries: enough to tell tokens apart, but not enough to use one.
+const tokenPrefixLength = 10
+
+// Maximum number of bytes of an error response body to include in a
+// log entry.
+const maxLoggedErrorBytes = 1024
+
+var (
+	// Request IDs supplied by clients are accepted if they look
+	// like this, and replaced otherwise.
+	validRequestID = regexp.MustCompile(`^[0-9A-Za-z_.:-]{1,64}$`)
+
+	// Tokens embedded in keep-web paths ("/t=TOKEN/...").
+	pathToken = regexp.MustCompile(`/t=([^/]*)`)
+
+	// Share links in keep-web paths ("/share/LINK/..."), which
+	// grant access to anyone who has them.
+	pathShareLink = regexp.MustCompile(`^/share/([^/]*)`)
+
+	// Query parameters that carry credentials, or (like S3
+	// presigned URL signatures) could be used to repeat the
+	// request. Only a prefix of each value is logged.
+	secretQueryParams = map[string]bool{
+		"api_token":        true,
+		"X-Amz-Credential": true,
+		"X-Amz-Signature":  true,
+	}
+
+	logOutput io.Writer = os.Stderr
+	logMtx    sync.Mutex
+)
+
+// A RequestLogEntry is written (as one line of JSON) for each
+// request handled by LogRequests.
+type RequestLogEntry struct {
+	Time        time.Time `json:"time"`
+	RequestID   string    `json:"request_id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Host        string    `json:"host,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Query       string    `json:"query,omitempty"`
+	TokenPrefix string    `json:"token_prefix,omitempty"`
+	ReqBytes    int64     `json:"req_bytes"`
+	Status      int       `json:"status"`
+	Bytes       int       `json:"bytes"`
+	Duration    float64   `json:"duration"`
+	Error       string    `json:"error,omitempty"`
+
+	// Service-specific details added by the handler (see
+	// LogDetail).
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+type logDetailsKey struct{}
+
+type logDetails struct {
+	mtx sync.Mutex
+	m   map[string]interface{}
+}
+
+// LogDetail adds a service-specific detail, like the number of
+// replicas written, to the log entry that LogRequests will write for
+// the request with the given context. It does nothing if the request
+// is not being logged by LogRequests.
+func LogDetail(ctx context.Context, key string, value interface{}) {
+	ld, ok := ctx.Value(logDetailsKey{}).(*logDetails)
+	if !ok {
+		return
+	}
+	ld.mtx.Lock()
+	defer ld.mtx.Unlock()
+	if ld.m == nil {
+		ld.m = make(map[string]interface{})
+	}
+	ld.m[key] = value
+}
+
+// AddRequestIDs wraps h, making sure every request has an ID. If the
+// client sent a reasonable-looking X-Request-Id header, that ID is
+// used; otherwise a new one is generated. The ID is set in the
+// request's X-Request-Id header, in the response's X-Request-Id
+// header, and in the request's context (see
+// arvados.ContextWithRequestID), where keepclient and arvados.Client
+// will find it and pass it along to other services.
+func AddRequestIDs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(HeaderRequestID)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+			req.Header.Set(HeaderRequestID, id)
+		}
+		w.Header().Set(HeaderRequestID, id)
+		h.ServeHTTP(w, req.WithContext(arvados.ContextWithRequestID(req.Context(), id)))
+	})
+}
+
+func newRequestID() string {
+	var buf [10]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("req-%x", buf)
+}
+
+// LogRequests wraps h, adding request IDs (see AddRequestIDs) and
+// writing a RequestLogEntry to stderr when each request finishes.
+func LogRequests(h http.Handler) http.Handler {
+	return AddRequestIDs(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t0 := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		ld := &logDetails{}
+		defer func() {
+			status := lw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			ent := RequestLogEntry{
+				Time:        t0.UTC(),
+				RequestID:   req.Header.Get(HeaderRequestID),
+				RemoteAddr:  remoteAddr(req),
+				Host:        req.Host,
+				Method:      req.Method,
+				Path:        redactPath(req.URL.Path),
+				Query:       redactQuery(req.URL),
+				TokenPrefix: tokenPrefix(requestToken(req)),
+				ReqBytes:    req.ContentLength,
+				Status:      status,
+				Bytes:       lw.bytes,
+				Duration:    time.Since(t0).Seconds(),
+				Error:       strings.TrimSpace(lw.errBody.String()),
+			}
+			ld.mtx.Lock()
+			ent.Details = ld.m
+			writeLogEntry(&ent)
+			ld.mtx.Unlock()
+		}()
+		h.ServeHTTP(lw, req.WithContext(context.WithValue(req.Context(), logDetailsKey{}, ld)))
+	}))
+}
+
+func writeLogEntry(ent *RequestLogEntry) {
+	buf, err := json.Marshal(ent)
+	if err != nil {
+		buf = []byte(fmt.Sprintf(`{"error":%q}`, err))
+	}
+	buf = append(buf, '\n')
+	logMtx.Lock()
+	defer logMtx.Unlock()
+	logOutput.Write(buf)
+}
+
+// remoteAddr returns the client's address, including any addresses
+// added by proxies in an X-Forwarded-For header.
+func remoteAddr(req *http.Request) string {
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		return xff + "," + req.RemoteAddr
+	}
+	return req.RemoteAddr
+}
+
+// requestToken returns the API token supplied with req, if any.
+func requestToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		for _, scheme := range []string{"OAuth2 ", "Bearer "} {
+			if strings.HasPrefix(auth, scheme) {
+				return strings.TrimSpace(auth[len(scheme):])
+			}
+		}
+	}
+	if m := pathToken.FindStringSubmatch(req.URL.Path); m != nil {
+		return m[1]
+	}
+	if tok := req.URL.Query().Get("api_token"); tok != "" {
+		return tok
+	}
+	if cookie, err := req.Cookie("arvados_api_token"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func tokenPrefix(tok string) string {
+	if len(tok) > tokenPrefixLength {
+		return tok[:tokenPrefixLength]
+	}
+	return tok
+}
+
+// redactPath returns path, with tokens and share links truncated.
+func redactPath(path string) string {
+	path = pathToken.ReplaceAllStringFunc(path, func(s string) string {
+		return "/t=" + tokenPrefix(s[len("/t="):]) + "..."
+	})
+	return pathShareLink.ReplaceAllStringFunc(path, func(s string) string {
+		return "/share/" + tokenPrefix(s[len("/share/"):]) + "..."
+	})
+}
+
+// redactQuery returns u's query string, with the values of
+// secretQueryParams truncated.
+func redactQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return ""
+	}
+	q := u.Query()
+	for k, vs := range q {
+		if !secretQueryParams[k] {
+			continue
+		}
+		for i, v := range vs {
+			vs[i] = tokenPrefix(v) + "..."
+		}
+	}
+	return q.Encode()
+}
+
+// loggingResponseWriter records the status and size of a response,
+// and the beginning of the body of an error response.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	bytes   int
+	errBody limitedBuffer
+}
+
+func (lw *loggingResponseWriter) WriteHeader(status int) {
+	if lw.status == 0 {
+		lw.status = status
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *loggingResponseWriter) Write(data []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	if lw.status >= 400 {
+		lw.errBody.Write(data)
+	}
+	n, err := lw.ResponseWriter.Write(data)
+	lw.bytes += n
+	return n, err
+}
+
+// CloseNotify implements http.CloseNotifier, if the wrapped
+// ResponseWriter does.
+func (lw *loggingResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := lw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	// A channel that never sends anything is a valid (if
+	// uninformative) CloseNotify result.
+	return nil
+}
+
+// Flush implements http.Flusher, if the wrapped ResponseWriter does.
+func (lw *loggingResponseWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// limitedBuffer keeps the first maxLoggedErrorBytes bytes written to
+// it, and discards the rest.
+type limitedBuffer struct {
+	buf []byte
+}
+
+func (lb *limitedBuffer) Write(data []byte) {
+	if room := maxLoggedErrorBytes - len(lb.buf); room < len(data) {
+		data = data[:room]
+	}
+	lb.buf = append(lb.buf, data...)
+}
+
+func (lb *limitedBuffer) String() string {
+	return string(lb.buf)
+}
@@ -0,0 +1,166 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// captureLog runs h with the given request, and returns the log
+// entry written by LogRequests.
+func captureLog(t *testing.T, h http.Handler, req *http.Request) (*httptest.ResponseRecorder, RequestLogEntry) {
+	var buf bytes.Buffer
+	defer func(orig io.Writer) { logOutput = orig }(logOutput)
+	logOutput = &buf
+	resp := httptest.NewRecorder()
+	LogRequests(h).ServeHTTP(resp, req)
+	var ent RequestLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &ent); err != nil {
+		t.Fatalf("%s: %q", err, buf.String())
+	}
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("expected exactly one log line, got %q", buf.String())
+	}
+	return resp, ent
+}
+
+func TestLogRequests(t *testing.T) {
+	var ctxID string
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctxID = arvados.RequestIDFromContext(req.Context())
+		w.Write([]byte("hello"))
+	})
+	req := httptest.NewRequest("GET", "http://example.com/foo?bar=baz", nil)
+	req.RemoteAddr = "10.20.30.40:1234"
+	req.Header.Set("Authorization", "OAuth2 abcdefghijklmnopqrstuvwxyz")
+	resp, ent := captureLog(t, h, req)
+
+	if resp.Code != http.StatusOK || resp.Body.String() != "hello" {
+		t.Errorf("unexpected response %d %q", resp.Code, resp.Body.String())
+	}
+	id := resp.Header().Get("X-Request-Id")
+	if !strings.HasPrefix(id, "req-") {
+		t.Errorf("bad request ID %q", id)
+	}
+	if ctxID != id || ent.RequestID != id {
+		t.Errorf("request ID mismatch: response %q, context %q, log %q", id, ctxID, ent.RequestID)
+	}
+	if ent.Method != "GET" || ent.Path != "/foo" || ent.Host != "example.com" {
+		t.Errorf("bad method/path/host in %+v", ent)
+	}
+	if ent.Status != http.StatusOK || ent.Bytes != 5 {
+		t.Errorf("bad status/bytes in %+v", ent)
+	}
+	if ent.TokenPrefix != "abcdefghij" {
+		t.Errorf("bad token prefix %q", ent.TokenPrefix)
+	}
+	if ent.RemoteAddr != "10.20.30.40:1234" {
+		t.Errorf("bad remote address %q", ent.RemoteAddr)
+	}
+	if ent.Duration < 0 || ent.Time.IsZero() {
+		t.Errorf("bad time/duration in %+v", ent)
+	}
+}
+
+func TestLogRequestsPropagateID(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	for id, ok := range map[string]bool{
+		"req-0123456789":         true,
+		"abc:def_ghi.jkl":        true,
+		"":                       false,
+		"has space":              false,
+		strings.Repeat("x", 100): false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-Id", id)
+		resp, ent := captureLog(t, h, req)
+		got := resp.Header().Get("X-Request-Id")
+		if (got == id) != ok || ent.RequestID != got || got == "" {
+			t.Errorf("incoming ID %q: got %q, logged %q", id, got, ent.RequestID)
+		}
+	}
+}
+
+func TestLogRequestsError(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, strings.Repeat("z", 2000), http.StatusNotFound)
+	})
+	req := httptest.NewRequest("GET", "http://collections.example/c=abc/t=secrettokensecrettoken/foo", nil)
+	_, ent := captureLog(t, h, req)
+	if ent.Status != http.StatusNotFound {
+		t.Errorf("bad status %d", ent.Status)
+	}
+	if len(ent.Error) != maxLoggedErrorBytes {
+		t.Errorf("logged %d bytes of error response", len(ent.Error))
+	}
+	if ent.Path != "/c=abc/t=secrettoke.../foo" {
+		t.Errorf("token not redacted from path %q", ent.Path)
+	}
+	if ent.TokenPrefix != "secrettoke" {
+		t.Errorf("bad token prefix %q", ent.TokenPrefix)
+	}
+}
+
+func TestLogRequestsRedactShareLink(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	req := httptest.NewRequest("GET", "http://collections.example/share/eyJjb2xsZWN0aW9uIjoiYWJjIn0.c2lnbmF0dXJl/foo/bar.txt", nil)
+	_, ent := captureLog(t, h, req)
+	if ent.Path != "/share/eyJjb2xsZW.../foo/bar.txt" {
+		t.Errorf("share link not redacted from path %q", ent.Path)
+	}
+	if ent.TokenPrefix != "" {
+		t.Errorf("share link logged as token prefix %q", ent.TokenPrefix)
+	}
+}
+
+func TestLogRequestsRedactQuery(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	req := httptest.NewRequest("GET", "/bucket/key?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=zzzzz-gj3su-aaaaaaaaaaaaaaa%2F20170101%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Signature=0123456789abcdef0123456789abcdef&api_token=secrettokensecrettoken&format=zip", nil)
+	_, ent := captureLog(t, h, req)
+	q, err := url.ParseQuery(ent.Query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, expect := range map[string]string{
+		"X-Amz-Algorithm":  "AWS4-HMAC-SHA256",
+		"X-Amz-Credential": "zzzzz-gj3s...",
+		"X-Amz-Signature":  "0123456789...",
+		"api_token":        "secrettoke...",
+		"format":           "zip",
+	} {
+		if q.Get(k) != expect {
+			t.Errorf("logged %s=%q, expected %q", k, q.Get(k), expect)
+		}
+	}
+}
+
+func TestLogDetail(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		LogDetail(req.Context(), "replicas", 2)
+		LogDetail(req.Context(), "message", "ok")
+	})
+	req := httptest.NewRequest("PUT", "/", nil)
+	req.SetBasicAuth("none", "abcdefghijklmnopqrstuvwxyz")
+	_, ent := captureLog(t, h, req)
+	if ent.Details["replicas"] != float64(2) || ent.Details["message"] != "ok" {
+		t.Errorf("bad details %+v", ent.Details)
+	}
+	// A password might not be a token, so it isn't logged.
+	if ent.TokenPrefix != "" {
+		t.Errorf("logged part of password %q", ent.TokenPrefix)
+	}
+
+	// Without LogRequests, LogDetail does nothing.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestLoggingResponseWriterImplementsCloseNotifier(t *testing.T) {
+	http.ResponseWriter(&loggingResponseWriter{ResponseWriter: httptest.NewRecorder()}).(http.CloseNotifier).CloseNotify()
+}
@@ -0,0 +1,250 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// TLSConfig configures a server to accept TLS connections, and
+// optionally to authenticate clients by their certificates.
+//
+// All of the files are read by Load, and read again when the process
+// receives SIGHUP (see WatchSIGHUP), so certificates can be renewed
+// without restarting the server. If the new files cannot be loaded,
+// the previous configuration stays in effect.
+type TLSConfig struct {
+	// PEM files with the server's certificate (chain) and private
+	// key. TLS is enabled if CertFile is not empty.
+	CertFile string
+	KeyFile  string
+
+	// PEM file with CA certificates used to verify client
+	// certificates. If empty, clients are not asked for
+	// certificates.
+	ClientCAFile string
+
+	// If true, clients must present a certificate signed by one
+	// of the CAs in ClientCAFile. Otherwise, a client certificate
+	// is optional, but verified if given.
+	RequireClientCert bool
+
+	// JSON file mapping client certificate subjects to Arvados
+	// API tokens, like
+	//
+	//	{"CN=instrument-1,O=Example Lab": "xyzzy"}
+	//
+	// See ClientCertSubject for the subject format. A request
+	// made with a verified client certificate listed here, and
+	// without an Authorization header, is handled as if it had
+	// "Authorization: OAuth2 <token>". Requires ClientCAFile.
+	ClientCertTokensFile string
+
+	mtx    sync.RWMutex
+	config *tls.Config
+	tokens map[string]string
+}
+
+// AddFlags adds command line flags for the TLS configuration to fs,
+// with the given prefix (e.g., "tls-").
+func (c *TLSConfig) AddFlags(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&c.CertFile, prefix+"cert", "",
+		"PEM file with TLS certificate. If empty, serve plain HTTP.")
+	fs.StringVar(&c.KeyFile, prefix+"key", "",
+		"PEM file with TLS private key.")
+	fs.StringVar(&c.ClientCAFile, prefix+"client-ca", "",
+		"PEM file with CA certificates used to verify TLS client certificates.")
+	fs.BoolVar(&c.RequireClientCert, prefix+"require-client-cert", false,
+		"Reject TLS clients without a valid client certificate.")
+	fs.StringVar(&c.ClientCertTokensFile, prefix+"client-cert-tokens", "",
+		"JSON file mapping TLS client certificate subjects to API tokens.")
+}
+
+// Enabled returns true if a certificate file has been configured.
+func (c *TLSConfig) Enabled() bool {
+	return c != nil && c.CertFile != ""
+}
+
+// Load reads the certificate, key, CA, and token files. It returns
+// an error (and leaves the current configuration untouched) if any
+// of them cannot be loaded.
+func (c *TLSConfig) Load() error {
+	if c.KeyFile == "" {
+		return errors.New("TLS certificate file given without key file")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading TLS certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS10,
+	}
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("Error reading TLS client CA file: %v", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in TLS client CA file %q", c.ClientCAFile)
+		}
+		if c.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else if c.RequireClientCert {
+		return errors.New("TLS client certificates required, but no client CA file given")
+	}
+	var tokens map[string]string
+	if c.ClientCertTokensFile != "" {
+		if c.ClientCAFile == "" {
+			return errors.New("TLS client certificate tokens given, but no client CA file")
+		}
+		buf, err := ioutil.ReadFile(c.ClientCertTokensFile)
+		if err != nil {
+			return fmt.Errorf("Error reading TLS client certificate tokens: %v", err)
+		}
+		if err = json.Unmarshal(buf, &tokens); err != nil {
+			return fmt.Errorf("Error decoding TLS client certificate tokens %q: %v", c.ClientCertTokensFile, err)
+		}
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.config = config
+	c.tokens = tokens
+	return nil
+}
+
+// WatchSIGHUP reloads the configuration (see Load) whenever the
+// process receives SIGHUP, until stop is called.
+func (c *TLSConfig) WatchSIGHUP() (stop func()) {
+	hup := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hup:
+			case <-done:
+				return
+			}
+			if err := c.Load(); err != nil {
+				log.Printf("Error reloading TLS configuration, keeping previous configuration: %v", err)
+			} else {
+				log.Printf("Reloaded TLS configuration")
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(hup)
+			close(done)
+		})
+	}
+}
+
+// NewListener returns a listener that accepts TLS connections on the
+// given listener, using the configuration that is current when each
+// connection is accepted. Load must be called first.
+func (c *TLSConfig) NewListener(inner net.Listener) net.Listener {
+	return &tlsListener{Listener: inner, c: c}
+}
+
+type tlsListener struct {
+	net.Listener
+	c *TLSConfig
+}
+
+func (ln *tlsListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ln.c.mtx.RLock()
+	config := ln.c.config
+	ln.c.mtx.RUnlock()
+	return tls.Server(conn, config), nil
+}
+
+// Handler returns an http.Handler that adds an Authorization header
+// to requests made with a client certificate listed in
+// ClientCertTokensFile, then passes them to h.
+func (c *TLSConfig) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && r.Header.Get("Authorization") == "" {
+			subject := ClientCertSubject(r.TLS.VerifiedChains[0][0].Subject)
+			c.mtx.RLock()
+			token, ok := c.tokens[subject]
+			c.mtx.RUnlock()
+			if ok {
+				r.Header.Set("Authorization", "OAuth2 "+token)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ClientCertSubject formats a certificate subject as it appears in
+// ClientCertTokensFile: comma-separated CN, OU, O, L, ST, and C
+// attributes, in that order, omitting empty ones. For example,
+// "CN=instrument-1,OU=Sequencing,O=Example Lab,C=US".
+//
+// Attribute values are escaped as specified in RFC 4514, so a
+// value containing "," or "=" cannot be mistaken for additional
+// attributes: a certificate with CN "x,O=admins" has the subject
+// "CN=x\,O\=admins".
+func ClientCertSubject(name pkix.Name) string {
+	var parts []string
+	add := func(key string, values ...string) {
+		for _, v := range values {
+			parts = append(parts, key+"="+escapeDNValue(v))
+		}
+	}
+	if name.CommonName != "" {
+		add("CN", name.CommonName)
+	}
+	add("OU", name.OrganizationalUnit...)
+	add("O", name.Organization...)
+	add("L", name.Locality...)
+	add("ST", name.Province...)
+	add("C", name.Country...)
+	return strings.Join(parts, ",")
+}
+
+// escapeDNValue escapes an attribute value for use in a
+// distinguished name string (RFC 4514 section 2.4). "=" is not
+// required to be escaped, but escaping it is allowed, and makes the
+// result easier to read unambiguously.
+func escapeDNValue(v string) string {
+	var buf bytes.Buffer
+	for i, r := range v {
+		switch {
+		case r == 0:
+			buf.WriteString(`\00`)
+			continue
+		case strings.ContainsRune(`"+,;<>\=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(v)-1 && r == ' ':
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
@@ -0,0 +1,274 @@
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+var testSerial int64
+
+// makeTestCert returns a new certificate signed by parent, or a
+// self-signed CA certificate if parent is nil.
+func makeTestCert(t *testing.T, name pkix.Name, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      name,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signerCert, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (tc *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(tc.certPEM, tc.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+type tlsTestEnv struct {
+	dir    string
+	ca     *testCert
+	server *testCert
+	client *testCert
+	srv    *Server
+}
+
+func setupTLSTest(t *testing.T, requireClientCert bool) *tlsTestEnv {
+	dir, err := ioutil.TempDir("", "httpserver-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &tlsTestEnv{dir: dir}
+	env.ca = makeTestCert(t, pkix.Name{CommonName: "Test CA"}, nil)
+	env.server = makeTestCert(t, pkix.Name{CommonName: "127.0.0.1"}, env.ca)
+	env.client = makeTestCert(t, pkix.Name{CommonName: "instrument-1", Organization: []string{"Example Lab"}}, env.ca)
+	env.writeFile(t, "server.crt", env.server.certPEM)
+	env.writeFile(t, "server.key", env.server.keyPEM)
+	env.writeFile(t, "ca.crt", env.ca.certPEM)
+	env.writeFile(t, "tokens.json", []byte(`{"CN=instrument-1,O=Example Lab": "instrumenttoken"}`))
+	env.srv = &Server{
+		Server: http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Header.Get("Authorization")))
+			}),
+		},
+		Addr: "127.0.0.1:0",
+		TLS: &TLSConfig{
+			CertFile:             filepath.Join(dir, "server.crt"),
+			KeyFile:              filepath.Join(dir, "server.key"),
+			ClientCAFile:         filepath.Join(dir, "ca.crt"),
+			RequireClientCert:    requireClientCert,
+			ClientCertTokensFile: filepath.Join(dir, "tokens.json"),
+		},
+	}
+	if err := env.srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func (env *tlsTestEnv) writeFile(t *testing.T, name string, data []byte) {
+	if err := ioutil.WriteFile(filepath.Join(env.dir, name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (env *tlsTestEnv) tearDown() {
+	env.srv.Close()
+	os.RemoveAll(env.dir)
+}
+
+// get makes a request using the given client certificate (if any),
+// and returns the Authorization header seen by the server.
+func (env *tlsTestEnv) get(t *testing.T, client *testCert, auth string) (string, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(env.ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if client != nil {
+		config.Certificates = []tls.Certificate{client.tlsCertificate(t)}
+	}
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	req, err := http.NewRequest("GET", "https://"+env.srv.Addr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestTLSClientCertTokens(t *testing.T) {
+	env := setupTLSTest(t, false)
+	defer env.tearDown()
+
+	if got, err := env.get(t, env.client, ""); err != nil || got != "OAuth2 instrumenttoken" {
+		t.Errorf("with mapped client cert: got %q, %v", got, err)
+	}
+	if got, err := env.get(t, env.client, "OAuth2 othertoken"); err != nil || got != "OAuth2 othertoken" {
+		t.Errorf("with mapped client cert and token: got %q, %v", got, err)
+	}
+	if got, err := env.get(t, nil, ""); err != nil || got != "" {
+		t.Errorf("without client cert: got %q, %v", got, err)
+	}
+	other := makeTestCert(t, pkix.Name{CommonName: "instrument-2"}, env.ca)
+	if got, err := env.get(t, other, ""); err != nil || got != "" {
+		t.Errorf("with unmapped client cert: got %q, %v", got, err)
+	}
+	rogueCA := makeTestCert(t, pkix.Name{CommonName: "Rogue CA"}, nil)
+	rogue := makeTestCert(t, pkix.Name{CommonName: "instrument-1", Organization: []string{"Example Lab"}}, rogueCA)
+	// The client doesn't offer a certificate the server won't
+	// accept, so this is just an unauthenticated request.
+	if got, _ := env.get(t, rogue, ""); got != "" {
+		t.Errorf("with client cert from unknown CA: got %q", got)
+	}
+}
+
+func TestTLSRequireClientCert(t *testing.T) {
+	env := setupTLSTest(t, true)
+	defer env.tearDown()
+
+	if got, err := env.get(t, nil, "OAuth2 othertoken"); err == nil {
+		t.Errorf("without client cert: got %q, expected error", got)
+	}
+	if got, err := env.get(t, env.client, ""); err != nil || got != "OAuth2 instrumenttoken" {
+		t.Errorf("with client cert: got %q, %v", got, err)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	env := setupTLSTest(t, false)
+	defer env.tearDown()
+
+	newServer := makeTestCert(t, pkix.Name{CommonName: "127.0.0.1"}, env.ca)
+	env.writeFile(t, "server.crt", newServer.certPEM)
+	env.writeFile(t, "server.key", newServer.keyPEM)
+	env.writeFile(t, "tokens.json", []byte(`{"CN=instrument-1,O=Example Lab": "newtoken"}`))
+	if err := env.srv.TLS.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := env.get(t, env.client, ""); err != nil || got != "OAuth2 newtoken" {
+		t.Errorf("after reload: got %q, %v", got, err)
+	}
+	conn, err := tls.Dial("tcp", env.srv.Addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber; serial.Cmp(newServer.cert.SerialNumber) != 0 {
+		t.Errorf("server presented certificate with serial %v, expected %v", serial, newServer.cert.SerialNumber)
+	}
+	conn.Close()
+
+	// A broken key file does not replace the working
+	// configuration.
+	env.writeFile(t, "server.key", []byte("garbage"))
+	if err := env.srv.TLS.Load(); err == nil {
+		t.Error("Load succeeded with garbage key file")
+	}
+	if got, err := env.get(t, env.client, ""); err != nil || got != "OAuth2 newtoken" {
+		t.Errorf("after failed reload: got %q, %v", got, err)
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	for _, c := range []*TLSConfig{
+		{CertFile: "/nonexistent.crt"},
+		{CertFile: "/nonexistent.crt", KeyFile: "/nonexistent.key"},
+	} {
+		if err := c.Load(); err == nil {
+			t.Errorf("%+v: Load succeeded", c)
+		}
+	}
+	if (*TLSConfig)(nil).Enabled() || (&TLSConfig{}).Enabled() {
+		t.Error("Enabled() returned true for empty config")
+	}
+}
+
+func TestClientCertSubject(t *testing.T) {
+	name := pkix.Name{
+		CommonName:         "instrument-1",
+		OrganizationalUnit: []string{"Sequencing"},
+		Organization:       []string{"Example Lab"},
+		Country:            []string{"US"},
+	}
+	if s := ClientCertSubject(name); s != "CN=instrument-1,OU=Sequencing,O=Example Lab,C=US" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestClientCertSubjectEscape(t *testing.T) {
+	for _, trial := range []struct {
+		name   pkix.Name
+		expect string
+	}{
+		{pkix.Name{CommonName: "x,O=admins"}, `CN=x\,O\=admins`},
+		{pkix.Name{CommonName: "x", Organization: []string{"admins"}}, `CN=x,O=admins`},
+		{pkix.Name{CommonName: ` #a+b;c<d>"e\ `}, `CN=\ #a\+b\;c\<d\>\"e\\\ `},
+		{pkix.Name{CommonName: "#1", Organization: []string{"a\x00b"}}, `CN=\#1,O=a\00b`},
+	} {
+		if s := ClientCertSubject(trial.name); s != trial.expect {
+			t.Errorf("%+v: got %q, expected %q", trial.name, s, trial.expect)
+		}
+	}
+}
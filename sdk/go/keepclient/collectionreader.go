@@ -1,6 +1,7 @@
 package keepclient
 
 import (
+	"context"
 	"errors"
 	"io"
 	"os"
@@ -35,17 +36,30 @@ var ErrNoManifest = errors.New("Collection has no manifest")
 // content from a collection. The filename must be given relative to
 // the root of the collection, without a leading "./".
 func (kc *KeepClient) CollectionFileReader(collection map[string]interface{}, filename string) (ReadCloserWithLen, error) {
+	return kc.CollectionFileReaderContext(context.Background(), collection, filename)
+}
+
+// CollectionFileReaderContext is the same as CollectionFileReader,
+// but block retrieval stops, and Read returns an error, if ctx is
+// cancelled or its deadline expires.
+func (kc *KeepClient) CollectionFileReaderContext(ctx context.Context, collection map[string]interface{}, filename string) (ReadCloserWithLen, error) {
 	mText, ok := collection["manifest_text"].(string)
 	if !ok {
 		return nil, ErrNoManifest
 	}
 	m := manifest.Manifest{Text: mText}
-	return kc.ManifestFileReader(m, filename)
+	return kc.ManifestFileReaderContext(ctx, m, filename)
 }
 
 func (kc *KeepClient) ManifestFileReader(m manifest.Manifest, filename string) (ReadCloserWithLen, error) {
+	return kc.ManifestFileReaderContext(context.Background(), m, filename)
+}
+
+// ManifestFileReaderContext is the same as ManifestFileReader, but
+// uses the given context. See CollectionFileReaderContext.
+func (kc *KeepClient) ManifestFileReaderContext(ctx context.Context, m manifest.Manifest, filename string) (ReadCloserWithLen, error) {
 	rdrChan := make(chan *cfReader)
-	go kc.queueSegmentsToGet(m, filename, rdrChan)
+	go kc.queueSegmentsToGet(ctx, m, filename, rdrChan)
 	r, ok := <-rdrChan
 	if !ok {
 		return nil, os.ErrNotExist
@@ -56,7 +70,7 @@ func (kc *KeepClient) ManifestFileReader(m manifest.Manifest, filename string) (
 // Send segments for the specified file to r.toGet. Send a *cfReader
 // to rdrChan if the specified file is found (even if it's empty).
 // Then, close rdrChan.
-func (kc *KeepClient) queueSegmentsToGet(m manifest.Manifest, filename string, rdrChan chan *cfReader) {
+func (kc *KeepClient) queueSegmentsToGet(ctx context.Context, m manifest.Manifest, filename string, rdrChan chan *cfReader) {
 	defer close(rdrChan)
 
 	// q is a queue of FileSegments that we have received but
@@ -69,7 +83,7 @@ func (kc *KeepClient) queueSegmentsToGet(m manifest.Manifest, filename string, r
 			// filename does appear in the manifest, so we
 			// can return a real reader (not nil) from
 			// CollectionFileReader().
-			r = newCFReader(kc)
+			r = newCFReader(ctx, kc)
 			rdrChan <- r
 		}
 		q = append(q, seg)
@@ -100,6 +114,9 @@ func (kc *KeepClient) queueSegmentsToGet(m manifest.Manifest, filename string, r
 type cfReader struct {
 	keepClient *KeepClient
 
+	// Block retrieval stops when ctx is done.
+	ctx context.Context
+
 	// doGet() reads FileSegments from toGet, gets the data from
 	// Keep, and sends byte slices to toRead to be consumed by
 	// Read().
@@ -201,7 +218,7 @@ func (r *cfReader) doGet() {
 	defer close(r.toRead)
 GET:
 	for fs := range r.toGet {
-		rdr, _, _, err := r.keepClient.Get(fs.Locator)
+		rdr, _, _, err := r.keepClient.GetContext(r.ctx, fs.Locator)
 		if err != nil {
 			r.err = err
 			close(r.errNotNil)
@@ -228,6 +245,10 @@ GET:
 				// Reader is closed: no point sending
 				// anything more to toRead.
 				break GET
+			case <-r.ctx.Done():
+				r.err = r.ctx.Err()
+				close(r.errNotNil)
+				break GET
 			}
 		}
 		// It is possible that r.rdrClosed is closed but we
@@ -247,9 +268,10 @@ GET:
 	}
 }
 
-func newCFReader(kc *KeepClient) (r *cfReader) {
+func newCFReader(ctx context.Context, kc *KeepClient) (r *cfReader) {
 	r = new(cfReader)
 	r.keepClient = kc
+	r.ctx = ctx
 	r.rdrClosed = make(chan struct{})
 	r.errNotNil = make(chan struct{})
 	r.toGet = make(chan *manifest.FileSegment, 2)
@@ -3,19 +3,24 @@ package keepclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/keeplocator"
 	"git.curoverse.com/arvados.git/sdk/go/streamer"
+	"git.curoverse.com/arvados.git/sdk/go/trace"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"regexp"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // A Keep "block" is 64MB.
@@ -54,6 +59,15 @@ var MissingArvadosApiHost = errors.New("Missing required environment variable AR
 var MissingArvadosApiToken = errors.New("Missing required environment variable ARVADOS_API_TOKEN")
 var InvalidLocatorError = errors.New("Invalid locator")
 
+// RetryDelay is the delay before the first round of retries, when
+// the KeepClient's RetryPolicy is nil. Subsequent delays grow
+// exponentially, up to MaxRetryDelay.
+var RetryDelay = 250 * time.Millisecond
+
+// MaxRetryDelay is the maximum delay between rounds of retries, when
+// the KeepClient's RetryPolicy is nil.
+var MaxRetryDelay = 10 * time.Second
+
 // ErrNoSuchKeepServer is returned when GetIndex is invoked with a UUID with no matching keep server
 var ErrNoSuchKeepServer = errors.New("No keep server matching the given UUID is found")
 
@@ -74,16 +88,34 @@ type KeepClient struct {
 	Client             *http.Client
 	Retries            int
 
+	// Policy for retrying failed Get, Ask and Put operations. If
+	// nil, a policy is derived from Retries, RetryDelay and
+	// MaxRetryDelay.
+	RetryPolicy *arvados.RetryPolicy
+
 	// set to 1 if all writable services are of disk type, otherwise 0
 	replicasPerService int
 
 	// Any non-disk typed services found in the list of keepservers?
 	foundNonDiskSvc bool
+
+	// Remote clusters, keyed by cluster ID, from which blocks
+	// with +R hints can be retrieved. MakeKeepClient loads this
+	// from the JSON file named by the ARVADOS_KEEP_REMOTE_CLUSTERS
+	// environment variable, if set (see LoadRemoteClusters).
+	RemoteClusters map[string]RemoteCluster
 }
 
 // MakeKeepClient creates a new KeepClient by contacting the API server to discover Keep servers.
 func MakeKeepClient(arv *arvadosclient.ArvadosClient) (*KeepClient, error) {
 	kc := New(arv)
+	if path := os.Getenv("ARVADOS_KEEP_REMOTE_CLUSTERS"); path != "" {
+		clusters, err := LoadRemoteClusters(path)
+		if err != nil {
+			return kc, err
+		}
+		kc.RemoteClusters = clusters
+	}
 	return kc, kc.DiscoverKeepServers()
 }
 
@@ -118,6 +150,13 @@ func New(arv *arvadosclient.ArvadosClient) *KeepClient {
 // Returns an InsufficientReplicas error if 0 <= replicas <
 // kc.Wants_replicas.
 func (kc *KeepClient) PutHR(hash string, r io.Reader, dataBytes int64) (string, int, error) {
+	return kc.PutHRContext(context.Background(), hash, r, dataBytes)
+}
+
+// PutHRContext is the same as PutHR, but the upload is abandoned if
+// ctx is cancelled or its deadline expires. Cancellation is
+// propagated to all replica uploads that are in progress.
+func (kc *KeepClient) PutHRContext(ctx context.Context, hash string, r io.Reader, dataBytes int64) (string, int, error) {
 	// Buffer for reads from 'r'
 	var bufsize int
 	if dataBytes > 0 {
@@ -132,7 +171,7 @@ func (kc *KeepClient) PutHR(hash string, r io.Reader, dataBytes int64) (string,
 	t := streamer.AsyncStreamFromReader(bufsize, HashCheckingReader{r, md5.New(), hash})
 	defer t.Close()
 
-	return kc.putReplicas(hash, t, dataBytes)
+	return kc.putReplicas(ctx, hash, t, dataBytes)
 }
 
 // PutHB writes a block to Keep. The hash of the bytes is given in
@@ -140,17 +179,27 @@ func (kc *KeepClient) PutHR(hash string, r io.Reader, dataBytes int64) (string,
 //
 // Return values are the same as for PutHR.
 func (kc *KeepClient) PutHB(hash string, buf []byte) (string, int, error) {
+	return kc.PutHBContext(context.Background(), hash, buf)
+}
+
+// PutHBContext is the same as PutHB, but uses the given context.
+func (kc *KeepClient) PutHBContext(ctx context.Context, hash string, buf []byte) (string, int, error) {
 	t := streamer.AsyncStreamFromSlice(buf)
 	defer t.Close()
-	return kc.putReplicas(hash, t, int64(len(buf)))
+	return kc.putReplicas(ctx, hash, t, int64(len(buf)))
 }
 
 // PutB writes a block to Keep. It computes the hash itself.
 //
 // Return values are the same as for PutHR.
 func (kc *KeepClient) PutB(buffer []byte) (string, int, error) {
+	return kc.PutBContext(context.Background(), buffer)
+}
+
+// PutBContext is the same as PutB, but uses the given context.
+func (kc *KeepClient) PutBContext(ctx context.Context, buffer []byte) (string, int, error) {
 	hash := fmt.Sprintf("%x", md5.Sum(buffer))
-	return kc.PutHB(hash, buffer)
+	return kc.PutHBContext(ctx, hash, buffer)
 }
 
 // PutR writes a block to Keep. It first reads all data from r into a buffer
@@ -160,71 +209,93 @@ func (kc *KeepClient) PutB(buffer []byte) (string, int, error) {
 //
 // If the block hash and data size are known, PutHR is more efficient.
 func (kc *KeepClient) PutR(r io.Reader) (locator string, replicas int, err error) {
+	return kc.PutRContext(context.Background(), r)
+}
+
+// PutRContext is the same as PutR, but uses the given context.
+func (kc *KeepClient) PutRContext(ctx context.Context, r io.Reader) (locator string, replicas int, err error) {
 	if buffer, err := ioutil.ReadAll(r); err != nil {
 		return "", 0, err
 	} else {
-		return kc.PutB(buffer)
+		return kc.PutBContext(ctx, buffer)
 	}
 }
 
-func (kc *KeepClient) getOrHead(method string, locator string) (io.ReadCloser, int64, string, error) {
+func (kc *KeepClient) getOrHead(ctx context.Context, method string, locator string) (io.ReadCloser, int64, string, error) {
 	var errs []string
 
-	tries_remaining := 1 + kc.Retries
-
-	serversToTry := kc.getSortedRoots(locator)
+	serversToTry := kc.getTargets(locator)
 
 	numServers := len(serversToTry)
 	count404 := 0
 
-	var retryList []string
+	var retryList []getTarget
 
-	for tries_remaining > 0 {
-		tries_remaining -= 1
+	policy := kc.retryPolicy()
+	for retrier := policy.Start(ctx); len(serversToTry) > 0 && retrier.Next(); {
 		retryList = nil
 
-		for _, host := range serversToTry {
-			url := host + "/" + locator
+		for _, target := range serversToTry {
+			if err := ctx.Err(); err != nil {
+				return nil, 0, "", err
+			}
+			url := target.url()
 
 			req, err := http.NewRequest(method, url, nil)
 			if err != nil {
 				errs = append(errs, fmt.Sprintf("%s: %v", url, err))
 				continue
 			}
-			req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", kc.Arvados.ApiToken))
+			actx, span := trace.StartChild(ctx, "keepclient."+method)
+			span.SetAttribute("url", url)
+			req = req.WithContext(actx)
+			req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", target.token))
+			propagateContext(req)
 			resp, err := kc.Client.Do(req)
 			if err != nil {
 				// Probably a network error, may be transient,
 				// can try again.
 				errs = append(errs, fmt.Sprintf("%s: %v", url, err))
-				retryList = append(retryList, host)
+				retryList = append(retryList, target)
+				span.SetError(err)
+				span.End()
 			} else if resp.StatusCode != http.StatusOK {
 				var respbody []byte
 				respbody, _ = ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
 				resp.Body.Close()
 				errs = append(errs, fmt.Sprintf("%s: HTTP %d %q",
 					url, resp.StatusCode, bytes.TrimSpace(respbody)))
+				span.SetAttribute("http.status", resp.StatusCode)
+				span.SetError(errors.New(resp.Status))
+				span.End()
 
-				if resp.StatusCode == 408 ||
-					resp.StatusCode == 429 ||
-					resp.StatusCode >= 500 {
+				if policy.Retryable(resp.StatusCode) {
 					// Timeout, too many requests, or other
 					// server side failure, transient
 					// error, can try again.
-					retryList = append(retryList, host)
+					retryList = append(retryList, target)
+					retrier.SetRetryAfter(resp.Header.Get("Retry-After"))
 				} else if resp.StatusCode == 404 {
 					count404++
 				}
 			} else {
 				// Success.
+				span.SetAttribute("http.status", resp.StatusCode)
 				if method == "GET" {
-					return HashCheckingReader{
+					hcr := HashCheckingReader{
 						Reader: resp.Body,
 						Hash:   md5.New(),
 						Check:  locator[0:32],
-					}, resp.ContentLength, url, nil
+					}
+					if span != nil {
+						// End the span when the
+						// caller is done reading.
+						return tracedReader{hcr, span}, resp.ContentLength, url, nil
+					}
+					return hcr, resp.ContentLength, url, nil
 				} else {
 					resp.Body.Close()
+					span.End()
 					return nil, resp.ContentLength, url, nil
 				}
 			}
@@ -232,6 +303,9 @@ func (kc *KeepClient) getOrHead(method string, locator string) (io.ReadCloser, i
 		}
 		serversToTry = retryList
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, "", err
+	}
 	DebugPrintf("DEBUG: %s %s failed: %v", method, locator, errs)
 
 	var err error
@@ -254,7 +328,14 @@ func (kc *KeepClient) getOrHead(method string, locator string) (io.ReadCloser, i
 // reader returned by this method will return a BadChecksum error
 // instead of EOF.
 func (kc *KeepClient) Get(locator string) (io.ReadCloser, int64, string, error) {
-	return kc.getOrHead("GET", locator)
+	return kc.GetContext(context.Background(), locator)
+}
+
+// GetContext is the same as Get, but the request is aborted if ctx
+// is cancelled or its deadline expires. This includes reads from the
+// returned reader, which will return an error after ctx is done.
+func (kc *KeepClient) GetContext(ctx context.Context, locator string) (io.ReadCloser, int64, string, error) {
+	return kc.getOrHead(ctx, "GET", locator)
 }
 
 // Ask() verifies that a block with the given hash is available and
@@ -265,7 +346,12 @@ func (kc *KeepClient) Get(locator string) (io.ReadCloser, int64, string, error)
 // Returns the data size (content length) reported by the Keep service
 // and the URI reporting the data size.
 func (kc *KeepClient) Ask(locator string) (int64, string, error) {
-	_, size, url, err := kc.getOrHead("HEAD", locator)
+	return kc.AskContext(context.Background(), locator)
+}
+
+// AskContext is the same as Ask, but uses the given context.
+func (kc *KeepClient) AskContext(ctx context.Context, locator string) (int64, string, error) {
+	_, size, url, err := kc.getOrHead(ctx, "HEAD", locator)
 	return size, url, err
 }
 
@@ -277,6 +363,12 @@ func (kc *KeepClient) Ask(locator string) (int64, string, error) {
 // It will return an error unless the client is using a "data manager token"
 // recognized by the Keep services.
 func (kc *KeepClient) GetIndex(keepServiceUUID, prefix string) (io.Reader, error) {
+	return kc.GetIndexContext(context.Background(), keepServiceUUID, prefix)
+}
+
+// GetIndexContext is the same as GetIndex, but uses the given
+// context.
+func (kc *KeepClient) GetIndexContext(ctx context.Context, keepServiceUUID, prefix string) (io.Reader, error) {
 	url := kc.LocalRoots()[keepServiceUUID]
 	if url == "" {
 		return nil, ErrNoSuchKeepServer
@@ -291,8 +383,10 @@ func (kc *KeepClient) GetIndex(keepServiceUUID, prefix string) (io.Reader, error
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 
 	req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", kc.Arvados.ApiToken))
+	propagateContext(req)
 	resp, err := kc.Client.Do(req)
 	if err != nil {
 		return nil, err
@@ -321,6 +415,32 @@ func (kc *KeepClient) GetIndex(keepServiceUUID, prefix string) (io.Reader, error
 	return bytes.NewReader(respBody[0 : len(respBody)-1]), nil
 }
 
+// retryPolicy returns the RetryPolicy to use for Keep requests.
+func (kc *KeepClient) retryPolicy() *arvados.RetryPolicy {
+	var policy arvados.RetryPolicy
+	if kc.RetryPolicy != nil {
+		policy = *kc.RetryPolicy
+	} else {
+		policy = arvados.RetryPolicy{
+			MaxAttempts: kc.Retries + 1,
+			BaseDelay:   RetryDelay,
+			MaxDelay:    MaxRetryDelay,
+			Jitter:      0.5,
+		}
+	}
+	if policy.RetryableStatus == nil {
+		policy.RetryableStatus = retryableStatus
+	}
+	return &policy
+}
+
+// retryableStatus returns true if a Keep service response with the
+// given status code indicates a timeout, too many requests, or other
+// transient server-side failure.
+func retryableStatus(code int) bool {
+	return code == 408 || code == 429 || code >= 500
+}
+
 // LocalRoots() returns the map of local (i.e., disk and proxy) Keep
 // services: uuid -> baseURI.
 func (kc *KeepClient) LocalRoots() map[string]string {
@@ -375,24 +495,44 @@ func (kc *KeepClient) SetServiceRoots(newLocals, newWritableLocals, newGateways
 	kc.gatewayRoots = &gateways
 }
 
+// Clone returns a new KeepClient that uses the given ArvadosClient
+// (typically a copy of kc.Arvados with a different API token) and
+// shares kc's HTTP client, settings, and current list of Keep
+// services. Services discovered by kc after Clone returns (e.g., by
+// RefreshServices) are not seen by the clone.
+func (kc *KeepClient) Clone(arv *arvadosclient.ArvadosClient) *KeepClient {
+	kc.lock.RLock()
+	defer kc.lock.RUnlock()
+	return &KeepClient{
+		Arvados:            arv,
+		Want_replicas:      kc.Want_replicas,
+		localRoots:         kc.localRoots,
+		writableLocalRoots: kc.writableLocalRoots,
+		gatewayRoots:       kc.gatewayRoots,
+		Client:             kc.Client,
+		Retries:            kc.Retries,
+		RetryPolicy:        kc.RetryPolicy,
+		replicasPerService: kc.replicasPerService,
+		foundNonDiskSvc:    kc.foundNonDiskSvc,
+		RemoteClusters:     kc.RemoteClusters,
+	}
+}
+
 // getSortedRoots returns a list of base URIs of Keep services, in the
 // order they should be attempted in order to retrieve content for the
 // given locator.
 func (kc *KeepClient) getSortedRoots(locator string) []string {
 	var found []string
-	for _, hint := range strings.Split(locator, "+") {
-		if len(hint) < 7 || hint[0:2] != "K@" {
-			// Not a service hint.
-			continue
-		}
-		if len(hint) == 7 {
+	loc, _ := keeplocator.Parse(locator)
+	for _, svc := range loc.Services() {
+		if len(svc) == 5 {
 			// +K@abcde means fetch from proxy at
 			// keep.abcde.arvadosapi.com
-			found = append(found, "https://keep."+hint[2:]+".arvadosapi.com")
-		} else if len(hint) == 29 {
+			found = append(found, "https://keep."+string(svc)+".arvadosapi.com")
+		} else if len(svc) == 27 {
 			// +K@abcde-abcde-abcdeabcdeabcde means fetch
 			// from gateway with given uuid
-			if gwURI, ok := kc.GatewayRoots()[hint[2:]]; ok {
+			if gwURI, ok := kc.GatewayRoots()[string(svc)]; ok {
 				found = append(found, gwURI)
 			}
 			// else this hint is no use to us; carry on.
@@ -417,23 +557,19 @@ func (loc *Locator) String() string {
 	return s
 }
 
-var locatorMatcher = regexp.MustCompile("^([0-9a-f]{32})([+](.*))?$")
-
+// MakeLocator parses a locator string. See keeplocator.Parse for the
+// accepted syntax and typed hints.
 func MakeLocator(path string) (*Locator, error) {
-	sm := locatorMatcher.FindStringSubmatch(path)
-	if sm == nil {
+	parsed, err := keeplocator.Parse(path)
+	if err != nil {
 		return nil, InvalidLocatorError
 	}
-	loc := Locator{Hash: sm[1], Size: -1}
-	if sm[2] != "" {
-		loc.Hints = strings.Split(sm[3], "+")
-	} else {
-		loc.Hints = []string{}
+	loc := Locator{Hash: parsed.Hash, Size: parsed.Size, Hints: []string{}}
+	if parsed.Size >= 0 {
+		loc.Hints = append(loc.Hints, strconv.Itoa(parsed.Size))
 	}
-	if len(loc.Hints) > 0 {
-		if size, err := strconv.Atoi(loc.Hints[0]); err == nil {
-			loc.Size = size
-		}
+	for _, h := range parsed.Hints {
+		loc.Hints = append(loc.Hints, h.String())
 	}
 	return &loc, nil
 }
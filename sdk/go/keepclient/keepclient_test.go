@@ -1,12 +1,15 @@
 package keepclient
 
 import (
+	"context"
 	"crypto/md5"
 	"flag"
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
 	"git.curoverse.com/arvados.git/sdk/go/streamer"
+	"git.curoverse.com/arvados.git/sdk/go/trace"
 	. "gopkg.in/check.v1"
 	"io"
 	"io/ioutil"
@@ -15,6 +18,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -146,14 +150,14 @@ func (s *StandaloneSuite) TestUploadToStubKeepServer(c *C) {
 	UploadToStubHelper(c, st,
 		func(kc *KeepClient, url string, reader io.ReadCloser, writer io.WriteCloser, upload_status chan uploadStatus) {
 
-			go kc.uploadToKeepServer(url, st.expectPath, reader, upload_status, int64(len("foo")), 0)
+			go kc.uploadToKeepServer(context.Background(), url, st.expectPath, reader, upload_status, int64(len("foo")), 0)
 
 			writer.Write([]byte("foo"))
 			writer.Close()
 
 			<-st.handled
 			status := <-upload_status
-			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, ""})
+			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, "", ""})
 		})
 }
 
@@ -174,7 +178,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServerBufferReader(c *C) {
 
 			br1 := tr.MakeStreamReader()
 
-			go kc.uploadToKeepServer(url, st.expectPath, br1, upload_status, 3, 0)
+			go kc.uploadToKeepServer(context.Background(), url, st.expectPath, br1, upload_status, 3, 0)
 
 			writer.Write([]byte("foo"))
 			writer.Close()
@@ -182,7 +186,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServerBufferReader(c *C) {
 			<-st.handled
 
 			status := <-upload_status
-			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, ""})
+			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, "", ""})
 		})
 }
 
@@ -230,7 +234,7 @@ func (s *StandaloneSuite) TestFailedUploadToStubKeepServer(c *C) {
 		func(kc *KeepClient, url string, reader io.ReadCloser,
 			writer io.WriteCloser, upload_status chan uploadStatus) {
 
-			go kc.uploadToKeepServer(url, hash, reader, upload_status, 3, 0)
+			go kc.uploadToKeepServer(context.Background(), url, hash, reader, upload_status, 3, 0)
 
 			writer.Write([]byte("foo"))
 			writer.Close()
@@ -495,6 +499,43 @@ func (s *StandaloneSuite) TestGet(c *C) {
 	c.Check(content, DeepEquals, []byte("foo"))
 }
 
+func (s *StandaloneSuite) TestClone(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+
+	st := StubGetHandler{
+		c,
+		hash,
+		"def456",
+		http.StatusOK,
+		[]byte("foo")}
+
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, Equals, nil)
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	arv2 := arv
+	arv2.ApiToken = "def456"
+	kc2 := kc.Clone(&arv2)
+	c.Check(kc2.LocalRoots(), DeepEquals, kc.LocalRoots())
+	c.Check(kc2.Client, Equals, kc.Client)
+
+	r, n, _, err := kc2.Get(hash)
+	c.Assert(err, Equals, nil)
+	defer r.Close()
+	c.Check(n, Equals, int64(3))
+	c.Check(kc.Arvados.ApiToken, Equals, "abc123")
+
+	// Later changes to the original's service list don't affect
+	// the clone.
+	kc.SetServiceRoots(map[string]string{"y": "http://localhost:1"}, nil, nil)
+	c.Check(kc2.LocalRoots(), DeepEquals, map[string]string{"x": ks.url})
+}
+
 func (s *StandaloneSuite) TestGet404(c *C) {
 	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
 
@@ -1254,3 +1295,171 @@ func (s *ServerRequiredSuite) TestMakeKeepClientWithNonDiskTypeService(c *C) {
 	c.Assert(kc.foundNonDiskSvc, Equals, true)
 	c.Assert(kc.Client.Timeout, Equals, 300*time.Second)
 }
+
+// SlowHandler waits until its release channel is closed before
+// responding.
+type SlowHandler struct {
+	release chan struct{}
+}
+
+func (h SlowHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	<-h.release
+	resp.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func (s *StandaloneSuite) TestGetContextCancel(c *C) {
+	st := SlowHandler{make(chan struct{})}
+	defer close(st.release)
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	_, _, _, err = kc.GetContext(ctx, Md5String("foo"))
+	c.Check(err, NotNil)
+	c.Check(time.Since(t0) < 5*time.Second, Equals, true)
+}
+
+func (s *StandaloneSuite) TestPutContextCancel(c *C) {
+	st := SlowHandler{make(chan struct{})}
+	defer close(st.release)
+	ks := RunSomeFakeKeepServers(st, 2)
+	roots := make(map[string]string)
+	for i, k := range ks {
+		roots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+	kc.Want_replicas = 2
+	kc.SetServiceRoots(roots, roots, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	t0 := time.Now()
+	_, replicas, err := kc.PutBContext(ctx, []byte("foo"))
+	c.Check(err, Equals, context.Canceled)
+	c.Check(replicas, Equals, 0)
+	c.Check(time.Since(t0) < 5*time.Second, Equals, true)
+}
+
+// RequestIDHandler records the X-Request-Id header of each request.
+type RequestIDHandler struct {
+	ids chan string
+}
+
+func (h RequestIDHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.ids <- req.Header.Get("X-Request-Id")
+	if req.Method == "PUT" {
+		resp.Write([]byte(Md5String("foo") + "+3"))
+	} else {
+		resp.Write([]byte("foo"))
+	}
+}
+
+func (s *StandaloneSuite) TestRequestIDFromContext(c *C) {
+	st := RequestIDHandler{make(chan string, 10)}
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+	kc.Want_replicas = 1
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, map[string]string{"x": ks.url}, nil)
+
+	ctx := arvados.ContextWithRequestID(context.Background(), "req-abcdefghij")
+	_, _, err := kc.PutBContext(ctx, []byte("foo"))
+	c.Check(err, IsNil)
+	c.Check(<-st.ids, Equals, "req-abcdefghij")
+
+	r, _, _, err := kc.GetContext(ctx, Md5String("foo"))
+	c.Assert(err, IsNil)
+	r.Close()
+	c.Check(<-st.ids, Equals, "req-abcdefghij")
+
+	r, _, _, err = kc.Get(Md5String("foo"))
+	c.Assert(err, IsNil)
+	r.Close()
+	c.Check(<-st.ids, Equals, "")
+}
+
+// traceExporter keeps spans in memory.
+type traceExporter struct {
+	mtx   sync.Mutex
+	spans []trace.SpanData
+}
+
+func (te *traceExporter) Export(span trace.SpanData) {
+	te.mtx.Lock()
+	defer te.mtx.Unlock()
+	te.spans = append(te.spans, span)
+}
+
+// TraceHandler records the traceparent header of each request.
+type TraceHandler struct {
+	RequestIDHandler
+}
+
+func (h TraceHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	req.Header.Set("X-Request-Id", req.Header.Get(trace.HeaderTraceParent))
+	h.RequestIDHandler.ServeHTTP(resp, req)
+}
+
+func (s *StandaloneSuite) TestTraceContext(c *C) {
+	te := &traceExporter{}
+	trace.SetExporter(te)
+	defer trace.SetExporter(nil)
+
+	st := TraceHandler{RequestIDHandler{make(chan string, 10)}}
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+	kc.Want_replicas = 1
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, map[string]string{"x": ks.url}, nil)
+
+	ctx, root := trace.Start(context.Background(), "test")
+	_, _, err := kc.PutBContext(ctx, []byte("foo"))
+	c.Check(err, IsNil)
+	putHeader := <-st.ids
+	r, _, _, err := kc.GetContext(ctx, Md5String("foo"))
+	c.Assert(err, IsNil)
+	getHeader := <-st.ids
+	c.Check(r.Close(), IsNil)
+	root.End()
+
+	// Without a trace in the context, no spans are recorded and
+	// no header is sent.
+	r, _, _, err = kc.Get(Md5String("foo"))
+	c.Assert(err, IsNil)
+	r.Close()
+	c.Check(<-st.ids, Equals, "")
+
+	te.mtx.Lock()
+	defer te.mtx.Unlock()
+	c.Assert(te.spans, HasLen, 3)
+	put, get := te.spans[0], te.spans[1]
+	c.Check(put.Name, Equals, "keepclient.PUT")
+	c.Check(get.Name, Equals, "keepclient.GET")
+	for _, span := range []trace.SpanData{put, get} {
+		c.Check(span.TraceID, Equals, root.Context().TraceID)
+		c.Check(span.ParentID, Equals, root.Context().SpanID)
+		c.Check(span.Attributes["http.status"], Equals, http.StatusOK)
+	}
+	c.Check(putHeader, Equals, "00-"+put.TraceID+"-"+put.SpanID+"-01")
+	c.Check(getHeader, Equals, "00-"+get.TraceID+"-"+get.SpanID+"-01")
+}
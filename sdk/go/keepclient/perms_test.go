@@ -1,6 +1,7 @@
 package keepclient
 
 import (
+	"strconv"
 	"testing"
 	"time"
 )
@@ -24,10 +25,10 @@ const (
 )
 
 func TestSignLocator(t *testing.T) {
-	if ts, err := parseHexTimestamp(knownTimestamp); err != nil {
+	if ts, err := strconv.ParseInt(knownTimestamp, 16, 64); err != nil {
 		t.Errorf("bad knownTimestamp %s", knownTimestamp)
 	} else {
-		if knownSignedLocator != SignLocator(knownLocator, knownToken, ts, blobSignatureTTL, []byte(knownKey)) {
+		if knownSignedLocator != SignLocator(knownLocator, knownToken, time.Unix(ts, 0), blobSignatureTTL, []byte(knownKey)) {
 			t.Fail()
 		}
 	}
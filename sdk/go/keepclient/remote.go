@@ -0,0 +1,102 @@
+package keepclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/keeplocator"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// A RemoteCluster tells a KeepClient how to retrieve blocks stored on
+// another Arvados cluster, i.e., blocks whose locators have a
+// "+R<cluster>-<signature>@<expiry>" hint.
+type RemoteCluster struct {
+	// Base URI of the remote cluster's Keep proxy, like
+	// "https://keep.abcde.example.com".
+	ProxyURI string
+
+	// API token to send to the remote cluster. This must be the
+	// token the remote cluster used to sign the +R hints. If
+	// empty, the KeepClient's own token is used.
+	Token string
+}
+
+// LoadRemoteClusters reads a map of cluster IDs to RemoteClusters
+// from a JSON file, like
+//
+//	{"abcde": {"ProxyURI": "https://keep.abcde.example.com", "Token": "xyzzy"}}
+func LoadRemoteClusters(path string) (map[string]RemoteCluster, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading remote clusters %q: %v", path, err)
+	}
+	var clusters map[string]RemoteCluster
+	if err = json.Unmarshal(buf, &clusters); err != nil {
+		return nil, fmt.Errorf("Error decoding remote clusters %q: %v", path, err)
+	}
+	for id, rc := range clusters {
+		if u, err := url.Parse(rc.ProxyURI); err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("Remote cluster %q: invalid ProxyURI %q", id, rc.ProxyURI)
+		}
+		rc.ProxyURI = strings.TrimSuffix(rc.ProxyURI, "/")
+		clusters[id] = rc
+	}
+	return clusters, nil
+}
+
+// getTarget is a place to look for a block: a service, the form of
+// the locator to ask it for, and the token to send.
+type getTarget struct {
+	root    string
+	locator string
+	token   string
+}
+
+func (t getTarget) url() string {
+	return t.root + "/" + t.locator
+}
+
+// getTargets returns the places to look for the given locator, in
+// the order they should be attempted: remote clusters named in +R
+// hints (if configured), then the services returned by
+// getSortedRoots.
+func (kc *KeepClient) getTargets(locator string) []getTarget {
+	var targets []getTarget
+	if loc, err := keeplocator.Parse(locator); err == nil {
+		for _, r := range loc.Remotes() {
+			rc, ok := kc.RemoteClusters[r.Cluster]
+			if !ok {
+				continue
+			}
+			token := rc.Token
+			if token == "" {
+				token = kc.Arvados.ApiToken
+			}
+			// The remote cluster's Keep proxy checks the
+			// signature as an ordinary permission hint.
+			remoteLoc := keeplocator.Locator{
+				Hash: loc.Hash,
+				Size: loc.Size,
+				Hints: []keeplocator.Hint{keeplocator.PermissionHint{
+					Signature: r.Signature,
+					Expiry:    r.Expiry,
+				}},
+			}
+			targets = append(targets, getTarget{
+				root:    rc.ProxyURI,
+				locator: remoteLoc.String(),
+				token:   token,
+			})
+		}
+	}
+	for _, root := range kc.getSortedRoots(locator) {
+		targets = append(targets, getTarget{
+			root:    root,
+			locator: locator,
+			token:   kc.Arvados.ApiToken,
+		})
+	}
+	return targets
+}
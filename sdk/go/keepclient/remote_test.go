@@ -0,0 +1,149 @@
+package keepclient
+
+import (
+	"crypto/md5"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const (
+	remoteTestSignature = "89118b78732c33104a4d6231e8b5a5fa1e4301e3"
+	remoteTestExpiry    = "7fffffff"
+)
+
+func (s *StandaloneSuite) TestGetWithRemoteHint(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	locator := hash + "+3+Rabcde-" + remoteTestSignature + "@" + remoteTestExpiry
+
+	// This one shouldn't be used:
+	ksLocal := RunFakeKeepServer(StubGetHandler{
+		c,
+		"error if used",
+		"abc123",
+		http.StatusOK,
+		[]byte("foo")})
+	defer ksLocal.listener.Close()
+	// The remote cluster's proxy should get an ordinary
+	// permission hint, and the remote token.
+	ksRemote := RunFakeKeepServer(StubGetHandler{
+		c,
+		hash + "+3+A" + remoteTestSignature + "@" + remoteTestExpiry,
+		"remotetoken",
+		http.StatusOK,
+		[]byte("foo")})
+	defer ksRemote.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ksLocal.url}, nil, nil)
+	kc.RemoteClusters = map[string]RemoteCluster{
+		"abcde": {ProxyURI: ksRemote.url, Token: "remotetoken"},
+		"fghij": {ProxyURI: "http://fghij.invalid", Token: "othertoken"},
+	}
+
+	r, n, uri, err := kc.Get(locator)
+	c.Assert(err, Equals, nil)
+	defer r.Close()
+	c.Check(n, Equals, int64(3))
+	c.Check(uri, Equals, ksRemote.url+"/"+hash+"+3+A"+remoteTestSignature+"@"+remoteTestExpiry)
+	content, err := ioutil.ReadAll(r)
+	c.Check(err, Equals, nil)
+	c.Check(content, DeepEquals, []byte("foo"))
+
+	n, uri, err = kc.Ask(locator)
+	c.Check(err, Equals, nil)
+	c.Check(n, Equals, int64(3))
+	c.Check(uri, Equals, ksRemote.url+"/"+hash+"+3+A"+remoteTestSignature+"@"+remoteTestExpiry)
+}
+
+func (s *StandaloneSuite) TestGetWithRemoteHintFailoverToLocals(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	locator := hash + "+3+Rabcde-" + remoteTestSignature + "@" + remoteTestExpiry
+
+	ksLocal := RunFakeKeepServer(StubGetHandler{
+		c,
+		locator,
+		"abc123",
+		http.StatusOK,
+		[]byte("foo")})
+	defer ksLocal.listener.Close()
+	ksRemote := RunFakeKeepServer(StubGetHandler{
+		c,
+		hash + "+3+A" + remoteTestSignature + "@" + remoteTestExpiry,
+		"abc123",
+		http.StatusNotFound,
+		nil})
+	defer ksRemote.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ksLocal.url}, nil, nil)
+	// With no Token, the client's own token is sent to the
+	// remote cluster.
+	kc.RemoteClusters = map[string]RemoteCluster{"abcde": {ProxyURI: ksRemote.url}}
+
+	r, _, uri, err := kc.Get(locator)
+	c.Assert(err, Equals, nil)
+	defer r.Close()
+	c.Check(uri, Equals, ksLocal.url+"/"+locator)
+	content, err := ioutil.ReadAll(r)
+	c.Check(err, Equals, nil)
+	c.Check(content, DeepEquals, []byte("foo"))
+}
+
+func (s *StandaloneSuite) TestGetWithUnknownRemoteHint(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	locator := hash + "+3+Rabcde-" + remoteTestSignature + "@" + remoteTestExpiry
+
+	ksLocal := RunFakeKeepServer(StubGetHandler{
+		c,
+		locator,
+		"abc123",
+		http.StatusOK,
+		[]byte("foo")})
+	defer ksLocal.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ksLocal.url}, nil, nil)
+
+	r, _, uri, err := kc.Get(locator)
+	c.Assert(err, Equals, nil)
+	defer r.Close()
+	c.Check(uri, Equals, ksLocal.url+"/"+locator)
+}
+
+func (s *StandaloneSuite) TestLoadRemoteClusters(c *C) {
+	f, err := ioutil.TempFile("", "keepclient-remote")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+
+	for _, trial := range []struct {
+		json   string
+		expect map[string]RemoteCluster
+		ok     bool
+	}{
+		{`{"abcde": {"ProxyURI": "https://keep.abcde.example/", "Token": "xyzzy"}}`,
+			map[string]RemoteCluster{"abcde": {ProxyURI: "https://keep.abcde.example", Token: "xyzzy"}}, true},
+		{`{"abcde": {"ProxyURI": "keep.abcde.example"}}`, nil, false},
+		{`{"abcde": `, nil, false},
+	} {
+		c.Assert(ioutil.WriteFile(f.Name(), []byte(trial.json), 0600), IsNil)
+		clusters, err := LoadRemoteClusters(f.Name())
+		if trial.ok {
+			c.Check(err, IsNil)
+			c.Check(clusters, DeepEquals, trial.expect)
+		} else {
+			c.Check(err, NotNil)
+		}
+	}
+	_, err = LoadRemoteClusters("/nonexistent")
+	c.Check(err, NotNil)
+}
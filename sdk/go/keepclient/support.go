@@ -1,10 +1,13 @@
 package keepclient
 
 import (
+	"context"
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
 	"git.curoverse.com/arvados.git/sdk/go/streamer"
+	"git.curoverse.com/arvados.git/sdk/go/trace"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -33,6 +36,29 @@ func Md5String(s string) string {
 	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
 }
 
+// propagateContext passes along the request ID and trace context (if
+// any) carried by req's context, so the Keep service's logs and
+// traces can be matched up with ours.
+func propagateContext(req *http.Request) {
+	if id := arvados.RequestIDFromContext(req.Context()); id != "" {
+		req.Header.Set(arvados.HeaderRequestID, id)
+	}
+	trace.Inject(req.Context(), req.Header)
+}
+
+// tracedReader ends a download span when the reader is closed.
+type tracedReader struct {
+	HashCheckingReader
+	span *trace.Span
+}
+
+func (tr tracedReader) Close() error {
+	err := tr.HashCheckingReader.Close()
+	tr.span.SetError(err)
+	tr.span.End()
+	return err
+}
+
 // Set timeouts applicable when connecting to non-disk services
 // (assumed to be over the Internet).
 func (this *KeepClient) setClientSettingsNonDisk() {
@@ -91,20 +117,27 @@ type uploadStatus struct {
 	statusCode      int
 	replicas_stored int
 	response        string
+	retryAfter      string
 }
 
-func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.ReadCloser,
+func (this *KeepClient) uploadToKeepServer(ctx context.Context, host string, hash string, body io.ReadCloser,
 	upload_status chan<- uploadStatus, expectedLength int64, requestID int32) {
 
 	var req *http.Request
 	var err error
 	var url = fmt.Sprintf("%s/%s", host, hash)
+	ctx, span := trace.StartChild(ctx, "keepclient.PUT")
+	span.SetAttribute("url", url)
+	span.SetAttribute("bytes", expectedLength)
+	defer span.End()
 	if req, err = http.NewRequest("PUT", url, nil); err != nil {
 		DebugPrintf("DEBUG: [%08x] Error creating request PUT %v error: %v", requestID, url, err.Error())
-		upload_status <- uploadStatus{err, url, 0, 0, ""}
+		span.SetError(err)
+		upload_status <- uploadStatus{err, url, 0, 0, "", ""}
 		body.Close()
 		return
 	}
+	req = req.WithContext(ctx)
 
 	req.ContentLength = expectedLength
 	if expectedLength > 0 {
@@ -122,14 +155,18 @@ func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.Rea
 	req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", this.Arvados.ApiToken))
 	req.Header.Add("Content-Type", "application/octet-stream")
 	req.Header.Add(X_Keep_Desired_Replicas, fmt.Sprint(this.Want_replicas))
+	propagateContext(req)
 
 	var resp *http.Response
 	if resp, err = this.Client.Do(req); err != nil {
 		DebugPrintf("DEBUG: [%08x] Upload failed %v error: %v", requestID, url, err.Error())
-		upload_status <- uploadStatus{err, url, 0, 0, ""}
+		span.SetError(err)
+		upload_status <- uploadStatus{err, url, 0, 0, "", ""}
 		return
 	}
+	span.SetAttribute("http.status", resp.StatusCode)
 
+	retryAfter := resp.Header.Get("Retry-After")
 	rep := 1
 	if xr := resp.Header.Get(X_Keep_Replicas_Stored); xr != "" {
 		fmt.Sscanf(xr, "%d", &rep)
@@ -137,22 +174,26 @@ func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.Rea
 
 	defer resp.Body.Close()
 	defer io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		span.SetError(errors.New(resp.Status))
+	}
 
 	respbody, err2 := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
 	response := strings.TrimSpace(string(respbody))
 	if err2 != nil && err2 != io.EOF {
 		DebugPrintf("DEBUG: [%08x] Upload %v error: %v response: %v", requestID, url, err2.Error(), response)
-		upload_status <- uploadStatus{err2, url, resp.StatusCode, rep, response}
+		upload_status <- uploadStatus{err2, url, resp.StatusCode, rep, response, retryAfter}
 	} else if resp.StatusCode == http.StatusOK {
 		DebugPrintf("DEBUG: [%08x] Upload %v success", requestID, url)
-		upload_status <- uploadStatus{nil, url, resp.StatusCode, rep, response}
+		upload_status <- uploadStatus{nil, url, resp.StatusCode, rep, response, retryAfter}
 	} else {
 		DebugPrintf("DEBUG: [%08x] Upload %v error: %v response: %v", requestID, url, resp.StatusCode, response)
-		upload_status <- uploadStatus{errors.New(resp.Status), url, resp.StatusCode, rep, response}
+		upload_status <- uploadStatus{errors.New(resp.Status), url, resp.StatusCode, rep, response, retryAfter}
 	}
 }
 
 func (this *KeepClient) putReplicas(
+	ctx context.Context,
 	hash string,
 	tr *streamer.AsyncStream,
 	expectedLength int64) (locator string, replicas int, err error) {
@@ -193,11 +234,10 @@ func (this *KeepClient) putReplicas(
 		replicasPerThread = replicasTodo
 	}
 
-	retriesRemaining := 1 + this.Retries
 	var retryServers []string
 
-	for retriesRemaining > 0 {
-		retriesRemaining -= 1
+	policy := this.retryPolicy()
+	for retrier := policy.Start(ctx); replicasTodo > 0 && len(sv) > 0 && retrier.Next(); {
 		next_server = 0
 		retryServers = []string{}
 		for replicasTodo > 0 {
@@ -205,15 +245,11 @@ func (this *KeepClient) putReplicas(
 				// Start some upload requests
 				if next_server < len(sv) {
 					DebugPrintf("DEBUG: [%08x] Begin upload %s to %s", requestID, hash, sv[next_server])
-					go this.uploadToKeepServer(sv[next_server], hash, tr.MakeStreamReader(), upload_status, expectedLength, requestID)
+					go this.uploadToKeepServer(ctx, sv[next_server], hash, tr.MakeStreamReader(), upload_status, expectedLength, requestID)
 					next_server += 1
 					active += 1
 				} else {
-					if active == 0 && retriesRemaining == 0 {
-						return locator, replicasDone, InsufficientReplicasError
-					} else {
-						break
-					}
+					break
 				}
 			}
 			DebugPrintf("DEBUG: [%08x] Replicas remaining to write: %v active uploads: %v",
@@ -221,7 +257,16 @@ func (this *KeepClient) putReplicas(
 
 			// Now wait for something to happen.
 			if active > 0 {
-				status := <-upload_status
+				var status uploadStatus
+				select {
+				case status = <-upload_status:
+				case <-ctx.Done():
+					// The in-progress uploads use
+					// ctx too, so they will finish
+					// soon; the deferred func above
+					// waits for them.
+					return locator, replicasDone, ctx.Err()
+				}
 				active -= 1
 
 				if status.statusCode == 200 {
@@ -229,11 +274,11 @@ func (this *KeepClient) putReplicas(
 					replicasDone += status.replicas_stored
 					replicasTodo -= status.replicas_stored
 					locator = status.response
-				} else if status.statusCode == 0 || status.statusCode == 408 || status.statusCode == 429 ||
-					(status.statusCode >= 500 && status.statusCode != 503) {
+				} else if status.statusCode == 0 || (status.statusCode != 503 && policy.Retryable(status.statusCode)) {
 					// Timeout, too many requests, or other server side failure
 					// Do not retry when status code is 503, which means the keep server is full
 					retryServers = append(retryServers, status.url[0:strings.LastIndex(status.url, "/")])
+					retrier.SetRetryAfter(status.retryAfter)
 				}
 			} else {
 				break
@@ -243,5 +288,11 @@ func (this *KeepClient) putReplicas(
 		sv = retryServers
 	}
 
+	if replicasTodo > 0 {
+		if err := ctx.Err(); err != nil {
+			return locator, replicasDone, err
+		}
+		return locator, replicasDone, InsufficientReplicasError
+	}
 	return locator, replicasDone, nil
 }
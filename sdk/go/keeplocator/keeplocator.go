@@ -0,0 +1,349 @@
+// Package keeplocator parses, formats, signs, and verifies Keep block
+// locators.
+//
+// A locator is a 32-digit hexadecimal MD5 hash, optionally followed
+// by a size hint and other hints, each preceded by "+":
+//
+//	acbd18db4cc2f85cedef654fccc4a4d8+3+K@zzzzz+A89118b78732c33104a4d6231e8b5a5fa1e4301e3@7fffffff
+//
+// See https://dev.arvados.org/projects/arvados/wiki/Keep_locator_format
+package keeplocator
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidLocator - a string could not be parsed as a
+	// locator.
+	ErrInvalidLocator = errors.New("Invalid locator")
+	// ErrSignatureExpired - a signature was rejected because the
+	// expiry time has passed.
+	ErrSignatureExpired = errors.New("Signature expired")
+	// ErrSignatureInvalid - a signature was rejected because it
+	// was badly formatted or did not match the given secret key.
+	ErrSignatureInvalid = errors.New("Invalid signature")
+	// ErrSignatureMissing - the given locator does not have a
+	// signature hint.
+	ErrSignatureMissing = errors.New("Missing signature")
+)
+
+// A Locator is a parsed Keep block locator.
+type Locator struct {
+	// Hash of the block content: 32 hexadecimal digits.
+	Hash string
+
+	// Size of the block content, or -1 if the locator has no
+	// size hint.
+	Size int
+
+	// Hints other than the size hint, in the order they appear.
+	Hints []Hint
+}
+
+// A Hint is a locator hint other than the size hint: a
+// PermissionHint, RemoteHint, ServiceHint, or OtherHint.
+type Hint interface {
+	// String returns the hint as it appears in a locator,
+	// without the leading "+".
+	String() string
+}
+
+// A PermissionHint ("+A<signature>@<expiry>") is a signature,
+// issued by the local cluster, granting the bearer of a particular
+// API token permission to read the block until the expiry time.
+type PermissionHint struct {
+	// HMAC-SHA1 signature: 40 hexadecimal digits.
+	Signature string
+	Expiry    time.Time
+}
+
+func (h PermissionHint) String() string {
+	return "A" + h.Signature + "@" + hexTimestamp(h.Expiry)
+}
+
+// A RemoteHint ("+R<cluster>-<signature>@<expiry>") is a permission
+// signature issued by a remote cluster, indicating that the block
+// can be retrieved from that cluster.
+type RemoteHint struct {
+	// Five-character cluster ID, like "zzzzz".
+	Cluster   string
+	Signature string
+	Expiry    time.Time
+}
+
+func (h RemoteHint) String() string {
+	return "R" + h.Cluster + "-" + h.Signature + "@" + hexTimestamp(h.Expiry)
+}
+
+// A ServiceHint ("+K@<service>") indicates where the block can be
+// retrieved: either a five-character cluster ID, meaning the Keep
+// proxy at keep.<cluster>.arvadosapi.com, or the UUID of a Keep
+// gateway service.
+type ServiceHint string
+
+func (h ServiceHint) String() string {
+	return "K@" + string(h)
+}
+
+// An OtherHint is a syntactically valid hint that is not recognized
+// as one of the other types (including malformed +A, +R, and +K
+// hints). It is preserved verbatim.
+type OtherHint string
+
+func (h OtherHint) String() string {
+	return string(h)
+}
+
+// Parse parses a locator. It returns ErrInvalidLocator if s is not
+// a hash, optionally followed by a size hint and other hints. Each
+// hint other than the size hint must start with an upper case letter
+// and contain only letters, digits, and the characters "@_-".
+func Parse(s string) (Locator, error) {
+	if len(s) < 32 || !isHex(s[:32], true) || (len(s) > 32 && s[32] != '+') {
+		return Locator{}, ErrInvalidLocator
+	}
+	loc := Locator{Hash: s[:32], Size: -1}
+	if len(s) == 32 {
+		return loc, nil
+	}
+	for i, tok := range strings.Split(s[33:], "+") {
+		if i == 0 && isDigits(tok) {
+			size, err := strconv.Atoi(tok)
+			if err != nil {
+				return Locator{}, ErrInvalidLocator
+			}
+			loc.Size = size
+			continue
+		}
+		hint, err := parseHint(tok)
+		if err != nil {
+			return Locator{}, err
+		}
+		loc.Hints = append(loc.Hints, hint)
+	}
+	return loc, nil
+}
+
+// IsHash returns true if s is a bare block hash, i.e., 32 lower case
+// hexadecimal digits.
+func IsHash(s string) bool {
+	return len(s) == 32 && isHex(s, false)
+}
+
+func parseHint(tok string) (Hint, error) {
+	if tok == "" || tok[0] < 'A' || tok[0] > 'Z' {
+		return nil, ErrInvalidLocator
+	}
+	for i := 1; i < len(tok); i++ {
+		c := tok[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '@' || c == '_' || c == '-') {
+			return nil, ErrInvalidLocator
+		}
+	}
+	switch tok[0] {
+	case 'A':
+		if sig, expiry, ok := parseSignature(tok[1:]); ok {
+			return PermissionHint{Signature: sig, Expiry: expiry}, nil
+		}
+	case 'R':
+		if len(tok) > 7 && tok[6] == '-' && isClusterID(tok[1:6]) {
+			if sig, expiry, ok := parseSignature(tok[7:]); ok {
+				return RemoteHint{Cluster: tok[1:6], Signature: sig, Expiry: expiry}, nil
+			}
+		}
+	case 'K':
+		if len(tok) > 2 && tok[1] == '@' {
+			return ServiceHint(tok[2:]), nil
+		}
+	}
+	return OtherHint(tok), nil
+}
+
+// parseSignature parses "<40 hex digits>@<8 hex digits>". Only the
+// lower case form generated by SignLocator is accepted, so the
+// signed message can be reconstructed exactly.
+func parseSignature(s string) (sig string, expiry time.Time, ok bool) {
+	if len(s) != 49 || s[40] != '@' || !isHex(s[:40], false) || !isHex(s[41:], false) {
+		return
+	}
+	ts, err := strconv.ParseInt(s[41:], 16, 64)
+	if err != nil {
+		return
+	}
+	return s[:40], time.Unix(ts, 0), true
+}
+
+// String returns the locator in its usual text form.
+func (loc Locator) String() string {
+	s := loc.Hash
+	if loc.Size >= 0 {
+		s += "+" + strconv.Itoa(loc.Size)
+	}
+	for _, h := range loc.Hints {
+		s += "+" + h.String()
+	}
+	return s
+}
+
+// Permission returns the locator's (first) permission hint, if any.
+func (loc Locator) Permission() (PermissionHint, bool) {
+	for _, h := range loc.Hints {
+		if h, ok := h.(PermissionHint); ok {
+			return h, true
+		}
+	}
+	return PermissionHint{}, false
+}
+
+// Remotes returns the locator's remote hints, if any.
+func (loc Locator) Remotes() []RemoteHint {
+	var remotes []RemoteHint
+	for _, h := range loc.Hints {
+		if h, ok := h.(RemoteHint); ok {
+			remotes = append(remotes, h)
+		}
+	}
+	return remotes
+}
+
+// Services returns the locator's service hints, if any.
+func (loc Locator) Services() []ServiceHint {
+	var services []ServiceHint
+	for _, h := range loc.Hints {
+		if h, ok := h.(ServiceHint); ok {
+			services = append(services, h)
+		}
+	}
+	return services
+}
+
+// Sign returns a copy of loc with a permission hint for the given
+// API token and expiry time, replacing any existing permission
+// hint. The new permission hint is the last hint.
+func (loc Locator) Sign(apiToken string, expiry time.Time, blobSignatureTTL time.Duration, permissionSecret []byte) Locator {
+	signed := loc
+	signed.Hints = nil
+	for _, h := range loc.Hints {
+		if _, ok := h.(PermissionHint); !ok {
+			signed.Hints = append(signed.Hints, h)
+		}
+	}
+	expiry = time.Unix(expiry.Unix(), 0)
+	signed.Hints = append(signed.Hints, PermissionHint{
+		Signature: makePermSignature(loc.Hash, apiToken, hexTimestamp(expiry), blobSignatureTTL, permissionSecret),
+		Expiry:    expiry,
+	})
+	return signed
+}
+
+// VerifySignature returns nil if the locator's permission hint can
+// be verified using the given apiToken. Otherwise it returns
+// ErrSignatureExpired (if the signature's expiry time has passed,
+// which is something the client could have figured out
+// independently), ErrSignatureMissing (if there is no well-formed
+// permission hint at all), or ErrSignatureInvalid (if the signature
+// is incorrect).
+func (loc Locator) VerifySignature(apiToken string, blobSignatureTTL time.Duration, permissionSecret []byte) error {
+	perm, ok := loc.Permission()
+	if !ok {
+		return ErrSignatureMissing
+	}
+	if perm.Expiry.Before(time.Now()) {
+		return ErrSignatureExpired
+	}
+	expect := makePermSignature(loc.Hash, apiToken, hexTimestamp(perm.Expiry), blobSignatureTTL, permissionSecret)
+	if !hmac.Equal([]byte(perm.Signature), []byte(expect)) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+// SignLocator returns blobLocator with a permission signature
+// added. If either permissionSecret or apiToken is empty, or
+// blobLocator is not a valid locator, blobLocator is returned
+// untouched.
+//
+// This function is intended to be used by system components and admin
+// utilities: userland programs do not know the permissionSecret.
+func SignLocator(blobLocator, apiToken string, expiry time.Time, blobSignatureTTL time.Duration, permissionSecret []byte) string {
+	if len(permissionSecret) == 0 || apiToken == "" {
+		return blobLocator
+	}
+	loc, err := Parse(blobLocator)
+	if err != nil {
+		return blobLocator
+	}
+	return loc.Sign(apiToken, expiry, blobSignatureTTL, permissionSecret).String()
+}
+
+// VerifySignature returns nil if the signature on the signedLocator
+// can be verified using the given apiToken. Otherwise it returns
+// ErrSignatureInvalid if signedLocator cannot be parsed, or one of
+// the errors described at (Locator)VerifySignature.
+//
+// This function is intended to be used by system components and admin
+// utilities: userland programs do not know the permissionSecret.
+func VerifySignature(signedLocator, apiToken string, blobSignatureTTL time.Duration, permissionSecret []byte) error {
+	loc, err := Parse(signedLocator)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	return loc.VerifySignature(apiToken, blobSignatureTTL, permissionSecret)
+}
+
+// makePermSignature generates a SHA-1 HMAC digest for the given blob,
+// token, expiry, and site secret.
+func makePermSignature(blobHash, apiToken, expiryHex string, blobSignatureTTL time.Duration, permissionSecret []byte) string {
+	hmac := hmac.New(sha1.New, permissionSecret)
+	hmac.Write([]byte(blobHash))
+	hmac.Write([]byte("@"))
+	hmac.Write([]byte(apiToken))
+	hmac.Write([]byte("@"))
+	hmac.Write([]byte(expiryHex))
+	hmac.Write([]byte("@"))
+	hmac.Write([]byte(strconv.FormatInt(int64(blobSignatureTTL.Seconds()), 16)))
+	digest := hmac.Sum(nil)
+	return fmt.Sprintf("%x", digest)
+}
+
+func hexTimestamp(t time.Time) string {
+	return fmt.Sprintf("%08x", t.Unix())
+}
+
+func isHex(s string, upperOK bool) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || upperOK && c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isClusterID(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= 'a' && s[i] <= 'z' || s[i] >= '0' && s[i] <= '9') {
+			return false
+		}
+	}
+	return true
+}
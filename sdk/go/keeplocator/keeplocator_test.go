@@ -0,0 +1,263 @@
+package keeplocator
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+const (
+	knownHash    = "acbd18db4cc2f85cedef654fccc4a4d8"
+	knownLocator = knownHash + "+3"
+	knownToken   = "hocfupkn2pjhrpgp2vxv8rsku7tvtx49arbc9s4bvu7p7wxqvk"
+	knownKey     = "13u9fkuccnboeewr0ne3mvapk28epf68a3bhj9q8sb4l6e4e5mkk" +
+		"p6nhj2mmpscgu1zze5h5enydxfe3j215024u16ij4hjaiqs5u4pzsl3nczmaoxnc" +
+		"ljkm4875xqn4xv058koz3vkptmzhyheiy6wzevzjmdvxhvcqsvr5abhl15c2d4o4" +
+		"jhl0s91lojy1mtrzqqvprqcverls0xvy9vai9t1l1lvvazpuadafm71jl4mrwq2y" +
+		"gokee3eamvjy8qq1fvy238838enjmy5wzy2md7yvsitp5vztft6j4q866efym7e6" +
+		"vu5wm9fpnwjyxfldw3vbo01mgjs75rgo7qioh8z8ij7jpyp8508okhgbbex3ceei" +
+		"786u5rw2a9gx743dj3fgq2irk"
+	knownSignature     = "89118b78732c33104a4d6231e8b5a5fa1e4301e3"
+	knownTimestamp     = "7fffffff"
+	knownSigHint       = "+A" + knownSignature + "@" + knownTimestamp
+	knownSignedLocator = knownLocator + knownSigHint
+	blobSignatureTTL   = 1209600 * time.Second
+)
+
+func TestParse(t *testing.T) {
+	for _, trial := range []struct {
+		in     string
+		expect Locator
+	}{
+		{knownHash, Locator{Hash: knownHash, Size: -1}},
+		{knownLocator, Locator{Hash: knownHash, Size: 3}},
+		{"A2345678901234abcdefababdeffdfdf+0", Locator{Hash: "A2345678901234abcdefababdeffdfdf", Size: 0}},
+		{knownSignedLocator, Locator{Hash: knownHash, Size: 3, Hints: []Hint{
+			PermissionHint{Signature: knownSignature, Expiry: time.Unix(0x7fffffff, 0)},
+		}}},
+		{knownHash + knownSigHint, Locator{Hash: knownHash, Size: -1, Hints: []Hint{
+			PermissionHint{Signature: knownSignature, Expiry: time.Unix(0x7fffffff, 0)},
+		}}},
+		{knownLocator + "+K@zzzzz+Rabcde-" + knownSignature + "@" + knownTimestamp + "+Zfoo", Locator{Hash: knownHash, Size: 3, Hints: []Hint{
+			ServiceHint("zzzzz"),
+			RemoteHint{Cluster: "abcde", Signature: knownSignature, Expiry: time.Unix(0x7fffffff, 0)},
+			OtherHint("Zfoo"),
+		}}},
+		// Malformed +A, +K, and +R hints are preserved, but
+		// not interpreted.
+		{knownLocator + "+Unknown+Kzzzzz+Afoobar+A+RABCDE-" + knownSignature + "@" + knownTimestamp, Locator{Hash: knownHash, Size: 3, Hints: []Hint{
+			OtherHint("Unknown"),
+			OtherHint("Kzzzzz"),
+			OtherHint("Afoobar"),
+			OtherHint("A"),
+			OtherHint("RABCDE-" + knownSignature + "@" + knownTimestamp),
+		}}},
+		{knownLocator + "+A" + strings.ToUpper(knownSignature) + "@" + knownTimestamp, Locator{Hash: knownHash, Size: 3, Hints: []Hint{
+			OtherHint("A" + strings.ToUpper(knownSignature) + "@" + knownTimestamp),
+		}}},
+	} {
+		loc, err := Parse(trial.in)
+		if err != nil {
+			t.Errorf("%q: %v", trial.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(loc, trial.expect) {
+			t.Errorf("%q: got %#v, expected %#v", trial.in, loc, trial.expect)
+		}
+		if loc.String() != trial.in {
+			t.Errorf("%q: String() returned %q", trial.in, loc.String())
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		knownHash[:31],
+		knownHash + "0",
+		"g" + knownHash[1:],
+		knownHash + "+",
+		knownHash + "+3+",
+		knownHash + "++3",
+		knownHash + "+3 ",
+		knownHash + "+3+1",
+		knownHash + "+3+1A",
+		knownHash + "+3+a1",
+		knownHash + "+3+A/",
+		knownHash + "+-3",
+		knownHash + "+99999999999999999999999",
+	} {
+		if loc, err := Parse(in); err != ErrInvalidLocator {
+			t.Errorf("%q: got %#v, %v", in, loc, err)
+		}
+	}
+}
+
+func TestIsHash(t *testing.T) {
+	for s, expect := range map[string]bool{
+		knownHash:                          true,
+		knownLocator:                       false,
+		knownHash[:31]:                     false,
+		strings.ToUpper(knownHash):         false,
+		"g" + knownHash[1:]:                false,
+		"00000000000000000000000000000000": true,
+	} {
+		if IsHash(s) != expect {
+			t.Errorf("IsHash(%q) != %v", s, expect)
+		}
+	}
+}
+
+func TestHintAccessors(t *testing.T) {
+	loc, err := Parse(knownLocator + "+K@zzzzz+K@zzzzz-bi6l4-000000000000000+Rabcde-" + knownSignature + "@" + knownTimestamp + knownSigHint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm, ok := loc.Permission(); !ok || perm.Signature != knownSignature {
+		t.Errorf("Permission() returned %#v, %v", perm, ok)
+	}
+	if svcs := loc.Services(); !reflect.DeepEqual(svcs, []ServiceHint{"zzzzz", "zzzzz-bi6l4-000000000000000"}) {
+		t.Errorf("Services() returned %#v", svcs)
+	}
+	if remotes := loc.Remotes(); len(remotes) != 1 || remotes[0].Cluster != "abcde" {
+		t.Errorf("Remotes() returned %#v", remotes)
+	}
+	if _, ok := (Locator{Hash: knownHash, Size: 3}).Permission(); ok {
+		t.Error("Permission() returned ok for unsigned locator")
+	}
+}
+
+func TestSignLocator(t *testing.T) {
+	ts := time.Unix(0x7fffffff, 0)
+	if x := SignLocator(knownLocator, knownToken, ts, blobSignatureTTL, []byte(knownKey)); x != knownSignedLocator {
+		t.Errorf("got %q, expected %q", x, knownSignedLocator)
+	}
+	// Re-signing replaces the old signature.
+	resigned := SignLocator(knownLocator+"+K@zzzzz"+knownSigHint, "anothertoken", ts, blobSignatureTTL, []byte(knownKey))
+	if strings.Count(resigned, "+A") != 1 || !strings.HasPrefix(resigned, knownLocator+"+K@zzzzz+A") {
+		t.Errorf("got %q", resigned)
+	}
+	for _, trial := range []struct {
+		locator, token, key string
+	}{
+		{knownLocator, "", knownKey},
+		{knownLocator, knownToken, ""},
+		{"not a locator", knownToken, knownKey},
+	} {
+		if x := SignLocator(trial.locator, trial.token, ts, blobSignatureTTL, []byte(trial.key)); x != trial.locator {
+			t.Errorf("%+v: got %q", trial, x)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	yesterday := time.Now().AddDate(0, 0, -1)
+	for _, trial := range []struct {
+		locator, token, key string
+		expect              error
+	}{
+		{knownSignedLocator, knownToken, knownKey, nil},
+		{knownLocator + "+K@xyzzy" + knownSigHint + "+Zfoo", knownToken, knownKey, nil},
+		{knownHash + "+999999" + knownSigHint, knownToken, knownKey, nil},
+		{knownHash + knownSigHint, knownToken, knownKey, nil},
+		{knownLocator, knownToken, knownKey, ErrSignatureMissing},
+		{knownLocator + "+Aaaaaaaaaaaaaaaa@" + knownTimestamp, knownToken, knownKey, ErrSignatureMissing},
+		{knownLocator + "+A" + knownSignature + "@OOOOOOOl", knownToken, knownKey, ErrSignatureMissing},
+		{knownSignedLocator, knownToken, "00000000000000000000", ErrSignatureInvalid},
+		{knownSignedLocator, "00000000", knownKey, ErrSignatureInvalid},
+		{knownSignedLocator + "+", knownToken, knownKey, ErrSignatureInvalid},
+		{SignLocator(knownHash, knownToken, yesterday, blobSignatureTTL, []byte(knownKey)), knownToken, knownKey, ErrSignatureExpired},
+	} {
+		if err := VerifySignature(trial.locator, trial.token, blobSignatureTTL, []byte(trial.key)); err != trial.expect {
+			t.Errorf("%+v: got %v", trial, err)
+		}
+	}
+}
+
+// Generate is used by testing/quick to generate random, valid
+// locators.
+func (Locator) Generate(r *rand.Rand, size int) reflect.Value {
+	hex := func(n int) string {
+		const digits = "0123456789abcdef"
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = digits[r.Intn(len(digits))]
+		}
+		return string(b)
+	}
+	loc := Locator{Hash: hex(32), Size: r.Intn(1<<26) - 1}
+	for i := r.Intn(size + 1); i > 0; i-- {
+		expiry := time.Unix(int64(r.Uint32()), 0)
+		switch r.Intn(4) {
+		case 0:
+			loc.Hints = append(loc.Hints, PermissionHint{Signature: hex(40), Expiry: expiry})
+		case 1:
+			loc.Hints = append(loc.Hints, RemoteHint{Cluster: hex(5), Signature: hex(40), Expiry: expiry})
+		case 2:
+			loc.Hints = append(loc.Hints, ServiceHint(hex(r.Intn(30)+1)))
+		case 3:
+			loc.Hints = append(loc.Hints, OtherHint("Z"+hex(r.Intn(10))))
+		}
+	}
+	return reflect.ValueOf(loc)
+}
+
+func TestFuzzRoundTrip(t *testing.T) {
+	err := quick.Check(func(loc Locator) bool {
+		parsed, err := Parse(loc.String())
+		return err == nil && reflect.DeepEqual(parsed, loc)
+	}, &quick.Config{MaxCount: 2000})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFuzzSignVerify(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	err := quick.Check(func(loc Locator, token string, key []byte) bool {
+		if token == "" || len(key) == 0 {
+			return true
+		}
+		signed := SignLocator(loc.String(), token, expiry, blobSignatureTTL, key)
+		return VerifySignature(signed, token, blobSignatureTTL, key) == nil &&
+			VerifySignature(signed, token+"x", blobSignatureTTL, key) == ErrSignatureInvalid
+	}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestFuzzParse checks that Parse never panics, and that anything it
+// accepts survives a round trip through String.
+func TestFuzzParse(t *testing.T) {
+	const alphabet = "0123456789abcdefABCDEFKRZ@+-_ /"
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < 100000; i++ {
+		var b []byte
+		if r.Intn(2) == 0 {
+			// Start with something plausible.
+			b = []byte(knownSignedLocator + "+K@zzzzz")
+			for j := r.Intn(4); j >= 0; j-- {
+				b[r.Intn(len(b))] = alphabet[r.Intn(len(alphabet))]
+			}
+			b = b[:r.Intn(len(b)+1)]
+		} else {
+			b = make([]byte, r.Intn(80))
+			for j := range b {
+				b[j] = alphabet[r.Intn(len(alphabet))]
+			}
+		}
+		in := string(b)
+		loc, err := Parse(in)
+		if err != nil {
+			continue
+		}
+		again, err := Parse(loc.String())
+		if err != nil || !reflect.DeepEqual(again, loc) {
+			t.Fatalf("%q parsed as %#v, but %q parsed as %#v, %v", in, loc, loc.String(), again, err)
+		}
+	}
+}
@@ -15,8 +15,8 @@ import (
 
 var ErrInvalidToken = errors.New("Invalid token")
 
-var LocatorPattern = regexp.MustCompile(
-	"^[0-9a-fA-F]{32}\\+[0-9]+(\\+[A-Z][A-Za-z0-9@_-]+)*$")
+// LocatorPattern matches block locators that have a size hint.
+var LocatorPattern = blockdigest.LocatorPattern
 
 type Manifest struct {
 	Text string
@@ -77,31 +77,26 @@ func UnescapeName(s string) string {
 	return escapeSeq.ReplaceAllStringFunc(s, unescapeSeq)
 }
 
+var escapeChars = regexp.MustCompile(`[\\:\000-\040]`)
+
+// EscapeName returns s with backslashes, colons, spaces and control
+// characters replaced by octal escape sequences, so it can be used as
+// a stream or file name in manifest text. UnescapeName reverses the
+// transformation.
+func EscapeName(s string) string {
+	return escapeChars.ReplaceAllStringFunc(s, func(c string) string {
+		return fmt.Sprintf("\\%03o", c[0])
+	})
+}
+
+// ParseBlockLocator parses a locator that has a size hint. See
+// keeplocator.Parse for the accepted syntax.
 func ParseBlockLocator(s string) (b BlockLocator, err error) {
-	if !LocatorPattern.MatchString(s) {
-		err = fmt.Errorf("String \"%s\" does not match BlockLocator pattern "+
-			"\"%s\".",
-			s,
-			LocatorPattern.String())
-	} else {
-		tokens := strings.Split(s, "+")
-		var blockSize int64
-		var blockDigest blockdigest.BlockDigest
-		// We expect both of the following to succeed since LocatorPattern
-		// restricts the strings appropriately.
-		blockDigest, err = blockdigest.FromString(tokens[0])
-		if err != nil {
-			return
-		}
-		blockSize, err = strconv.ParseInt(tokens[1], 10, 0)
-		if err != nil {
-			return
-		}
-		b.Digest = blockDigest
-		b.Size = int(blockSize)
-		b.Hints = tokens[2:]
+	bl, err := blockdigest.ParseBlockLocator(s)
+	if err != nil {
+		return
 	}
-	return
+	return BlockLocator(bl), nil
 }
 
 func parseFileStreamSegment(tok string) (ft FileStreamSegment, err error) {
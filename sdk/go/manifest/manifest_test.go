@@ -176,6 +176,25 @@ func TestUnescape(t *testing.T) {
 	}
 }
 
+func TestEscape(t *testing.T) {
+	for _, testCase := range [][]string{
+		{`foo`, `foo`},
+		{`foo bar`, `foo\040bar`},
+		{`./a\b:c`, `./a\134b\072c`},
+		{"tab\tnl\n", `tab\011nl\012`},
+	} {
+		in := testCase[0]
+		expect := testCase[1]
+		got := EscapeName(in)
+		if expect != got {
+			t.Errorf("For '%s' got '%s' instead of '%s'", in, got, expect)
+		}
+		if back := UnescapeName(got); back != in {
+			t.Errorf("For '%s' round trip got '%s'", in, back)
+		}
+	}
+}
+
 type fsegtest struct {
 	mt   string        // manifest text
 	f    string        // filename
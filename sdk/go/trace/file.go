@@ -0,0 +1,65 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// EnvTraceFile is the environment variable that ConfigureFromEnv
+// checks for the name of a file to write spans to.
+const EnvTraceFile = "ARVADOS_TRACE_FILE"
+
+// A FileExporter appends each span to a file as a line of JSON, for
+// offline analysis.
+type FileExporter struct {
+	mtx sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewFileExporter opens (or creates) the given file for appending.
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("trace: %v", err)
+	}
+	return &FileExporter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Export implements Exporter.
+func (fe *FileExporter) Export(span SpanData) {
+	fe.mtx.Lock()
+	defer fe.mtx.Unlock()
+	if fe.enc == nil {
+		return
+	}
+	if err := fe.enc.Encode(span); err != nil {
+		log.Printf("trace: error writing span: %v", err)
+	}
+}
+
+// Close closes the file. Spans exported after Close are discarded.
+func (fe *FileExporter) Close() error {
+	fe.mtx.Lock()
+	defer fe.mtx.Unlock()
+	fe.enc = nil
+	return fe.f.Close()
+}
+
+// ConfigureFromEnv installs a FileExporter if the ARVADOS_TRACE_FILE
+// environment variable is set, and does nothing otherwise.
+func ConfigureFromEnv() error {
+	path := os.Getenv(EnvTraceFile)
+	if path == "" {
+		return nil
+	}
+	fe, err := NewFileExporter(path)
+	if err != nil {
+		return err
+	}
+	SetExporter(fe)
+	return nil
+}
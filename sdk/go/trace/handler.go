@@ -0,0 +1,60 @@
+package trace
+
+import (
+	"net/http"
+)
+
+// Handler wraps h, recording a span with the given name for each
+// request. If the request has a traceparent header, the span is part
+// of the client's trace. The span is carried by the request context
+// that h sees, so h can add child spans.
+func Handler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if getExporter() == nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+		ctx, span := Start(Extract(req.Context(), req.Header), name)
+		defer span.End()
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.path", req.URL.Path)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, req.WithContext(ctx))
+		span.SetAttribute("http.status", sw.status)
+	})
+}
+
+// statusWriter records the response status.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status, sw.wroteHeader = status, true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(data)
+}
+
+// CloseNotify implements http.CloseNotifier, if the wrapped
+// ResponseWriter does.
+func (sw *statusWriter) CloseNotify() <-chan bool {
+	if cn, ok := sw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+// Flush implements http.Flusher, if the wrapped ResponseWriter does.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
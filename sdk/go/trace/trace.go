@@ -0,0 +1,217 @@
+// Package trace records spans -- named, timed operations which can
+// be nested, and can be followed from one Arvados process to another
+// -- and passes them to an Exporter.
+//
+// Nothing is recorded until an Exporter is installed with
+// SetExporter (or ConfigureFromEnv). Library code (arvadosclient,
+// keepclient) uses StartChild, so it only records spans for
+// operations that are already part of a trace; servers and programs
+// like keepstore and crunch-run use Start to begin new traces.
+//
+// Trace context is passed over HTTP in a W3C-style "traceparent"
+// header (see Inject and Extract).
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// HeaderTraceParent is the HTTP header used to pass trace context
+// from one process to another.
+const HeaderTraceParent = "Traceparent"
+
+// SpanData is a record of a finished span, as passed to an Exporter.
+type SpanData struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Name       string                 `json:"name"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Duration   float64                `json:"duration"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// An Exporter receives each span when it ends. Export must be safe to
+// call from multiple goroutines, and should not block for long.
+type Exporter interface {
+	Export(SpanData)
+}
+
+var (
+	exporter    Exporter
+	exporterMtx sync.RWMutex
+)
+
+// SetExporter installs e as the destination for finished spans. If e
+// is nil, spans are no longer recorded.
+func SetExporter(e Exporter) {
+	exporterMtx.Lock()
+	defer exporterMtx.Unlock()
+	exporter = e
+}
+
+func getExporter() Exporter {
+	exporterMtx.RLock()
+	defer exporterMtx.RUnlock()
+	return exporter
+}
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+type contextKeySpan struct{}
+
+// FromContext returns the SpanContext of the span carried by ctx,
+// which may be a span in this process (see Start) or in the process
+// that sent us a request (see Extract).
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(contextKeySpan{}).(SpanContext)
+	return sc, ok
+}
+
+// A Span is an operation in progress. Its methods are safe to call on
+// a nil Span, which is what Start and StartChild return when tracing
+// is disabled.
+type Span struct {
+	mtx      sync.Mutex
+	data     SpanData
+	ended    bool
+	exporter Exporter
+}
+
+// Start begins a span with the given name. If ctx carries a span, the
+// new span is its child; otherwise, the new span begins a new trace.
+// The returned context carries the new span.
+//
+// If no Exporter is installed, Start returns ctx and a nil Span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	e := getExporter()
+	if e == nil {
+		return ctx, nil
+	}
+	parent, _ := FromContext(ctx)
+	return start(ctx, e, parent, name)
+}
+
+// StartChild is like Start, but if ctx does not carry a span, it
+// returns ctx and a nil Span instead of beginning a new trace.
+func StartChild(ctx context.Context, name string) (context.Context, *Span) {
+	e := getExporter()
+	if e == nil {
+		return ctx, nil
+	}
+	parent, ok := FromContext(ctx)
+	if !ok {
+		return ctx, nil
+	}
+	return start(ctx, e, parent, name)
+}
+
+func start(ctx context.Context, e Exporter, parent SpanContext, name string) (context.Context, *Span) {
+	traceID := parent.TraceID
+	if traceID == "" {
+		traceID = randomID(16)
+	}
+	span := &Span{
+		exporter: e,
+		data: SpanData{
+			TraceID:  traceID,
+			SpanID:   randomID(8),
+			ParentID: parent.SpanID,
+			Name:     name,
+			Start:    time.Now(),
+		},
+	}
+	return context.WithValue(ctx, contextKeySpan{}, span.Context()), span
+}
+
+func randomID(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Context returns the SpanContext that identifies s.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID}
+}
+
+// SetAttribute records a key/value pair describing the operation.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+// SetError records that the operation failed. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End records the end of the span and passes it to the Exporter.
+// Calls after the first have no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	if s.ended {
+		s.mtx.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	s.data.Duration = s.data.End.Sub(s.data.Start).Seconds()
+	data := s.data
+	s.mtx.Unlock()
+	s.exporter.Export(data)
+}
+
+var traceParentRegexp = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// Inject adds a traceparent header identifying the span carried by
+// ctx (if any) to h.
+func Inject(ctx context.Context, h http.Header) {
+	if sc, ok := FromContext(ctx); ok {
+		h.Set(HeaderTraceParent, fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID))
+	}
+}
+
+// Extract returns a copy of ctx carrying the remote span identified
+// by the traceparent header in h. If there is no valid traceparent
+// header, ctx is returned unchanged.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	m := traceParentRegexp.FindStringSubmatch(h.Get(HeaderTraceParent))
+	if m == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeySpan{}, SpanContext{TraceID: m[1], SpanID: m[2]})
+}
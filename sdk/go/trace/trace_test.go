@@ -0,0 +1,157 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Gocheck boilerplate
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&TraceSuite{})
+
+type TraceSuite struct{}
+
+func (s *TraceSuite) TearDownTest(c *C) {
+	SetExporter(nil)
+}
+
+// memExporter keeps spans in memory.
+type memExporter struct {
+	mtx   sync.Mutex
+	spans []SpanData
+}
+
+func (me *memExporter) Export(span SpanData) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	me.spans = append(me.spans, span)
+}
+
+func (s *TraceSuite) TestDisabled(c *C) {
+	ctx, span := Start(context.Background(), "foo")
+	c.Check(span, IsNil)
+	c.Check(ctx, Equals, context.Background())
+	span.SetAttribute("x", 1)
+	span.SetError(errors.New("x"))
+	span.End()
+	_, ok := FromContext(ctx)
+	c.Check(ok, Equals, false)
+}
+
+func (s *TraceSuite) TestNesting(c *C) {
+	me := &memExporter{}
+	SetExporter(me)
+
+	ctx, child := StartChild(context.Background(), "orphan")
+	c.Check(child, IsNil)
+
+	ctx, root := Start(ctx, "root")
+	root.SetAttribute("container_uuid", "zzzzz-dz642-000000000000000")
+	_, child = StartChild(ctx, "child")
+	child.SetError(errors.New("oops"))
+	child.End()
+	child.End()
+	root.End()
+
+	c.Assert(me.spans, HasLen, 2)
+	c.Check(me.spans[0].Name, Equals, "child")
+	c.Check(me.spans[0].TraceID, Equals, me.spans[1].TraceID)
+	c.Check(me.spans[0].ParentID, Equals, me.spans[1].SpanID)
+	c.Check(me.spans[0].Error, Equals, "oops")
+	c.Check(me.spans[1].Name, Equals, "root")
+	c.Check(me.spans[1].ParentID, Equals, "")
+	c.Check(me.spans[1].TraceID, HasLen, 32)
+	c.Check(me.spans[1].SpanID, HasLen, 16)
+	c.Check(me.spans[1].Attributes["container_uuid"], Equals, "zzzzz-dz642-000000000000000")
+	c.Check(me.spans[1].End.Before(me.spans[1].Start), Equals, false)
+}
+
+func (s *TraceSuite) TestPropagation(c *C) {
+	me := &memExporter{}
+	SetExporter(me)
+	ctx, client := Start(context.Background(), "client")
+
+	srv := httptest.NewServer(Handler("server", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, span := StartChild(req.Context(), "work")
+		span.End()
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/foo", nil)
+	c.Assert(err, IsNil)
+	Inject(ctx, req.Header)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	client.End()
+	srv.Close()
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+	c.Assert(me.spans, HasLen, 3)
+	spans := make(map[string]SpanData)
+	for _, span := range me.spans {
+		spans[span.Name] = span
+	}
+	work, server := spans["work"], spans["server"]
+	c.Check(server.Name, Equals, "server")
+	c.Check(server.TraceID, Equals, client.Context().TraceID)
+	c.Check(server.ParentID, Equals, client.Context().SpanID)
+	c.Check(server.Attributes["http.path"], Equals, "/foo")
+	c.Check(server.Attributes["http.status"], Equals, http.StatusTeapot)
+	c.Check(work.ParentID, Equals, server.SpanID)
+}
+
+func (s *TraceSuite) TestExtractInvalid(c *C) {
+	for _, hdr := range []string{"", "00-abc-def-01", "01-0123456789abcdef0123456789abcdef-0123456789abcdef-01"} {
+		h := http.Header{}
+		h.Set(HeaderTraceParent, hdr)
+		_, ok := FromContext(Extract(context.Background(), h))
+		c.Check(ok, Equals, false, Commentf("%q", hdr))
+	}
+}
+
+func (s *TraceSuite) TestFileExporter(c *C) {
+	dir, err := ioutil.TempDir("", "trace")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.json")
+
+	os.Setenv(EnvTraceFile, path)
+	defer os.Unsetenv(EnvTraceFile)
+	c.Assert(ConfigureFromEnv(), IsNil)
+	ctx, root := Start(context.Background(), "root")
+	_, child := StartChild(ctx, "child")
+	child.End()
+	root.End()
+	c.Check(getExporter().(*FileExporter).Close(), IsNil)
+
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	var spans []SpanData
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var span SpanData
+		c.Check(json.Unmarshal(scanner.Bytes(), &span), IsNil)
+		spans = append(spans, span)
+	}
+	c.Assert(spans, HasLen, 2)
+	c.Check(spans[0].Name, Equals, "child")
+	c.Check(spans[0].ParentID, Equals, spans[1].SpanID)
+}
@@ -46,7 +46,15 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 			passwordToLog = apiToken[0:10]
 		}
 
-		httpserver.Log(r.RemoteAddr, passwordToLog, w.WroteStatus(), statusText, repoName, r.Method, r.URL.Path)
+		// The request itself is logged by
+		// httpserver.LogRequests, which doesn't log
+		// passwords.
+		if passwordToLog != "" {
+			httpserver.LogDetail(r.Context(), "token_prefix", passwordToLog)
+		}
+		if repoName != "" {
+			httpserver.LogDetail(r.Context(), "repo", repoName)
+		}
 	}()
 
 	creds := auth.NewCredentialsFromHTTPRequest(r)
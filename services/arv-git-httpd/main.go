@@ -4,12 +4,16 @@ import (
 	"flag"
 	"log"
 	"os"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
 )
 
 type config struct {
 	Addr       string
 	GitCommand string
 	Root       string
+	TLS        httpserver.TLSConfig
 }
 
 var theConfig *config
@@ -26,6 +30,7 @@ func init() {
 	}
 	flag.StringVar(&theConfig.Root, "repo-root", cwd,
 		"Path to git repositories.")
+	theConfig.TLS.AddFlags(flag.CommandLine, "tls-")
 
 	// MakeArvadosClient returns an error if token is unset (even
 	// though we don't need to do anything requiring
@@ -44,6 +49,7 @@ func main() {
 	}
 	log.Println("Listening at", srv.Addr)
 	log.Println("Repository root", theConfig.Root)
+	srv.DrainOnSignal(0, time.Minute)
 	if err := srv.Wait(); err != nil {
 		log.Fatal(err)
 	}
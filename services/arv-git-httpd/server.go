@@ -13,7 +13,8 @@ type server struct {
 func (srv *server) Start() error {
 	mux := http.NewServeMux()
 	mux.Handle("/", &authHandler{newGitHandler()})
-	srv.Handler = mux
+	srv.Handler = httpserver.LogRequests(mux)
 	srv.Addr = theConfig.Addr
+	srv.TLS = &theConfig.TLS
 	return srv.Server.Start()
 }
@@ -36,6 +36,11 @@ func doMain() error {
 		10,
 		"Interval in seconds to poll for queued containers")
 
+	useEventBus := flags.Bool(
+		"use-event-bus",
+		false,
+		"Subscribe to container events on the websocket event bus, in addition to polling")
+
 	crunchRunCommand = flags.String(
 		"crunch-run-command",
 		"/usr/bin/crunch-run",
@@ -57,6 +62,7 @@ func doMain() error {
 		Arv:            arv,
 		RunContainer:   run,
 		PollInterval:   time.Duration(*pollInterval) * time.Second,
+		UseEventBus:    *useEventBus,
 		DoneProcessing: make(chan struct{})}
 
 	err = dispatcher.RunDispatcher()
@@ -29,6 +29,10 @@ type Config struct {
 	//
 	// Example: []string{"crunch-run", "--cgroup-parent-subsystem=memory"}
 	CrunchRunCommand []string
+
+	// Subscribe to container events on the websocket event bus,
+	// in addition to polling every PollPeriod.
+	UseEventBus bool
 }
 
 func main() {
@@ -85,6 +89,7 @@ func doMain() error {
 		Arv:            arv,
 		RunContainer:   run,
 		PollInterval:   time.Duration(config.PollPeriod),
+		UseEventBus:    config.UseEventBus,
 		DoneProcessing: make(chan struct{})}
 
 	err = dispatcher.RunDispatcher()
@@ -10,6 +10,7 @@ var exampleConfigFile = []byte(`
     {
 	"CrunchRunCommand": ["crunch-run"],
 	"PollPeriod": "10s",
+	"UseEventBus": false,
 	"SbatchArguments": ["--partition=foo", "--exclude=node13"]
     }`)
 
@@ -10,6 +10,7 @@ import (
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/keepclient"
 	"git.curoverse.com/arvados.git/sdk/go/manifest"
+	"git.curoverse.com/arvados.git/sdk/go/trace"
 	"github.com/curoverse/dockerclient"
 	"io"
 	"io/ioutil"
@@ -94,6 +95,9 @@ type ContainerRunner struct {
 	ArvMountExit   chan error
 	finalState     string
 
+	// Trace context of the phase in progress (see phase)
+	trace *traceContext
+
 	statLogger   io.WriteCloser
 	statReporter *crunchstat.Reporter
 	statInterval time.Duration
@@ -737,6 +741,14 @@ func (runner *ContainerRunner) NewArvLogWriter(name string) io.WriteCloser {
 
 // Run the full container lifecycle.
 func (runner *ContainerRunner) Run() (err error) {
+	ctx, span := trace.Start(runner.trace.get(), "crunch-run")
+	span.SetAttribute("container_uuid", runner.Container.UUID)
+	runner.trace.set(ctx)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	runner.CrunchLog.Printf("Executing container '%s'", runner.Container.UUID)
 
 	hostname, hosterr := os.Hostname()
@@ -782,8 +794,8 @@ func (runner *ContainerRunner) Run() (err error) {
 			// capture partial output and write logs
 		}
 
-		checkErr(runner.CaptureOutput())
-		checkErr(runner.CommitLogs())
+		checkErr(runner.phase("CaptureOutput", runner.CaptureOutput))
+		checkErr(runner.phase("CommitLogs", runner.CommitLogs))
 		checkErr(runner.UpdateContainerFinal())
 
 		// The real log is already closed, but then we opened
@@ -802,14 +814,14 @@ func (runner *ContainerRunner) Run() (err error) {
 	runner.SetupSignals()
 
 	// check for and/or load image
-	err = runner.LoadImage()
+	err = runner.phase("LoadImage", runner.LoadImage)
 	if err != nil {
 		err = fmt.Errorf("While loading container image: %v", err)
 		return
 	}
 
 	// set up FUSE mount and binds
-	err = runner.SetupMounts()
+	err = runner.phase("SetupMounts", runner.SetupMounts)
 	if err != nil {
 		err = fmt.Errorf("While setting up mounts: %v", err)
 		return
@@ -837,7 +849,7 @@ func (runner *ContainerRunner) Run() (err error) {
 		return
 	}
 
-	err = runner.WaitFinish()
+	err = runner.phase("WaitFinish", runner.WaitFinish)
 	if err == nil {
 		runner.finalState = "Complete"
 	}
@@ -850,7 +862,7 @@ func NewContainerRunner(api IArvadosClient,
 	docker ThinDockerClient,
 	containerUUID string) *ContainerRunner {
 
-	cr := &ContainerRunner{ArvClient: api, Kc: kc, Docker: docker}
+	cr := &ContainerRunner{ArvClient: api, Kc: kc, Docker: docker, trace: &traceContext{}}
 	cr.NewLogWriter = cr.NewArvLogWriter
 	cr.RunArvMount = cr.ArvMountCmd
 	cr.MkTempDir = ioutil.TempDir
@@ -889,7 +901,12 @@ func main() {
 		log.Fatalf("%s: %v", containerId, err)
 	}
 
-	cr := NewContainerRunner(api, kc, docker, containerId)
+	if err := trace.ConfigureFromEnv(); err != nil {
+		log.Fatalf("%s: %v", containerId, err)
+	}
+	tc := &traceContext{}
+	cr := NewContainerRunner(tracedArvadosClient{api, tc}, tracedKeepClient{kc, tc}, docker, containerId)
+	cr.trace = tc
 	cr.statInterval = *statInterval
 	cr.cgroupRoot = *cgroupRoot
 	cr.expectCgroupParent = *cgroupParent
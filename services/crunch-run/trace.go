@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+	"git.curoverse.com/arvados.git/sdk/go/trace"
+)
+
+// traceContext holds the trace context of the phase in progress, so
+// API and Keep calls made during a phase are recorded as part of it.
+type traceContext struct {
+	mtx sync.Mutex
+	ctx context.Context
+}
+
+func (tc *traceContext) get() context.Context {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	if tc.ctx == nil {
+		return context.Background()
+	}
+	return tc.ctx
+}
+
+func (tc *traceContext) set(ctx context.Context) {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	tc.ctx = ctx
+}
+
+// phase runs f, recording it as a span named "crunch-run."+name.
+func (runner *ContainerRunner) phase(name string, f func() error) error {
+	parent := runner.trace.get()
+	ctx, span := trace.StartChild(parent, "crunch-run."+name)
+	runner.trace.set(ctx)
+	err := f()
+	runner.trace.set(parent)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+// tracedArvadosClient makes API calls in the current phase's trace
+// context.
+type tracedArvadosClient struct {
+	arvadosclient.ArvadosClient
+	trace *traceContext
+}
+
+func (c tracedArvadosClient) Create(resourceType string, parameters arvadosclient.Dict, output interface{}) error {
+	return c.ArvadosClient.CreateContext(c.trace.get(), resourceType, parameters, output)
+}
+
+func (c tracedArvadosClient) Get(resourceType string, uuid string, parameters arvadosclient.Dict, output interface{}) error {
+	return c.ArvadosClient.GetContext(c.trace.get(), resourceType, uuid, parameters, output)
+}
+
+func (c tracedArvadosClient) Update(resourceType string, uuid string, parameters arvadosclient.Dict, output interface{}) error {
+	return c.ArvadosClient.UpdateContext(c.trace.get(), resourceType, uuid, parameters, output)
+}
+
+func (c tracedArvadosClient) Call(method, resourceType, uuid, action string, parameters arvadosclient.Dict, output interface{}) error {
+	return c.ArvadosClient.CallContext(c.trace.get(), method, resourceType, uuid, action, parameters, output)
+}
+
+// tracedKeepClient makes Keep calls in the current phase's trace
+// context.
+type tracedKeepClient struct {
+	*keepclient.KeepClient
+	trace *traceContext
+}
+
+func (kc tracedKeepClient) PutHB(hash string, buf []byte) (string, int, error) {
+	return kc.KeepClient.PutHBContext(kc.trace.get(), hash, buf)
+}
+
+func (kc tracedKeepClient) ManifestFileReader(m manifest.Manifest, filename string) (keepclient.ReadCloserWithLen, error) {
+	return kc.KeepClient.ManifestFileReaderContext(kc.trace.get(), m, filename)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+
+	"git.curoverse.com/arvados.git/sdk/go/trace"
+	"github.com/curoverse/dockerclient"
+	. "gopkg.in/check.v1"
+)
+
+// traceExporter keeps spans in memory.
+type traceExporter struct {
+	sync.Mutex
+	spans []trace.SpanData
+}
+
+func (te *traceExporter) Export(span trace.SpanData) {
+	te.Lock()
+	defer te.Unlock()
+	te.spans = append(te.spans, span)
+}
+
+func (s *TestSuite) TestTracePhases(c *C) {
+	te := &traceExporter{}
+	trace.SetExporter(te)
+	defer trace.SetExporter(nil)
+
+	FullRunHelper(c, `{
+    "command": ["echo", "hello world"],
+    "container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {}
+}`, func(t *TestDockerClient) {
+		t.logWriter.Write(dockerLog(1, "hello world\n"))
+		t.logWriter.Close()
+		t.finish <- dockerclient.WaitResult{}
+	})
+
+	te.Lock()
+	defer te.Unlock()
+	c.Assert(len(te.spans) > 0, Equals, true)
+	root := te.spans[len(te.spans)-1]
+	c.Check(root.Name, Equals, "crunch-run")
+	c.Check(root.ParentID, Equals, "")
+	c.Check(root.Attributes["container_uuid"], Equals, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	var phases []string
+	for _, span := range te.spans[:len(te.spans)-1] {
+		c.Check(span.TraceID, Equals, root.TraceID)
+		c.Check(span.ParentID, Equals, root.SpanID)
+		c.Check(span.Error, Equals, "")
+		phases = append(phases, span.Name)
+	}
+	c.Check(phases, DeepEquals, []string{
+		"crunch-run.LoadImage",
+		"crunch-run.SetupMounts",
+		"crunch-run.WaitFinish",
+		"crunch-run.CaptureOutput",
+		"crunch-run.CommitLogs",
+	})
+}
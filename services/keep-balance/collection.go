@@ -40,52 +40,30 @@ func EachCollection(c *arvados.Client, pageSize int, f func(arvados.Collection)
 		// Use the maximum page size the server allows
 		limit = 1<<31 - 1
 	}
-	params := arvados.ResourceListParams{
+	progressInterval := pageSize
+	if progressInterval <= 0 {
+		progressInterval = 1000
+	}
+	var coll arvados.Collection
+	iter := c.NewListIterator(&coll, arvados.ResourceListParams{
 		Limit:  &limit,
-		Order:  "modified_at, uuid",
 		Select: []string{"uuid", "manifest_text", "modified_at", "portable_data_hash", "replication_desired"},
-	}
-	var last arvados.Collection
+	})
 	var filterTime time.Time
 	callCount := 0
-	for {
-		progress(callCount, expectCount)
-		var page arvados.CollectionList
-		err := c.RequestAndDecode(&page, "GET", "arvados/v1/collections", nil, params)
+	for iter.Next() {
+		if callCount%progressInterval == 0 {
+			progress(callCount, expectCount)
+		}
+		callCount++
+		err = f(coll)
 		if err != nil {
 			return err
 		}
-		for _, coll := range page.Items {
-			if last.ModifiedAt != nil && *last.ModifiedAt == *coll.ModifiedAt && last.UUID >= coll.UUID {
-				continue
-			}
-			callCount++
-			err = f(coll)
-			if err != nil {
-				return err
-			}
-			last = coll
-		}
-		if last.ModifiedAt == nil || *last.ModifiedAt == filterTime {
-			if page.ItemsAvailable > len(page.Items) {
-				// TODO: use "mtime=X && UUID>Y"
-				// filters to get all collections with
-				// this timestamp, then use "mtime>X"
-				// to get the next timestamp.
-				return fmt.Errorf("BUG: Received an entire page with the same modified_at timestamp (%v), cannot make progress", filterTime)
-			}
-			break
-		}
-		filterTime = *last.ModifiedAt
-		params.Filters = []arvados.Filter{{
-			Attr:     "modified_at",
-			Operator: ">=",
-			Operand:  filterTime,
-		}, {
-			Attr:     "uuid",
-			Operator: "!=",
-			Operand:  last.UUID,
-		}}
+		filterTime = *coll.ModifiedAt
+	}
+	if err := iter.Err(); err != nil {
+		return err
 	}
 	progress(callCount, expectCount)
 
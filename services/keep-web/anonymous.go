@@ -29,6 +29,15 @@ func (ts *tokenSet) IsBoolFlag() bool {
 	return true
 }
 
+func (ts tokenSet) contains(tok string) bool {
+	for _, t := range ts {
+		if t == tok {
+			return true
+		}
+	}
+	return false
+}
+
 func init() {
 	flag.Var(&anonymousTokens, "allow-anonymous",
 		"Serve public data to anonymous clients. Try the token supplied in the ARVADOS_API_TOKEN environment variable when none of the tokens provided in an HTTP request succeed in reading the desired collection.")
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// archiveFormat describes a ?format= value accepted for directory
+// downloads.
+type archiveFormat struct {
+	ext         string
+	contentType string
+	newWriter   func(io.Writer) archiveWriter
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"zip":    {".zip", "application/zip", newZipWriter},
+	"tar":    {".tar", "application/x-tar", newTarWriter},
+	"tar.gz": {".tar.gz", "application/gzip", newTgzWriter},
+	"tgz":    {".tar.gz", "application/gzip", newTgzWriter},
+}
+
+// An archiveWriter adds directories and files to an archive.
+type archiveWriter interface {
+	addDir(name string, modTime time.Time) error
+	// addFile returns a writer for the file's content, which
+	// must be exactly size bytes. It is valid until the next
+	// call to addDir, addFile, or Close.
+	addFile(name string, size int64, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+// Name of the checksum file added if requested with ?checksums=1.
+const archiveChecksumFile = "MD5SUMS"
+
+// Name of the manifest file added if requested with ?manifest=1.
+const archiveManifestFile = "manifest.txt"
+
+var signatureHint = regexp.MustCompile(`\+A[^ +]*`)
+
+// serveArchive sends the content of the given directory in fs (""
+// for the whole collection) as a zip or tar archive, streaming data
+// from Keep as it goes. All entries are inside a top level directory
+// named after the collection or subdirectory.
+//
+// If the checksums param is set, the archive ends with an MD5SUMS
+// file (in md5sum format) listing the files that were sent. If the
+// manifest param is set, it also has a manifest.txt file with the
+// manifest for the directory, without permission signatures.
+//
+// It returns the response status, and an error if the archive was
+// not sent completely.
+func serveArchive(w http.ResponseWriter, r *http.Request, fs *collectionFS, collection map[string]interface{}, dirname string) (int, error) {
+	format, ok := archiveFormats[r.FormValue("format")]
+	if !ok {
+		return http.StatusBadRequest, fmt.Errorf("unsupported archive format %q", r.FormValue("format"))
+	}
+	wantChecksums := r.FormValue("checksums") != ""
+	wantManifest := r.FormValue("manifest") != ""
+
+	top := strings.Trim(dirname, "/")
+	if top != "" {
+		top = path.Base(top)
+	} else if name, _ := collection["name"].(string); name != "" {
+		top = name
+	} else {
+		top, _ = collection["uuid"].(string)
+		if top == "" {
+			top, _ = collection["portable_data_hash"].(string)
+		}
+	}
+	top = strings.Replace(top, "/", "_", -1)
+
+	var manifestText string
+	if wantManifest {
+		mText, err := fs.MarshalManifestDir(r.Context(), dirname)
+		if err != nil {
+			return http.StatusBadGateway, err
+		}
+		manifestText = signatureHint.ReplaceAllString(mText, "")
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": top + format.ext}))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return http.StatusOK, nil
+	}
+
+	aw := format.newWriter(w)
+	var checksums []string
+	err := walkDir(r, fs, dirname, top, func(name string, fi os.FileInfo, f *cfsFile) error {
+		if fi.IsDir() {
+			return aw.addDir(name, fi.ModTime())
+		}
+		fw, err := aw.addFile(name, fi.Size(), fi.ModTime())
+		if err != nil {
+			return err
+		}
+		if !wantChecksums {
+			_, err = io.Copy(fw, f)
+			return err
+		}
+		h := md5.New()
+		_, err = io.Copy(io.MultiWriter(fw, h), f)
+		checksums = append(checksums, fmt.Sprintf("%x  %s\n", h.Sum(nil), strings.TrimPrefix(name, top+"/")))
+		return err
+	})
+	if err == nil && wantChecksums {
+		err = addArchiveFile(aw, top+"/"+archiveChecksumFile, strings.Join(checksums, ""))
+	}
+	if err == nil && wantManifest {
+		err = addArchiveFile(aw, top+"/"+archiveManifestFile, manifestText)
+	}
+	if err == nil {
+		err = aw.Close()
+	}
+	return http.StatusOK, err
+}
+
+func addArchiveFile(aw archiveWriter, name, content string) error {
+	fw, err := aw.addFile(name, int64(len(content)), time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fw, content)
+	return err
+}
+
+// walkDir calls fn for dirname and each file and directory below
+// it, in lexical order. The name passed to fn is the path relative
+// to dirname, prefixed with top. For files, fn also gets an open file
+// that it can read from.
+func walkDir(r *http.Request, fs *collectionFS, dirname, top string, fn func(string, os.FileInfo, *cfsFile) error) error {
+	f, err := fs.OpenFile(r.Context(), dirname, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := fn(top, fi, f); err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		err := walkDir(r, fs, path.Join(dirname, fi.Name()), top+"/"+fi.Name(), fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type zipWriter struct {
+	*zip.Writer
+}
+
+func newZipWriter(w io.Writer) archiveWriter {
+	return zipWriter{zip.NewWriter(w)}
+}
+
+func (zw zipWriter) addDir(name string, modTime time.Time) error {
+	hdr := &zip.FileHeader{Name: name + "/"}
+	hdr.SetModTime(modTime)
+	hdr.SetMode(os.ModeDir | 0755)
+	_, err := zw.CreateHeader(hdr)
+	return err
+}
+
+func (zw zipWriter) addFile(name string, size int64, modTime time.Time) (io.Writer, error) {
+	// Most large files stored in Keep are already compressed,
+	// so Store (rather than Deflate) saves a lot of CPU time. The
+	// zip package uses Zip64 extensions as needed.
+	hdr := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		UncompressedSize64: uint64(size),
+	}
+	hdr.SetModTime(modTime)
+	hdr.SetMode(0644)
+	return zw.CreateHeader(hdr)
+}
+
+type tarWriter struct {
+	*tar.Writer
+}
+
+func newTarWriter(w io.Writer) archiveWriter {
+	return tarWriter{tar.NewWriter(w)}
+}
+
+func (tw tarWriter) addDir(name string, modTime time.Time) error {
+	return tw.WriteHeader(&tar.Header{
+		Name:     name + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  modTime,
+	})
+}
+
+func (tw tarWriter) addFile(name string, size int64, modTime time.Time) (io.Writer, error) {
+	// The tar package uses PAX headers as needed for long names
+	// and large files.
+	return tw, tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+	})
+}
+
+type tgzWriter struct {
+	tarWriter
+	gz *gzip.Writer
+}
+
+func newTgzWriter(w io.Writer) archiveWriter {
+	gz := gzip.NewWriter(w)
+	return tgzWriter{tarWriter{tar.NewWriter(gz)}, gz}
+}
+
+func (tw tgzWriter) Close() error {
+	if err := tw.tarWriter.Close(); err != nil {
+		return err
+	}
+	return tw.gz.Close()
+}
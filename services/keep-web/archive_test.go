@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+const archiveTestManifest = ". acbd18db4cc2f85cedef654fccc4a4d8+3+Asig@12345678 0:3:foo\n" +
+	"./dir1 37b51d194a7513e45b56f6524f2d51f2+3+Asig@12345678 0:3:bar\n" +
+	"./dir1/empty d41d8cd98f00b204e9800998ecf8427e+0 0:0:\\056\n"
+
+func (s *CollectionFSSuite) archiveTestRequest(c *check.C, query string) *httptest.ResponseRecorder {
+	fs, err := newCollectionFS(s.kc, archiveTestManifest, time.Now(), true)
+	c.Assert(err, check.IsNil)
+	coll := map[string]interface{}{"uuid": "zzzzz-4zz18-aaaaaaaaaaaaaaa", "name": "test/collection"}
+	req := httptest.NewRequest("GET", "/?"+query, nil).WithContext(context.Background())
+	resp := httptest.NewRecorder()
+	status, err := serveArchive(resp, req, fs, coll, "")
+	c.Check(err, check.IsNil)
+	c.Check(status, check.Equals, resp.Code)
+	return resp
+}
+
+func (s *CollectionFSSuite) TestArchiveZip(c *check.C) {
+	resp := s.archiveTestRequest(c, "format=zip&checksums=1&manifest=1")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "application/zip")
+	c.Check(resp.Header().Get("Content-Disposition"), check.Equals, `attachment; filename=test_collection.zip`)
+
+	zr, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+	c.Assert(err, check.IsNil)
+	content := map[string]string{}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		rdr, err := f.Open()
+		c.Assert(err, check.IsNil)
+		buf, err := ioutil.ReadAll(rdr)
+		c.Check(err, check.IsNil)
+		content[f.Name] = string(buf)
+	}
+	c.Check(names, check.DeepEquals, []string{
+		"test_collection/",
+		"test_collection/dir1/",
+		"test_collection/dir1/bar",
+		"test_collection/dir1/empty/",
+		"test_collection/foo",
+		"test_collection/MD5SUMS",
+		"test_collection/manifest.txt",
+	})
+	c.Check(content["test_collection/foo"], check.Equals, "foo")
+	c.Check(content["test_collection/dir1/bar"], check.Equals, "bar")
+	c.Check(content["test_collection/MD5SUMS"], check.Equals, ""+
+		"37b51d194a7513e45b56f6524f2d51f2  dir1/bar\n"+
+		"acbd18db4cc2f85cedef654fccc4a4d8  foo\n")
+	c.Check(content["test_collection/manifest.txt"], check.Equals, ""+
+		". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n"+
+		"./dir1 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n"+
+		"./dir1/empty d41d8cd98f00b204e9800998ecf8427e+0 0:0:\\056\n")
+}
+
+func (s *CollectionFSSuite) TestArchiveTgz(c *check.C) {
+	resp := s.archiveTestRequest(c, "format=tar.gz")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Disposition"), check.Equals, `attachment; filename=test_collection.tar.gz`)
+
+	gz, err := gzip.NewReader(resp.Body)
+	c.Assert(err, check.IsNil)
+	tr := tar.NewReader(gz)
+	content := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, check.IsNil)
+		buf, err := ioutil.ReadAll(tr)
+		c.Check(err, check.IsNil)
+		content[hdr.Name] = string(buf)
+	}
+	c.Check(content, check.DeepEquals, map[string]string{
+		"test_collection/":            "",
+		"test_collection/dir1/":       "",
+		"test_collection/dir1/bar":    "bar",
+		"test_collection/dir1/empty/": "",
+		"test_collection/foo":         "foo",
+	})
+}
+
+func (s *CollectionFSSuite) TestArchiveFilename(c *check.C) {
+	fs, err := newCollectionFS(s.kc, archiveTestManifest, time.Now(), true)
+	c.Assert(err, check.IsNil)
+	for name, expect := range map[string]string{
+		"two words": `attachment; filename="two words.tar"`,
+		`a"b\c`:     `attachment; filename="a\"b\\c.tar"`,
+		"résumé":    `attachment; filename*=utf-8''r%C3%A9sum%C3%A9.tar`,
+	} {
+		coll := map[string]interface{}{"name": name}
+		req := httptest.NewRequest("HEAD", "/?format=tar", nil)
+		resp := httptest.NewRecorder()
+		_, err := serveArchive(resp, req, fs, coll, "")
+		c.Check(err, check.IsNil)
+		c.Check(resp.Header().Get("Content-Disposition"), check.Equals, expect, check.Commentf("%q", name))
+	}
+}
+
+func (s *CollectionFSSuite) TestArchiveBadFormat(c *check.C) {
+	fs, err := newCollectionFS(s.kc, archiveTestManifest, time.Now(), true)
+	c.Assert(err, check.IsNil)
+	req := httptest.NewRequest("GET", "/?format=rar", nil)
+	resp := httptest.NewRecorder()
+	status, err := serveArchive(resp, req, fs, nil, "")
+	c.Check(status, check.Equals, http.StatusBadRequest)
+	c.Check(err, check.NotNil)
+	c.Check(resp.Body.Len(), check.Equals, 0)
+}
+
+func (s *IntegrationSuite) TestArchiveDownload(c *check.C) {
+	u := mustParseURL("http://" + arvadostest.FooBarDirCollection + ".example.com/dir1?format=tar")
+	req := &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header:     http.Header{"Authorization": {"OAuth2 " + arvadostest.ActiveToken}},
+	}
+	resp := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Disposition"), check.Equals, `attachment; filename=dir1.tar`)
+	tr := tar.NewReader(resp.Body)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, check.IsNil)
+		names = append(names, hdr.Name)
+	}
+	c.Check(names, check.DeepEquals, []string{"dir1/", "dir1/bar", "dir1/foo"})
+}
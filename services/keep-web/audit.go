@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/auditlog"
+)
+
+var (
+	auditConfig auditlog.Config
+
+	// audit records collection accesses, if enabled with the
+	// -audit-log-* flags.
+	audit *auditlog.Logger
+)
+
+func init() {
+	auditConfig.AddFlags(flag.CommandLine, "audit-log-")
+}
+
+// How long to remember which user a token belongs to.
+const userCacheTTL = 5 * time.Minute
+
+type cachedUser struct {
+	uuid    string
+	expires time.Time
+}
+
+var (
+	userCache    = make(map[string]cachedUser)
+	userCacheMtx sync.Mutex
+)
+
+// userUUIDForToken returns the UUID of the user that owns arv's
+// token, or "" if the API server doesn't say.
+func userUUIDForToken(arv *arvadosclient.ArvadosClient) string {
+	userCacheMtx.Lock()
+	cu, ok := userCache[arv.ApiToken]
+	userCacheMtx.Unlock()
+	if ok && time.Now().Before(cu.expires) {
+		return cu.uuid
+	}
+
+	var user arvados.User
+	if err := arv.Call("GET", "users", "", "current", nil, &user); err != nil {
+		return ""
+	}
+
+	userCacheMtx.Lock()
+	defer userCacheMtx.Unlock()
+	now := time.Now()
+	for tok, cu := range userCache {
+		if now.After(cu.expires) {
+			delete(userCache, tok)
+		}
+	}
+	userCache[arv.ApiToken] = cachedUser{uuid: user.UUID, expires: now.Add(userCacheTTL)}
+	return user.UUID
+}
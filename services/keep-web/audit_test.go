@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	"git.curoverse.com/arvados.git/sdk/go/auditlog"
+	check "gopkg.in/check.v1"
+)
+
+func auditTestRequest() *http.Request {
+	u := mustParseURL("http://" + arvadostest.FooCollection + ".example.com/foo")
+	return &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header: http.Header{
+			"Authorization": {"OAuth2 " + arvadostest.ActiveToken},
+			"Range":         {"bytes=0-1"},
+			"User-Agent":    {"audit-test"},
+		},
+	}
+}
+
+func (s *IntegrationSuite) TestAuditLog(c *check.C) {
+	dir, err := ioutil.TempDir("", "keep-web-audit")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	audit, err = (&auditlog.Config{File: path, BufferSize: 10}).NewLogger(nil)
+	c.Assert(err, check.IsNil)
+	defer func() { audit = nil }()
+
+	resp := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, auditTestRequest())
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	c.Check(audit.Close(), check.IsNil)
+
+	buf, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	var ev auditlog.Event
+	c.Assert(json.Unmarshal(buf, &ev), check.IsNil)
+	c.Check(ev.Service, check.Equals, "keep-web")
+	c.Check(ev.Method, check.Equals, "GET")
+	c.Check(ev.Status, check.Equals, http.StatusPartialContent)
+	c.Check(ev.UserUUID, check.Equals, "zzzzz-tpzed-xurymjxw79nv3jz")
+	c.Check(ev.CollectionUUID, check.Equals, arvadostest.FooCollection)
+	c.Check(ev.PortableDataHash, check.Equals, arvadostest.FooPdh)
+	c.Check(ev.Path, check.Equals, "foo")
+	c.Check(ev.Range, check.Equals, "bytes=0-1")
+	c.Check(ev.Bytes, check.Equals, int64(2))
+	c.Check(ev.UserAgent, check.Equals, "audit-test")
+}
+
+type failingSink struct{}
+
+func (failingSink) Write([]auditlog.Event) (int, error) {
+	return 0, errors.New("failingSink")
+}
+
+func (s *IntegrationSuite) TestAuditLogFailClosed(c *check.C) {
+	audit = auditlog.NewLogger(failingSink{}, 10, true)
+	defer func() {
+		audit.Close()
+		audit = nil
+	}()
+	audit.Log(auditlog.Event{})
+	for deadline := time.Now().Add(5 * time.Second); audit.Ready() == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	resp := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, auditTestRequest())
+	c.Check(resp.Code, check.Equals, http.StatusServiceUnavailable)
+	c.Check(resp.Body.String(), check.Equals, "")
+}
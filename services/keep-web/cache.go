@@ -0,0 +1,289 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"flag"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+)
+
+var (
+	cacheTTL                  = 5 * time.Minute
+	cacheNegativeTTL          = 10 * time.Second
+	cacheMaxCollectionEntries = 1000
+	cacheMaxPermissionEntries = 10000
+	cacheMaxPreviewEntries    = 1000
+)
+
+func init() {
+	flag.DurationVar(&cacheTTL, "cache-ttl", cacheTTL,
+		"Maximum time to cache collection records, manifests, and permission checks. Changes made to a collection (by other clients) might not be visible to readers until this much time has passed.")
+	flag.DurationVar(&cacheNegativeTTL, "cache-negative-ttl", cacheNegativeTTL,
+		"Maximum time to remember that a token was not allowed to read a collection (API server responded 401 or 404).")
+	flag.IntVar(&cacheMaxCollectionEntries, "cache-max-collections", cacheMaxCollectionEntries,
+		"Maximum number of manifests to cache.")
+	flag.IntVar(&cacheMaxPermissionEntries, "cache-max-permissions", cacheMaxPermissionEntries,
+		"Maximum number of (token, collection) lookup results to cache.")
+	flag.IntVar(&cacheMaxPreviewEntries, "cache-max-previews", cacheMaxPreviewEntries,
+		"Maximum number of generated previews (thumbnails and text heads) to cache.")
+}
+
+// Previews depend only on file content, which never changes for a
+// given portable data hash and path, so they can be kept much longer
+// than collection lookups.
+const cachePreviewTTL = 24 * time.Hour
+
+// A cache remembers the results of collection lookups, so a client
+// that loads many files from the same collection doesn't cost an API
+// call per file.
+//
+// Lookup results are cached for each (token, collection ID)
+// combination, including failures (401 and 404 responses), which
+// are only kept for cacheNegativeTTL. Manifests are cached
+// separately, keyed by token and portable data hash, so they are
+// stored once even if the same content is requested by UUID and by
+// PDH. (Manifests can't be shared across tokens because the block
+// signatures in them are only valid with the token that was used to
+// retrieve them.)
+//
+// Generated previews are cached by portable data hash, path, and
+// preview parameters. They are shared by all tokens, so callers must
+// check permission (by calling Get) before using them.
+//
+// The zero value is ready to use.
+type cache struct {
+	setupOnce   sync.Once
+	mtx         sync.Mutex
+	permissions *lruCache // token+"\000"+targetID => *cachedPermission
+	manifests   *lruCache // token+"\000"+pdh => manifest text
+	previews    *lruCache // pdh+"\000"+path+"\000"+params => *preview
+	stats       cacheStats
+}
+
+// cacheStats are reported at /status.json.
+type cacheStats struct {
+	Requests          uint64
+	PermissionHits    uint64
+	NegativeHits      uint64
+	ManifestHits      uint64
+	APICalls          uint64
+	PreviewRequests   uint64
+	PreviewHits       uint64
+	PermissionEntries int
+	ManifestEntries   int
+	PreviewEntries    int
+}
+
+// cachedPermission is the result of looking up a collection with a
+// given token: either an API error status (401 or 404) or the
+// collection record, without its manifest_text.
+type cachedPermission struct {
+	status     int
+	collection map[string]interface{}
+}
+
+func (c *cache) setup() {
+	c.permissions = newLRUCache(cacheMaxPermissionEntries)
+	c.manifests = newLRUCache(cacheMaxCollectionEntries)
+	c.previews = newLRUCache(cacheMaxPreviewEntries)
+}
+
+// Get returns the collection record for targetID (a UUID or PDH),
+// using arv's token. The caller gets its own copy of the record and
+// may modify it.
+//
+// If forceReload is true, cached results are not used (but the
+// record retrieved from the API server is cached for subsequent
+// calls).
+//
+// Errors are returned as they were returned by the API server -- in
+// the case of cached 401 and 404 responses, as an APIServerError
+// with the cached status code.
+func (c *cache) Get(ctx context.Context, arv *arvadosclient.ArvadosClient, targetID string, forceReload bool) (map[string]interface{}, error) {
+	c.setupOnce.Do(c.setup)
+	atomic.AddUint64(&c.stats.Requests, 1)
+
+	permKey := arv.ApiToken + "\000" + targetID
+	if !forceReload {
+		now := time.Now()
+		c.mtx.Lock()
+		var perm *cachedPermission
+		var mText string
+		var haveManifest bool
+		if ent, ok := c.permissions.get(permKey, now); ok {
+			perm = ent.(*cachedPermission)
+			if perm.status == 0 {
+				pdh, _ := perm.collection["portable_data_hash"].(string)
+				var ent interface{}
+				ent, haveManifest = c.manifests.get(arv.ApiToken+"\000"+pdh, now)
+				mText, _ = ent.(string)
+			}
+		}
+		c.mtx.Unlock()
+		if perm != nil && perm.status != 0 {
+			atomic.AddUint64(&c.stats.NegativeHits, 1)
+			return nil, arvadosclient.APIServerError{
+				HttpStatusCode:    perm.status,
+				HttpStatusMessage: "(cached)",
+			}
+		} else if perm != nil && haveManifest {
+			atomic.AddUint64(&c.stats.PermissionHits, 1)
+			atomic.AddUint64(&c.stats.ManifestHits, 1)
+			collection := copyCollection(perm.collection)
+			collection["manifest_text"] = mText
+			return collection, nil
+		}
+	}
+
+	atomic.AddUint64(&c.stats.APICalls, 1)
+	collection := make(map[string]interface{})
+	err := arv.GetContext(ctx, "collections", targetID, nil, &collection)
+	if err != nil {
+		if srvErr, ok := err.(arvadosclient.APIServerError); ok {
+			switch srvErr.HttpStatusCode {
+			case 401, 404:
+				c.mtx.Lock()
+				c.permissions.add(permKey, &cachedPermission{status: srvErr.HttpStatusCode}, time.Now().Add(cacheNegativeTTL))
+				c.mtx.Unlock()
+			}
+		}
+		return nil, err
+	}
+	c.update(arv.ApiToken, targetID, collection)
+	return collection, nil
+}
+
+// Update replaces the cached record for the given token and
+// collection, e.g., after the collection has been modified using
+// that token.
+func (c *cache) Update(token, targetID string, collection map[string]interface{}) {
+	c.setupOnce.Do(c.setup)
+	c.update(token, targetID, collection)
+}
+
+func (c *cache) update(token, targetID string, collection map[string]interface{}) {
+	pdh, _ := collection["portable_data_hash"].(string)
+	mText, _ := collection["manifest_text"].(string)
+	perm := &cachedPermission{collection: copyCollection(collection)}
+	delete(perm.collection, "manifest_text")
+	expire := time.Now().Add(cacheTTL)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.permissions.add(token+"\000"+targetID, perm, expire)
+	c.manifests.add(token+"\000"+pdh, mText, expire)
+}
+
+// Stats returns the current cache statistics.
+func (c *cache) Stats() cacheStats {
+	c.setupOnce.Do(c.setup)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return cacheStats{
+		Requests:          atomic.LoadUint64(&c.stats.Requests),
+		PermissionHits:    atomic.LoadUint64(&c.stats.PermissionHits),
+		NegativeHits:      atomic.LoadUint64(&c.stats.NegativeHits),
+		ManifestHits:      atomic.LoadUint64(&c.stats.ManifestHits),
+		APICalls:          atomic.LoadUint64(&c.stats.APICalls),
+		PreviewRequests:   atomic.LoadUint64(&c.stats.PreviewRequests),
+		PreviewHits:       atomic.LoadUint64(&c.stats.PreviewHits),
+		PermissionEntries: c.permissions.len(),
+		ManifestEntries:   c.manifests.len(),
+		PreviewEntries:    c.previews.len(),
+	}
+}
+
+// GetPreview returns the preview cached by AddPreview with the same
+// key, if any.
+func (c *cache) GetPreview(key string) (*preview, bool) {
+	c.setupOnce.Do(c.setup)
+	atomic.AddUint64(&c.stats.PreviewRequests, 1)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ent, ok := c.previews.get(key, time.Now())
+	if !ok {
+		return nil, false
+	}
+	atomic.AddUint64(&c.stats.PreviewHits, 1)
+	return ent.(*preview), true
+}
+
+// AddPreview caches a generated preview.
+func (c *cache) AddPreview(key string, p *preview) {
+	c.setupOnce.Do(c.setup)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.previews.add(key, p, time.Now().Add(cachePreviewTTL))
+}
+
+// copyCollection returns a shallow copy of a collection record.
+func copyCollection(collection map[string]interface{}) map[string]interface{} {
+	cp := make(map[string]interface{}, len(collection))
+	for k, v := range collection {
+		cp[k] = v
+	}
+	return cp
+}
+
+// An lruCache holds up to max entries, each with an expiry time,
+// discarding the least recently used entry when full. It is not
+// safe for concurrent use.
+type lruCache struct {
+	max   int
+	lru   *list.List // of *lruEntry, most recently used first
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key    string
+	value  interface{}
+	expire time.Time
+}
+
+func newLRUCache(max int) *lruCache {
+	return &lruCache{
+		max:   max,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the value stored for key, if it has not expired at
+// the given time.
+func (c *lruCache) get(key string, now time.Time) (interface{}, bool) {
+	elt, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	ent := elt.Value.(*lruEntry)
+	if now.After(ent.expire) {
+		c.lru.Remove(elt)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elt)
+	return ent.value, true
+}
+
+// add stores a value for key, replacing any existing value.
+func (c *lruCache) add(key string, value interface{}, expire time.Time) {
+	if elt, ok := c.items[key]; ok {
+		elt.Value = &lruEntry{key: key, value: value, expire: expire}
+		c.lru.MoveToFront(elt)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&lruEntry{key: key, value: value, expire: expire})
+	for c.lru.Len() > c.max {
+		elt := c.lru.Back()
+		c.lru.Remove(elt)
+		delete(c.items, elt.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) len() int {
+	return c.lru.Len()
+}
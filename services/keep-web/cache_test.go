@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+// stubCollectionAPI serves collection records to clients with token
+// "good", and counts the requests it receives. PUT requests update
+// the stored manifest. It also serves the record of the API token
+// used as the S3 test access key.
+type stubCollectionAPI struct {
+	records map[string]map[string]interface{}
+	calls   int64
+	mtx     sync.Mutex
+}
+
+func (stub *stubCollectionAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&stub.calls, 1)
+	w.Header().Set("Content-Type", "application/json")
+	if uuid := strings.TrimPrefix(r.URL.Path, "/arvados/v1/api_client_authorizations/"); uuid != r.URL.Path {
+		// S3 access key lookups use keep-web's own token.
+		if r.Header.Get("Authorization") != "OAuth2 "+os.Getenv("ARVADOS_API_TOKEN") || uuid != s3TestAccessKey {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":["Path not found"]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"uuid": uuid, "api_token": s3TestSecret})
+		return
+	}
+	if r.Header.Get("Authorization") != "OAuth2 good" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errors":["Not logged in"]}`))
+		return
+	}
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	rec, ok := stub.records[strings.TrimPrefix(r.URL.Path, "/arvados/v1/collections/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":["Path not found"]}`))
+		return
+	}
+	if r.Method == "PUT" {
+		var update map[string]string
+		if err := json.Unmarshal([]byte(r.FormValue("collection")), &update); err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"errors":["Bad collection param"]}`))
+			return
+		}
+		mText := update["manifest_text"]
+		rec["manifest_text"] = mText
+		rec["portable_data_hash"] = fmt.Sprintf("%x+%d", md5.Sum([]byte(mText)), len(mText))
+	}
+	json.NewEncoder(w).Encode(rec)
+}
+
+func (s *UnitSuite) setupStubCollectionAPI(c *check.C) (*stubCollectionAPI, *arvadosclient.ArvadosClient, func()) {
+	stub := &stubCollectionAPI{records: map[string]map[string]interface{}{
+		"zzzzz-4zz18-aaaaaaaaaaaaaaa": {
+			"uuid":               "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+			"portable_data_hash": "1f4b0bc7583c2a7f9102c395f4ffc5e3+45",
+			"manifest_text":      ". acbd18db4cc2f85cedef654fccc4a4d8+3+Agood@12345678 0:3:foo\n",
+		},
+		"1f4b0bc7583c2a7f9102c395f4ffc5e3+45": {
+			"portable_data_hash": "1f4b0bc7583c2a7f9102c395f4ffc5e3+45",
+			"manifest_text":      ". acbd18db4cc2f85cedef654fccc4a4d8+3+Agood@12345678 0:3:foo\n",
+		},
+	}}
+	srv := httptest.NewServer(stub)
+	arv := &arvadosclient.ArvadosClient{
+		Scheme:    "http",
+		ApiServer: strings.TrimPrefix(srv.URL, "http://"),
+		Client:    http.DefaultClient,
+	}
+	return stub, arv, srv.Close
+}
+
+func (s *UnitSuite) TestCache(c *check.C) {
+	stub, arv, done := s.setupStubCollectionAPI(c)
+	defer done()
+	ctx := context.Background()
+	var cache cache
+
+	arv.ApiToken = "good"
+	for i := 0; i < 5; i++ {
+		coll, err := cache.Get(ctx, arv, "zzzzz-4zz18-aaaaaaaaaaaaaaa", false)
+		c.Assert(err, check.IsNil)
+		c.Check(coll["manifest_text"], check.Matches, `.* 0:3:foo\n`)
+		// Changes made by the caller don't affect the cache.
+		coll["manifest_text"] = "modified"
+	}
+	c.Check(stub.calls, check.Equals, int64(1))
+
+	// Same content requested by PDH: one more API call, but the
+	// manifest is only stored once.
+	for i := 0; i < 5; i++ {
+		coll, err := cache.Get(ctx, arv, "1f4b0bc7583c2a7f9102c395f4ffc5e3+45", false)
+		c.Assert(err, check.IsNil)
+		c.Check(coll["manifest_text"], check.Matches, `.* 0:3:foo\n`)
+	}
+	c.Check(stub.calls, check.Equals, int64(2))
+
+	_, err := cache.Get(ctx, arv, "zzzzz-4zz18-aaaaaaaaaaaaaaa", true)
+	c.Check(err, check.IsNil)
+	c.Check(stub.calls, check.Equals, int64(3))
+
+	st := cache.Stats()
+	c.Check(st.Requests, check.Equals, uint64(11))
+	c.Check(st.PermissionHits, check.Equals, uint64(8))
+	c.Check(st.ManifestHits, check.Equals, uint64(8))
+	c.Check(st.APICalls, check.Equals, uint64(3))
+	c.Check(st.PermissionEntries, check.Equals, 2)
+	c.Check(st.ManifestEntries, check.Equals, 1)
+}
+
+func (s *UnitSuite) TestCacheNegative(c *check.C) {
+	stub, arv, done := s.setupStubCollectionAPI(c)
+	defer done()
+	ctx := context.Background()
+	var cache cache
+
+	defer func(ttl time.Duration) { cacheNegativeTTL = ttl }(cacheNegativeTTL)
+	cacheNegativeTTL = time.Hour
+
+	for _, trial := range []struct {
+		token    string
+		targetID string
+		status   int
+	}{
+		{"bad", "zzzzz-4zz18-aaaaaaaaaaaaaaa", http.StatusUnauthorized},
+		{"good", "zzzzz-4zz18-bbbbbbbbbbbbbbb", http.StatusNotFound},
+	} {
+		arv.ApiToken = trial.token
+		calls := stub.calls
+		for i := 0; i < 3; i++ {
+			_, err := cache.Get(ctx, arv, trial.targetID, false)
+			c.Assert(err, check.FitsTypeOf, arvadosclient.APIServerError{})
+			c.Check(err.(arvadosclient.APIServerError).HttpStatusCode, check.Equals, trial.status)
+		}
+		c.Check(stub.calls, check.Equals, calls+1)
+	}
+	c.Check(cache.Stats().NegativeHits, check.Equals, uint64(4))
+
+	// Negative results expire sooner than positive ones.
+	cacheNegativeTTL = time.Nanosecond
+	arv.ApiToken = "bad"
+	calls := stub.calls
+	cache.Get(ctx, arv, "zzzzz-4zz18-bbbbbbbbbbbbbbb", false)
+	time.Sleep(time.Millisecond)
+	cache.Get(ctx, arv, "zzzzz-4zz18-bbbbbbbbbbbbbbb", false)
+	c.Check(stub.calls, check.Equals, calls+2)
+}
+
+func (s *UnitSuite) TestCacheUpdate(c *check.C) {
+	stub, arv, done := s.setupStubCollectionAPI(c)
+	defer done()
+	ctx := context.Background()
+	var cache cache
+
+	arv.ApiToken = "good"
+	_, err := cache.Get(ctx, arv, "zzzzz-4zz18-aaaaaaaaaaaaaaa", false)
+	c.Assert(err, check.IsNil)
+	cache.Update("good", "zzzzz-4zz18-aaaaaaaaaaaaaaa", map[string]interface{}{
+		"uuid":               "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		"portable_data_hash": "d41d8cd98f00b204e9800998ecf8427e+0",
+		"manifest_text":      "",
+	})
+	coll, err := cache.Get(ctx, arv, "zzzzz-4zz18-aaaaaaaaaaaaaaa", false)
+	c.Assert(err, check.IsNil)
+	c.Check(coll["portable_data_hash"], check.Equals, "d41d8cd98f00b204e9800998ecf8427e+0")
+	c.Check(coll["manifest_text"], check.Equals, "")
+	c.Check(stub.calls, check.Equals, int64(1))
+}
+
+func (s *UnitSuite) TestLRUCache(c *check.C) {
+	lru := newLRUCache(2)
+	now := time.Now()
+	lru.add("a", 1, now.Add(time.Hour))
+	lru.add("b", 2, now.Add(time.Hour))
+	lru.get("a", now)
+	lru.add("c", 3, now.Add(time.Hour))
+	_, ok := lru.get("b", now)
+	c.Check(ok, check.Equals, false)
+	v, ok := lru.get("a", now)
+	c.Check(ok, check.Equals, true)
+	c.Check(v, check.Equals, 1)
+
+	lru.add("c", 4, now.Add(time.Second))
+	v, ok = lru.get("c", now)
+	c.Check(v, check.Equals, 4)
+	_, ok = lru.get("c", now.Add(time.Minute))
+	c.Check(ok, check.Equals, false)
+	c.Check(lru.len(), check.Equals, 1)
+}
+
+func (s *IntegrationSuite) TestCacheStatus(c *check.C) {
+	h := &handler{}
+	for i := 0; i < 3; i++ {
+		u := mustParseURL("http://" + arvadostest.FooCollection + ".example.com/foo")
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{"Authorization": {"OAuth2 " + arvadostest.ActiveToken}},
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Body.String(), check.Equals, "foo")
+	}
+
+	u := mustParseURL("http://collections.example.com/status.json")
+	req := &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+	}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	var st webStatus
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &st), check.IsNil)
+	c.Check(st.Cache.Requests, check.Equals, uint64(3))
+	c.Check(st.Cache.APICalls, check.Equals, uint64(1))
+	c.Check(st.Cache.PermissionHits, check.Equals, uint64(2))
+}
@@ -0,0 +1,821 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+)
+
+// Maximum size of a block written by collectionFS. This is also the
+// maximum amount of written data buffered in memory for each file.
+const cfsBlockSize = 1 << 26
+
+const emptyBlockLocator = "d41d8cd98f00b204e9800998ecf8427e+0"
+
+var (
+	errReadOnly     = os.ErrPermission
+	errRandomWrite  = errors.New("writing anywhere but the end of a file is not supported")
+	errIsDirectory  = errors.New("is a directory")
+	errNotDirectory = errors.New("not a directory")
+	errInvalidMove  = errors.New("cannot move a directory into itself")
+)
+
+// cfsKeepClient is the subset of *keepclient.KeepClient used by
+// collectionFS.
+type cfsKeepClient interface {
+	GetContext(ctx context.Context, locator string) (io.ReadCloser, int64, string, error)
+	PutBContext(ctx context.Context, buf []byte) (string, int, error)
+}
+
+// collectionFS is a filesystem tree built from a collection's
+// manifest. It implements webdav.FileSystem.
+//
+// File content is read from Keep as needed. Data written to a file
+// is buffered in memory and stored in new Keep blocks; the resulting
+// manifest (see MarshalManifest) is not saved anywhere until the
+// caller updates the collection record.
+type collectionFS struct {
+	kc       cfsKeepClient
+	readOnly bool
+
+	mtx      sync.Mutex
+	root     *cfsNode
+	modified bool
+}
+
+// cfsNode is a directory (children != nil) or a file.
+type cfsNode struct {
+	name     string
+	parent   *cfsNode
+	children map[string]*cfsNode
+	modTime  time.Time
+
+	// File content is the data referenced by segments, followed
+	// by pending (data not yet written to Keep).
+	segments []cfsSegment
+	pending  []byte
+}
+
+// cfsSegment is a portion of a Keep block.
+type cfsSegment struct {
+	locator string
+	offset  int
+	length  int
+}
+
+// newCollectionFS returns a collectionFS with the content of the
+// given manifest.
+func newCollectionFS(kc cfsKeepClient, manifestText string, modTime time.Time, readOnly bool) (*collectionFS, error) {
+	fs := &collectionFS{
+		kc:       kc,
+		readOnly: readOnly,
+		root:     &cfsNode{children: map[string]*cfsNode{}, modTime: modTime},
+	}
+	m := manifest.Manifest{Text: manifestText}
+	for stream := range m.StreamIter() {
+		if stream.Err != nil {
+			return nil, stream.Err
+		}
+		if err := fs.loadStream(stream, modTime); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// collectionFSForRecord returns a collectionFS with the content of
+// the given collection record.
+func collectionFSForRecord(kc cfsKeepClient, collection map[string]interface{}, readOnly bool) (*collectionFS, error) {
+	mText, _ := collection["manifest_text"].(string)
+	modTime, _ := time.Parse(time.RFC3339Nano, fmt.Sprint(collection["modified_at"]))
+	return newCollectionFS(kc, mText, modTime, readOnly)
+}
+
+func (fs *collectionFS) loadStream(stream manifest.ManifestStream, modTime time.Time) error {
+	blockPos := make([]uint64, len(stream.Blocks)+1)
+	for i, loc := range stream.Blocks {
+		b, err := manifest.ParseBlockLocator(loc)
+		if err != nil {
+			return err
+		}
+		blockPos[i+1] = blockPos[i] + uint64(b.Size)
+	}
+	for _, fseg := range stream.FileStreamSegments {
+		if fseg.Name == "." {
+			// Placeholder for an empty directory.
+			if _, err := fs.mkdirAll(stream.StreamName, modTime); err != nil {
+				return err
+			}
+			continue
+		}
+		name := path.Join(stream.StreamName, fseg.Name)
+		if fseg.SegPos+fseg.SegLen > blockPos[len(stream.Blocks)] {
+			return fmt.Errorf("invalid manifest: file segment %d:%d:%s extends past end of stream", fseg.SegPos, fseg.SegLen, fseg.Name)
+		}
+		dir, err := fs.mkdirAll(path.Dir(name), modTime)
+		if err != nil {
+			return err
+		}
+		base := path.Base(name)
+		f := dir.children[base]
+		if f == nil {
+			f = &cfsNode{name: base, parent: dir, modTime: modTime}
+			dir.children[base] = f
+		} else if f.children != nil {
+			return fmt.Errorf("invalid manifest: %q is both a file and a directory", name)
+		}
+		for i, loc := range stream.Blocks {
+			start, end := fseg.SegPos, fseg.SegPos+fseg.SegLen
+			if blockPos[i+1] <= start || blockPos[i] >= end {
+				continue
+			}
+			seg := cfsSegment{locator: loc, length: int(blockPos[i+1] - blockPos[i])}
+			if start > blockPos[i] {
+				seg.offset = int(start - blockPos[i])
+				seg.length -= seg.offset
+			}
+			if end < blockPos[i+1] {
+				seg.length -= int(blockPos[i+1] - end)
+			}
+			f.segments = append(f.segments, seg)
+		}
+	}
+	return nil
+}
+
+// mkdirAll returns the directory at the given manifest stream name
+// (like "." or "./foo/bar"), creating it and its parents if needed.
+func (fs *collectionFS) mkdirAll(name string, modTime time.Time) (*cfsNode, error) {
+	dir := fs.root
+	for _, part := range strings.Split(name, "/") {
+		if part == "." || part == "" {
+			continue
+		}
+		child := dir.children[part]
+		if child == nil {
+			child = &cfsNode{name: part, parent: dir, children: map[string]*cfsNode{}, modTime: modTime}
+			dir.children[part] = child
+		} else if child.children == nil {
+			return nil, fmt.Errorf("invalid manifest: %q is both a file and a directory", part)
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+// lookup returns the node at the given path, or nil if there is no
+// such node. Caller must have fs.mtx.
+func (fs *collectionFS) lookup(name string) *cfsNode {
+	n := fs.root
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		if n.children == nil {
+			return nil
+		}
+		n = n.children[part]
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// lookupParent returns the directory that contains (or would
+// contain) the given path, and the last path component. Caller must
+// have fs.mtx.
+func (fs *collectionFS) lookupParent(name string) (*cfsNode, string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil, "", os.ErrInvalid
+	}
+	dir := fs.lookup(path.Dir(name))
+	if dir == nil {
+		return nil, "", os.ErrNotExist
+	}
+	if dir.children == nil {
+		return nil, "", errNotDirectory
+	}
+	return dir, path.Base(name), nil
+}
+
+// Modified reports whether the filesystem has changed since it was
+// loaded.
+func (fs *collectionFS) Modified() bool {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	return fs.modified
+}
+
+func (fs *collectionFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if fs.readOnly {
+		return errReadOnly
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	dir, base, err := fs.lookupParent(name)
+	if err != nil {
+		return err
+	}
+	if dir.children[base] != nil {
+		return os.ErrExist
+	}
+	now := time.Now()
+	dir.children[base] = &cfsNode{name: base, parent: dir, children: map[string]*cfsNode{}, modTime: now}
+	dir.modTime = now
+	fs.modified = true
+	return nil
+}
+
+func (fs *collectionFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (*cfsFile, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable && fs.readOnly {
+		return nil, errReadOnly
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	n := fs.lookup(name)
+	if n == nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		if fs.readOnly {
+			return nil, errReadOnly
+		}
+		dir, base, err := fs.lookupParent(name)
+		if err != nil {
+			return nil, err
+		}
+		n = &cfsNode{name: base, parent: dir, modTime: time.Now()}
+		dir.children[base] = n
+		dir.modTime = n.modTime
+		fs.modified = true
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, os.ErrExist
+	} else if n.children != nil && writable {
+		return nil, errIsDirectory
+	}
+	if flag&os.O_TRUNC != 0 && writable && (n.segments != nil || n.pending != nil) {
+		n.segments, n.pending = nil, nil
+		n.modTime = time.Now()
+		fs.modified = true
+	}
+	f := &cfsFile{fs: fs, node: n, ctx: ctx, writable: writable}
+	if flag&os.O_APPEND != 0 {
+		f.pos = n.size()
+	}
+	return f, nil
+}
+
+func (fs *collectionFS) RemoveAll(ctx context.Context, name string) error {
+	if fs.readOnly {
+		return errReadOnly
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	dir, base, err := fs.lookupParent(name)
+	if err != nil {
+		return err
+	}
+	if dir.children[base] == nil {
+		return os.ErrNotExist
+	}
+	delete(dir.children, base)
+	dir.modTime = time.Now()
+	fs.modified = true
+	return nil
+}
+
+func (fs *collectionFS) Rename(ctx context.Context, oldName, newName string) error {
+	if fs.readOnly {
+		return errReadOnly
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	olddir, oldbase, err := fs.lookupParent(oldName)
+	if err != nil {
+		return err
+	}
+	n := olddir.children[oldbase]
+	if n == nil {
+		return os.ErrNotExist
+	}
+	newdir, newbase, err := fs.lookupParent(newName)
+	if err != nil {
+		return err
+	}
+	if newdir.children[newbase] != nil {
+		return os.ErrExist
+	}
+	for d := newdir; d != nil; d = d.parent {
+		if d == n {
+			return errInvalidMove
+		}
+	}
+	now := time.Now()
+	delete(olddir.children, oldbase)
+	olddir.modTime = now
+	n.name, n.parent = newbase, newdir
+	newdir.children[newbase] = n
+	newdir.modTime = now
+	fs.modified = true
+	return nil
+}
+
+func (fs *collectionFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	n := fs.lookup(name)
+	if n == nil {
+		return nil, os.ErrNotExist
+	}
+	return fs.fileInfo(n), nil
+}
+
+// fileInfo returns an os.FileInfo describing n. Caller must have
+// fs.mtx.
+func (fs *collectionFS) fileInfo(n *cfsNode) *cfsFileInfo {
+	fi := &cfsFileInfo{name: n.name, modTime: n.modTime}
+	if n == fs.root {
+		fi.name = "/"
+	}
+	if n.children != nil {
+		fi.mode = os.ModeDir | 0755
+	} else {
+		fi.mode = 0644
+		fi.size = n.size()
+		if len(n.pending) == 0 {
+			fi.etag = segmentsETag(n.segments)
+		}
+	}
+	if fs.readOnly {
+		fi.mode &^= 0222
+	}
+	return fi
+}
+
+// segmentsETag returns a strong ETag for a file with the given
+// segments. The ETag depends only on the block hashes and the
+// portions of the blocks used, so it doesn't change when the
+// collection's other files change, or when the blocks' permission
+// signatures change.
+func segmentsETag(segments []cfsSegment) string {
+	h := md5.New()
+	for _, seg := range segments {
+		hash := seg.locator
+		if i := strings.Index(hash, "+"); i >= 0 {
+			hash = hash[:i]
+		}
+		fmt.Fprintf(h, "%s %d %d\n", hash, seg.offset, seg.length)
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil))
+}
+
+// flush writes n's pending data to Keep. Caller must have fs.mtx.
+func (fs *collectionFS) flush(ctx context.Context, n *cfsNode) error {
+	if len(n.pending) == 0 {
+		return nil
+	}
+	loc, _, err := fs.kc.PutBContext(ctx, n.pending)
+	if err != nil {
+		return err
+	}
+	n.segments = append(n.segments, cfsSegment{locator: loc, length: len(n.pending)})
+	n.pending = nil
+	return nil
+}
+
+// fileSegments writes any buffered data for the named file to Keep,
+// and returns the file's content as a list of segments.
+func (fs *collectionFS) fileSegments(ctx context.Context, name string) ([]cfsSegment, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	n := fs.lookup(name)
+	if n == nil {
+		return nil, os.ErrNotExist
+	} else if n.children != nil {
+		return nil, errIsDirectory
+	}
+	if err := fs.flush(ctx, n); err != nil {
+		return nil, err
+	}
+	return append([]cfsSegment(nil), n.segments...), nil
+}
+
+// writeFile creates or replaces the named file, using the given
+// segments (e.g., from fileSegments on another collectionFS) as its
+// content. Parent directories are created as needed.
+func (fs *collectionFS) writeFile(name string, segments []cfsSegment) error {
+	if fs.readOnly {
+		return errReadOnly
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return os.ErrInvalid
+	}
+	now := time.Now()
+	dir, err := fs.mkdirParents(path.Dir(name), now)
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	if n := dir.children[base]; n != nil && n.children != nil {
+		return errIsDirectory
+	}
+	dir.children[base] = &cfsNode{
+		name:     base,
+		parent:   dir,
+		modTime:  now,
+		segments: append([]cfsSegment(nil), segments...),
+	}
+	dir.modTime = now
+	fs.modified = true
+	return nil
+}
+
+// MkdirAll creates the named directory and any missing parents.
+func (fs *collectionFS) MkdirAll(ctx context.Context, name string) error {
+	if fs.readOnly {
+		return errReadOnly
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	_, err := fs.mkdirParents(path.Clean("/"+name), time.Now())
+	return err
+}
+
+// mkdirParents is like mkdirAll, but fails with errNotDirectory
+// instead of reporting an invalid manifest if a file is in the way,
+// and marks the filesystem as modified if it creates anything.
+// Caller must have fs.mtx.
+func (fs *collectionFS) mkdirParents(name string, modTime time.Time) (*cfsNode, error) {
+	dir := fs.root
+	for _, part := range strings.Split(name, "/") {
+		if part == "." || part == "" {
+			continue
+		}
+		child := dir.children[part]
+		if child == nil {
+			child = &cfsNode{name: part, parent: dir, children: map[string]*cfsNode{}, modTime: modTime}
+			dir.children[part] = child
+			dir.modTime = modTime
+			fs.modified = true
+		} else if child.children == nil {
+			return nil, errNotDirectory
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+// MarshalManifest writes any buffered file data to Keep, and returns
+// a manifest describing the current content of the filesystem.
+func (fs *collectionFS) MarshalManifest(ctx context.Context) (string, error) {
+	return fs.MarshalManifestDir(ctx, "")
+}
+
+// MarshalManifestDir is like MarshalManifest, but only describes the
+// given directory, which becomes the top level of the returned
+// manifest.
+func (fs *collectionFS) MarshalManifestDir(ctx context.Context, name string) (string, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	dir := fs.lookup(name)
+	if dir == nil || dir.children == nil {
+		return "", os.ErrNotExist
+	}
+	var buf []string
+	err := fs.marshalDir(ctx, dir, ".", &buf)
+	return strings.Join(buf, ""), err
+}
+
+func (fs *collectionFS) marshalDir(ctx context.Context, dir *cfsNode, streamName string, buf *[]string) error {
+	var names []string
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var blocks []string
+	blockPos := map[string]uint64{}
+	var streamLen uint64
+	var fileTokens []string
+	var subdirs []string
+	for _, name := range names {
+		n := dir.children[name]
+		if n.children != nil {
+			subdirs = append(subdirs, name)
+			continue
+		}
+		if err := fs.flush(ctx, n); err != nil {
+			return err
+		}
+		if len(n.segments) == 0 {
+			fileTokens = append(fileTokens, fmt.Sprintf("0:0:%s", manifest.EscapeName(name)))
+			continue
+		}
+		// Contiguous segments are merged into a single file
+		// token.
+		var tokStart, tokLen uint64
+		for i, seg := range n.segments {
+			pos, ok := blockPos[seg.locator]
+			if !ok {
+				b, err := manifest.ParseBlockLocator(seg.locator)
+				if err != nil {
+					return err
+				}
+				pos = streamLen
+				blockPos[seg.locator] = pos
+				blocks = append(blocks, seg.locator)
+				streamLen += uint64(b.Size)
+			}
+			segStart := pos + uint64(seg.offset)
+			if i > 0 && segStart == tokStart+tokLen {
+				tokLen += uint64(seg.length)
+				continue
+			}
+			if i > 0 {
+				fileTokens = append(fileTokens, fmt.Sprintf("%d:%d:%s", tokStart, tokLen, manifest.EscapeName(name)))
+			}
+			tokStart, tokLen = segStart, uint64(seg.length)
+		}
+		fileTokens = append(fileTokens, fmt.Sprintf("%d:%d:%s", tokStart, tokLen, manifest.EscapeName(name)))
+	}
+	if len(fileTokens) == 0 && len(subdirs) == 0 && streamName != "." {
+		// Represent an empty directory with a placeholder
+		// file named ".".
+		fileTokens = append(fileTokens, `0:0:\056`)
+	}
+	if len(fileTokens) > 0 {
+		if len(blocks) == 0 {
+			blocks = append(blocks, emptyBlockLocator)
+		}
+		*buf = append(*buf, manifest.EscapeName(streamName)+" "+strings.Join(blocks, " ")+" "+strings.Join(fileTokens, " ")+"\n")
+	}
+	for _, name := range subdirs {
+		if err := fs.marshalDir(ctx, dir.children[name], streamName+"/"+name, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// size returns the size of file n. Caller must have fs.mtx.
+func (n *cfsNode) size() int64 {
+	var size int64
+	for _, seg := range n.segments {
+		size += int64(seg.length)
+	}
+	return size + int64(len(n.pending))
+}
+
+// cfsFile is an open file or directory in a collectionFS. It
+// implements webdav.File.
+type cfsFile struct {
+	fs       *collectionFS
+	node     *cfsNode
+	ctx      context.Context
+	writable bool
+	pos      int64
+
+	// Names of directory entries already returned by Readdir.
+	readdirDone int
+
+	// Most recently retrieved block.
+	cacheLocator string
+	cacheData    []byte
+
+	// Block being retrieved in the background.
+	readAheadLocator string
+	readAheadResult  chan blockResult
+}
+
+func (f *cfsFile) Close() error {
+	if !f.writable {
+		return nil
+	}
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	return f.fs.flush(f.ctx, f.node)
+}
+
+func (f *cfsFile) Read(p []byte) (int, error) {
+	f.fs.mtx.Lock()
+	if f.node.children != nil {
+		f.fs.mtx.Unlock()
+		return 0, errIsDirectory
+	}
+	// Find the segment containing f.pos. The node's segments
+	// and pending data can change after we unlock, but our
+	// copies of the slices won't.
+	segments, pending := f.node.segments, f.node.pending
+	f.fs.mtx.Unlock()
+
+	pos := f.pos
+	for i, seg := range segments {
+		if pos >= int64(seg.length) {
+			pos -= int64(seg.length)
+			continue
+		}
+		data, err := f.block(seg.locator)
+		if err != nil {
+			return 0, err
+		}
+		start := seg.offset + int(pos)
+		end := seg.offset + seg.length
+		if end > len(data) {
+			return 0, fmt.Errorf("block %s is shorter than expected", seg.locator)
+		}
+		n := copy(p, data[start:end])
+		f.pos += int64(n)
+		if i+1 < len(segments) && 2*(pos+int64(n)) >= int64(seg.length) {
+			// The caller is halfway through this
+			// segment, and will probably want the next
+			// one soon. (A caller reading a small range
+			// near the start of a segment doesn't cause
+			// an unnecessary fetch.)
+			f.readAhead(segments[i+1].locator)
+		}
+		return n, nil
+	}
+	if pos < int64(len(pending)) {
+		n := copy(p, pending[pos:])
+		f.pos += int64(n)
+		return n, nil
+	}
+	return 0, io.EOF
+}
+
+// block returns the content of the given block, retrieving it from
+// Keep unless it was also the last block read (or is already being
+// retrieved by readAhead).
+func (f *cfsFile) block(locator string) ([]byte, error) {
+	if locator == f.cacheLocator {
+		return f.cacheData, nil
+	}
+	var res blockResult
+	if locator == f.readAheadLocator {
+		res = <-f.readAheadResult
+		f.readAheadLocator = ""
+	} else {
+		res = f.fetch(locator)
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	f.cacheLocator, f.cacheData = locator, res.data
+	return res.data, nil
+}
+
+// readAhead starts retrieving the given block in the background,
+// unless it's already cached or being retrieved.
+func (f *cfsFile) readAhead(locator string) {
+	if locator == f.cacheLocator || locator == f.readAheadLocator {
+		return
+	}
+	ch := make(chan blockResult, 1)
+	f.readAheadLocator, f.readAheadResult = locator, ch
+	go func() {
+		ch <- f.fetch(locator)
+	}()
+}
+
+type blockResult struct {
+	data []byte
+	err  error
+}
+
+func (f *cfsFile) fetch(locator string) blockResult {
+	rdr, _, _, err := f.fs.kc.GetContext(f.ctx, locator)
+	if err != nil {
+		return blockResult{err: err}
+	}
+	defer rdr.Close()
+	data, err := ioutil.ReadAll(rdr)
+	return blockResult{data: data, err: err}
+}
+
+func (f *cfsFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mtx.Lock()
+	size := f.node.size()
+	f.fs.mtx.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += size
+	default:
+		return f.pos, os.ErrInvalid
+	}
+	if offset < 0 {
+		return f.pos, os.ErrInvalid
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+func (f *cfsFile) Write(p []byte) (int, error) {
+	if !f.writable {
+		return 0, os.ErrPermission
+	}
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	if f.pos != f.node.size() {
+		return 0, errRandomWrite
+	}
+	written := 0
+	for len(p) > 0 {
+		n := cfsBlockSize - len(f.node.pending)
+		if n > len(p) {
+			n = len(p)
+		}
+		f.node.pending = append(f.node.pending, p[:n]...)
+		p = p[n:]
+		written += n
+		f.pos += int64(n)
+		if len(f.node.pending) >= cfsBlockSize {
+			if err := f.fs.flush(f.ctx, f.node); err != nil {
+				return written, err
+			}
+		}
+	}
+	f.node.modTime = time.Now()
+	f.fs.modified = true
+	return written, nil
+}
+
+func (f *cfsFile) Readdir(count int) ([]os.FileInfo, error) {
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	if f.node.children == nil {
+		return nil, errNotDirectory
+	}
+	var names []string
+	for name := range f.node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if f.readdirDone < len(names) {
+		names = names[f.readdirDone:]
+	} else {
+		names = nil
+	}
+	if count > 0 && len(names) == 0 {
+		return nil, io.EOF
+	}
+	if count > 0 && len(names) > count {
+		names = names[:count]
+	}
+	f.readdirDone += len(names)
+	fis := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		fis = append(fis, f.fs.fileInfo(f.node.children[name]))
+	}
+	return fis, nil
+}
+
+func (f *cfsFile) Stat() (os.FileInfo, error) {
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	return f.fs.fileInfo(f.node), nil
+}
+
+// cfsFileInfo implements os.FileInfo, and webdav.ContentTyper and
+// webdav.ETager so PROPFIND doesn't need to read file content.
+type cfsFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	etag    string
+}
+
+func (fi *cfsFileInfo) Name() string       { return fi.name }
+func (fi *cfsFileInfo) Size() int64        { return fi.size }
+func (fi *cfsFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *cfsFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *cfsFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *cfsFileInfo) Sys() interface{}   { return nil }
+
+func (fi *cfsFileInfo) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(fi.name)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
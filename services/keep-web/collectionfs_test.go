@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&CollectionFSSuite{})
+
+type CollectionFSSuite struct {
+	kc *memKeepClient
+}
+
+// memKeepClient stores blocks in memory.
+type memKeepClient struct {
+	mtx    sync.Mutex
+	blocks map[string][]byte
+}
+
+func (kc *memKeepClient) GetContext(ctx context.Context, locator string) (io.ReadCloser, int64, string, error) {
+	kc.mtx.Lock()
+	defer kc.mtx.Unlock()
+	data, ok := kc.blocks[locator[:32]]
+	if !ok {
+		return nil, 0, "", os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), "", nil
+}
+
+func (kc *memKeepClient) PutBContext(ctx context.Context, buf []byte) (string, int, error) {
+	kc.mtx.Lock()
+	defer kc.mtx.Unlock()
+	hash := fmt.Sprintf("%x", md5.Sum(buf))
+	kc.blocks[hash] = append([]byte(nil), buf...)
+	return fmt.Sprintf("%s+%d+Afakesignature@12345678", hash, len(buf)), 2, nil
+}
+
+func (s *CollectionFSSuite) SetUpTest(c *check.C) {
+	s.kc = &memKeepClient{blocks: map[string][]byte{}}
+	for _, data := range []string{"foo", "bar"} {
+		s.kc.PutBContext(context.Background(), []byte(data))
+	}
+}
+
+func (s *CollectionFSSuite) readFile(c *check.C, fs *collectionFS, name string) string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	c.Assert(err, check.IsNil)
+	return string(buf)
+}
+
+func (s *CollectionFSSuite) TestPathologicalManifest(c *check.C) {
+	fs, err := newCollectionFS(s.kc, arvadostest.PathologicalManifest, time.Now(), true)
+	c.Assert(err, check.IsNil)
+	for name, content := range map[string]string{
+		"/f":                 "f",
+		"/ooba":              "ooba",
+		"/zero@0":            "",
+		"/overlapReverse/oo": "oo",
+		"/segmented/frob":    "frob",
+		"/segmented/oof":     "oof",
+		"/foo bar/baz":       "foo",
+		"/foo bar/baz waz":   "foo",
+		"/foo/foo":           "foofoo",
+	} {
+		c.Check(s.readFile(c, fs, name), check.Equals, content, check.Commentf("%s", name))
+	}
+
+	f, err := fs.OpenFile(context.Background(), "/foo", os.O_RDONLY, 0)
+	c.Assert(err, check.IsNil)
+	fis, err := f.Readdir(-1)
+	c.Assert(err, check.IsNil)
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+		c.Check(fi.Mode()&0222, check.Equals, os.FileMode(0))
+	}
+	c.Check(names, check.DeepEquals, []string{"foo", "zero"})
+
+	fi, err := fs.Stat(context.Background(), "/foo bar")
+	c.Assert(err, check.IsNil)
+	c.Check(fi.IsDir(), check.Equals, true)
+	_, err = fs.Stat(context.Background(), "/nonexistent")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *CollectionFSSuite) TestReadOnly(c *check.C) {
+	fs, err := newCollectionFS(s.kc, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n", time.Now(), true)
+	c.Assert(err, check.IsNil)
+	ctx := context.Background()
+	_, err = fs.OpenFile(ctx, "/foo", os.O_RDWR|os.O_TRUNC, 0)
+	c.Check(os.IsPermission(err), check.Equals, true)
+	c.Check(os.IsPermission(fs.Mkdir(ctx, "/dir", 0755)), check.Equals, true)
+	c.Check(os.IsPermission(fs.RemoveAll(ctx, "/foo")), check.Equals, true)
+	c.Check(os.IsPermission(fs.Rename(ctx, "/foo", "/bar")), check.Equals, true)
+	c.Check(fs.Modified(), check.Equals, false)
+}
+
+func (s *CollectionFSSuite) TestWriteAndMarshal(c *check.C) {
+	fs, err := newCollectionFS(s.kc, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n./dir1 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n", time.Now(), false)
+	c.Assert(err, check.IsNil)
+	ctx := context.Background()
+
+	f, err := fs.OpenFile(ctx, "/dir1/new file", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	c.Assert(err, check.IsNil)
+	_, err = io.WriteString(f, "foo")
+	c.Check(err, check.IsNil)
+	_, err = io.WriteString(f, "bar")
+	c.Check(err, check.IsNil)
+	_, err = f.Seek(0, io.SeekStart)
+	c.Check(err, check.IsNil)
+	_, err = f.Write([]byte("x"))
+	c.Check(err, check.Equals, errRandomWrite)
+	c.Check(f.Close(), check.IsNil)
+	c.Check(s.readFile(c, fs, "/dir1/new file"), check.Equals, "foobar")
+
+	c.Check(fs.Mkdir(ctx, "/dir2", 0755), check.IsNil)
+	c.Check(fs.Mkdir(ctx, "/dir2", 0755), check.Equals, os.ErrExist)
+	c.Check(os.IsNotExist(fs.Mkdir(ctx, "/dir3/dir4", 0755)), check.Equals, true)
+	c.Check(fs.Rename(ctx, "/foo", "/dir2/foo"), check.IsNil)
+	c.Check(fs.Rename(ctx, "/dir2", "/dir2/dir5"), check.Equals, errInvalidMove)
+	c.Check(fs.Mkdir(ctx, "/empty", 0755), check.IsNil)
+	c.Check(fs.RemoveAll(ctx, "/dir1/bar"), check.IsNil)
+	c.Check(fs.Modified(), check.Equals, true)
+
+	mText, err := fs.MarshalManifest(ctx)
+	c.Assert(err, check.IsNil)
+	c.Check(mText, check.Equals, ""+
+		"./dir1 3858f62230ac3c915f300c664312c63f+6+Afakesignature@12345678 0:6:new\\040file\n"+
+		"./dir2 acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n"+
+		"./empty d41d8cd98f00b204e9800998ecf8427e+0 0:0:\\056\n")
+
+	// The marshalled manifest loads the same tree.
+	fs, err = newCollectionFS(s.kc, mText, time.Now(), true)
+	c.Assert(err, check.IsNil)
+	c.Check(s.readFile(c, fs, "/dir1/new file"), check.Equals, "foobar")
+	c.Check(s.readFile(c, fs, "/dir2/foo"), check.Equals, "foo")
+	fi, err := fs.Stat(ctx, "/empty")
+	c.Assert(err, check.IsNil)
+	c.Check(fi.IsDir(), check.Equals, true)
+}
+
+func (s *CollectionFSSuite) TestMarshalMergesSegments(c *check.C) {
+	mText := ". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:3:foobar 3:3:foobar 0:0:empty\n"
+	fs, err := newCollectionFS(s.kc, mText, time.Now(), false)
+	c.Assert(err, check.IsNil)
+	c.Check(s.readFile(c, fs, "/foobar"), check.Equals, "foobar")
+	out, err := fs.MarshalManifest(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Check(out, check.Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:0:empty 0:6:foobar\n")
+}
+
+func (s *CollectionFSSuite) TestInvalidManifest(c *check.C) {
+	for _, mText := range []string{
+		". acbd18db4cc2f85cedef654fccc4a4d8+3 0:4:foo\n",
+		". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo 0:3:foo/bar\n",
+		"foo acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n",
+	} {
+		_, err := newCollectionFS(s.kc, mText, time.Now(), true)
+		c.Check(err, check.NotNil, check.Commentf("%q", mText))
+	}
+	_, err := newCollectionFS(s.kc, "", time.Now(), true)
+	c.Check(err, check.IsNil)
+}
+
+func (s *CollectionFSSuite) TestSeek(c *check.C) {
+	for _, data := range []string{"Hello", " world\n"} {
+		s.kc.PutBContext(context.Background(), []byte(data))
+	}
+	fs, err := newCollectionFS(s.kc, ". 8b1a9953c4611296a827abf8c47804d7+5 bb5355cf57318e0e67f684433f19017d+7 0:12:hello.txt\n", time.Now(), true)
+	c.Assert(err, check.IsNil)
+	f, err := fs.OpenFile(context.Background(), "/hello.txt", os.O_RDONLY, 0)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	for _, trial := range []struct {
+		offset int64
+		whence int
+		expect string
+	}{
+		{6, io.SeekStart, "world\n"},
+		{-3, io.SeekEnd, "ld\n"},
+		{0, io.SeekStart, "Hello world\n"},
+		{2, io.SeekStart, "llo world\n"},
+		{20, io.SeekStart, ""},
+	} {
+		_, err := f.Seek(trial.offset, trial.whence)
+		c.Check(err, check.IsNil)
+		buf, err := ioutil.ReadAll(f)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf), check.Equals, trial.expect)
+	}
+	_, err = f.Seek(-1, io.SeekStart)
+	c.Check(err, check.Equals, os.ErrInvalid)
+}
+
+func (s *CollectionFSSuite) TestServeContent(c *check.C) {
+	for _, data := range []string{"Hello", " world\n"} {
+		s.kc.PutBContext(context.Background(), []byte(data))
+	}
+	fs, err := newCollectionFS(s.kc, ". 8b1a9953c4611296a827abf8c47804d7+5 bb5355cf57318e0e67f684433f19017d+7 0:12:hello.txt\n", time.Now(), true)
+	c.Assert(err, check.IsNil)
+	f, err := fs.OpenFile(context.Background(), "/hello.txt", os.O_RDONLY, 0)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+
+	req := httptest.NewRequest("GET", "/hello.txt", nil)
+	req.Header.Set("Range", "bytes=3-3,-4")
+	resp := httptest.NewRecorder()
+	http.ServeContent(resp, req, "hello.txt", time.Time{}, f)
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*Content-Range: bytes 3-3/12\r\n(Content-Type: [^\r]*\r\n)?\r\nl\r\n--.*Content-Range: bytes 8-11/12\r\n(Content-Type: [^\r]*\r\n)?\r\nrld\n\r\n--.*`)
+}
+
+func (s *CollectionFSSuite) TestETag(c *check.C) {
+	fs, err := newCollectionFS(s.kc, ". acbd18db4cc2f85cedef654fccc4a4d8+3+Asig1@12345678 37b51d194a7513e45b56f6524f2d51f2+3 0:3:foo 0:6:foobar 3:3:bar\n./dir acbd18db4cc2f85cedef654fccc4a4d8+3+Asig2@12345678 0:3:foo\n", time.Now(), true)
+	c.Assert(err, check.IsNil)
+	etag := func(name string) string {
+		fi, err := fs.Stat(context.Background(), name)
+		c.Assert(err, check.IsNil)
+		return fi.(*cfsFileInfo).etag
+	}
+	c.Check(etag("/foo"), check.Matches, `"[0-9a-f]{32}"`)
+	c.Check(etag("/foo"), check.Equals, etag("/dir/foo"))
+	c.Check(etag("/foo"), check.Not(check.Equals), etag("/bar"))
+	c.Check(etag("/foo"), check.Not(check.Equals), etag("/foobar"))
+	c.Check(etag("/dir"), check.Equals, "")
+}
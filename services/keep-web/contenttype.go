@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var (
+	inlineTypes        = "image/png,image/jpeg,image/gif,image/webp,text/plain,text/csv,text/tab-separated-values"
+	collectionVhostCSP = "default-src 'self' 'unsafe-inline' 'unsafe-eval' data: blob:"
+)
+
+func init() {
+	flag.StringVar(&inlineTypes, "inline-types", inlineTypes,
+		"Comma-separated list of media types (\"type/subtype\" or \"type/*\") that can be displayed inline at URLs that aren't specific to one collection. Other files are served as attachments at those URLs. HTML, SVG, XML, and PDF files are always served as attachments unless -trust-all-content is given or the URL's host name identifies a collection.")
+	flag.StringVar(&collectionVhostCSP, "collection-vhost-csp", collectionVhostCSP,
+		"Content-Security-Policy header for files served at host names that identify a collection. The default policy stops scripts in collection content from sending data to other sites. Use \"\" to omit the header.")
+}
+
+// sharedHostCSP is the Content-Security-Policy header for files
+// served at host names that aren't specific to one collection.
+const sharedHostCSP = "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; sandbox"
+
+// Media types that can run scripts when displayed, and are therefore
+// never displayed inline at a shared host name. This includes PDF:
+// browsers don't display PDFs at all under the sandbox directive in
+// sharedHostCSP.
+var scriptableTypes = map[string]bool{
+	"application/pdf":       true,
+	"application/xhtml+xml": true,
+	"application/xml":       true,
+	"application/xslt+xml":  true,
+	"image/svg+xml":         true,
+	"text/html":             true,
+	"text/xml":              true,
+	"text/xsl":              true,
+}
+
+// detectContentType returns the media type of a file, based on its
+// name or (if the extension isn't known) its first 512 bytes. The
+// read position of f is left at the start of the file.
+func detectContentType(f io.ReadSeeker, filename string) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(filename)); t != "" {
+		return t, nil
+	}
+	var buf [512]byte
+	n, err := io.ReadFull(f, buf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// inlineAllowed returns true if a file of the given media type can
+// be displayed inline at a shared host name.
+func inlineAllowed(ctype string) bool {
+	mtype, _, err := mime.ParseMediaType(ctype)
+	if err != nil || scriptableTypes[mtype] {
+		return false
+	}
+	for _, allowed := range strings.Split(inlineTypes, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == mtype || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mtype, allowed[:len(allowed)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// setContentHeaders sets the Content-Type, Content-Disposition, and
+// security headers for a file download. Unless vhost is true (the
+// host name identifies the file's collection, or the operator
+// trusts all content), files whose type isn't allowed inline are
+// served as attachments.
+func setContentHeaders(w http.ResponseWriter, r *http.Request, f io.ReadSeeker, filename string, vhost, attachment bool) error {
+	ctype, err := detectContentType(f, filename)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", ctype)
+	setSecurityHeaders(w, vhost)
+	if !vhost {
+		attachment = attachment || !inlineAllowed(ctype)
+	}
+	applyContentDispositionHdr(w, r, path.Base(filename), attachment)
+	return nil
+}
+
+// setSecurityHeaders sets the X-Content-Type-Options and
+// Content-Security-Policy headers for content served from a
+// collection.
+func setSecurityHeaders(w http.ResponseWriter, vhost bool) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !vhost {
+		w.Header().Set("Content-Security-Policy", sharedHostCSP)
+	} else if collectionVhostCSP != "" {
+		w.Header().Set("Content-Security-Policy", collectionVhostCSP)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestDetectContentType(c *check.C) {
+	for _, trial := range []struct {
+		filename string
+		content  string
+		expect   string
+	}{
+		{"foo.txt", "<html><body>", "text/plain; charset=utf-8"},
+		{"foo.png", "", "image/png"},
+		{"README", "Hello world", "text/plain; charset=utf-8"},
+		{"report", "<!DOCTYPE html><html><body>hi</body></html>", "text/html; charset=utf-8"},
+		{"image", "\x89PNG\x0d\x0a\x1a\x0a" + strings.Repeat("\x00", 600), "image/png"},
+		{"empty", "", "text/plain; charset=utf-8"},
+		{"dir/binary", "\x00\x01\x02", "application/octet-stream"},
+	} {
+		f := strings.NewReader(trial.content)
+		ctype, err := detectContentType(f, trial.filename)
+		c.Check(err, check.IsNil)
+		c.Check(ctype, check.Equals, trial.expect, check.Commentf("%s", trial.filename))
+		// Sniffing doesn't consume any data.
+		buf, _ := ioutil.ReadAll(f)
+		c.Check(string(buf), check.Equals, trial.content)
+	}
+}
+
+func (s *UnitSuite) TestInlineAllowed(c *check.C) {
+	defer func(orig string) { inlineTypes = orig }(inlineTypes)
+	for ctype, ok := range map[string]bool{
+		"image/png":                 true,
+		"application/pdf":           false,
+		"text/plain; charset=utf-8": true,
+		"TEXT/PLAIN":                true,
+		"text/html; charset=utf-8":  false,
+		"image/svg+xml":             false,
+		"application/octet-stream":  false,
+		"video/mp4":                 false,
+		"garbage":                   false,
+	} {
+		c.Check(inlineAllowed(ctype), check.Equals, ok, check.Commentf("%s", ctype))
+	}
+
+	inlineTypes = "image/*, video/mp4, text/html, application/pdf"
+	for ctype, ok := range map[string]bool{
+		"image/png": true,
+		"video/mp4": true,
+		// Scriptable types are never allowed, and PDFs
+		// wouldn't display under sharedHostCSP anyway
+		"image/svg+xml":   false,
+		"text/html":       false,
+		"application/pdf": false,
+	} {
+		c.Check(inlineAllowed(ctype), check.Equals, ok, check.Commentf("%s", ctype))
+	}
+}
+
+func (s *UnitSuite) TestContentHeaders(c *check.C) {
+	html := "<!DOCTYPE html><html><script>alert(1)</script></html>"
+	for _, trial := range []struct {
+		filename    string
+		content     string
+		vhost       bool
+		attachment  bool
+		disposition string
+		csp         string
+	}{
+		{"report.html", html, false, false, "attachment", sharedHostCSP},
+		{"report", html, false, false, "attachment", sharedHostCSP},
+		{"drawing.svg", "<svg/>", false, false, "attachment", sharedHostCSP},
+		{"report.html", html, true, false, "", collectionVhostCSP},
+		{"report.html", html, true, true, "attachment", collectionVhostCSP},
+		{"notes.txt", "hello", false, false, "", sharedHostCSP},
+		{"notes.txt", "hello", false, true, "attachment", sharedHostCSP},
+		{"data.bin", "\x00\x01", false, false, "attachment", sharedHostCSP},
+		{"paper.pdf", "%PDF-1.4\n", false, false, "attachment", sharedHostCSP},
+		{"paper.pdf", "%PDF-1.4\n", true, false, "", collectionVhostCSP},
+	} {
+		c.Logf("%+v", trial)
+		w := httptest.NewRecorder()
+		r := &http.Request{RequestURI: "/c=" + arvadostest.FooCollection + "/" + trial.filename}
+		err := setContentHeaders(w, r, strings.NewReader(trial.content), trial.filename, trial.vhost, trial.attachment)
+		c.Assert(err, check.IsNil)
+		c.Check(w.Header().Get("Content-Disposition"), check.Equals, trial.disposition)
+		c.Check(w.Header().Get("Content-Security-Policy"), check.Equals, trial.csp)
+		c.Check(w.Header().Get("X-Content-Type-Options"), check.Equals, "nosniff")
+	}
+
+	defer func(orig string) { collectionVhostCSP = orig }(collectionVhostCSP)
+	collectionVhostCSP = ""
+	w := httptest.NewRecorder()
+	r := &http.Request{RequestURI: "/report.html"}
+	c.Check(setContentHeaders(w, r, strings.NewReader(html), "report.html", true, false), check.IsNil)
+	_, ok := w.Header()["Content-Security-Policy"]
+	c.Check(ok, check.Equals, false)
+}
+
+func (s *IntegrationSuite) TestContentSecurityHeaders(c *check.C) {
+	defer func(orig tokenSet) { anonymousTokens = orig }(anonymousTokens)
+	anonymousTokens = tokenSet{arvadostest.ActiveToken}
+	for _, trial := range []struct {
+		host string
+		path string
+		csp  string
+	}{
+		{arvadostest.FooCollection + ".example.com", "/foo", collectionVhostCSP},
+		{"collections.example.com", "/c=" + arvadostest.FooCollection + "/foo", sharedHostCSP},
+	} {
+		u := mustParseURL("http://" + trial.host + trial.path)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{},
+		}
+		resp := httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Body.String(), check.Equals, "foo")
+		c.Check(resp.Header().Get("Content-Type"), check.Equals, "text/plain; charset=utf-8")
+		c.Check(resp.Header().Get("Content-Disposition"), check.Equals, "")
+		c.Check(resp.Header().Get("X-Content-Type-Options"), check.Equals, "nosniff")
+		c.Check(resp.Header().Get("Content-Security-Policy"), check.Equals, trial.csp)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// dirListEntry describes one file or subdirectory in a directory
+// listing.
+type dirListEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // "file" or "directory"
+	Size int64  `json:"size"`
+	Href string `json:"href"`
+}
+
+// dirListing is the content of a directory listing.
+type dirListing struct {
+	CollectionID   string         `json:"collection"`
+	CollectionName string         `json:"collection_name,omitempty"`
+	Path           string         `json:"path"`
+	Entries        []dirListEntry `json:"entries"`
+}
+
+var dirListTemplate = template.Must(template.New("dirlist").Parse(`<!DOCTYPE HTML>
+<HTML><HEAD>
+  <META name="robots" content="NOINDEX">
+  <TITLE>{{.CollectionName}}{{if not .CollectionName}}{{.CollectionID}}{{end}}/{{.Path}}</TITLE>
+  <STYLE type="text/css">
+    body { margin: 1.5em; font-family: sans-serif; }
+    td { padding: 0 1em 0 0; }
+    td.size { text-align: right; font-family: monospace; }
+    .footer { font-size: 82%; }
+  </STYLE>
+</HEAD>
+<BODY>
+<H1>{{.CollectionName}}{{if not .CollectionName}}{{.CollectionID}}{{end}}/{{.Path}}</H1>
+<TABLE>
+{{if .Path}}<TR><TD><A href="../">../</A></TD><TD></TD></TR>
+{{end}}{{range .Entries}}<TR><TD><A href="{{.Href}}">{{.Name}}{{if eq .Type "directory"}}/{{end}}</A></TD><TD class="size">{{if eq .Type "file"}}{{.Size}}{{end}}</TD></TR>
+{{end}}</TABLE>
+<P class="footer">Collection {{.CollectionID}}</P>
+</BODY>
+</HTML>
+`))
+
+// serveDirectory sends a listing of the given directory in fs: JSON
+// if the client prefers application/json, otherwise HTML. Links in
+// the listing are relative, so they work with all of the URL forms
+// (and tokens) accepted by keep-web.
+//
+// dirname is relative to the collection root, and must be "" or end
+// with "/". If attachment is true, links include
+// "?disposition=attachment" so files are downloaded rather than
+// displayed. The listing gets the same security headers as a file
+// served at the same host name (see setContentHeaders).
+func serveDirectory(w http.ResponseWriter, r *http.Request, fs *collectionFS, collection map[string]interface{}, dirname string, vhost, attachment bool) int {
+	f, err := fs.OpenFile(r.Context(), dirname, os.O_RDONLY, 0)
+	if err != nil {
+		return http.StatusNotFound
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return http.StatusNotFound
+	}
+
+	listing := dirListing{Path: dirname, Entries: []dirListEntry{}}
+	listing.CollectionName, _ = collection["name"].(string)
+	listing.CollectionID, _ = collection["uuid"].(string)
+	if listing.CollectionID == "" {
+		listing.CollectionID, _ = collection["portable_data_hash"].(string)
+	}
+	for _, fi := range fis {
+		ent := dirListEntry{Name: fi.Name(), Type: "file", Size: fi.Size()}
+		href := fi.Name()
+		if dirname == "" && (href == "_" || strings.HasPrefix(href, "t=")) {
+			// Otherwise this name would be mistaken for
+			// the "_" escape or a token.
+			href = "_/" + href
+		}
+		if fi.IsDir() {
+			ent.Type, ent.Size = "directory", 0
+			href += "/"
+		}
+		// Escape the name, and prefix "./" if the name looks
+		// like a URL scheme.
+		ent.Href = (&url.URL{Path: href}).String()
+		if attachment && !fi.IsDir() {
+			ent.Href += "?disposition=attachment"
+		}
+		listing.Entries = append(listing.Entries, ent)
+	}
+
+	setSecurityHeaders(w, vhost)
+	if preferJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(listing)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		dirListTemplate.Execute(w, listing)
+	}
+	return http.StatusOK
+}
+
+// preferJSON returns true if the request's Accept header mentions
+// application/json before text/html.
+func preferJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediatype {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
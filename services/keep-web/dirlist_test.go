@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestServeDirectory(c *check.C) {
+	fs, err := newCollectionFS(&memKeepClient{}, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:t=foo 0:3:_ 0:3:a:b 0:3:<b>x\n./sub\\040dir acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n", time.Now(), true)
+	c.Assert(err, check.IsNil)
+	coll := map[string]interface{}{"uuid": "zzzzz-4zz18-aaaaaaaaaaaaaaa", "name": "test<collection>"}
+
+	req := httptest.NewRequest("GET", "/", nil).WithContext(context.Background())
+	resp := httptest.NewRecorder()
+	c.Check(serveDirectory(resp, req, fs, coll, "", false, false), check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "text/html; charset=utf-8")
+	c.Check(resp.Header().Get("X-Content-Type-Options"), check.Equals, "nosniff")
+	c.Check(resp.Header().Get("Content-Security-Policy"), check.Equals, sharedHostCSP)
+	body := resp.Body.String()
+	c.Check(body, check.Matches, `(?s).*<TITLE>test&lt;collection&gt;/</TITLE>.*`)
+	c.Check(body, check.Matches, `(?s).*<A href="_/t=foo">t=foo</A>.*`)
+	c.Check(body, check.Matches, `(?s).*<A href="_/_">_</A>.*`)
+	c.Check(body, check.Matches, `(?s).*<A href="./a:b">a:b</A>.*`)
+	c.Check(body, check.Matches, `(?s).*<A href="%3Cb%3Ex">&lt;b&gt;x</A>.*`)
+	c.Check(body, check.Matches, `(?s).*<A href="sub%20dir/">sub dir/</A>.*`)
+	c.Check(body, check.Not(check.Matches), `(?s).*\.\./.*`)
+
+	req.Header.Set("Accept", "application/json")
+	resp = httptest.NewRecorder()
+	c.Check(serveDirectory(resp, req, fs, coll, "sub dir/", true, true), check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "application/json")
+	c.Check(resp.Header().Get("X-Content-Type-Options"), check.Equals, "nosniff")
+	c.Check(resp.Header().Get("Content-Security-Policy"), check.Equals, collectionVhostCSP)
+	var listing dirListing
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &listing), check.IsNil)
+	c.Check(listing, check.DeepEquals, dirListing{
+		CollectionID:   "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		CollectionName: "test<collection>",
+		Path:           "sub dir/",
+		Entries: []dirListEntry{
+			{Name: "foo", Type: "file", Size: 3, Href: "foo?disposition=attachment"},
+		},
+	})
+
+	resp = httptest.NewRecorder()
+	c.Check(serveDirectory(resp, req, fs, coll, "nonexistent/", false, false), check.Equals, http.StatusNotFound)
+}
+
+func (s *UnitSuite) TestPreferJSON(c *check.C) {
+	for accept, expect := range map[string]bool{
+		"":                                  false,
+		"application/json":                  true,
+		"text/html,application/json":        false,
+		"application/json;q=0.9, text/html": true,
+		"text/plain, */*":                   false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		c.Check(preferJSON(req), check.Equals, expect, check.Commentf("%q", accept))
+	}
+}
+
+func (s *IntegrationSuite) TestDirectoryListing(c *check.C) {
+	for _, trial := range []struct {
+		host   string
+		path   string
+		accept string
+		status int
+		expect string
+	}{
+		{
+			host:   arvadostest.FooBarDirCollection + ".example.com",
+			path:   "/",
+			status: http.StatusOK,
+			expect: `(?s).*<A href="dir1/">dir1/</A>.*`,
+		},
+		{
+			host:   arvadostest.FooBarDirCollection + ".example.com",
+			path:   "/dir1",
+			status: http.StatusMovedPermanently,
+		},
+		{
+			host:   arvadostest.FooBarDirCollection + ".example.com",
+			path:   "/dir1/",
+			status: http.StatusOK,
+			expect: `(?s).*<A href="foo">foo</A>.*`,
+		},
+		{
+			host:   "collections.example.com",
+			path:   "/c=" + arvadostest.FooBarDirCollection + "/t=" + arvadostest.ActiveToken,
+			status: http.StatusMovedPermanently,
+		},
+		{
+			host:   "collections.example.com",
+			path:   "/c=" + arvadostest.FooBarDirCollection + "/t=" + arvadostest.ActiveToken + "/",
+			status: http.StatusOK,
+			expect: `(?s).*<A href="dir1/">dir1/</A>.*`,
+		},
+		{
+			host:   "collections.example.com",
+			path:   "/c=" + arvadostest.FooBarDirCollection + "/t=" + arvadostest.ActiveToken + "/dir1/",
+			accept: "application/json",
+			status: http.StatusOK,
+			expect: `.*"entries":\[{"name":"bar","type":"file","size":3,"href":"bar"},{"name":"foo".*`,
+		},
+		{
+			host:   arvadostest.FooBarDirCollection + ".example.com",
+			path:   "/dir1/foo/",
+			status: http.StatusNotFound,
+		},
+	} {
+		comment := check.Commentf("%s%s", trial.host, trial.path)
+		u := mustParseURL("http://" + trial.host + trial.path)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header: http.Header{
+				"Authorization": {"OAuth2 " + arvadostest.ActiveToken},
+				"Accept":        {trial.accept},
+			},
+		}
+		resp := httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.status, comment)
+		if trial.status == http.StatusMovedPermanently {
+			c.Check(resp.Header().Get("Location"), check.Equals, trial.path+"/", comment)
+		}
+		if trial.expect != "" {
+			c.Check(resp.Body.String(), check.Matches, trial.expect, comment)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-// Keep-web provides read-only HTTP access to files stored in Keep. It
+// Keep-web provides HTTP and WebDAV access to files stored in Keep. It
 // serves public data to anonymous and unauthenticated clients, and
 // serves private data to clients that supply Arvados API tokens. It
 // can be installed anywhere with access to Keep services, typically
@@ -156,13 +156,221 @@
 // the token stripped from the query string and added to a cookie
 // instead.
 //
+// Range requests
+//
+// Keep-web supports HTTP range requests (RFC 7233), including suffix
+// ("bytes=-500") and open-ended ("bytes=9500-") ranges and requests
+// for multiple ranges, which are answered with a multipart/byteranges
+// response. Only the Keep blocks needed for the requested ranges are
+// retrieved. Each file is sent with a strong ETag, derived from the
+// data blocks and portions of blocks that make up the file, which
+// clients can use in an If-Range header.
+//
 // Indexes
 //
-// Currently, keep-web does not generate HTML index listings, nor does
-// it serve a default file like "index.html" when a directory is
-// requested. These features are likely to be added in future
-// versions. Until then, keep-web responds with 404 if a directory
-// name (or any path ending with "/") is requested.
+// When a directory is requested, keep-web responds with an HTML
+// listing of the files and subdirectories it contains, with sizes and
+// download links. If the request has an "Accept: application/json"
+// header, the listing is sent as JSON instead:
+//
+//   {"collection":"zzzzz-4zz18-znfnqtbbv4spc3w",
+//    "collection_name":"example",
+//    "path":"dir1/",
+//    "entries":[{"name":"foo","type":"file","size":3,"href":"foo"}]}
+//
+// Links in the listing are relative, so they work with any of the URL
+// forms described above. If a directory (including the collection
+// itself, as in /c=ID/t=TOKEN) is requested without a trailing "/",
+// keep-web redirects to the same URL with "/" added.
+//
+// Keep-web does not serve a default file like "index.html" when a
+// directory is requested.
+//
+// Archive downloads
+//
+// A whole collection or directory can be downloaded as a single zip
+// or tar file by adding a "format" parameter ("zip", "tar", or
+// "tar.gz") to the directory URL:
+//
+//   http://collections.example.com/c=uuid_or_pdh/dir1/?format=zip
+//
+// The archive is streamed while data is read from Keep, so large
+// collections start downloading right away. Zip64 and PAX extensions
+// are used where needed for large files. Files are stored without
+// compression in zip archives. Add "checksums=1" to include an
+// MD5SUMS file in md5sum format, and "manifest=1" to include the
+// directory's manifest (without permission signatures) as
+// manifest.txt. The same tokens are accepted as for other
+// downloads.
+//
+// Previews
+//
+// Adding "preview=thumb" to the URL of a PNG, JPEG, or GIF file
+// returns a scaled-down copy of the image, at least "w" pixels wide
+// (default 256, at most 1024). Thumbnails are made in widths of 64,
+// 128, 256, 512, and 1024 pixels, and "w" is rounded up to the next
+// of these. Images are never enlarged. Thumbnails of JPEG files are
+// JPEG images; other thumbnails are PNG images. Images over 25
+// megapixels are rejected, and keep-web makes at most one thumbnail
+// at a time per CPU.
+//
+//   http://collections.example.com/c=uuid_or_pdh/plots/fig1.png?preview=thumb&w=128
+//
+// Adding "preview=head" to the URL of a text file (including CSV,
+// TSV, JSON, and files with no extension that look like text)
+// returns its first "lines" lines (default 100, at most 10000, and
+// at most 1 MiB) as text/plain.
+//
+//   http://collections.example.com/c=uuid_or_pdh/results.tsv?preview=head&lines=20
+//
+// Previews need the same permission as downloading the file. Since
+// file content never changes for a given portable data hash, each
+// generated preview is cached (up to -cache-max-previews entries) and
+// reused for any client that can read the same content.
+//
+// WebDAV
+//
+// Each of the URL forms above (up to and including the collection ID
+// and token, if any) is also the root of a WebDAV share. WebDAV
+// clients like davfs2, Finder and Windows Explorer can list
+// directories (PROPFIND) and, if the token has permission to update
+// the collection, add, copy, move and delete files and directories
+// (PUT, COPY, MOVE, DELETE, MKCOL). For example:
+//
+//   mount -t davfs https://uuid--collections.example.com/ /mnt
+//
+// Most WebDAV clients supply the token as the password for HTTP Basic
+// authentication; the username is ignored.
+//
+// Data written with PUT is stored in new Keep blocks. When a request
+// changes the collection, keep-web saves the new manifest before
+// responding; if that fails, the response status is 403 (the token
+// cannot update the collection), 404 (the collection has been
+// deleted), 409 (conflict), or 502. Collections requested by portable
+// data hash are read-only.
+//
+// Requests that change a collection always start from the current
+// version on the API server, not a cached copy. Locks requested by
+// WebDAV clients are granted but not enforced, and if two clients
+// change the same collection at the same time, the last update wins.
+//
+// Caching
+//
+// Keep-web remembers the result of looking up a collection with a
+// given token for -cache-ttl (default 5 minutes), so a page that
+// loads many files from one collection costs a single API call.
+// Failed lookups (the token is invalid, or cannot read the
+// collection) are remembered for -cache-negative-ttl (default 10
+// seconds). Manifests are cached by token and portable data hash, up
+// to -cache-max-collections entries. As a result, changes made to a
+// collection by other clients can take up to -cache-ttl to become
+// visible, and a token that is revoked can still be used to read
+// recently accessed collections for that long.
+//
+// Keep services are discovered once and refreshed every 5 minutes
+// (or on SIGHUP), rather than on each request.
+//
+// Cache statistics are available at /status.json:
+//
+//   curl https://collections.example.com/status.json
+//   {"Cache":{"Requests":1234,"PermissionHits":1100,"NegativeHits":12,...}}
+//
+// HTTP caching
+//
+// Files and previews are sent with ETag, Last-Modified, and
+// Cache-Control headers, so browsers and caching proxies (like a CDN
+// in front of keep-web) can reuse them, and keep-web answers
+// If-None-Match and If-Modified-Since requests with 304 Not Modified
+// when the client's copy is current.
+//
+// A file in a collection requested by portable data hash never
+// changes, so it is sent with "Cache-Control: max-age=31536000,
+// immutable", and any If-Modified-Since request for it gets a 304
+// response. A file in a collection requested by UUID can be reused
+// for -uuid-max-age (default 1 minute), after which the client must
+// revalidate it.
+//
+// Responses are marked "public" -- i.e., a shared cache may store
+// them and send them to other clients -- only if the token that
+// worked was in the URL or was the anonymous token. Responses to
+// requests authorized by a cookie, an Authorization header, or a
+// share link are marked "private".
+//
+// Share links
+//
+// A share link gives read-only access to a collection, or to one
+// file or directory in it, without putting an API token in the URL.
+// To enable share links, put one or more signing keys in a file and
+// pass it with -share-link-keys:
+//
+//   # key ID, secret
+//   2018a kHc9xcOWGb1TJ4QsNxvrP0tIW3bK2pOa
+//
+// A user who can read a collection can create a link to it:
+//
+//   curl -X POST -H "Authorization: OAuth2 $ARVADOS_API_TOKEN" \
+//     -d collection=zzzzz-4zz18-znfnqtbbv4spc3w -d path=dir1 -d ttl=48h \
+//     https://collections.example.com/share-links
+//   {"expires_at":"2018-02-03T04:05:06Z","id":"5c7a...","path":"/share/eyJpZ....../dir1"}
+//
+// Anyone with the resulting URL (https://collections.example.com
+// followed by the returned path) can download files in
+// zzzzz-4zz18-znfnqtbbv4spc3w/dir1 for the next 48 hours. The link
+// is checked by keep-web alone; the files are read using the
+// ARVADOS_API_TOKEN given to keep-web, so that token must be able to
+// read the collection. Like tokens in "/t=" paths, links are
+// truncated in keep-web's logs.
+//
+// Optional parameters are "path" (default: the whole collection),
+// "ttl" (default 24h, at most -share-link-max-ttl), and "ip" (only
+// clients at the given address can use the link).
+//
+// To revoke a single link, add its ID to the file given with
+// -share-link-deny. To revoke all links signed with a key, remove
+// the key from the -share-link-keys file. New links are signed with
+// the first key in the file, so keys can be rotated by adding a new
+// key at the top, and removing the old key after the old links have
+// expired. Keep-web re-reads both files when it receives SIGHUP.
+//
+// S3 API
+//
+// Keep-web also accepts requests from S3 clients. Use the UUID of an
+// Arvados API token as the access key, the token itself as the
+// secret key, and keep-web's URL as the endpoint:
+//
+//   aws configure set aws_access_key_id zzzzz-gj3su-aaaaaaaaaaaaaaa
+//   aws configure set aws_secret_access_key zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz
+//   aws --endpoint-url https://collections.example.com s3 ls s3://zzzzz-4zz18-znfnqtbbv4spc3w/
+//
+// Keep-web looks up the token by its UUID to check each request's
+// signature, so the token in keep-web's ARVADOS_API_TOKEN environment
+// variable must belong to an admin user. The secret key is never sent
+// to keep-web, and access key IDs and signatures in presigned URLs
+// are truncated in keep-web's logs.
+//
+// A bucket is a collection (UUID, or portable data hash with "-"
+// instead of "+") or a project (UUID). Object keys are file paths
+// in the collection; in a project bucket, the first part of the key
+// is a collection name. Both path-style and virtual-hosted-style
+// (bucket as the first part of the host name, as with collection
+// vhosts) requests are supported.
+//
+// Requests must be signed with AWS Signature Version 4, either in
+// the Authorization header or in a presigned URL (valid for up to 7
+// days).
+//
+// Supported operations are GetObject (including byte ranges),
+// HeadObject, HeadBucket, GetBucketLocation, ListObjects and
+// ListObjectsV2 (with prefix, delimiter and paging), PutObject,
+// DeleteObject, and multipart uploads. Objects can only be written
+// in collections identified by UUID. A key ending in "/" denotes an
+// empty directory.
+//
+// Multipart uploads in progress are kept in memory. If several
+// keep-web processes serve the same endpoint, the requests for a
+// given upload must all reach the same process, e.g., by routing
+// clients to processes by address. Uploads not completed within 24
+// hours are discarded.
 //
 // Compatibility
 //
@@ -213,6 +421,37 @@
 //
 //   keep-web -listen :9999 -attachment-only-host domain.example:9999
 //
+// Inline display
+//
+// The Content-Type of a file is determined by its extension or, if
+// the extension is not recognized, by examining the first 512 bytes
+// of the file.
+//
+// At a host name that is shared by many collections (including
+// "/c=ID/..." URLs, secret links, and share links), files are only
+// displayed inline if their type is listed in -inline-types (by
+// default: common image formats and plain text). Other files are
+// served with "Content-Disposition: attachment". HTML, SVG, XML, and
+// PDF files, which can run scripts in the browser, are always served
+// as attachments at shared host names. These responses also have a
+// Content-Security-Policy header that prevents inline content from
+// running scripts or loading resources from other sites.
+//
+//   keep-web -listen :9999 -inline-types 'image/*,text/plain,video/mp4'
+//
+// At a collection-specific host name ("ID.collections.example.com"),
+// or in trust-all-content mode, any file can be displayed inline.
+// The Content-Security-Policy header given with -collection-vhost-csp
+// is added: the default policy allows HTML reports in a collection
+// to use scripts, styles, and images from the same collection, but
+// not to load anything from (or send anything to) other sites. Use
+// -collection-vhost-csp="" to omit the header.
+//
+// All file downloads have an "X-Content-Type-Options: nosniff"
+// header, so browsers don't interpret a file as a different type.
+// Directory listings get the same headers, including the
+// Content-Security-Policy header, as files at the same host name.
+//
 // Trust All Content mode
 //
 // In "trust all content" mode, Keep-web will accept credentials (API
@@ -5,21 +5,25 @@ import (
 	"fmt"
 	"html"
 	"io"
-	"mime"
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/auditlog"
 	"git.curoverse.com/arvados.git/sdk/go/auth"
 	"git.curoverse.com/arvados.git/sdk/go/httpserver"
 	"git.curoverse.com/arvados.git/sdk/go/keepclient"
 )
 
-type handler struct{}
+type handler struct {
+	cache cache
+	s3    s3State
+}
 
 var (
 	clientPool         = arvadosclient.MakeClientPool()
@@ -79,6 +83,10 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		remoteAddr = xff + "," + remoteAddr
 	}
 
+	// auditEvent is filled in once we know which collection is
+	// being accessed.
+	var auditEvent *auditlog.Event
+
 	w := httpserver.WrapResponseWriter(wOrig)
 	defer func() {
 		if statusCode == 0 {
@@ -89,13 +97,19 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 			httpserver.Log(r.RemoteAddr, "WARNING",
 				fmt.Sprintf("Our status changed from %d to %d after we sent headers", w.WroteStatus(), statusCode))
 		}
-		if statusText == "" {
-			statusText = http.StatusText(statusCode)
+		if statusText != "" {
+			// The request itself is logged by
+			// httpserver.LogRequests.
+			httpserver.LogDetail(r.Context(), "status_text", statusText)
+		}
+		if auditEvent != nil {
+			auditEvent.Status = statusCode
+			auditEvent.Bytes = int64(w.WroteBodyBytes())
+			audit.Log(*auditEvent)
 		}
-		httpserver.Log(remoteAddr, statusCode, statusText, w.WroteBodyBytes(), r.Method, r.Host, r.URL.Path, r.URL.RawQuery)
 	}()
 
-	if r.Method != "GET" && r.Method != "POST" {
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "POST" && !webdavMethods[r.Method] {
 		statusCode, statusText = http.StatusMethodNotAllowed, r.Method
 		return
 	}
@@ -116,6 +130,13 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	}
 	defer clientPool.Put(arv)
 
+	if isS3Request(r) {
+		s3req := &s3Request{h: h, w: w, r: r, arv: arv, remoteAddr: remoteAddr}
+		statusText = s3req.serve()
+		auditEvent = s3req.auditEvent
+		return
+	}
+
 	pathParts := strings.Split(r.URL.Path[1:], "/")
 
 	var targetID string
@@ -124,7 +145,12 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	var reqTokens []string
 	var pathToken bool
 	var attachment bool
+	var link *shareLink
 	credentialsOK := trustAllContent
+	// vhost is true if content served here can only affect one
+	// collection (or the operator doesn't mind if it affects
+	// others), so any file type can be displayed inline.
+	vhost := trustAllContent
 
 	if r.Host != "" && r.Host == attachmentOnlyHost {
 		credentialsOK = true
@@ -136,6 +162,7 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	if targetID = parseCollectionIDFromDNSName(r.Host); targetID != "" {
 		// http://ID.collections.example/PATH...
 		credentialsOK = true
+		vhost = true
 		targetPath = pathParts
 	} else if len(pathParts) >= 2 && strings.HasPrefix(pathParts[0], "c=") {
 		// /c=ID/PATH...
@@ -154,6 +181,24 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 			tokens = anonymousTokens
 			targetPath = pathParts[2:]
 		}
+	} else if len(pathParts) >= 2 && pathParts[0] == "share" {
+		// /share/LINK/PATH...
+		var err error
+		link, err = shareLinks.verify(pathParts[1], time.Now(), clientIP(r))
+		if err != nil {
+			statusCode, statusText = http.StatusNotFound, err.Error()
+			return
+		}
+		targetID = link.Collection
+		tokens = []string{shareLinks.token}
+		targetPath = pathParts[2:]
+		pathToken = true
+	} else if r.URL.Path == "/status.json" {
+		h.serveStatus(w, r)
+		return
+	} else if r.URL.Path == "/share-links" {
+		statusCode, statusText = h.serveShareLinkRequest(w, r, arv)
+		return
 	} else {
 		statusCode = http.StatusNotFound
 		return
@@ -259,11 +304,23 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		targetPath = targetPath[1:]
 	}
 
+	// The part of the URL path that identifies the collection
+	// (and token, if any) is the WebDAV root.
+	webdavPrefix := "/" + strings.Join(pathParts[:len(pathParts)-len(targetPath)], "/")
+	if webdavPrefix == "/" {
+		webdavPrefix = ""
+	}
+
+	// WebDAV write methods must start with the current version
+	// of the collection, not a cached one.
+	forceReload := webdavWriteMethods[r.Method]
+
 	tokenResult := make(map[string]int)
-	collection := make(map[string]interface{})
+	var collection map[string]interface{}
 	found := false
 	for _, arv.ApiToken = range tokens {
-		err := arv.Get("collections", targetID, nil, &collection)
+		var err error
+		collection, err = h.cache.Get(r.Context(), arv, targetID, forceReload)
 		if err == nil {
 			// Success
 			found = true
@@ -315,18 +372,52 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	}
 
 	filename := strings.Join(targetPath, "/")
-	kc, err := keepclient.MakeKeepClient(arv)
+	if link != nil && !link.allows(filename) {
+		statusCode = http.StatusNotFound
+		return
+	}
+
+	if audit != nil {
+		// A request refused because the audit log isn't
+		// working is not logged there.
+		if err := audit.Ready(); err != nil {
+			statusCode, statusText = http.StatusServiceUnavailable, "Audit log unavailable: "+err.Error()
+			return
+		}
+		auditEvent = &auditlog.Event{
+			Service:    "keep-web",
+			Method:     r.Method,
+			UserUUID:   userUUIDForToken(arv),
+			Path:       filename,
+			Range:      r.Header.Get("Range"),
+			RemoteAddr: remoteAddr,
+			UserAgent:  r.UserAgent(),
+		}
+		auditEvent.CollectionUUID, _ = collection["uuid"].(string)
+		auditEvent.PortableDataHash, _ = collection["portable_data_hash"].(string)
+	}
+
+	kc, err := keepClientForToken(arv)
 	if err != nil {
 		statusCode, statusText = http.StatusInternalServerError, err.Error()
 		return
 	}
-	if kc.Client != nil && kc.Client.Transport != nil {
-		// Workaround for https://dev.arvados.org/issues/9005
-		if t, ok := kc.Client.Transport.(*http.Transport); ok {
-			defer t.CloseIdleConnections()
-		}
+
+	if webdavMethods[r.Method] {
+		token := arv.ApiToken
+		serveWebDAV(w, r, arv, kc, collection, webdavPrefix, link == nil && collectionWritable(arv, targetID, collection), func(updated map[string]interface{}) {
+			h.cache.Update(token, targetID, updated)
+		})
+		return
+	}
+
+	fs, err := collectionFSForRecord(kc, collection, true)
+	if err != nil {
+		statusCode, statusText = http.StatusBadGateway, err.Error()
+		return
 	}
-	rdr, err := kc.CollectionFileReader(collection, filename)
+	// Stop fetching blocks from Keep if the client disconnects.
+	f, err := fs.OpenFile(r.Context(), filename, os.O_RDONLY, 0)
 	if os.IsNotExist(err) {
 		statusCode = http.StatusNotFound
 		return
@@ -334,53 +425,149 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		statusCode, statusText = http.StatusBadGateway, err.Error()
 		return
 	}
-	defer rdr.Close()
-
-	basenamePos := strings.LastIndex(filename, "/")
-	if basenamePos < 0 {
-		basenamePos = 0
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		statusCode, statusText = http.StatusBadGateway, err.Error()
+		return
 	}
-	extPos := strings.LastIndex(filename, ".")
-	if extPos > basenamePos {
-		// Now extPos is safely >= 0.
-		if t := mime.TypeByExtension(filename[extPos:]); t != "" {
-			w.Header().Set("Content-Type", t)
+	if fi.IsDir() {
+		if r.FormValue("format") != "" {
+			var err error
+			statusCode, err = serveArchive(w, r, fs, collection, filename)
+			if err != nil {
+				statusText = err.Error()
+			}
+			return
 		}
-	}
-	if rdr, ok := rdr.(keepclient.ReadCloserWithLen); ok {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", rdr.Len()))
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// Relative links in the listing only work if
+			// the URL ends with "/". This includes the
+			// collection root, e.g., /c=ID/t=TOKEN.
+			redir := (&url.URL{Path: r.URL.Path + "/", RawQuery: r.URL.RawQuery}).String()
+			w.Header().Set("Location", redir)
+			statusCode, statusText = http.StatusMovedPermanently, redir
+			return
+		}
+		statusCode = serveDirectory(w, r, fs, collection, filename, vhost, attachment)
+		return
+	} else if strings.HasSuffix(filename, "/") {
+		statusCode = http.StatusNotFound
+		return
 	}
 
-	applyContentDispositionHdr(w, r, filename[basenamePos:], attachment)
-	rangeRdr, statusCode := applyRangeHdr(w, r, rdr)
+	// Content addressed by PDH never changes. Shared caches may
+	// store the response only if anyone with the URL could get
+	// it -- i.e., the token that worked was in the URL or
+	// anonymous.
+	immutable := arvadosclient.PDHMatch(targetID)
+	public := link == nil && (pathToken || anonymousTokens.contains(arv.ApiToken))
+	cc := cacheControl(immutable, public)
 
-	w.WriteHeader(statusCode)
-	_, err = io.Copy(w, rangeRdr)
-	if err != nil {
+	if r.FormValue("preview") != "" {
+		statusCode, statusText = h.servePreview(w, r, f, fi, collection, filename, cc)
+		return
+	}
+
+	w.Header().Set("Cache-Control", cc)
+	if etag := fi.(*cfsFileInfo).etag; etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if immutable && immutableNotModified(w, r) {
+		// No need to sniff the content type.
+		statusCode = http.StatusNotModified
+		return
+	}
+	if err := setContentHeaders(w, r, f, filename, vhost, attachment); err != nil {
 		statusCode, statusText = http.StatusBadGateway, err.Error()
+		return
+	}
+	if rng := r.Header.Get("Range"); rng != "" && !strings.HasPrefix(rng, "bytes=") {
+		// RFC 7233 3.1: "An origin server MUST ignore a
+		// Range header field that contains a range unit it
+		// does not understand."
+		r.Header.Del("Range")
+	} else if rangeOverflows(rng) {
+		// A range that doesn't fit in an int64 can't be
+		// served as requested, but the whole file can.
+		r.Header.Del("Range")
 	}
-}
 
-var rangeRe = regexp.MustCompile(`^bytes=0-([0-9]*)$`)
+	// ServeContent handles Range, If-Range, conditional
+	// requests, and multipart responses, seeking to each
+	// requested range.
+	rdr := &readErrRecorder{ReadSeeker: f}
+	http.ServeContent(w, r, filename, fi.ModTime(), rdr)
+	if rdr.err != nil {
+		statusText = rdr.err.Error()
+	}
+}
 
-func applyRangeHdr(w http.ResponseWriter, r *http.Request, rdr keepclient.ReadCloserWithLen) (io.Reader, int) {
-	w.Header().Set("Accept-Ranges", "bytes")
-	hdr := r.Header.Get("Range")
-	fields := rangeRe.FindStringSubmatch(hdr)
-	if fields == nil {
-		return rdr, http.StatusOK
+// rangeOverflows returns true if any byte position in the given
+// "bytes=..." Range header value is too big to parse as an int64.
+func rangeOverflows(rng string) bool {
+	for _, spec := range strings.Split(strings.TrimPrefix(rng, "bytes="), ",") {
+		for _, pos := range strings.SplitN(spec, "-", 2) {
+			pos = strings.TrimSpace(pos)
+			if pos == "" {
+				continue
+			}
+			if _, err := strconv.ParseInt(pos, 10, 64); err != nil && err.(*strconv.NumError).Err == strconv.ErrRange {
+				return true
+			}
+		}
 	}
-	rangeEnd, err := strconv.ParseInt(fields[1], 10, 64)
-	if err != nil {
-		// Empty or too big for int64 == send entire content
-		return rdr, http.StatusOK
+	return false
+}
+
+var (
+	sharedKeepClient    *keepclient.KeepClient
+	sharedKeepClientMtx sync.Mutex
+)
+
+// keepClientForToken returns a KeepClient that uses arv's API
+// token. All requests share one list of Keep services, which is
+// discovered when first needed and refreshed in the background after
+// that. Discovery uses the ARVADOS_API_TOKEN environment variable if
+// it works, otherwise arv's token.
+func keepClientForToken(arv *arvadosclient.ArvadosClient) (*keepclient.KeepClient, error) {
+	sharedKeepClientMtx.Lock()
+	defer sharedKeepClientMtx.Unlock()
+	if sharedKeepClient == nil {
+		// Use a copy, so the shared client's token doesn't
+		// change when arv goes back to the pool.
+		discoveryArv := *arv
+		var kc *keepclient.KeepClient
+		var err error
+		for _, discoveryArv.ApiToken = range []string{os.Getenv("ARVADOS_API_TOKEN"), arv.ApiToken} {
+			kc, err = keepclient.MakeKeepClient(&discoveryArv)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		go kc.RefreshServices(5*time.Minute, 3*time.Second)
+		sharedKeepClient = kc
 	}
-	if uint64(rangeEnd) >= rdr.Len() {
-		return rdr, http.StatusOK
+	return sharedKeepClient.Clone(arv), nil
+}
+
+// readErrRecorder remembers the first error (other than io.EOF)
+// returned by Read, so it can be logged. http.ServeContent doesn't
+// report it.
+type readErrRecorder struct {
+	io.ReadSeeker
+	err error
+}
+
+func (rer *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := rer.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF && rer.err == nil {
+		rer.err = err
 	}
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", rangeEnd+1))
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", 0, rangeEnd, rdr.Len()))
-	return &io.LimitedReader{R: rdr, N: rangeEnd + 1}, http.StatusPartialContent
+	return n, err
 }
 
 func applyContentDispositionHdr(w http.ResponseWriter, r *http.Request, filename string, isAttachment bool) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"html"
 	"io/ioutil"
 	"net/http"
@@ -363,39 +364,76 @@ func (s *IntegrationSuite) TestRange(c *check.C) {
 		Host:       u.Host,
 		URL:        u,
 		RequestURI: u.RequestURI(),
-		Header:     http.Header{"Range": {"bytes=0-4"}},
+		Header:     http.Header{},
 	}
 	resp := httptest.NewRecorder()
 	(&handler{}).ServeHTTP(resp, req)
-	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
-	c.Check(resp.Body.String(), check.Equals, "Hello")
-	c.Check(resp.Header().Get("Content-Length"), check.Equals, "5")
-	c.Check(resp.Header().Get("Content-Range"), check.Equals, "bytes 0-4/12")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Accept-Ranges"), check.Equals, "bytes")
+	etag := resp.Header().Get("ETag")
+	c.Check(etag, check.Matches, `"[0-9a-f]{32}"`)
+
+	for _, trial := range []struct {
+		hdr          string
+		body         string
+		contentRange string
+	}{
+		{"bytes=0-4", "Hello", "bytes 0-4/12"},
+		{"bytes=0-", "Hello world\n", "bytes 0-11/12"},
+		{"bytes=5-5", " ", "bytes 5-5/12"},
+		{"bytes=6-", "world\n", "bytes 6-11/12"},
+		{"bytes=-6", "world\n", "bytes 6-11/12"},
+		{"bytes=6-100", "world\n", "bytes 6-11/12"},
+	} {
+		req.Header.Set("Range", trial.hdr)
+		resp = httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusPartialContent, check.Commentf("%s", trial.hdr))
+		c.Check(resp.Body.String(), check.Equals, trial.body)
+		c.Check(resp.Header().Get("Content-Length"), check.Equals, fmt.Sprintf("%d", len(trial.body)))
+		c.Check(resp.Header().Get("Content-Range"), check.Equals, trial.contentRange)
+	}
 
-	req.Header.Set("Range", "bytes=0-")
+	// Multiple ranges
+	req.Header.Set("Range", "bytes=0-0,6-6")
 	resp = httptest.NewRecorder()
 	(&handler{}).ServeHTTP(resp, req)
-	// 200 and 206 are both correct:
-	c.Check(resp.Code, check.Equals, http.StatusOK)
-	c.Check(resp.Body.String(), check.Equals, "Hello world\n")
-	c.Check(resp.Header().Get("Content-Length"), check.Equals, "12")
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	c.Check(resp.Header().Get("Content-Type"), check.Matches, `multipart/byteranges; boundary=.*`)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*Content-Range: bytes 0-0/12\r\n(Content-Type: [^\r]*\r\n)?\r\nH\r\n--.*Content-Range: bytes 6-6/12\r\n(Content-Type: [^\r]*\r\n)?\r\nw\r\n--.*`)
 
-	// Unsupported ranges are ignored
+	// Unsatisfiable ranges
 	for _, hdr := range []string{
-		"bytes=5-5",  // non-zero start byte
-		"bytes=-5",   // last 5 bytes
-		"cubits=0-5", // unsupported unit
-		"bytes=0-340282366920938463463374607431768211456", // 2^128
+		"bytes=12-20",
 	} {
 		req.Header.Set("Range", hdr)
 		resp = httptest.NewRecorder()
 		(&handler{}).ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusRequestedRangeNotSatisfiable, check.Commentf("%s", hdr))
+	}
+
+	// Unsupported units are ignored, and so are ranges that
+	// overflow or depend on a stale ETag
+	for _, hdr := range []http.Header{
+		{"Range": {"cubits=0-5"}},
+		{"Range": {"bytes=0-340282366920938463463374607431768211456"}}, // 2^128
+		{"Range": {"bytes=0-4"}, "If-Range": {`"0123456789abcdef0123456789abcdef"`}},
+	} {
+		req.Header = hdr
+		resp = httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, req)
 		c.Check(resp.Code, check.Equals, http.StatusOK)
 		c.Check(resp.Body.String(), check.Equals, "Hello world\n")
 		c.Check(resp.Header().Get("Content-Length"), check.Equals, "12")
 		c.Check(resp.Header().Get("Content-Range"), check.Equals, "")
-		c.Check(resp.Header().Get("Accept-Ranges"), check.Equals, "bytes")
 	}
+
+	// If-Range with the current ETag
+	req.Header = http.Header{"Range": {"bytes=0-4"}, "If-Range": {etag}}
+	resp = httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	c.Check(resp.Body.String(), check.Equals, "Hello")
 }
 
 // XHRs can't follow redirect-with-cookie so they rely on method=POST
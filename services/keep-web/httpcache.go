@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var uuidMaxAge = time.Minute
+
+func init() {
+	flag.DurationVar(&uuidMaxAge, "uuid-max-age", uuidMaxAge,
+		"How long browsers and proxies may reuse a file downloaded from a collection identified by UUID, before checking whether it has changed. Files in a collection identified by portable data hash never change, and can be reused indefinitely.")
+}
+
+// Maximum age for responses that never change (RFC 8246 suggests
+// one year).
+const immutableMaxAge = 365 * 24 * time.Hour
+
+// cacheControl returns a Cache-Control header for a file download.
+// If immutable is true, the response can be reused indefinitely.
+// If public is false, the response depends on credentials that
+// aren't in the URL, so shared caches (like a CDN) must not store
+// it.
+func cacheControl(immutable, public bool) string {
+	scope := "private"
+	if public {
+		scope = "public"
+	}
+	if immutable {
+		return fmt.Sprintf("%s, max-age=%d, immutable", scope, int(immutableMaxAge.Seconds()))
+	}
+	return fmt.Sprintf("%s, max-age=%d, must-revalidate", scope, int(uuidMaxAge.Seconds()))
+}
+
+// immutableNotModified responds 304 to a conditional GET or HEAD
+// request for immutable content, and returns true, if the client
+// has a copy of the content. With an If-None-Match header, that
+// depends on the ETag (which http.ServeContent checks), but any
+// If-Modified-Since date means the client has the same content we
+// would send -- even if it came from a different collection record
+// with the same portable data hash and a different modification
+// time.
+func immutableNotModified(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Range") != "" {
+		return false
+	}
+	if _, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil {
+		return false
+	}
+	// RFC 7232 4.1: a 304 response doesn't describe a
+	// representation (http.ServeContent does the same).
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
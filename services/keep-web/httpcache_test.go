@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestCacheControl(c *check.C) {
+	defer func(orig time.Duration) { uuidMaxAge = orig }(uuidMaxAge)
+	uuidMaxAge = 90 * time.Second
+	c.Check(cacheControl(true, true), check.Equals, "public, max-age=31536000, immutable")
+	c.Check(cacheControl(true, false), check.Equals, "private, max-age=31536000, immutable")
+	c.Check(cacheControl(false, true), check.Equals, "public, max-age=90, must-revalidate")
+	c.Check(cacheControl(false, false), check.Equals, "private, max-age=90, must-revalidate")
+}
+
+func (s *UnitSuite) TestImmutableNotModified(c *check.C) {
+	lastYear := time.Now().AddDate(-1, 0, 0).UTC().Format(http.TimeFormat)
+	for _, trial := range []struct {
+		method string
+		header http.Header
+		expect bool
+	}{
+		{"GET", http.Header{}, false},
+		{"GET", http.Header{"If-Modified-Since": {lastYear}}, true},
+		{"HEAD", http.Header{"If-Modified-Since": {lastYear}}, true},
+		{"GET", http.Header{"If-Modified-Since": {"garbage"}}, false},
+		{"PUT", http.Header{"If-Modified-Since": {lastYear}}, false},
+		// If-None-Match takes precedence, and depends on the ETag
+		{"GET", http.Header{"If-Modified-Since": {lastYear}, "If-None-Match": {`"abc"`}}, false},
+		{"GET", http.Header{"If-Modified-Since": {lastYear}, "If-Range": {`"abc"`}}, false},
+	} {
+		c.Logf("%+v", trial)
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", "text/plain")
+		r := &http.Request{Method: trial.method, Header: trial.header}
+		c.Check(immutableNotModified(w, r), check.Equals, trial.expect)
+		if trial.expect {
+			c.Check(w.Code, check.Equals, http.StatusNotModified)
+			c.Check(w.Header().Get("Content-Type"), check.Equals, "")
+		}
+	}
+}
+
+func (s *IntegrationSuite) TestCacheHeaders(c *check.C) {
+	for _, trial := range []struct {
+		host         string
+		path         string
+		token        string
+		cacheControl string
+	}{
+		{arvadostest.FooPdh + ".example.com", "/foo", arvadostest.ActiveToken, "private, max-age=31536000, immutable"},
+		{arvadostest.FooCollection + ".example.com", "/foo", arvadostest.ActiveToken, "private, max-age=60, must-revalidate"},
+		{"collections.example.com", "/c=" + strings.Replace(arvadostest.FooPdh, "+", "-", -1) + "/t=" + arvadostest.ActiveToken + "/foo", "", "public, max-age=31536000, immutable"},
+		{"collections.example.com", "/c=" + arvadostest.FooCollection + "/t=" + arvadostest.ActiveToken + "/foo", "", "public, max-age=60, must-revalidate"},
+	} {
+		c.Logf("%+v", trial)
+		u := mustParseURL("http://" + trial.host + trial.path)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{},
+		}
+		if trial.token != "" {
+			req.Header.Set("Authorization", "OAuth2 "+trial.token)
+		}
+		resp := httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Body.String(), check.Equals, "foo")
+		c.Check(resp.Header().Get("Cache-Control"), check.Equals, trial.cacheControl)
+		c.Check(resp.Header().Get("Last-Modified"), check.Not(check.Equals), "")
+		etag := resp.Header().Get("ETag")
+		c.Check(etag, check.Not(check.Equals), "")
+
+		req.Header.Set("If-None-Match", etag)
+		resp = httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusNotModified)
+		c.Check(resp.Body.Len(), check.Equals, 0)
+		c.Check(resp.Header().Get("Cache-Control"), check.Equals, trial.cacheControl)
+
+		// Any If-Modified-Since date means the client already
+		// has the content of a PDH-addressed file.
+		req.Header.Del("If-None-Match")
+		req.Header.Set("If-Modified-Since", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat))
+		resp = httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, req)
+		if strings.Contains(trial.cacheControl, "immutable") {
+			c.Check(resp.Code, check.Equals, http.StatusNotModified)
+		} else {
+			c.Check(resp.Code, check.Equals, http.StatusOK)
+		}
+	}
+}
+
+func (s *IntegrationSuite) TestCacheHeadersAnonymous(c *check.C) {
+	defer func(orig tokenSet) { anonymousTokens = orig }(anonymousTokens)
+	anonymousTokens = tokenSet{arvadostest.ActiveToken}
+	u := mustParseURL("http://collections.example.com/c=" + arvadostest.FooCollection + "/foo")
+	req := &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header:     http.Header{},
+	}
+	resp := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Cache-Control"), check.Equals, "public, max-age=60, must-revalidate")
+}
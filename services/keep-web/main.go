@@ -4,6 +4,11 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
 )
 
 func init() {
@@ -22,11 +27,32 @@ func main() {
 	if os.Getenv("ARVADOS_API_HOST") == "" {
 		log.Fatal("ARVADOS_API_HOST environment variable must be set.")
 	}
+	var err error
+	audit, err = auditConfig.NewLogger(arvados.NewClientFromEnv())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer audit.Close()
+
+	if err := shareLinks.load(); err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		gotHUP := make(chan os.Signal, 1)
+		signal.Notify(gotHUP, syscall.SIGHUP)
+		for range gotHUP {
+			if err := shareLinks.load(); err != nil {
+				log.Printf("error reloading share link keys: %s", err)
+			}
+		}
+	}()
+
 	srv := &server{}
 	if err := srv.Start(); err != nil {
 		log.Fatal(err)
 	}
 	log.Println("Listening at", srv.Addr)
+	srv.DrainOnSignal(0, time.Minute)
 	if err := srv.Wait(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	previewDefaultWidth = 256
+	previewMaxWidth     = 1024
+	// Largest part of an image file we read to find out its
+	// size, before deciding whether to read the rest.
+	previewMaxConfigSize = 1 << 20
+	// Largest image file we will read to make a thumbnail.
+	previewMaxImageSize = 32 << 20
+	// Largest image (in pixels) we will decode.
+	previewMaxPixels = 25000000
+
+	previewDefaultLines = 100
+	previewMaxLines     = 10000
+	// Largest text head we will return, regardless of the number
+	// of lines requested.
+	previewMaxHeadSize = 1 << 20
+)
+
+var (
+	errPreviewUnsupported = errors.New("no preview available for this file type")
+	errPreviewTooLarge    = errors.New("file is too large to preview")
+
+	// Thumbnail widths. A requested width is rounded up to the
+	// next one, so a few cached thumbnails of each image serve
+	// all requests.
+	previewWidths = []int{64, 128, 256, 512, previewMaxWidth}
+
+	// Limits the number of thumbnails being made at once. Each
+	// one can use previewMaxImageSize bytes, plus a decoded image
+	// of up to previewMaxPixels pixels, and a CPU for a while.
+	thumbnailSlots = make(chan struct{}, runtime.NumCPU())
+)
+
+// A preview is a generated thumbnail or text head.
+type preview struct {
+	contentType string
+	data        []byte
+}
+
+// servePreview responds to a "?preview=thumb" or "?preview=head"
+// request for the file f. The caller must have checked that the
+// client can read the collection. A successful response carries the
+// given Cache-Control header, and an ETag derived from the file's
+// ETag and the preview parameters.
+func (h *handler) servePreview(w http.ResponseWriter, r *http.Request, f io.ReadSeeker, fi os.FileInfo, collection map[string]interface{}, filename string, cacheControl string) (int, string) {
+	// Remember read errors, so we can report a Keep problem as
+	// such instead of blaming the file format.
+	rdr := &readErrRecorder{ReadSeeker: f}
+	var params string
+	var build func() (*preview, error)
+	switch r.FormValue("preview") {
+	case "thumb":
+		width, err := previewParam(r, "w", previewDefaultWidth, previewMaxWidth)
+		if err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		if fi.Size() > previewMaxImageSize {
+			return http.StatusUnprocessableEntity, errPreviewTooLarge.Error()
+		}
+		width = snapPreviewWidth(width)
+		params = "thumb " + strconv.Itoa(width)
+		build = func() (*preview, error) {
+			select {
+			case thumbnailSlots <- struct{}{}:
+				defer func() { <-thumbnailSlots }()
+			case <-r.Context().Done():
+				return nil, r.Context().Err()
+			}
+			return makeThumbnail(rdr, width)
+		}
+	case "head":
+		lines, err := previewParam(r, "lines", previewDefaultLines, previewMaxLines)
+		if err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		ctype, err := detectContentType(rdr, filename)
+		if err != nil {
+			return http.StatusBadGateway, err.Error()
+		}
+		if !isTextType(ctype) {
+			return http.StatusUnsupportedMediaType, errPreviewUnsupported.Error()
+		}
+		params = "head " + strconv.Itoa(lines)
+		build = func() (*preview, error) { return makeHead(rdr, lines) }
+	default:
+		return http.StatusBadRequest, "preview must be \"thumb\" or \"head\""
+	}
+
+	pdh, _ := collection["portable_data_hash"].(string)
+	key := pdh + "\000" + path.Clean("/"+filename) + "\000" + params
+	p, ok := h.cache.GetPreview(key)
+	if !ok {
+		var err error
+		p, err = build()
+		switch {
+		case rdr.err != nil:
+			return http.StatusBadGateway, rdr.err.Error()
+		case err == errPreviewTooLarge:
+			return http.StatusUnprocessableEntity, err.Error()
+		case err == errPreviewUnsupported:
+			return http.StatusUnsupportedMediaType, err.Error()
+		case err != nil:
+			return http.StatusInternalServerError, err.Error()
+		}
+		h.cache.AddPreview(key, p)
+	}
+	w.Header().Set("Content-Type", p.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", cacheControl)
+	if cfi, ok := fi.(*cfsFileInfo); ok && cfi.etag != "" {
+		// "etag" -> "etag-thumb256"
+		w.Header().Set("ETag", strings.TrimSuffix(cfi.etag, `"`)+"-"+strings.Replace(params, " ", "", -1)+`"`)
+	}
+	// ServeContent handles conditional requests, and ranges
+	// (which a client might reasonably use to resume a large
+	// head).
+	http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(p.data))
+	return 0, ""
+}
+
+// previewParam returns the value of an integer form parameter
+// between 1 and max.
+func previewParam(r *http.Request, name string, def, max int) (int, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > max {
+		return 0, errors.New(name + " must be an integer between 1 and " + strconv.Itoa(max))
+	}
+	return n, nil
+}
+
+// snapPreviewWidth returns the smallest of previewWidths that is at
+// least width.
+func snapPreviewWidth(width int) int {
+	for _, w := range previewWidths {
+		if w >= width {
+			return w
+		}
+	}
+	return previewMaxWidth
+}
+
+// makeThumbnail returns a PNG or JPEG image (depending on the
+// original format) no wider than width. Images with too many pixels
+// are rejected after reading only their headers.
+func makeThumbnail(rdr io.Reader, width int) (*preview, error) {
+	rdr = io.LimitReader(rdr, previewMaxImageSize+1)
+	var head bytes.Buffer
+	cfg, format, err := image.DecodeConfig(io.TeeReader(io.LimitReader(rdr, previewMaxConfigSize), &head))
+	if err != nil {
+		return nil, errPreviewUnsupported
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > previewMaxPixels {
+		return nil, errPreviewTooLarge
+	}
+	data, err := ioutil.ReadAll(io.MultiReader(&head, rdr))
+	if err != nil {
+		return nil, err
+	} else if len(data) > previewMaxImageSize {
+		return nil, errPreviewTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errPreviewUnsupported
+	}
+	thumb := resizeImage(img, width)
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		return &preview{contentType: "image/jpeg", data: buf.Bytes()}, err
+	}
+	err = png.Encode(&buf, thumb)
+	return &preview{contentType: "image/png", data: buf.Bytes()}, err
+}
+
+// resizeImage scales src down to the given width, preserving the
+// aspect ratio. Each output pixel is the average of the source
+// pixels it covers. Images that are already small enough are
+// returned unchanged.
+func resizeImage(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw <= width {
+		return src
+	}
+	height := sh * width / sw
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	// Source rows are converted one at a time, and added to the
+	// sums for the output row they belong to.
+	row := make([]uint32, 4*sw)
+	sum := make([]uint64, 4*width)
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		for i := range sum {
+			sum[i] = 0
+		}
+		for sy := y0; sy < y1; sy++ {
+			readRow(src, b.Min.Y+sy, row)
+			for x := 0; x < width; x++ {
+				for sx := x * sw / width; sx < (x+1)*sw/width; sx++ {
+					for i := 0; i < 4; i++ {
+						sum[4*x+i] += uint64(row[4*sx+i])
+					}
+				}
+			}
+		}
+		pix := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			n := uint64(y1-y0) * uint64((x+1)*sw/width-x*sw/width)
+			for i := 0; i < 4; i++ {
+				pix[4*x+i] = uint8(sum[4*x+i] / n >> 8)
+			}
+		}
+	}
+	return dst
+}
+
+// readRow stores the alpha-premultiplied 16-bit RGBA values of the
+// pixels in row y of src in row. The common decoded image types are
+// read directly, which is much faster than calling At for each
+// pixel.
+func readRow(src image.Image, y int, row []uint32) {
+	b := src.Bounds()
+	switch src := src.(type) {
+	case *image.RGBA:
+		pix := src.Pix[src.PixOffset(b.Min.X, y):]
+		for i := range row {
+			row[i] = uint32(pix[i]) * 0x101
+		}
+	case *image.NRGBA:
+		pix := src.Pix[src.PixOffset(b.Min.X, y):]
+		for i := 0; i < len(row); i += 4 {
+			row[i], row[i+1], row[i+2], row[i+3] = color.NRGBA{pix[i], pix[i+1], pix[i+2], pix[i+3]}.RGBA()
+		}
+	case *image.YCbCr:
+		for x := 0; x < len(row)/4; x++ {
+			yi, ci := src.YOffset(b.Min.X+x, y), src.COffset(b.Min.X+x, y)
+			row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = color.YCbCr{src.Y[yi], src.Cb[ci], src.Cr[ci]}.RGBA()
+		}
+	case *image.Gray:
+		pix := src.Pix[src.PixOffset(b.Min.X, y):]
+		for x := 0; x < len(row)/4; x++ {
+			v := uint32(pix[x]) * 0x101
+			row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = v, v, v, 0xffff
+		}
+	case *image.Paletted:
+		// Convert each palette entry once, not once per
+		// pixel.
+		pal := make([][4]uint32, len(src.Palette))
+		for i, c := range src.Palette {
+			pal[i][0], pal[i][1], pal[i][2], pal[i][3] = c.RGBA()
+		}
+		pix := src.Pix[src.PixOffset(b.Min.X, y):]
+		for x := 0; x < len(row)/4; x++ {
+			if int(pix[x]) < len(pal) {
+				copy(row[4*x:4*x+4], pal[pix[x]][:])
+			} else {
+				row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = 0, 0, 0, 0
+			}
+		}
+	default:
+		for x := 0; x < len(row)/4; x++ {
+			row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = src.At(b.Min.X+x, y).RGBA()
+		}
+	}
+}
+
+// isTextType returns true if a file of the given media type can be
+// previewed as text.
+func isTextType(ctype string) bool {
+	mtype, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mtype, "text/") ||
+		strings.HasSuffix(mtype, "/json") || strings.HasSuffix(mtype, "+json") ||
+		strings.HasSuffix(mtype, "/xml") || strings.HasSuffix(mtype, "+xml") ||
+		mtype == "application/javascript" || mtype == "application/x-yaml"
+}
+
+// makeHead returns the first lines of a text file, up to
+// previewMaxHeadSize bytes.
+func makeHead(rdr io.Reader, lines int) (*preview, error) {
+	br := bufio.NewReader(io.LimitReader(rdr, previewMaxHeadSize))
+	var buf bytes.Buffer
+	for i := 0; i < lines; i++ {
+		line, err := br.ReadBytes('\n')
+		buf.Write(line)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return &preview{contentType: "text/plain; charset=utf-8", data: buf.Bytes()}, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing/iotest"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+// testImage returns a w×h image with black and white vertical
+// stripes one pixel wide.
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	return img
+}
+
+func (s *UnitSuite) TestResizeImage(c *check.C) {
+	thumb := resizeImage(testImage(100, 50), 10)
+	c.Check(thumb.Bounds(), check.Equals, image.Rect(0, 0, 10, 5))
+	r, g, b, a := thumb.At(3, 3).RGBA()
+	c.Check(r>>8, check.Equals, uint32(0x7f))
+	c.Check(g, check.Equals, r)
+	c.Check(b, check.Equals, r)
+	c.Check(a, check.Equals, uint32(0xffff))
+
+	// Never enlarge
+	small := testImage(8, 8)
+	c.Check(resizeImage(small, 10), check.Equals, image.Image(small))
+
+	// Extreme aspect ratio
+	c.Check(resizeImage(testImage(1000, 2), 10).Bounds(), check.Equals, image.Rect(0, 0, 10, 1))
+}
+
+// genericImage hides the concrete type of an image, so resizeImage
+// has to use At.
+type genericImage struct{ image.Image }
+
+func (s *UnitSuite) TestResizeImageTypes(c *check.C) {
+	rect := image.Rect(3, 5, 103, 55)
+	nrgba := image.NewNRGBA(rect)
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	gray := image.NewGray(rect)
+	paletted := image.NewPaletted(rect, color.Palette{color.Black, color.White, color.NRGBA{255, 0, 0, 128}})
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			nrgba.Set(x, y, color.NRGBA{uint8(x), uint8(y), uint8(x * y), uint8(x + y)})
+			ycbcr.Y[ycbcr.YOffset(x, y)] = uint8(x * 3)
+			ycbcr.Cb[ycbcr.COffset(x, y)] = uint8(y * 5)
+			ycbcr.Cr[ycbcr.COffset(x, y)] = uint8(x + y)
+			gray.Set(x, y, color.Gray{uint8(x * y)})
+			paletted.SetColorIndex(x, y, uint8((x+y)%3))
+		}
+	}
+	for _, img := range []image.Image{testImage(100, 50), nrgba, ycbcr, gray, paletted} {
+		c.Logf("%T", img)
+		c.Check(resizeImage(img, 10), check.DeepEquals, resizeImage(genericImage{img}, 10))
+	}
+}
+
+func (s *UnitSuite) TestMakeThumbnail(c *check.C) {
+	img := testImage(300, 200)
+	for _, trial := range []struct {
+		encode func(*bytes.Buffer) error
+		ctype  string
+		decode func(*bytes.Reader) (image.Image, error)
+	}{
+		{func(buf *bytes.Buffer) error { return png.Encode(buf, img) }, "image/png", func(r *bytes.Reader) (image.Image, error) { return png.Decode(r) }},
+		{func(buf *bytes.Buffer) error { return jpeg.Encode(buf, img, nil) }, "image/jpeg", func(r *bytes.Reader) (image.Image, error) { return jpeg.Decode(r) }},
+		{func(buf *bytes.Buffer) error { return gif.Encode(buf, img, nil) }, "image/png", func(r *bytes.Reader) (image.Image, error) { return png.Decode(r) }},
+	} {
+		var buf bytes.Buffer
+		c.Assert(trial.encode(&buf), check.IsNil)
+		p, err := makeThumbnail(&buf, 150)
+		c.Assert(err, check.IsNil)
+		c.Check(p.contentType, check.Equals, trial.ctype)
+		thumb, err := trial.decode(bytes.NewReader(p.data))
+		c.Assert(err, check.IsNil)
+		c.Check(thumb.Bounds(), check.Equals, image.Rect(0, 0, 150, 100))
+	}
+
+	_, err := makeThumbnail(strings.NewReader("this is not an image"), 150)
+	c.Check(err, check.Equals, errPreviewUnsupported)
+
+	// A PNG header claiming to be 10000×10000 pixels is rejected
+	// before decoding.
+	var hdr bytes.Buffer
+	hdr.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], 10000)
+	binary.BigEndian.PutUint32(ihdr[8:], 10000)
+	ihdr[12], ihdr[13] = 8, 6 // 8-bit RGBA
+	binary.Write(&hdr, binary.BigEndian, uint32(13))
+	hdr.Write(ihdr)
+	binary.Write(&hdr, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	_, err = makeThumbnail(io.MultiReader(&hdr, iotest.ErrReader(errors.New("read past header"))), 150)
+	c.Check(err, check.Equals, errPreviewTooLarge)
+}
+
+func (s *UnitSuite) TestMakeHead(c *check.C) {
+	for _, trial := range []struct {
+		content string
+		lines   int
+		expect  string
+	}{
+		{"a\tb\n1\t2\n3\t4\n", 2, "a\tb\n1\t2\n"},
+		{"a\tb\n1\t2\n3\t4\n", 3, "a\tb\n1\t2\n3\t4\n"},
+		{"a\tb\n1\t2\n3\t4", 10, "a\tb\n1\t2\n3\t4"},
+		{"", 10, ""},
+		{strings.Repeat("x", previewMaxHeadSize+10), 1, strings.Repeat("x", previewMaxHeadSize)},
+	} {
+		p, err := makeHead(strings.NewReader(trial.content), trial.lines)
+		c.Assert(err, check.IsNil)
+		c.Check(string(p.data), check.Equals, trial.expect)
+		c.Check(p.contentType, check.Equals, "text/plain; charset=utf-8")
+	}
+}
+
+func (s *UnitSuite) TestServePreview(c *check.C) {
+	kc := &memKeepClient{blocks: map[string][]byte{}}
+	fs, err := newCollectionFS(kc, "", time.Now(), false)
+	c.Assert(err, check.IsNil)
+	var pngData bytes.Buffer
+	c.Assert(png.Encode(&pngData, testImage(600, 300)), check.IsNil)
+	ctx := context.Background()
+	for name, data := range map[string][]byte{
+		"plot.png":    pngData.Bytes(),
+		"results.tsv": []byte(strings.Repeat("1\t2\t3\n", 1000)),
+		"data.bin":    {0, 1, 2, 3},
+	} {
+		f, err := fs.OpenFile(ctx, name, os.O_CREATE|os.O_WRONLY, 0)
+		c.Assert(err, check.IsNil)
+		f.Write(data)
+		c.Assert(f.Close(), check.IsNil)
+	}
+	collection := map[string]interface{}{"portable_data_hash": "d41d8cd98f00b204e9800998ecf8427e+0"}
+	h := &handler{}
+
+	for _, trial := range []struct {
+		filename string
+		query    string
+		status   int
+		ctype    string
+		size     int
+		width    int
+	}{
+		{"plot.png", "preview=thumb", http.StatusOK, "image/png", 0, 256},
+		{"plot.png", "preview=thumb&w=64", http.StatusOK, "image/png", 0, 64},
+		{"plot.png", "preview=thumb&w=100", http.StatusOK, "image/png", 0, 128},
+		{"plot.png", "preview=thumb&w=128", http.StatusOK, "image/png", 0, 128},
+		{"plot.png", "preview=thumb&w=0", http.StatusBadRequest, "", 0, 0},
+		{"plot.png", "preview=thumb&w=100000", http.StatusBadRequest, "", 0, 0},
+		{"plot.png", "preview=head", http.StatusUnsupportedMediaType, "", 0, 0},
+		{"results.tsv", "preview=head", http.StatusOK, "text/plain; charset=utf-8", 600, 0},
+		{"results.tsv", "preview=head&lines=3", http.StatusOK, "text/plain; charset=utf-8", 18, 0},
+		{"results.tsv", "preview=thumb", http.StatusUnsupportedMediaType, "", 0, 0},
+		{"data.bin", "preview=head", http.StatusUnsupportedMediaType, "", 0, 0},
+		{"data.bin", "preview=bogus", http.StatusBadRequest, "", 0, 0},
+	} {
+		for i := 0; i < 2; i++ {
+			c.Logf("%+v", trial)
+			f, err := fs.OpenFile(ctx, trial.filename, os.O_RDONLY, 0)
+			c.Assert(err, check.IsNil)
+			fi, err := f.Stat()
+			c.Assert(err, check.IsNil)
+			u := mustParseURL("http://collections.example.com/c=x/" + trial.filename + "?" + trial.query)
+			req := &http.Request{Method: "GET", URL: u, RequestURI: u.RequestURI(), Header: http.Header{}}
+			resp := httptest.NewRecorder()
+			status, _ := h.servePreview(resp, req, f, fi, collection, trial.filename, "private")
+			f.Close()
+			if status == 0 {
+				status = resp.Code
+			}
+			c.Check(status, check.Equals, trial.status)
+			if status != http.StatusOK {
+				continue
+			}
+			c.Check(resp.Header().Get("Content-Type"), check.Equals, trial.ctype)
+			c.Check(resp.Header().Get("Cache-Control"), check.Equals, "private")
+			if trial.size > 0 {
+				c.Check(resp.Body.Len(), check.Equals, trial.size)
+			}
+			if trial.width > 0 {
+				cfg, err := png.DecodeConfig(resp.Body)
+				c.Check(err, check.IsNil)
+				c.Check(cfg.Width, check.Equals, trial.width)
+			}
+		}
+	}
+	// The second request for each successful preview was a
+	// cache hit, and so were both requests for w=128, which was
+	// made for w=100. (Requests for thumbnails of non-images are
+	// counted, but never hit.)
+	st := h.cache.Stats()
+	c.Check(st.PreviewEntries, check.Equals, 5)
+	c.Check(st.PreviewRequests, check.Equals, uint64(14))
+	c.Check(st.PreviewHits, check.Equals, uint64(7))
+}
+
+func (s *UnitSuite) TestPreviewConditional(c *check.C) {
+	kc := &memKeepClient{blocks: map[string][]byte{}}
+	ctx := context.Background()
+	loc, _, err := kc.PutBContext(ctx, []byte("a\tb\n1\t2\n"))
+	c.Assert(err, check.IsNil)
+	modTime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	fs, err := newCollectionFS(kc, ". "+loc+" 0:8:results.tsv\n", modTime, true)
+	c.Assert(err, check.IsNil)
+	collection := map[string]interface{}{"portable_data_hash": "d41d8cd98f00b204e9800998ecf8427e+0"}
+	h := &handler{}
+
+	get := func(query string, hdr http.Header) *httptest.ResponseRecorder {
+		f, err := fs.OpenFile(ctx, "results.tsv", os.O_RDONLY, 0)
+		c.Assert(err, check.IsNil)
+		defer f.Close()
+		fi, err := f.Stat()
+		c.Assert(err, check.IsNil)
+		u := mustParseURL("http://collections.example.com/c=x/results.tsv?" + query)
+		req := &http.Request{Method: "GET", URL: u, RequestURI: u.RequestURI(), Header: hdr}
+		resp := httptest.NewRecorder()
+		status, _ := h.servePreview(resp, req, f, fi, collection, "results.tsv", "public")
+		c.Check(status, check.Equals, 0)
+		return resp
+	}
+
+	resp := get("preview=head&lines=1", http.Header{})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "a\tb\n")
+	etag := resp.Header().Get("ETag")
+	c.Check(etag, check.Matches, `"[0-9a-f]{32}-head1"`)
+	c.Check(resp.Header().Get("Last-Modified"), check.Equals, modTime.Format(http.TimeFormat))
+
+	// Different parameters, different ETag
+	resp = get("preview=head&lines=2", http.Header{})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("ETag"), check.Not(check.Equals), etag)
+
+	resp = get("preview=head&lines=1", http.Header{"If-None-Match": {etag}})
+	c.Check(resp.Code, check.Equals, http.StatusNotModified)
+	c.Check(resp.Body.Len(), check.Equals, 0)
+
+	resp = get("preview=head&lines=2", http.Header{"If-None-Match": {etag}})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+
+	resp = get("preview=head&lines=1", http.Header{"If-Modified-Since": {modTime.Format(http.TimeFormat)}})
+	c.Check(resp.Code, check.Equals, http.StatusNotModified)
+
+	resp = get("preview=head&lines=1", http.Header{"If-Modified-Since": {modTime.Add(-time.Hour).Format(http.TimeFormat)}})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+}
+
+func (s *IntegrationSuite) TestPreviewHead(c *check.C) {
+	u := mustParseURL("http://" + arvadostest.FooCollection + ".example.com/foo?preview=head&lines=1")
+	req := &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header:     http.Header{"Authorization": {"OAuth2 " + arvadostest.ActiveToken}},
+	}
+	resp := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "text/plain; charset=utf-8")
+
+	// Previews need the same permission as downloads.
+	req.Header.Set("Authorization", "OAuth2 "+arvadostest.SpectatorToken)
+	resp = httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+}
@@ -0,0 +1,882 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/auditlog"
+)
+
+// S3 API
+//
+// Requests signed with AWS Signature Version 4 are handled as S3
+// requests instead of regular downloads. A bucket is a collection
+// (identified by UUID, or by portable data hash with "-" instead of
+// "+") or a project. Object keys are file paths in the collection;
+// in a project bucket, the first component of the key is a
+// collection name.
+//
+// Objects can be written only in collections identified by UUID.
+// Each write (PutObject, DeleteObject, or CompleteMultipartUpload)
+// updates the collection record before responding. Writes to the
+// same collection through one keep-web process are serialized, so
+// clients can upload many objects in parallel.
+
+const s3XMLNamespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// An S3 access key ID is the UUID of an Arvados API token.
+var s3AccessKeyID = regexp.MustCompile(`^[0-9a-z]{5}-gj3su-[0-9a-z]{15}$`)
+
+// Default and maximum number of entries in a ListObjects response.
+const s3MaxKeys = 1000
+
+// s3Error is an error response, as described in
+// https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+type s3Error struct {
+	status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	s3ErrAccessDenied                      = &s3Error{http.StatusForbidden, "AccessDenied", "Access denied"}
+	s3ErrAuthorizationHeaderMalformed      = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	s3ErrAuthorizationQueryParametersError = &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be a number of seconds, at most 604800"}
+	s3ErrContentSHA256Mismatch             = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed"}
+	s3ErrExpiredPresignedRequest           = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	s3ErrIncompleteBody                    = &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body is truncated or not correctly aws-chunked encoded"}
+	s3ErrInvalidAccessKeyID                = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID is not the UUID of a valid Arvados API token"}
+	s3ErrInvalidKey                        = &s3Error{http.StatusBadRequest, "InvalidArgument", "Object key is not a valid file path"}
+	s3ErrKeyConflict                       = &s3Error{http.StatusConflict, "InvalidArgument", "Object key conflicts with an existing file or directory"}
+	s3ErrMalformedXML                      = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML provided was not well-formed"}
+	s3ErrNoSuchBucket                      = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	s3ErrNoSuchKey                         = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	s3ErrNoSuchUpload                      = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	s3ErrInvalidPart                       = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	s3ErrInvalidPartOrder                  = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	s3ErrNotImplemented                    = &s3Error{http.StatusNotImplemented, "NotImplemented", "This operation is not supported"}
+	s3ErrReadOnlyBucket                    = &s3Error{http.StatusForbidden, "AccessDenied", "Objects can only be written in a collection identified by UUID"}
+	s3ErrRequestTimeTooSkewed              = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	s3ErrSignatureDoesNotMatch             = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	s3ErrSignatureVersion                  = &s3Error{http.StatusBadRequest, "InvalidRequest", "Please use AWS Signature Version 4"}
+)
+
+// isS3Request returns true if r looks like an S3 API request, i.e.,
+// it is signed with an AWS signature.
+func isS3Request(r *http.Request) bool {
+	authz := r.Header.Get("Authorization")
+	return strings.HasPrefix(authz, "AWS4-") ||
+		strings.HasPrefix(authz, "AWS ") ||
+		r.URL.Query().Get("X-Amz-Algorithm") != ""
+}
+
+// s3State is the handler's state for S3 requests.
+type s3State struct {
+	uploads s3Uploads
+
+	mtx         sync.Mutex
+	commitLocks map[string]*sync.Mutex
+}
+
+// commitLock returns a mutex for serializing updates to the given
+// collection.
+func (st *s3State) commitLock(uuid string) *sync.Mutex {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if st.commitLocks == nil {
+		st.commitLocks = make(map[string]*sync.Mutex)
+	}
+	mtx, ok := st.commitLocks[uuid]
+	if !ok {
+		mtx = &sync.Mutex{}
+		st.commitLocks[uuid] = mtx
+	}
+	return mtx
+}
+
+// s3Request is an S3 API request being handled.
+type s3Request struct {
+	h          *handler
+	w          http.ResponseWriter
+	r          *http.Request
+	arv        *arvadosclient.ArvadosClient
+	kc         cfsKeepClient
+	remoteAddr string
+
+	auth   *s3Auth
+	bucket string
+	key    string
+
+	// Set if the request accessed a collection.
+	auditEvent *auditlog.Event
+}
+
+// serve handles the request, and returns a description of the
+// error, if any, for logging.
+func (s *s3Request) serve() string {
+	err := s.route()
+	if err == nil {
+		return ""
+	}
+	s3err, ok := err.(*s3Error)
+	if !ok {
+		s3err = &s3Error{http.StatusBadGateway, "InternalError", err.Error()}
+	}
+	if ws, ok := s.w.(interface{ WroteStatus() int }); ok && ws.WroteStatus() != 0 {
+		// Too late to send an error response.
+		return err.Error()
+	}
+	s.w.Header().Set("Content-Type", "application/xml")
+	s.w.WriteHeader(s3err.status)
+	if s.r.Method != "HEAD" {
+		io.WriteString(s.w, xml.Header)
+		xml.NewEncoder(s.w).Encode(struct {
+			XMLName  xml.Name `xml:"Error"`
+			Code     string
+			Message  string
+			Resource string
+		}{Code: s3err.Code, Message: s3err.Message, Resource: s.r.URL.Path})
+	}
+	return err.Error()
+}
+
+func (s *s3Request) route() error {
+	auth, err := s3Authenticate(s.r, time.Now(), s.tokenSecret)
+	if err != nil {
+		return err
+	}
+	s.auth = auth
+	s.arv.ApiToken = auth.token
+
+	if id := parseCollectionIDFromDNSName(s.r.Host); id != "" {
+		// Virtual-hosted-style request:
+		// http://bucket.collections.example/key
+		s.bucket = id
+		s.key = s.r.URL.Path[1:]
+	} else {
+		// Path-style request:
+		// http://collections.example/bucket/key
+		parts := strings.SplitN(s.r.URL.Path[1:], "/", 2)
+		s.bucket = parseCollectionIDFromURL(parts[0])
+		if s.bucket == "" && parts[0] != "" {
+			return s3ErrNoSuchBucket
+		}
+		if len(parts) > 1 {
+			s.key = parts[1]
+		}
+	}
+	query := s.r.URL.Query()
+
+	switch {
+	case s.bucket == "":
+		// ListBuckets
+		return s3ErrNotImplemented
+	case s.key == "" && s.r.Method == "HEAD":
+		return s.headBucket()
+	case s.key == "" && s.r.Method == "GET" && query["location"] != nil:
+		return s.getBucketLocation()
+	case s.key == "" && s.r.Method == "GET":
+		return s.listObjects()
+	case s.key == "":
+		return s3ErrNotImplemented
+	}
+
+	if p := path.Clean("/" + s.key); p != "/"+strings.TrimSuffix(s.key, "/") || p == "/" {
+		return s3ErrInvalidKey
+	}
+	switch {
+	case s.r.Method == "GET" || s.r.Method == "HEAD":
+		return s.getObject()
+	case s.r.Method == "PUT" && s.r.Header.Get("X-Amz-Copy-Source") != "":
+		return s3ErrNotImplemented
+	case s.r.Method == "PUT" && query.Get("uploadId") != "":
+		return s.uploadPart()
+	case s.r.Method == "PUT":
+		return s.putObject()
+	case s.r.Method == "POST" && query["uploads"] != nil:
+		return s.createMultipartUpload()
+	case s.r.Method == "POST" && query.Get("uploadId") != "":
+		return s.completeMultipartUpload()
+	case s.r.Method == "DELETE" && query.Get("uploadId") != "":
+		return s.abortMultipartUpload()
+	case s.r.Method == "DELETE":
+		return s.deleteObject()
+	}
+	return s3ErrNotImplemented
+}
+
+// tokenSecret returns the API token whose UUID is the given S3
+// access key ID. Only admins can look up other users' tokens, so this
+// uses the token in keep-web's ARVADOS_API_TOKEN environment
+// variable.
+func (s *s3Request) tokenSecret(accessKey string) (string, error) {
+	if !s3AccessKeyID.MatchString(accessKey) {
+		return "", s3ErrInvalidAccessKeyID
+	}
+	arv := *s.arv
+	arv.ApiToken = os.Getenv("ARVADOS_API_TOKEN")
+	var auth struct {
+		APIToken string `json:"api_token"`
+	}
+	err := arv.GetContext(s.r.Context(), "api_client_authorizations", accessKey, nil, &auth)
+	if srvErr, ok := err.(arvadosclient.APIServerError); ok && srvErr.HttpStatusCode == http.StatusNotFound {
+		return "", s3ErrInvalidAccessKeyID
+	} else if err != nil {
+		return "", fmt.Errorf("looking up access key ID: %s", err)
+	} else if auth.APIToken == "" {
+		return "", s3ErrInvalidAccessKeyID
+	}
+	return auth.APIToken, nil
+}
+
+// isProject returns true if the bucket is a project rather than a
+// collection.
+func (s *s3Request) isProject() bool {
+	return strings.Contains(s.bucket, "-j7d0g-")
+}
+
+// keepClient returns the KeepClient to use for reading and writing
+// file data.
+func (s *s3Request) keepClient() (cfsKeepClient, error) {
+	if s.kc == nil {
+		kc, err := keepClientForToken(s.arv)
+		if err != nil {
+			return nil, err
+		}
+		s.kc = kc
+	}
+	return s.kc, nil
+}
+
+// apiError converts an error from the API server to the
+// corresponding S3 error.
+func (s *s3Request) apiError(err error, notFound *s3Error) error {
+	if srvErr, ok := err.(arvadosclient.APIServerError); ok {
+		switch srvErr.HttpStatusCode {
+		case 401:
+			return s3ErrInvalidAccessKeyID
+		case 403:
+			return s3ErrAccessDenied
+		case 404:
+			return notFound
+		case 409, 422:
+			return &s3Error{http.StatusConflict, "OperationAborted", srvErr.Error()}
+		}
+	}
+	return err
+}
+
+// collection returns the record of the collection identified by
+// uuid (a UUID or PDH).
+func (s *s3Request) collection(uuid string, forceReload bool) (map[string]interface{}, error) {
+	coll, err := s.h.cache.Get(s.r.Context(), s.arv, uuid, forceReload)
+	if err != nil {
+		return nil, s.apiError(err, s3ErrNoSuchBucket)
+	}
+	return coll, nil
+}
+
+// projectCollections returns the UUIDs of the collections in the
+// bucket's project, keyed by name. Collections whose names can't be
+// used as the first component of an object key are skipped.
+func (s *s3Request) projectCollections(filters [][]interface{}) (map[string]string, error) {
+	filters = append(filters, []interface{}{"owner_uuid", "=", s.bucket})
+	names := make(map[string]string)
+	for offset := 0; ; {
+		var resp struct {
+			Items []struct {
+				UUID string `json:"uuid"`
+				Name string `json:"name"`
+			} `json:"items"`
+			ItemsAvailable int `json:"items_available"`
+		}
+		err := s.arv.ListContext(s.r.Context(), "collections", arvadosclient.Dict{
+			"filters": filters,
+			"select":  []string{"uuid", "name"},
+			"order":   []string{"uuid"},
+			"offset":  offset,
+			"limit":   1000,
+		}, &resp)
+		if err != nil {
+			return nil, s.apiError(err, s3ErrNoSuchBucket)
+		}
+		for _, item := range resp.Items {
+			if item.Name == "" || strings.Contains(item.Name, "/") {
+				continue
+			}
+			if _, dup := names[item.Name]; !dup {
+				names[item.Name] = item.UUID
+			}
+		}
+		offset += len(resp.Items)
+		if len(resp.Items) == 0 || offset >= resp.ItemsAvailable {
+			return names, nil
+		}
+	}
+}
+
+// objectCollection returns the collection containing the requested
+// object, and the object's path within the collection.
+func (s *s3Request) objectCollection(forceReload bool) (map[string]interface{}, string, error) {
+	if !s.isProject() {
+		coll, err := s.collection(s.bucket, forceReload)
+		return coll, s.key, err
+	}
+	parts := strings.SplitN(s.key, "/", 2)
+	if len(parts) < 2 {
+		return nil, "", s3ErrNoSuchKey
+	}
+	colls, err := s.projectCollections([][]interface{}{{"name", "=", parts[0]}})
+	if err != nil {
+		return nil, "", err
+	}
+	uuid, ok := colls[parts[0]]
+	if !ok {
+		return nil, "", s3ErrNoSuchKey
+	}
+	coll, err := s.collection(uuid, forceReload)
+	if err == s3ErrNoSuchBucket {
+		err = s3ErrNoSuchKey
+	}
+	return coll, parts[1], err
+}
+
+// auditReady returns an error if the audit log is enabled but not
+// working. Requests that read or change data must check it before
+// doing so.
+func (s *s3Request) auditReady() error {
+	if audit == nil {
+		return nil
+	}
+	if err := audit.Ready(); err != nil {
+		return &s3Error{http.StatusServiceUnavailable, "ServiceUnavailable", "Audit log unavailable: " + err.Error()}
+	}
+	return nil
+}
+
+// setAuditEvent prepares an audit log entry for an operation on the
+// given file in the given collection.
+func (s *s3Request) setAuditEvent(collection map[string]interface{}, filename string) {
+	if audit == nil {
+		return
+	}
+	s.auditEvent = &auditlog.Event{
+		Service:    "keep-web",
+		Method:     s.r.Method,
+		UserUUID:   userUUIDForToken(s.arv),
+		Path:       filename,
+		Range:      s.r.Header.Get("Range"),
+		RemoteAddr: s.remoteAddr,
+		UserAgent:  s.r.UserAgent(),
+	}
+	s.auditEvent.CollectionUUID, _ = collection["uuid"].(string)
+	s.auditEvent.PortableDataHash, _ = collection["portable_data_hash"].(string)
+}
+
+func (s *s3Request) headBucket() error {
+	if s.isProject() {
+		var project map[string]interface{}
+		err := s.arv.GetContext(s.r.Context(), "groups", s.bucket, arvadosclient.Dict{"select": []string{"uuid"}}, &project)
+		return s.apiError(err, s3ErrNoSuchBucket)
+	}
+	_, err := s.collection(s.bucket, false)
+	return err
+}
+
+func (s *s3Request) getBucketLocation() error {
+	if err := s.headBucket(); err != nil {
+		return err
+	}
+	return s.writeXML(http.StatusOK, struct {
+		XMLName xml.Name `xml:"LocationConstraint"`
+		XMLNS   string   `xml:"xmlns,attr"`
+	}{XMLNS: s3XMLNamespace})
+}
+
+func (s *s3Request) getObject() error {
+	coll, filename, err := s.objectCollection(false)
+	if err != nil {
+		return err
+	}
+	kc, err := s.keepClient()
+	if err != nil {
+		return err
+	}
+	fs, err := collectionFSForRecord(kc, coll, true)
+	if err != nil {
+		return err
+	}
+	f, err := fs.OpenFile(s.r.Context(), filename, os.O_RDONLY, 0)
+	if err != nil {
+		return s3ErrNoSuchKey
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() != strings.HasSuffix(filename, "/") {
+		// "foo/" is an (empty) object only if foo is a
+		// directory, and "foo" is an object only if foo is a
+		// file.
+		return s3ErrNoSuchKey
+	}
+	if err := s.auditReady(); err != nil {
+		return err
+	}
+	s.setAuditEvent(coll, filename)
+	if fi.IsDir() {
+		s.w.Header().Set("ETag", s3ETag(segmentsETag(nil)))
+		http.ServeContent(s.w, s.r, filename, fi.ModTime(), strings.NewReader(""))
+		return nil
+	}
+	// Presigned URLs can be opened in a browser, so the same
+	// inline display rules apply as for other downloads.
+	vhost := trustAllContent || parseCollectionIDFromDNSName(s.r.Host) != ""
+	if err := setContentHeaders(s.w, s.r, f, filename, vhost, false); err != nil {
+		return err
+	}
+	s.w.Header().Set("ETag", s3ETag(fi.(*cfsFileInfo).etag))
+	rdr := &readErrRecorder{ReadSeeker: f}
+	http.ServeContent(s.w, s.r, filename, fi.ModTime(), rdr)
+	return rdr.err
+}
+
+// s3ETag returns the ETag to use for a file in S3 responses. The
+// "-1" suffix tells clients, as it does for objects uploaded in
+// multiple parts, that the ETag is not an MD5 hash of the content.
+func s3ETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + `-1"`
+}
+
+// writeTarget returns the collection that a write request will
+// modify.
+func (s *s3Request) writeTarget() error {
+	if s.isProject() || !arvadosclient.UUIDMatch(s.bucket) {
+		return s3ErrReadOnlyBucket
+	}
+	return nil
+}
+
+// storeData writes the data from rdr to Keep, and returns the
+// resulting segments, along with the MD5 hash of the data.
+func (s *s3Request) storeData(rdr io.Reader) ([]cfsSegment, string, error) {
+	kc, err := s.keepClient()
+	if err != nil {
+		return nil, "", err
+	}
+	fs, err := newCollectionFS(kc, "", time.Now(), false)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := fs.OpenFile(s.r.Context(), "data", os.O_CREATE|os.O_WRONLY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, h), rdr)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = f.Close(); err != nil {
+		return nil, "", err
+	}
+	segments, err := fs.fileSegments(s.r.Context(), "data")
+	return segments, fmt.Sprintf("%x", h.Sum(nil)), err
+}
+
+// commit applies fn to the current version of the bucket's
+// collection, and saves the result.
+func (s *s3Request) commit(fn func(fs *collectionFS) error) (map[string]interface{}, error) {
+	mtx := s.h.s3.commitLock(s.bucket)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	coll, err := s.collection(s.bucket, true)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := s.keepClient()
+	if err != nil {
+		return nil, err
+	}
+	fs, err := collectionFSForRecord(kc, coll, false)
+	if err != nil {
+		return nil, err
+	}
+	switch err := fn(fs); err {
+	case nil:
+	case errNotDirectory, errIsDirectory:
+		return nil, s3ErrKeyConflict
+	default:
+		return nil, err
+	}
+	if !fs.Modified() {
+		return coll, nil
+	}
+	mText, err := fs.MarshalManifest(s.r.Context())
+	if err != nil {
+		return nil, err
+	}
+	err = s.arv.UpdateContext(s.r.Context(), "collections", s.bucket, arvadosclient.Dict{
+		"collection": arvadosclient.Dict{"manifest_text": mText},
+	}, &coll)
+	if err != nil {
+		return nil, s.apiError(err, s3ErrNoSuchBucket)
+	}
+	s.h.cache.Update(s.arv.ApiToken, s.bucket, coll)
+	return coll, nil
+}
+
+func (s *s3Request) putObject() error {
+	if err := s.writeTarget(); err != nil {
+		return err
+	}
+	if err := s.auditReady(); err != nil {
+		return err
+	}
+	body := s.auth.body(s.r)
+	if strings.HasSuffix(s.key, "/") {
+		// Creating a "folder" object makes an empty
+		// directory.
+		if n, err := io.Copy(ioutil.Discard, body); err != nil {
+			return err
+		} else if n > 0 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "A folder object (key ending with \"/\") must be empty"}
+		}
+		coll, err := s.commit(func(fs *collectionFS) error {
+			return fs.MkdirAll(s.r.Context(), s.key)
+		})
+		if err != nil {
+			return err
+		}
+		s.setAuditEvent(coll, s.key)
+		s.w.Header().Set("ETag", s3ETag(segmentsETag(nil)))
+		s.w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	segments, _, err := s.storeData(body)
+	if err != nil {
+		return err
+	}
+	coll, err := s.commit(func(fs *collectionFS) error {
+		return fs.writeFile(s.key, segments)
+	})
+	if err != nil {
+		return err
+	}
+	s.setAuditEvent(coll, s.key)
+	s.w.Header().Set("ETag", s3ETag(segmentsETag(segments)))
+	s.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *s3Request) deleteObject() error {
+	if err := s.writeTarget(); err != nil {
+		return err
+	}
+	if err := s.auditReady(); err != nil {
+		return err
+	}
+	coll, err := s.commit(func(fs *collectionFS) error {
+		fi, err := fs.Stat(s.r.Context(), s.key)
+		if err != nil || fi.IsDir() != strings.HasSuffix(s.key, "/") {
+			// Deleting a nonexistent object succeeds.
+			return nil
+		}
+		if fi.IsDir() {
+			f, err := fs.OpenFile(s.r.Context(), s.key, os.O_RDONLY, 0)
+			if err != nil {
+				return err
+			}
+			fis, err := f.Readdir(-1)
+			f.Close()
+			if err != nil || len(fis) > 0 {
+				// A "folder" object only disappears
+				// when it's empty.
+				return err
+			}
+		}
+		return fs.RemoveAll(s.r.Context(), s.key)
+	})
+	if err != nil {
+		return err
+	}
+	s.setAuditEvent(coll, s.key)
+	s.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// s3Object is an entry in a ListObjects response.
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+func (s *s3Request) listObjects() error {
+	query := s.r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if mk := query.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid max-keys"}
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	var marker string
+	if v2 {
+		marker = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			marker = token
+		}
+	} else {
+		marker = query.Get("marker")
+	}
+
+	objects, err := s.bucketObjects(prefix, delimiter)
+	if err != nil {
+		return err
+	}
+
+	var contents []s3Object
+	var prefixes []s3CommonPrefix
+	var next string
+	truncated := false
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Key, prefix) || obj.Key <= marker {
+			continue
+		}
+		if delimiter != "" && strings.HasSuffix(marker, delimiter) && strings.HasPrefix(obj.Key, marker) {
+			// Already returned as a common prefix.
+			continue
+		}
+		commonPrefix := ""
+		if delimiter != "" {
+			if i := strings.Index(obj.Key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix = obj.Key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if commonPrefix != "" && len(prefixes) > 0 && prefixes[len(prefixes)-1].Prefix == commonPrefix {
+			continue
+		}
+		if len(contents)+len(prefixes) >= maxKeys {
+			truncated = true
+			break
+		}
+		if commonPrefix != "" {
+			prefixes = append(prefixes, s3CommonPrefix{commonPrefix})
+			next = commonPrefix
+		} else {
+			contents = append(contents, obj)
+			next = obj.Key
+		}
+	}
+	if !truncated {
+		next = ""
+	}
+
+	enc := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		enc = func(s string) string { return url.QueryEscape(s) }
+		for i := range contents {
+			contents[i].Key = enc(contents[i].Key)
+		}
+		for i := range prefixes {
+			prefixes[i].Prefix = enc(prefixes[i].Prefix)
+		}
+	}
+	resp := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		XMLNS                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		EncodingType          string `xml:",omitempty"`
+		MaxKeys               int
+		IsTruncated           bool
+		Marker                *string `xml:",omitempty"`
+		NextMarker            string  `xml:",omitempty"`
+		KeyCount              *int    `xml:",omitempty"`
+		StartAfter            string  `xml:",omitempty"`
+		ContinuationToken     string  `xml:",omitempty"`
+		NextContinuationToken string  `xml:",omitempty"`
+		Contents              []s3Object
+		CommonPrefixes        []s3CommonPrefix
+	}{
+		XMLNS:        s3XMLNamespace,
+		Name:         s.bucket,
+		Prefix:       enc(prefix),
+		Delimiter:    enc(delimiter),
+		EncodingType: query.Get("encoding-type"),
+		MaxKeys:      maxKeys,
+		IsTruncated:  truncated,
+		Contents:     contents,
+	}
+	resp.CommonPrefixes = prefixes
+	if v2 {
+		keyCount := len(contents) + len(prefixes)
+		resp.KeyCount = &keyCount
+		resp.StartAfter = enc(query.Get("start-after"))
+		resp.ContinuationToken = query.Get("continuation-token")
+		resp.NextContinuationToken = next
+	} else {
+		m := enc(marker)
+		resp.Marker = &m
+		if delimiter != "" {
+			resp.NextMarker = enc(next)
+		}
+	}
+	return s.writeXML(http.StatusOK, resp)
+}
+
+// bucketObjects returns the objects in the bucket whose keys start
+// with prefix, sorted by key. With a "/" delimiter, each collection
+// in a project bucket that would only appear as a common prefix is
+// returned as a single placeholder object, so its manifest doesn't
+// need to be loaded.
+func (s *s3Request) bucketObjects(prefix, delimiter string) ([]s3Object, error) {
+	if !s.isProject() {
+		coll, err := s.collection(s.bucket, false)
+		if err != nil {
+			return nil, err
+		}
+		return s.collectionObjects(coll, "", prefix)
+	}
+	if err := s.headBucket(); err != nil {
+		return nil, err
+	}
+	colls, err := s.projectCollections(nil)
+	if err != nil {
+		return nil, err
+	}
+	var objects []s3Object
+	for name, uuid := range colls {
+		dir := name + "/"
+		if !strings.HasPrefix(dir, prefix) && !strings.HasPrefix(prefix, dir) {
+			continue
+		}
+		if delimiter == "/" && len(prefix) < len(dir) {
+			objects = append(objects, s3Object{Key: dir})
+			continue
+		}
+		coll, err := s.collection(uuid, false)
+		if err == s3ErrNoSuchBucket {
+			// Deleted since we listed the project.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		objs, err := s.collectionObjects(coll, dir, prefix)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, objs...)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// collectionObjects returns an object for each file, and each empty
+// directory, in the given collection whose key (the path prefixed
+// with keyPrefix) starts with prefix.
+func (s *s3Request) collectionObjects(coll map[string]interface{}, keyPrefix, prefix string) ([]s3Object, error) {
+	kc, err := s.keepClient()
+	if err != nil {
+		return nil, err
+	}
+	fs, err := collectionFSForRecord(kc, coll, true)
+	if err != nil {
+		return nil, err
+	}
+	var objects []s3Object
+	err = walkDir(s.r, fs, "", strings.TrimSuffix(keyPrefix, "/"), func(name string, fi os.FileInfo, f *cfsFile) error {
+		key := strings.TrimPrefix(name, "/")
+		obj := s3Object{
+			Key:          key,
+			LastModified: fi.ModTime().UTC().Format("2006-01-02T15:04:05.000Z"),
+			Size:         fi.Size(),
+			StorageClass: "STANDARD",
+		}
+		if fi.IsDir() {
+			if key == "" || key+"/" == keyPrefix {
+				return nil
+			}
+			// Use a separate handle: walkDir reads f's
+			// entries after we return.
+			d, err := fs.OpenFile(s.r.Context(), strings.TrimPrefix(key, keyPrefix), os.O_RDONLY, 0)
+			if err != nil {
+				return err
+			}
+			fis, err := d.Readdir(-1)
+			d.Close()
+			if err != nil || len(fis) > 0 {
+				// Only empty directories are
+				// objects.
+				return err
+			}
+			obj.Key += "/"
+			obj.Size = 0
+			obj.ETag = s3ETag(segmentsETag(nil))
+		} else {
+			obj.ETag = s3ETag(fi.(*cfsFileInfo).etag)
+		}
+		if strings.HasPrefix(obj.Key, prefix) {
+			objects = append(objects, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *s3Request) writeXML(status int, resp interface{}) error {
+	s.w.Header().Set("Content-Type", "application/xml")
+	s.w.WriteHeader(status)
+	io.WriteString(s.w, xml.Header)
+	return xml.NewEncoder(s.w).Encode(resp)
+}
+
+// readXML decodes the request body, after checking its signature.
+func (s *s3Request) readXML(v interface{}) error {
+	buf, err := ioutil.ReadAll(io.LimitReader(s.auth.body(s.r), 1<<20))
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(buf, v); err != nil {
+		return s3ErrMalformedXML
+	}
+	return nil
+}
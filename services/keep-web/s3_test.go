@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	"git.curoverse.com/arvados.git/sdk/go/auditlog"
+	check "gopkg.in/check.v1"
+)
+
+const s3TestBucket = "zzzzz-4zz18-aaaaaaaaaaaaaaa"
+
+// s3Stub sends S3 requests straight to an s3Request, using a stub
+// API server and an in-memory Keep client.
+type s3Stub struct {
+	h    *handler
+	arv  *arvadosclient.ArvadosClient
+	kc   *memKeepClient
+	api  *stubCollectionAPI
+	done func()
+}
+
+func (s *UnitSuite) newS3Stub(c *check.C) *s3Stub {
+	api, arv, done := s.setupStubCollectionAPI(c)
+	kc := &memKeepClient{blocks: map[string][]byte{}}
+	kc.PutBContext(context.Background(), []byte("foo"))
+	return &s3Stub{h: &handler{}, arv: arv, kc: kc, api: api, done: done}
+}
+
+func (stub *s3Stub) do(method, path, body string, hdr http.Header) *httptest.ResponseRecorder {
+	r := newS3TestRequest(method, "http://collections.example.com"+path, body)
+	for k, v := range hdr {
+		r.Header[k] = v
+	}
+	s3SignRequest(r, s3TestAccessKey, s3TestSecret, time.Now(), s3Hash([]byte(body)))
+	w := httptest.NewRecorder()
+	(&s3Request{h: stub.h, w: w, r: r, arv: stub.arv, kc: stub.kc}).serve()
+	return w
+}
+
+func (stub *s3Stub) list(c *check.C, query string) (keys, prefixes []string, truncated bool, next string) {
+	resp := stub.do("GET", "/"+s3TestBucket+"?"+query, "", nil)
+	c.Assert(resp.Code, check.Equals, http.StatusOK, check.Commentf("%s", resp.Body.String()))
+	var result struct {
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []struct{ Key string }
+		CommonPrefixes        []struct{ Prefix string }
+	}
+	c.Assert(xml.Unmarshal(resp.Body.Bytes(), &result), check.IsNil)
+	for _, obj := range result.Contents {
+		keys = append(keys, obj.Key)
+	}
+	for _, cp := range result.CommonPrefixes {
+		prefixes = append(prefixes, cp.Prefix)
+	}
+	return keys, prefixes, result.IsTruncated, result.NextContinuationToken
+}
+
+func s3ErrorCode(c *check.C, resp *httptest.ResponseRecorder) string {
+	var e struct{ Code string }
+	c.Check(xml.Unmarshal(resp.Body.Bytes(), &e), check.IsNil, check.Commentf("%q", resp.Body.String()))
+	return e.Code
+}
+
+func (s *UnitSuite) TestS3GetObject(c *check.C) {
+	stub := s.newS3Stub(c)
+	defer stub.done()
+
+	resp := stub.do("GET", "/"+s3TestBucket+"/foo", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+	c.Check(resp.Header().Get("ETag"), check.Matches, `"[0-9a-f]{32}-1"`)
+
+	resp = stub.do("GET", "/"+s3TestBucket+"/foo", "", http.Header{"Range": {"bytes=1-"}})
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	c.Check(resp.Body.String(), check.Equals, "oo")
+
+	resp = stub.do("HEAD", "/"+s3TestBucket+"/foo", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Length"), check.Equals, "3")
+
+	// Same collection, by PDH
+	resp = stub.do("GET", "/1f4b0bc7583c2a7f9102c395f4ffc5e3-45/foo", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+
+	for _, trial := range []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/" + s3TestBucket + "/bar", http.StatusNotFound, "NoSuchKey"},
+		{"/" + s3TestBucket + "/foo/", http.StatusNotFound, "NoSuchKey"},
+		{"/" + s3TestBucket + "/foo/../foo", http.StatusBadRequest, "InvalidArgument"},
+		{"/zzzzz-4zz18-bbbbbbbbbbbbbbb/foo", http.StatusNotFound, "NoSuchBucket"},
+		{"/bucket/foo", http.StatusNotFound, "NoSuchBucket"},
+	} {
+		resp = stub.do("GET", trial.path, "", nil)
+		c.Check(resp.Code, check.Equals, trial.status, check.Commentf("%s", trial.path))
+		c.Check(s3ErrorCode(c, resp), check.Equals, trial.code, check.Commentf("%s", trial.path))
+	}
+
+	// Bad credentials
+	for _, trial := range []struct {
+		accessKey string
+		secret    string
+		code      string
+	}{
+		{s3TestAccessKey, "bad", "SignatureDoesNotMatch"},
+		{"zzzzz-gj3su-bbbbbbbbbbbbbbb", s3TestSecret, "InvalidAccessKeyId"},
+		{s3TestSecret, s3TestSecret, "InvalidAccessKeyId"},
+	} {
+		r := newS3TestRequest("GET", "http://collections.example.com/"+s3TestBucket+"/foo", "")
+		s3SignRequest(r, trial.accessKey, trial.secret, time.Now(), s3Hash(nil))
+		w := httptest.NewRecorder()
+		(&s3Request{h: stub.h, w: w, r: r, arv: stub.arv, kc: stub.kc}).serve()
+		c.Check(w.Code, check.Equals, http.StatusForbidden)
+		c.Check(s3ErrorCode(c, w), check.Equals, trial.code, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *UnitSuite) TestS3PutDeleteObject(c *check.C) {
+	stub := s.newS3Stub(c)
+	defer stub.done()
+
+	resp := stub.do("PUT", "/"+s3TestBucket+"/dir/bar", "bar", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	etag := resp.Header().Get("ETag")
+	c.Check(etag, check.Matches, `"[0-9a-f]{32}-1"`)
+	c.Check(stub.api.records[s3TestBucket]["manifest_text"], check.Matches, `(?ms).*\./dir .* 0:3:bar\n.*`)
+
+	resp = stub.do("GET", "/"+s3TestBucket+"/dir/bar", "", nil)
+	c.Check(resp.Body.String(), check.Equals, "bar")
+	c.Check(resp.Header().Get("ETag"), check.Equals, etag)
+
+	// Empty folder object
+	resp = stub.do("PUT", "/"+s3TestBucket+"/emptydir/", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = stub.do("HEAD", "/"+s3TestBucket+"/emptydir/", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = stub.do("PUT", "/"+s3TestBucket+"/emptydir2/", "data", nil)
+	c.Check(resp.Code, check.Equals, http.StatusBadRequest)
+
+	// Files and directories can't have the same name
+	resp = stub.do("PUT", "/"+s3TestBucket+"/foo/bar", "bar", nil)
+	c.Check(resp.Code, check.Equals, http.StatusConflict)
+	resp = stub.do("PUT", "/"+s3TestBucket+"/dir", "bar", nil)
+	c.Check(resp.Code, check.Equals, http.StatusConflict)
+
+	// Collections identified by PDH are read-only
+	resp = stub.do("PUT", "/1f4b0bc7583c2a7f9102c395f4ffc5e3-45/bar", "bar", nil)
+	c.Check(resp.Code, check.Equals, http.StatusForbidden)
+
+	resp = stub.do("DELETE", "/"+s3TestBucket+"/dir/bar", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNoContent)
+	resp = stub.do("GET", "/"+s3TestBucket+"/dir/bar", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+	// Deleting a nonexistent object succeeds
+	resp = stub.do("DELETE", "/"+s3TestBucket+"/dir/bar", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNoContent)
+	resp = stub.do("DELETE", "/"+s3TestBucket+"/emptydir/", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNoContent)
+	resp = stub.do("HEAD", "/"+s3TestBucket+"/emptydir/", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *UnitSuite) TestS3ListObjects(c *check.C) {
+	stub := s.newS3Stub(c)
+	defer stub.done()
+
+	for _, key := range []string{"a/b/c", "a/b/d", "a/e", "f", "g/"} {
+		resp := stub.do("PUT", "/"+s3TestBucket+"/"+key, "", nil)
+		c.Assert(resp.Code, check.Equals, http.StatusOK, check.Commentf("%s: %s", key, resp.Body.String()))
+	}
+
+	keys, prefixes, _, _ := stub.list(c, "list-type=2")
+	c.Check(keys, check.DeepEquals, []string{"a/b/c", "a/b/d", "a/e", "f", "foo", "g/"})
+	c.Check(prefixes, check.HasLen, 0)
+
+	keys, prefixes, _, _ = stub.list(c, "list-type=2&delimiter=/")
+	c.Check(keys, check.DeepEquals, []string{"f", "foo"})
+	c.Check(prefixes, check.DeepEquals, []string{"a/", "g/"})
+
+	keys, prefixes, _, _ = stub.list(c, "list-type=2&delimiter=/&prefix=a/")
+	c.Check(keys, check.DeepEquals, []string{"a/e"})
+	c.Check(prefixes, check.DeepEquals, []string{"a/b/"})
+
+	keys, _, _, _ = stub.list(c, "list-type=2&prefix=a/b")
+	c.Check(keys, check.DeepEquals, []string{"a/b/c", "a/b/d"})
+
+	// Paging
+	var all []string
+	token := ""
+	for i := 0; i < 10; i++ {
+		keys, prefixes, truncated, next := stub.list(c, "list-type=2&max-keys=2&delimiter=/&continuation-token="+token)
+		all = append(append(all, keys...), prefixes...)
+		if !truncated {
+			break
+		}
+		token = next
+	}
+	sort.Strings(all)
+	c.Check(all, check.DeepEquals, []string{"a/", "f", "foo", "g/"})
+}
+
+func (s *UnitSuite) TestS3MultipartUpload(c *check.C) {
+	stub := s.newS3Stub(c)
+	defer stub.done()
+	key := "/" + s3TestBucket + "/dir/multi"
+
+	resp := stub.do("POST", key+"?uploads", "", nil)
+	c.Assert(resp.Code, check.Equals, http.StatusOK, check.Commentf("%s", resp.Body.String()))
+	var initiated struct{ UploadId string }
+	c.Assert(xml.Unmarshal(resp.Body.Bytes(), &initiated), check.IsNil)
+	id := initiated.UploadId
+	c.Check(id, check.Matches, `[0-9a-f]{32}`)
+
+	etags := map[int]string{}
+	for n, data := range map[int]string{1: "foo", 2: "wrong", 3: "baz"} {
+		resp = stub.do("PUT", fmt.Sprintf("%s?partNumber=%d&uploadId=%s", key, n, id), data, nil)
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		etags[n] = resp.Header().Get("ETag")
+	}
+	// Replace part 2
+	resp = stub.do("PUT", key+"?partNumber=2&uploadId="+id, "bar", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	etags[2] = resp.Header().Get("ETag")
+	c.Check(etags[2], check.Equals, `"37b51d194a7513e45b56f6524f2d51f2"`)
+
+	// Wrong upload ID / part numbers
+	resp = stub.do("PUT", key+"?partNumber=1&uploadId=bogus", "x", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+	resp = stub.do("PUT", key+"?partNumber=0&uploadId="+id, "x", nil)
+	c.Check(resp.Code, check.Equals, http.StatusBadRequest)
+	resp = stub.do("PUT", "/"+s3TestBucket+"/other?partNumber=1&uploadId="+id, "x", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	complete := func(parts ...int) *httptest.ResponseRecorder {
+		body := "<CompleteMultipartUpload>"
+		for _, n := range parts {
+			body += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", n, etags[n])
+		}
+		body += "</CompleteMultipartUpload>"
+		return stub.do("POST", key+"?uploadId="+id, body, nil)
+	}
+	resp = complete(2, 1)
+	c.Check(s3ErrorCode(c, resp), check.Equals, "InvalidPartOrder")
+	resp = complete(1, 4)
+	c.Check(s3ErrorCode(c, resp), check.Equals, "InvalidPart")
+	resp = complete(1, 2, 3)
+	c.Check(resp.Code, check.Equals, http.StatusOK, check.Commentf("%s", resp.Body.String()))
+
+	resp = stub.do("GET", key, "", nil)
+	c.Check(resp.Body.String(), check.Equals, "foobarbaz")
+
+	// The upload can't be completed twice
+	resp = complete(1, 2, 3)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	// Abort
+	resp = stub.do("POST", key+"?uploads", "", nil)
+	c.Assert(xml.Unmarshal(resp.Body.Bytes(), &initiated), check.IsNil)
+	resp = stub.do("DELETE", key+"?uploadId="+initiated.UploadId, "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNoContent)
+	resp = stub.do("PUT", key+"?partNumber=1&uploadId="+initiated.UploadId, "x", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *IntegrationSuite) TestS3GetObject(c *check.C) {
+	h := &handler{}
+	for _, trial := range []struct {
+		target    string
+		accessKey string
+		token     string
+		status    int
+		body      string
+	}{
+		{"http://collections.example.com/" + arvadostest.FooCollection + "/foo", arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, http.StatusOK, "foo"},
+		{"http://" + arvadostest.FooCollection + ".collections.example.com/foo", arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, http.StatusOK, "foo"},
+		{"http://collections.example.com/" + arvadostest.FooCollection + "/foo", arvadostest.SpectatorTokenUUID, arvadostest.SpectatorToken, http.StatusNotFound, ""},
+		{"http://collections.example.com/" + arvadostest.FooCollection + "/foo", arvadostest.ActiveTokenUUID, "bogus", http.StatusForbidden, ""},
+		{"http://collections.example.com/" + arvadostest.FooCollection + "/foo", arvadostest.ActiveToken, arvadostest.ActiveToken, http.StatusForbidden, ""},
+	} {
+		c.Logf("%+v", trial)
+		r := newS3TestRequest("GET", trial.target, "")
+		s3SignRequest(r, trial.accessKey, trial.token, time.Now(), s3Hash(nil))
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, r)
+		c.Check(resp.Code, check.Equals, trial.status)
+		if trial.status == http.StatusOK {
+			c.Check(resp.Body.String(), check.Equals, trial.body)
+		}
+	}
+}
+
+func (s *UnitSuite) TestS3AuditFailClosed(c *check.C) {
+	stub := s.newS3Stub(c)
+	defer stub.done()
+	key := "/" + s3TestBucket + "/multi"
+	resp := stub.do("POST", key+"?uploads", "", nil)
+	var initiated struct{ UploadId string }
+	c.Assert(xml.Unmarshal(resp.Body.Bytes(), &initiated), check.IsNil)
+	resp = stub.do("PUT", key+"?partNumber=1&uploadId="+initiated.UploadId, "foo", nil)
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	complete := fmt.Sprintf("<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>", resp.Header().Get("ETag"))
+
+	audit = auditlog.NewLogger(failingSink{}, 10, true)
+	defer func() {
+		if audit != nil {
+			audit.Close()
+			audit = nil
+		}
+	}()
+	audit.Log(auditlog.Event{})
+	for deadline := time.Now().Add(5 * time.Second); audit.Ready() == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Writes are refused before the collection is changed.
+	for _, trial := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"PUT", "/" + s3TestBucket + "/bar", "bar"},
+		{"DELETE", "/" + s3TestBucket + "/foo", ""},
+		{"POST", key + "?uploadId=" + initiated.UploadId, complete},
+	} {
+		resp = stub.do(trial.method, trial.path, trial.body, nil)
+		c.Check(resp.Code, check.Equals, http.StatusServiceUnavailable, check.Commentf("%+v", trial))
+	}
+	c.Check(stub.api.records[s3TestBucket]["manifest_text"], check.Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3+Agood@12345678 0:3:foo\n")
+
+	// The refused upload can still be completed.
+	audit.Close()
+	audit = nil
+	resp = stub.do("POST", key+"?uploadId="+initiated.UploadId, complete, nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK, check.Commentf("%s", resp.Body.String()))
+}
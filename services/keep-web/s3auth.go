@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3SignatureV4     = "AWS4-HMAC-SHA256"
+	s3DateFormat      = "20060102T150405Z"
+	s3MaxClockSkew    = 15 * time.Minute
+	s3MaxPresignedTTL = 7 * 24 * time.Hour
+
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	s3StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+	// Largest aws-chunked chunk we are willing to buffer.
+	s3MaxChunkSize = 1 << 24
+)
+
+// s3Auth is the result of checking an S3 request's signature.
+type s3Auth struct {
+	// Access key ID, which is the UUID of an Arvados API token.
+	accessKey string
+
+	// Secret key, which is the API token itself.
+	token string
+
+	amzDate     string
+	scope       string
+	signingKey  []byte
+	signature   string
+	payloadHash string
+}
+
+// s3Authenticate checks the AWS Signature Version 4 signature of
+// an S3 request, which can be in the Authorization header or
+// (for a presigned URL) in the query string.
+//
+// Keep-web doesn't store any S3 credentials: the access key ID is the
+// UUID of an Arvados API token, and the secret key is the token
+// itself, which lookup returns given the UUID. The secret key is
+// never sent with the request, only used to sign it.
+func s3Authenticate(r *http.Request, now time.Time, lookup func(accessKey string) (string, error)) (*s3Auth, error) {
+	var credential, signedHeaders string
+	auth := &s3Auth{}
+	query := r.URL.Query()
+	if authz := r.Header.Get("Authorization"); strings.HasPrefix(authz, s3SignatureV4+" ") {
+		for _, field := range strings.Split(authz[len(s3SignatureV4)+1:], ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				return nil, s3ErrAuthorizationHeaderMalformed
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				auth.signature = kv[1]
+			}
+		}
+		auth.amzDate = r.Header.Get("X-Amz-Date")
+		auth.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	} else if query.Get("X-Amz-Algorithm") == s3SignatureV4 {
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		auth.signature = query.Get("X-Amz-Signature")
+		auth.amzDate = query.Get("X-Amz-Date")
+		auth.payloadHash = s3UnsignedPayload
+	} else {
+		return nil, s3ErrSignatureVersion
+	}
+	if credential == "" || signedHeaders == "" || auth.signature == "" {
+		return nil, s3ErrAuthorizationHeaderMalformed
+	}
+
+	// Credential is accesskey/yyyymmdd/region/service/aws4_request
+	cparts := strings.Split(credential, "/")
+	if len(cparts) != 5 || cparts[4] != "aws4_request" {
+		return nil, s3ErrAuthorizationHeaderMalformed
+	}
+	auth.accessKey = cparts[0]
+	auth.scope = strings.Join(cparts[1:], "/")
+
+	t, err := time.Parse(s3DateFormat, auth.amzDate)
+	if err != nil || !strings.HasPrefix(auth.amzDate, cparts[1]) {
+		return nil, s3ErrAuthorizationHeaderMalformed
+	}
+	if t.After(now.Add(s3MaxClockSkew)) {
+		return nil, s3ErrRequestTimeTooSkewed
+	}
+	if query.Get("X-Amz-Algorithm") == "" {
+		if t.Before(now.Add(-s3MaxClockSkew)) {
+			return nil, s3ErrRequestTimeTooSkewed
+		}
+	} else {
+		ttl, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || ttl < 0 || time.Duration(ttl)*time.Second > s3MaxPresignedTTL {
+			return nil, s3ErrAuthorizationQueryParametersError
+		}
+		if now.After(t.Add(time.Duration(ttl) * time.Second)) {
+			return nil, s3ErrExpiredPresignedRequest
+		}
+	}
+
+	auth.token, err = lookup(auth.accessKey)
+	if err != nil {
+		return nil, err
+	}
+	auth.signingKey = s3SigningKey(auth.token, auth.scope)
+	expect := s3Sign(auth.signingKey, s3StringToSign(auth.amzDate, auth.scope, s3CanonicalRequest(r, signedHeaders, auth.payloadHash)))
+	if !hmac.Equal([]byte(expect), []byte(auth.signature)) {
+		return nil, s3ErrSignatureDoesNotMatch
+	}
+	return auth, nil
+}
+
+// body returns a reader for the request body that checks the
+// signature or hash of the payload, and returns an error instead of
+// EOF if it doesn't match. Callers must not use any of the data
+// unless they read to EOF without errors.
+func (auth *s3Auth) body(r *http.Request) io.Reader {
+	switch auth.payloadHash {
+	case s3UnsignedPayload:
+		return r.Body
+	case s3StreamingPayload:
+		return &s3ChunkedReader{
+			auth:          auth,
+			rdr:           bufio.NewReader(r.Body),
+			prevSignature: auth.signature,
+		}
+	default:
+		return &s3HashingReader{rdr: r.Body, hash: sha256.New(), expect: auth.payloadHash}
+	}
+}
+
+// s3CanonicalRequest returns the canonical form of r, as described
+// in https://docs.aws.amazon.com/general/latest/gr/sigv4-create-canonical-request.html
+func s3CanonicalRequest(r *http.Request, signedHeaders, payloadHash string) string {
+	return strings.Join([]string{
+		r.Method,
+		s3EscapePath(r.URL.Path),
+		s3CanonicalQuery(r.URL.Query()),
+		s3CanonicalHeaders(r, signedHeaders),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+}
+
+func s3StringToSign(amzDate, scope, canonicalRequest string) string {
+	return strings.Join([]string{
+		s3SignatureV4,
+		amzDate,
+		scope,
+		s3Hash([]byte(canonicalRequest)),
+	}, "\n")
+}
+
+// s3SigningKey derives the signing key for the given secret key and
+// credential scope (yyyymmdd/region/service/aws4_request).
+func s3SigningKey(secret, scope string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return key
+}
+
+func s3Sign(key []byte, stringToSign string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func s3Hash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// s3Escape URI-encodes s the way AWS does when computing
+// signatures: everything except unreserved characters is
+// percent-encoded.
+func s3Escape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// s3EscapePath is like s3Escape, but leaves "/" alone.
+func s3EscapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = s3Escape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var params []string
+	for k, vs := range query {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			params = append(params, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3CanonicalHeaders returns the canonical form of the given
+// (semicolon-separated, lower case) headers, each followed by "\n".
+func s3CanonicalHeaders(r *http.Request, signedHeaders string) string {
+	var buf bytes.Buffer
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var values []string
+		if name == "host" {
+			values = []string{r.Host}
+		} else {
+			for _, v := range r.Header[http.CanonicalHeaderKey(name)] {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+		}
+		buf.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return buf.String()
+}
+
+// s3HashingReader returns s3ErrContentSHA256Mismatch instead of EOF
+// if the data it reads doesn't have the expected SHA-256 hash.
+type s3HashingReader struct {
+	rdr    io.Reader
+	hash   hash.Hash
+	expect string
+}
+
+func (hr *s3HashingReader) Read(p []byte) (int, error) {
+	n, err := hr.rdr.Read(p)
+	hr.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(hr.hash.Sum(nil)) != hr.expect {
+		err = s3ErrContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// s3ChunkedReader decodes a body sent with "Content-Encoding:
+// aws-chunked", checking the signature of each chunk.
+type s3ChunkedReader struct {
+	auth          *s3Auth
+	rdr           *bufio.Reader
+	prevSignature string
+	chunk         []byte
+	err           error
+}
+
+func (cr *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(cr.chunk) == 0 && cr.err == nil {
+		cr.err = cr.nextChunk()
+	}
+	if len(cr.chunk) == 0 {
+		return 0, cr.err
+	}
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+// nextChunk reads and checks the next chunk, and returns io.EOF
+// after the final (empty) chunk.
+func (cr *s3ChunkedReader) nextChunk() error {
+	line, err := cr.rdr.ReadString('\n')
+	if err != nil {
+		return s3ErrIncompleteBody
+	}
+	// hex-size;chunk-signature=signature\r\n
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), ";", 2)
+	if len(fields) != 2 || !strings.HasPrefix(fields[1], "chunk-signature=") {
+		return s3ErrIncompleteBody
+	}
+	size, err := strconv.ParseInt(fields[0], 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return s3ErrIncompleteBody
+	}
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(cr.rdr, chunk); err != nil {
+		return s3ErrIncompleteBody
+	}
+	if crlf, err := cr.rdr.ReadString('\n'); err != nil || crlf != "\r\n" {
+		return s3ErrIncompleteBody
+	}
+	signature := fields[1][len("chunk-signature="):]
+	expect := s3Sign(cr.auth.signingKey, strings.Join([]string{
+		s3SignatureV4 + "-PAYLOAD",
+		cr.auth.amzDate,
+		cr.auth.scope,
+		cr.prevSignature,
+		s3Hash(nil),
+		s3Hash(chunk),
+	}, "\n"))
+	if !hmac.Equal([]byte(expect), []byte(signature)) {
+		return s3ErrSignatureDoesNotMatch
+	}
+	cr.prevSignature = signature
+	cr.chunk = chunk
+	if size == 0 {
+		return io.EOF
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+// s3SignRequest adds an AWS Signature Version 4 Authorization header
+// to r, using the given access key ID and secret key.
+func s3SignRequest(r *http.Request, accessKey, secret string, now time.Time, payloadHash string) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	scope := amzDate[:8] + "/us-east-1/s3/aws4_request"
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	sig := s3Sign(s3SigningKey(secret, scope), s3StringToSign(amzDate, scope, s3CanonicalRequest(r, signedHeaders, payloadHash)))
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3SignatureV4, accessKey, scope, signedHeaders, sig))
+}
+
+// s3PresignURL adds presigned-URL query parameters to r.
+func s3PresignURL(r *http.Request, accessKey, secret string, now time.Time, ttl int) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	scope := amzDate[:8] + "/us-east-1/s3/aws4_request"
+	q := r.URL.Query()
+	q.Set("X-Amz-Algorithm", s3SignatureV4)
+	q.Set("X-Amz-Credential", accessKey+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", fmt.Sprintf("%d", ttl))
+	q.Set("X-Amz-SignedHeaders", "host")
+	r.URL.RawQuery = q.Encode()
+	sig := s3Sign(s3SigningKey(secret, scope), s3StringToSign(amzDate, scope, s3CanonicalRequest(r, "host", s3UnsignedPayload)))
+	q.Set("X-Amz-Signature", sig)
+	r.URL.RawQuery = q.Encode()
+}
+
+// Access key ID and secret key accepted by s3TestLookup and
+// stubCollectionAPI.
+const (
+	s3TestAccessKey = "zzzzz-gj3su-aaaaaaaaaaaaaaa"
+	s3TestSecret    = "good"
+)
+
+func s3TestLookup(accessKey string) (string, error) {
+	if accessKey != s3TestAccessKey {
+		return "", s3ErrInvalidAccessKeyID
+	}
+	return s3TestSecret, nil
+}
+
+func newS3TestRequest(method, target, body string) *http.Request {
+	u := mustParseURL(target)
+	return &http.Request{
+		Method:     method,
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// Example from
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *UnitSuite) TestS3SignatureExample(c *check.C) {
+	r := newS3TestRequest("GET", "http://examplebucket.s3.amazonaws.com/test.txt", "")
+	r.Header.Set("Range", "bytes=0-9")
+	r.Header.Set("X-Amz-Content-Sha256", s3Hash(nil))
+	r.Header.Set("X-Amz-Date", "20130524T000000Z")
+	scope := "20130524/us-east-1/s3/aws4_request"
+	canonical := s3CanonicalRequest(r, "host;range;x-amz-content-sha256;x-amz-date", s3Hash(nil))
+	c.Check(canonical, check.Equals, "GET\n/test.txt\n\nhost:examplebucket.s3.amazonaws.com\nrange:bytes=0-9\nx-amz-content-sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\nx-amz-date:20130524T000000Z\n\nhost;range;x-amz-content-sha256;x-amz-date\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	sig := s3Sign(s3SigningKey("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", scope), s3StringToSign("20130524T000000Z", scope, canonical))
+	c.Check(sig, check.Equals, "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41")
+}
+
+func (s *UnitSuite) TestS3Authenticate(c *check.C) {
+	now := time.Now()
+	for _, trial := range []struct {
+		label  string
+		sign   func(*http.Request)
+		modify func(*http.Request)
+		expect error
+	}{
+		{
+			label: "ok",
+			sign:  func(r *http.Request) { s3SignRequest(r, s3TestAccessKey, s3TestSecret, now, s3Hash(nil)) },
+		},
+		{
+			label:  "tampered path",
+			sign:   func(r *http.Request) { s3SignRequest(r, s3TestAccessKey, s3TestSecret, now, s3Hash(nil)) },
+			modify: func(r *http.Request) { r.URL.Path = "/bucket/other" },
+			expect: s3ErrSignatureDoesNotMatch,
+		},
+		{
+			label:  "tampered query",
+			sign:   func(r *http.Request) { s3SignRequest(r, s3TestAccessKey, s3TestSecret, now, s3Hash(nil)) },
+			modify: func(r *http.Request) { r.URL.RawQuery = "prefix=x" },
+			expect: s3ErrSignatureDoesNotMatch,
+		},
+		{
+			label:  "wrong secret",
+			sign:   func(r *http.Request) { s3SignRequest(r, s3TestAccessKey, "bad", now, s3Hash(nil)) },
+			expect: s3ErrSignatureDoesNotMatch,
+		},
+		{
+			label:  "unknown access key",
+			sign:   func(r *http.Request) { s3SignRequest(r, "zzzzz-gj3su-bbbbbbbbbbbbbbb", s3TestSecret, now, s3Hash(nil)) },
+			expect: s3ErrInvalidAccessKeyID,
+		},
+		{
+			label: "clock skew",
+			sign: func(r *http.Request) {
+				s3SignRequest(r, s3TestAccessKey, s3TestSecret, now.Add(-time.Hour), s3Hash(nil))
+			},
+			expect: s3ErrRequestTimeTooSkewed,
+		},
+		{
+			label:  "signature version 2",
+			modify: func(r *http.Request) { r.Header.Set("Authorization", "AWS good:c2lnbmF0dXJl") },
+			expect: s3ErrSignatureVersion,
+		},
+		{
+			label: "presigned",
+			sign:  func(r *http.Request) { s3PresignURL(r, s3TestAccessKey, s3TestSecret, now.Add(-time.Hour), 7200) },
+		},
+		{
+			label:  "presigned, expired",
+			sign:   func(r *http.Request) { s3PresignURL(r, s3TestAccessKey, s3TestSecret, now.Add(-time.Hour), 60) },
+			expect: s3ErrExpiredPresignedRequest,
+		},
+		{
+			label:  "presigned, too long",
+			sign:   func(r *http.Request) { s3PresignURL(r, s3TestAccessKey, s3TestSecret, now, 30*86400) },
+			expect: s3ErrAuthorizationQueryParametersError,
+		},
+	} {
+		c.Logf("trial: %s", trial.label)
+		r := newS3TestRequest("GET", "http://collections.example.com/bucket/key", "")
+		if trial.sign != nil {
+			trial.sign(r)
+		}
+		if trial.modify != nil {
+			trial.modify(r)
+		}
+		auth, err := s3Authenticate(r, now, s3TestLookup)
+		c.Check(err, check.Equals, trial.expect)
+		if err == nil {
+			c.Check(auth.accessKey, check.Equals, s3TestAccessKey)
+			c.Check(auth.token, check.Equals, s3TestSecret)
+		}
+	}
+}
+
+func (s *UnitSuite) TestS3PayloadHash(c *check.C) {
+	now := time.Now()
+	r := newS3TestRequest("PUT", "http://collections.example.com/bucket/key", "foo")
+	s3SignRequest(r, s3TestAccessKey, s3TestSecret, now, s3Hash([]byte("bar")))
+	auth, err := s3Authenticate(r, now, s3TestLookup)
+	c.Assert(err, check.IsNil)
+	_, err = ioutil.ReadAll(auth.body(r))
+	c.Check(err, check.Equals, s3ErrContentSHA256Mismatch)
+
+	r = newS3TestRequest("PUT", "http://collections.example.com/bucket/key", "foo")
+	s3SignRequest(r, s3TestAccessKey, s3TestSecret, now, s3Hash([]byte("foo")))
+	auth, err = s3Authenticate(r, now, s3TestLookup)
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadAll(auth.body(r))
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "foo")
+}
+
+func (s *UnitSuite) TestS3ChunkedPayload(c *check.C) {
+	now := time.Now()
+	chunks := []string{"foo", "barbaz", ""}
+	for _, tamper := range []bool{false, true} {
+		r := newS3TestRequest("PUT", "http://collections.example.com/bucket/key", "")
+		s3SignRequest(r, s3TestAccessKey, s3TestSecret, now, s3StreamingPayload)
+		auth, err := s3Authenticate(r, now, s3TestLookup)
+		c.Assert(err, check.IsNil)
+
+		var body bytes.Buffer
+		prev := auth.signature
+		for _, chunk := range chunks {
+			sig := s3Sign(auth.signingKey, strings.Join([]string{
+				s3SignatureV4 + "-PAYLOAD",
+				auth.amzDate,
+				auth.scope,
+				prev,
+				s3Hash(nil),
+				s3Hash([]byte(chunk)),
+			}, "\n"))
+			if tamper && chunk == "barbaz" {
+				chunk = "barbat"
+			}
+			fmt.Fprintf(&body, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), sig, chunk)
+			prev = sig
+		}
+		r.Body = ioutil.NopCloser(&body)
+		buf, err := ioutil.ReadAll(auth.body(r))
+		if tamper {
+			c.Check(err, check.Equals, s3ErrSignatureDoesNotMatch)
+		} else {
+			c.Check(err, check.IsNil)
+			c.Check(string(buf), check.Equals, "foobarbaz")
+		}
+	}
+
+	// Truncated body
+	r := newS3TestRequest("PUT", "http://collections.example.com/bucket/key", "")
+	s3SignRequest(r, s3TestAccessKey, s3TestSecret, now, s3StreamingPayload)
+	auth, err := s3Authenticate(r, now, s3TestLookup)
+	c.Assert(err, check.IsNil)
+	r.Body = ioutil.NopCloser(strings.NewReader("3;chunk-signature=abc\r\nfo"))
+	_, err = ioutil.ReadAll(auth.body(r))
+	c.Check(err, check.Equals, s3ErrIncompleteBody)
+}
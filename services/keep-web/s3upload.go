@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multipart uploads that haven't been completed or aborted after
+// this long are forgotten. The data blocks are left for Keep's
+// garbage collector.
+const s3UploadTTL = 24 * time.Hour
+
+// Part numbers are 1..s3MaxParts.
+const s3MaxParts = 10000
+
+// s3Uploads holds the multipart uploads in progress. They are kept
+// in memory, so all requests for a given upload must be sent to the
+// same keep-web process.
+type s3Uploads struct {
+	mtx sync.Mutex
+	m   map[string]*s3Upload
+}
+
+type s3Upload struct {
+	bucket  string
+	key     string
+	token   string
+	created time.Time
+	parts   map[int]s3Part
+}
+
+type s3Part struct {
+	etag     string
+	segments []cfsSegment
+}
+
+// start adds a new upload and returns its ID.
+func (u *s3Uploads) start(bucket, key, token string) (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("%x", buf)
+	now := time.Now()
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.m == nil {
+		u.m = make(map[string]*s3Upload)
+	}
+	for id, upload := range u.m {
+		if now.Sub(upload.created) > s3UploadTTL {
+			delete(u.m, id)
+		}
+	}
+	u.m[id] = &s3Upload{
+		bucket:  bucket,
+		key:     key,
+		token:   token,
+		created: now,
+		parts:   make(map[int]s3Part),
+	}
+	return id, nil
+}
+
+// get returns the upload with the given ID, if it was started by
+// the same token for the same bucket and key. If remove is true, it
+// is also removed, so other requests can't use it.
+func (u *s3Uploads) get(id, bucket, key, token string, remove bool) (*s3Upload, error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	upload, ok := u.m[id]
+	if !ok || upload.bucket != bucket || upload.key != key || upload.token != token || time.Since(upload.created) > s3UploadTTL {
+		return nil, s3ErrNoSuchUpload
+	}
+	if remove {
+		delete(u.m, id)
+	}
+	return upload, nil
+}
+
+// restore puts back an upload that was removed by get, e.g., because
+// it could not be completed.
+func (u *s3Uploads) restore(id string, upload *s3Upload) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.m[id] = upload
+}
+
+// addPart records an uploaded part, replacing any previous part with
+// the same number.
+func (u *s3Uploads) addPart(id string, n int, part s3Part) error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	upload, ok := u.m[id]
+	if !ok {
+		// Completed or aborted while the part was being
+		// uploaded.
+		return s3ErrNoSuchUpload
+	}
+	upload.parts[n] = part
+	return nil
+}
+
+func (s *s3Request) createMultipartUpload() error {
+	if err := s.writeTarget(); err != nil {
+		return err
+	}
+	if strings.HasSuffix(s.key, "/") {
+		return s3ErrInvalidKey
+	}
+	if _, err := s.collection(s.bucket, false); err != nil {
+		return err
+	}
+	id, err := s.h.s3.uploads.start(s.bucket, s.key, s.arv.ApiToken)
+	if err != nil {
+		return err
+	}
+	return s.writeXML(http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		XMLNS    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{XMLNS: s3XMLNamespace, Bucket: s.bucket, Key: s.key, UploadId: id})
+}
+
+func (s *s3Request) uploadPart() error {
+	query := s.r.URL.Query()
+	id := query.Get("uploadId")
+	n, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || n < 1 || n > s3MaxParts {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("Part number must be an integer between 1 and %d", s3MaxParts)}
+	}
+	if _, err := s.h.s3.uploads.get(id, s.bucket, s.key, s.arv.ApiToken, false); err != nil {
+		return err
+	}
+	segments, md5hex, err := s.storeData(s.auth.body(s.r))
+	if err != nil {
+		return err
+	}
+	etag := `"` + md5hex + `"`
+	if err := s.h.s3.uploads.addPart(id, n, s3Part{etag: etag, segments: segments}); err != nil {
+		return err
+	}
+	s.w.Header().Set("ETag", etag)
+	s.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *s3Request) completeMultipartUpload() error {
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := s.readXML(&req); err != nil {
+		return err
+	}
+	if len(req.Parts) == 0 {
+		return s3ErrMalformedXML
+	}
+	if err := s.auditReady(); err != nil {
+		return err
+	}
+	// Remove the upload while completing it, so concurrent
+	// requests can't add parts to it or complete it twice. If it
+	// can't be completed, put it back so the client can retry.
+	id := s.r.URL.Query().Get("uploadId")
+	upload, err := s.h.s3.uploads.get(id, s.bucket, s.key, s.arv.ApiToken, true)
+	if err != nil {
+		return err
+	}
+	var segments []cfsSegment
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			s.h.s3.uploads.restore(id, upload)
+			return s3ErrInvalidPartOrder
+		}
+		part, ok := upload.parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != strings.Trim(part.etag, `"`) {
+			s.h.s3.uploads.restore(id, upload)
+			return s3ErrInvalidPart
+		}
+		segments = append(segments, part.segments...)
+	}
+
+	coll, err := s.commit(func(fs *collectionFS) error {
+		return fs.writeFile(s.key, segments)
+	})
+	if err != nil {
+		s.h.s3.uploads.restore(id, upload)
+		return err
+	}
+	s.setAuditEvent(coll, s.key)
+	return s.writeXML(http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		XMLNS    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		XMLNS:    s3XMLNamespace,
+		Location: s.r.URL.Path,
+		Bucket:   s.bucket,
+		Key:      s.key,
+		ETag:     s3ETag(segmentsETag(segments)),
+	})
+}
+
+func (s *s3Request) abortMultipartUpload() error {
+	id := s.r.URL.Query().Get("uploadId")
+	if _, err := s.h.s3.uploads.get(id, s.bucket, s.key, s.arv.ApiToken, true); err != nil {
+		return err
+	}
+	s.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
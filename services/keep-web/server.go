@@ -7,11 +7,15 @@ import (
 	"git.curoverse.com/arvados.git/sdk/go/httpserver"
 )
 
-var address string
+var (
+	address   string
+	tlsConfig httpserver.TLSConfig
+)
 
 func init() {
 	flag.StringVar(&address, "listen", ":80",
 		"Address to listen on: \"host:port\", or \":port\" to listen on all interfaces.")
+	tlsConfig.AddFlags(flag.CommandLine, "tls-")
 }
 
 type server struct {
@@ -21,7 +25,8 @@ type server struct {
 func (srv *server) Start() error {
 	mux := http.NewServeMux()
 	mux.Handle("/", &handler{})
-	srv.Handler = mux
+	srv.Handler = httpserver.LogRequests(mux)
 	srv.Addr = address
+	srv.TLS = &tlsConfig
 	return srv.Server.Start()
 }
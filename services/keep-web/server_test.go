@@ -56,12 +56,7 @@ func (s *IntegrationSuite) Test404(c *check.C) {
 		"/download",
 		"/collections",
 		"/collections/",
-		// Implicit/generated index is not implemented yet;
-		// until then, return 404.
 		"/collections/" + arvadostest.FooCollection,
-		"/collections/" + arvadostest.FooCollection + "/",
-		"/collections/" + arvadostest.FooBarDirCollection + "/dir1",
-		"/collections/" + arvadostest.FooBarDirCollection + "/dir1/",
 		// Non-existent file in collection
 		"/collections/" + arvadostest.FooCollection + "/theperthcountyconspiracy",
 		"/collections/download/" + arvadostest.FooCollection + "/" + arvadostest.ActiveToken + "/theperthcountyconspiracy",
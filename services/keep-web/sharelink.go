@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+)
+
+var (
+	shareLinkKeyFile  string
+	shareLinkDenyFile string
+	shareLinkMaxTTL   = 7 * 24 * time.Hour
+)
+
+func init() {
+	flag.StringVar(&shareLinkKeyFile, "share-link-keys", "",
+		"Enable signed share links, using the keys in the given `file`. Each line is a key ID and a secret, separated by a space. New links are signed with the first key; links signed with any of the keys are accepted. Links are served using the token in the ARVADOS_API_TOKEN environment variable. The file is re-read on SIGHUP.")
+	flag.StringVar(&shareLinkDenyFile, "share-link-deny", "",
+		"Reject share links whose IDs are listed (one per line) in the given `file`. The file is re-read on SIGHUP.")
+	flag.DurationVar(&shareLinkMaxTTL, "share-link-max-ttl", shareLinkMaxTTL,
+		"Maximum lifetime of a new share link.")
+}
+
+var (
+	errShareLinksDisabled = errors.New("share links are not enabled")
+	errShareLinkInvalid   = errors.New("invalid share link")
+	errShareLinkExpired   = errors.New("share link has expired")
+	errShareLinkRevoked   = errors.New("share link has been revoked")
+	errShareLinkClientIP  = errors.New("share link is not valid for this client address")
+)
+
+// shareLink is the signed content of a share link. It grants
+// read-only access to the files at Prefix (a file, or a directory
+// and everything in it) in Collection until Expires, optionally only
+// to clients at ClientIP.
+type shareLink struct {
+	ID         string `json:"id"`
+	KeyID      string `json:"k"`
+	Collection string `json:"c"`
+	Prefix     string `json:"p,omitempty"`
+	Expires    int64  `json:"e"`
+	ClientIP   string `json:"ip,omitempty"`
+}
+
+// allows returns true if the link grants access to the given file
+// path in its collection.
+func (link *shareLink) allows(filename string) bool {
+	if link.Prefix == "" {
+		return true
+	}
+	filename = path.Clean("/" + filename)
+	prefix := "/" + link.Prefix
+	return filename == prefix || strings.HasPrefix(filename, prefix+"/")
+}
+
+type shareLinkKey struct {
+	id     string
+	secret []byte
+}
+
+// shareLinkKeyring holds the keys used to sign and verify share
+// links, and the list of revoked link IDs.
+type shareLinkKeyring struct {
+	mtx    sync.RWMutex
+	keys   []shareLinkKey
+	denied map[string]bool
+	// API token used to serve share links.
+	token string
+}
+
+var shareLinks shareLinkKeyring
+
+// load (re)reads the key and deny-list files named by the
+// command-line flags.
+func (kr *shareLinkKeyring) load() error {
+	var keys []shareLinkKey
+	denied := make(map[string]bool)
+	if shareLinkKeyFile != "" {
+		lines, err := readConfigLines(shareLinkKeyFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || len(fields[1]) < 16 {
+				return fmt.Errorf("%s: each line must have a key ID and a secret of at least 16 characters", shareLinkKeyFile)
+			}
+			keys = append(keys, shareLinkKey{id: fields[0], secret: []byte(fields[1])})
+		}
+	}
+	if shareLinkDenyFile != "" {
+		lines, err := readConfigLines(shareLinkDenyFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			denied[line] = true
+		}
+	}
+	kr.mtx.Lock()
+	defer kr.mtx.Unlock()
+	kr.keys = keys
+	kr.denied = denied
+	kr.token = os.Getenv("ARVADOS_API_TOKEN")
+	return nil
+}
+
+// readConfigLines returns the non-empty lines of a file, ignoring
+// comments ("#...").
+func readConfigLines(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func (kr *shareLinkKeyring) enabled() bool {
+	kr.mtx.RLock()
+	defer kr.mtx.RUnlock()
+	return len(kr.keys) > 0
+}
+
+// sign fills in link's ID and KeyID, and returns the encoded link.
+func (kr *shareLinkKeyring) sign(link *shareLink) (string, error) {
+	kr.mtx.RLock()
+	defer kr.mtx.RUnlock()
+	if len(kr.keys) == 0 {
+		return "", errShareLinksDisabled
+	}
+	var id [12]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	link.ID = fmt.Sprintf("%x", id)
+	link.KeyID = kr.keys[0].id
+	payload, err := json.Marshal(link)
+	if err != nil {
+		return "", err
+	}
+	msg := base64.RawURLEncoding.EncodeToString(payload)
+	return msg + "." + shareLinkSignature(kr.keys[0].secret, msg), nil
+}
+
+// verify decodes a share link and checks that it is usable by the
+// given client at the given time.
+func (kr *shareLinkKeyring) verify(encoded string, now time.Time, clientIP string) (*shareLink, error) {
+	kr.mtx.RLock()
+	defer kr.mtx.RUnlock()
+	if len(kr.keys) == 0 {
+		return nil, errShareLinksDisabled
+	}
+	parts := strings.Split(encoded, ".")
+	if len(parts) != 2 {
+		return nil, errShareLinkInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errShareLinkInvalid
+	}
+	var link shareLink
+	if err := json.Unmarshal(payload, &link); err != nil {
+		return nil, errShareLinkInvalid
+	}
+	valid := false
+	for _, key := range kr.keys {
+		if key.id == link.KeyID {
+			valid = hmac.Equal([]byte(parts[1]), []byte(shareLinkSignature(key.secret, parts[0])))
+			break
+		}
+	}
+	switch {
+	case !valid || link.Collection == "":
+		return nil, errShareLinkInvalid
+	case now.Unix() >= link.Expires:
+		return nil, errShareLinkExpired
+	case kr.denied[link.ID]:
+		return nil, errShareLinkRevoked
+	case link.ClientIP != "" && link.ClientIP != clientIP:
+		return nil, errShareLinkClientIP
+	}
+	return &link, nil
+}
+
+func shareLinkSignature(secret []byte, msg string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(msg))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// clientIP returns the address of the client that sent r. If r came
+// from a proxy on the same host, the last address the proxy added to
+// X-Forwarded-For is used.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			addrs := strings.Split(xff, ",")
+			host = strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	return host
+}
+
+// serveShareLinkRequest responds to a POST /share-links request by
+// creating a share link. The client must supply an API token (in an
+// "Authorization: OAuth2 ..." header) that can read the collection.
+func (h *handler) serveShareLinkRequest(w http.ResponseWriter, r *http.Request, arv *arvadosclient.ArvadosClient) (int, string) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, r.Method
+	}
+	if !shareLinks.enabled() {
+		return http.StatusNotFound, errShareLinksDisabled.Error()
+	}
+	authz := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(authz) != 2 || authz[0] != "OAuth2" {
+		w.Header().Set("WWW-Authenticate", "OAuth2")
+		return http.StatusUnauthorized, "missing Authorization header"
+	}
+	ttl := 24 * time.Hour
+	if s := r.FormValue("ttl"); s != "" {
+		var err error
+		ttl, err = time.ParseDuration(s)
+		if err != nil || ttl <= 0 {
+			return http.StatusBadRequest, "invalid ttl"
+		}
+	}
+	if ttl > shareLinkMaxTTL {
+		ttl = shareLinkMaxTTL
+	}
+	link := &shareLink{
+		Collection: r.FormValue("collection"),
+		Prefix:     strings.Trim(path.Clean("/"+r.FormValue("path")), "/"),
+		Expires:    time.Now().Add(ttl).Unix(),
+		ClientIP:   r.FormValue("ip"),
+	}
+	if link.ClientIP != "" && net.ParseIP(link.ClientIP) == nil {
+		return http.StatusBadRequest, "invalid ip"
+	}
+	if link.Collection == "" {
+		return http.StatusBadRequest, "missing collection"
+	}
+
+	// The client's token must be able to read the collection.
+	arv.ApiToken = authz[1]
+	if _, err := h.cache.Get(r.Context(), arv, link.Collection, false); err != nil {
+		if srvErr, ok := err.(arvadosclient.APIServerError); ok {
+			return srvErr.HttpStatusCode, err.Error()
+		}
+		return http.StatusBadGateway, err.Error()
+	}
+
+	encoded, err := shareLinks.sign(link)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	linkPath := (&url.URL{Path: "/share/" + encoded + "/" + link.Prefix}).EscapedPath()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":         link.ID,
+		"path":       linkPath,
+		"expires_at": time.Unix(link.Expires, 0).UTC().Format(time.RFC3339),
+	})
+	return http.StatusOK, ""
+}
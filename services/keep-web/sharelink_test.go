@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+// setupShareLinks writes the given key and deny-list files and
+// loads them into shareLinks. The returned func restores the
+// previous configuration.
+func setupShareLinks(c *check.C, keys, denied string) func() {
+	dir, err := ioutil.TempDir("", "keep-web-test-")
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(dir+"/keys", []byte(keys), 0600), check.IsNil)
+	c.Assert(ioutil.WriteFile(dir+"/deny", []byte(denied), 0600), check.IsNil)
+	defer func(keyFile, denyFile string) {
+		shareLinkKeyFile, shareLinkDenyFile = keyFile, denyFile
+	}(shareLinkKeyFile, shareLinkDenyFile)
+	shareLinkKeyFile, shareLinkDenyFile = dir+"/keys", dir+"/deny"
+	c.Assert(shareLinks.load(), check.IsNil)
+	return func() {
+		os.RemoveAll(dir)
+		shareLinks.load()
+	}
+}
+
+func (s *UnitSuite) TestShareLinkSignVerify(c *check.C) {
+	defer setupShareLinks(c, "# comment\nkey2 secret2secret2secret2\nkey1 secret1secret1secret1\n", "")()
+	now := time.Now()
+	link := &shareLink{
+		Collection: arvadostest.FooCollection,
+		Prefix:     "dir",
+		Expires:    now.Add(time.Hour).Unix(),
+	}
+	encoded, err := shareLinks.sign(link)
+	c.Assert(err, check.IsNil)
+	c.Check(link.KeyID, check.Equals, "key2")
+	c.Check(link.ID, check.Matches, `[0-9a-f]{24}`)
+
+	got, err := shareLinks.verify(encoded, now, "10.1.2.3")
+	c.Assert(err, check.IsNil)
+	c.Check(*got, check.DeepEquals, *link)
+
+	_, err = shareLinks.verify(encoded, now.Add(2*time.Hour), "10.1.2.3")
+	c.Check(err, check.Equals, errShareLinkExpired)
+
+	// Tampering with the payload or signature
+	for _, bad := range []string{
+		strings.Replace(encoded, ".", "x.", 1),
+		encoded + "x",
+		encoded[:strings.Index(encoded, ".")],
+		"",
+	} {
+		_, err = shareLinks.verify(bad, now, "10.1.2.3")
+		c.Check(err, check.Equals, errShareLinkInvalid)
+	}
+
+	// Client IP restriction
+	link = &shareLink{Collection: arvadostest.FooCollection, Expires: now.Add(time.Hour).Unix(), ClientIP: "10.1.2.3"}
+	ipLink, err := shareLinks.sign(link)
+	c.Assert(err, check.IsNil)
+	_, err = shareLinks.verify(ipLink, now, "10.1.2.3")
+	c.Check(err, check.IsNil)
+	_, err = shareLinks.verify(ipLink, now, "10.1.2.4")
+	c.Check(err, check.Equals, errShareLinkClientIP)
+
+	// Key rotation: links signed with an old key still work
+	// until the key is removed.
+	defer setupShareLinks(c, "key3 secret3secret3secret3\nkey2 secret2secret2secret2\n", "")()
+	_, err = shareLinks.verify(encoded, now, "10.1.2.3")
+	c.Check(err, check.IsNil)
+	defer setupShareLinks(c, "key3 secret3secret3secret3\n", "")()
+	_, err = shareLinks.verify(encoded, now, "10.1.2.3")
+	c.Check(err, check.Equals, errShareLinkInvalid)
+
+	// Revocation
+	defer setupShareLinks(c, "key2 secret2secret2secret2\n", got.ID+"\n")()
+	_, err = shareLinks.verify(encoded, now, "10.1.2.3")
+	c.Check(err, check.Equals, errShareLinkRevoked)
+	_, err = shareLinks.verify(ipLink, now, "10.1.2.3")
+	c.Check(err, check.IsNil)
+
+	// Disabled
+	defer setupShareLinks(c, "", "")()
+	_, err = shareLinks.verify(ipLink, now, "10.1.2.3")
+	c.Check(err, check.Equals, errShareLinksDisabled)
+}
+
+func (s *UnitSuite) TestShareLinkKeyFileErrors(c *check.C) {
+	defer func(keyFile string) { shareLinkKeyFile = keyFile }(shareLinkKeyFile)
+	shareLinkKeyFile = "/nonexistent"
+	c.Check(shareLinks.load(), check.NotNil)
+
+	f, err := ioutil.TempFile("", "keep-web-test-")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.Write([]byte("key1 tooshort\n"))
+	f.Close()
+	shareLinkKeyFile = f.Name()
+	c.Check(shareLinks.load(), check.ErrorMatches, `.*at least 16 characters`)
+}
+
+func (s *UnitSuite) TestShareLinkAllows(c *check.C) {
+	link := &shareLink{Prefix: "dir/sub"}
+	for filename, ok := range map[string]bool{
+		"dir/sub":            true,
+		"dir/sub/":           true,
+		"dir/sub/file":       true,
+		"dir/sub/../sub/foo": true,
+		"dir/sub/../foo":     false,
+		"dir/subway":         false,
+		"dir":                false,
+		"":                   false,
+	} {
+		c.Check(link.allows(filename), check.Equals, ok, check.Commentf("%q", filename))
+	}
+	link.Prefix = ""
+	c.Check(link.allows("anything/at/all"), check.Equals, true)
+}
+
+func (s *UnitSuite) TestClientIP(c *check.C) {
+	for _, trial := range []struct {
+		remoteAddr string
+		xff        string
+		expect     string
+	}{
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "10.9.9.9", "10.1.2.3"},
+		{"127.0.0.1:1234", "10.9.9.9, 10.1.2.3", "10.1.2.3"},
+		{"[::1]:1234", "10.1.2.3", "10.1.2.3"},
+		{"[::1]:1234", "", "::1"},
+	} {
+		r := &http.Request{RemoteAddr: trial.remoteAddr, Header: http.Header{}}
+		if trial.xff != "" {
+			r.Header.Set("X-Forwarded-For", trial.xff)
+		}
+		c.Check(clientIP(r), check.Equals, trial.expect, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *UnitSuite) TestShareLinkRequest(c *check.C) {
+	defer setupShareLinks(c, "key1 secret1secret1secret1\n", "")()
+	_, arv, done := s.setupStubCollectionAPI(c)
+	defer done()
+	h := &handler{}
+
+	for _, trial := range []struct {
+		method string
+		token  string
+		form   url.Values
+		status int
+	}{
+		{"POST", "good", url.Values{"collection": {"zzzzz-4zz18-aaaaaaaaaaaaaaa"}, "path": {"foo"}}, http.StatusOK},
+		{"POST", "good", url.Values{"collection": {"zzzzz-4zz18-aaaaaaaaaaaaaaa"}, "ttl": {"1000h"}, "ip": {"10.1.2.3"}}, http.StatusOK},
+		{"POST", "good", url.Values{"collection": {"zzzzz-4zz18-bbbbbbbbbbbbbbb"}}, http.StatusNotFound},
+		{"POST", "bad", url.Values{"collection": {"zzzzz-4zz18-aaaaaaaaaaaaaaa"}}, http.StatusUnauthorized},
+		{"POST", "", url.Values{"collection": {"zzzzz-4zz18-aaaaaaaaaaaaaaa"}}, http.StatusUnauthorized},
+		{"POST", "good", url.Values{}, http.StatusBadRequest},
+		{"POST", "good", url.Values{"collection": {"zzzzz-4zz18-aaaaaaaaaaaaaaa"}, "ttl": {"-1h"}}, http.StatusBadRequest},
+		{"POST", "good", url.Values{"collection": {"zzzzz-4zz18-aaaaaaaaaaaaaaa"}, "ip": {"example.com"}}, http.StatusBadRequest},
+		{"GET", "good", url.Values{"collection": {"zzzzz-4zz18-aaaaaaaaaaaaaaa"}}, http.StatusMethodNotAllowed},
+	} {
+		c.Logf("%+v", trial)
+		req := &http.Request{
+			Method: trial.method,
+			URL:    mustParseURL("http://collections.example.com/share-links"),
+			Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+			Body:   ioutil.NopCloser(strings.NewReader(trial.form.Encode())),
+		}
+		if trial.token != "" {
+			req.Header.Set("Authorization", "OAuth2 "+trial.token)
+		}
+		resp := httptest.NewRecorder()
+		status, _ := h.serveShareLinkRequest(resp, req, arv)
+		c.Check(status, check.Equals, trial.status)
+		if status != http.StatusOK {
+			continue
+		}
+		var result map[string]string
+		c.Assert(json.Unmarshal(resp.Body.Bytes(), &result), check.IsNil)
+		c.Check(result["path"], check.Matches, `/share/[-_A-Za-z0-9]+\.[-_A-Za-z0-9]+/`+trial.form.Get("path"))
+		link, err := shareLinks.verify(strings.Split(result["path"], "/")[2], time.Now(), trial.form.Get("ip"))
+		c.Assert(err, check.IsNil)
+		c.Check(link.ID, check.Equals, result["id"])
+		c.Check(link.Collection, check.Equals, trial.form.Get("collection"))
+		c.Check(link.Prefix, check.Equals, trial.form.Get("path"))
+		c.Check(link.Expires <= time.Now().Add(shareLinkMaxTTL).Unix(), check.Equals, true)
+	}
+}
+
+func (s *IntegrationSuite) TestShareLink(c *check.C) {
+	defer setupShareLinks(c, "key1 secret1secret1secret1\n", "")()
+	shareLinks.token = arvadostest.ActiveToken
+	h := &handler{}
+
+	u := mustParseURL("http://collections.example.com/share-links")
+	req := &http.Request{
+		Method:     "POST",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header: http.Header{
+			"Authorization": {"OAuth2 " + arvadostest.ActiveToken},
+			"Content-Type":  {"application/x-www-form-urlencoded"},
+		},
+		Body: ioutil.NopCloser(strings.NewReader(url.Values{
+			"collection": {arvadostest.FooCollection},
+			"path":       {"foo"},
+		}.Encode())),
+	}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	var result map[string]string
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &result), check.IsNil)
+
+	for _, trial := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", result["path"], http.StatusOK},
+		{"PUT", result["path"], http.StatusForbidden},
+		{"GET", strings.TrimSuffix(result["path"], "foo") + "bar", http.StatusNotFound},
+		{"GET", strings.Replace(result["path"], ".", ".x", 1), http.StatusNotFound},
+	} {
+		u := mustParseURL("http://collections.example.com" + trial.path)
+		req := &http.Request{
+			Method:     trial.method,
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.status, check.Commentf("%+v", trial))
+		if trial.status == http.StatusOK {
+			c.Check(resp.Body.String(), check.Equals, "foo")
+		}
+	}
+}
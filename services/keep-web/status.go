@@ -0,0 +1,19 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// webStatus is the response to a /status.json request.
+type webStatus struct {
+	Cache cacheStats
+}
+
+// serveStatus responds to /status.json requests (at any host name
+// that isn't a collection ID) with the current cache statistics.
+func (h *handler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	st := webStatus{Cache: h.cache.Stats()}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&st)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	// webdavMethods are handled by webdav.Handler. GET, HEAD and
+	// POST use the plain download code path instead.
+	webdavMethods = map[string]bool{
+		"COPY":      true,
+		"DELETE":    true,
+		"LOCK":      true,
+		"MKCOL":     true,
+		"MOVE":      true,
+		"OPTIONS":   true,
+		"PROPFIND":  true,
+		"PROPPATCH": true,
+		"PUT":       true,
+		"UNLOCK":    true,
+	}
+
+	// webdavWriteMethods need write permission on the collection.
+	webdavWriteMethods = map[string]bool{
+		"COPY":      true,
+		"DELETE":    true,
+		"LOCK":      true,
+		"MKCOL":     true,
+		"MOVE":      true,
+		"PROPPATCH": true,
+		"PUT":       true,
+		"UNLOCK":    true,
+	}
+)
+
+// webdavFS adapts collectionFS to webdav.FileSystem.
+type webdavFS struct {
+	*collectionFS
+}
+
+func (fs webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.collectionFS.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ETag implements webdav.ETager.
+func (fi *cfsFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.etag, nil
+}
+
+// noLockSystem grants every lock request without enforcing
+// anything. Some clients (like Finder) mount read-only unless the
+// server supports locking, but keep-web has nothing to lock: each
+// request works on its own copy of the collection, and concurrent
+// changes are resolved when the collection record is updated (the
+// last update wins).
+type noLockSystem struct{}
+
+func (noLockSystem) Confirm(time.Time, string, string, ...webdav.Condition) (func(), error) {
+	return func() {}, nil
+}
+
+func (noLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("opaquelocktoken:%x", buf), nil
+}
+
+func (noLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	return webdav.LockDetails{}, nil
+}
+
+func (noLockSystem) Unlock(now time.Time, token string) error {
+	return nil
+}
+
+// collectionWritable returns true if arv's token can be used to
+// update the given collection. A collection identified by portable
+// data hash is never writable.
+func collectionWritable(arv *arvadosclient.ArvadosClient, targetID string, collection map[string]interface{}) bool {
+	if !arvadosclient.UUIDMatch(targetID) {
+		return false
+	}
+	writableBy, ok := collection["writable_by"].([]interface{})
+	if !ok {
+		// Let the API server decide when we try to save.
+		return true
+	}
+	userUUID := userUUIDForToken(arv)
+	for _, uuid := range writableBy {
+		if uuid == userUUID {
+			return true
+		}
+	}
+	return false
+}
+
+// serveWebDAV handles a WebDAV request for the given collection,
+// using prefix as the URL path of the collection root. If the
+// request changes the collection, the new manifest is saved before
+// the response status is sent, and the updated collection record is
+// passed to saved.
+func serveWebDAV(w http.ResponseWriter, r *http.Request, arv *arvadosclient.ArvadosClient, kc cfsKeepClient, collection map[string]interface{}, prefix string, writable bool, saved func(map[string]interface{})) {
+	if webdavWriteMethods[r.Method] && !writable {
+		http.Error(w, "collection is read-only", http.StatusForbidden)
+		return
+	}
+	fs, err := collectionFSForRecord(kc, collection, !writable)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if r.Method == "PUT" {
+		// RFC 4918 9.7.1: "A PUT that would result in the
+		// creation of a resource without an appropriately
+		// scoped parent collection MUST fail with a 409
+		// (Conflict)."
+		reqPath := path.Clean("/" + r.URL.Path[len(prefix):])
+		if fi, err := fs.Stat(r.Context(), path.Dir(reqPath)); err != nil || !fi.IsDir() {
+			http.Error(w, "parent directory does not exist", http.StatusConflict)
+			return
+		}
+	}
+	uuid, _ := collection["uuid"].(string)
+	h := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: webdavFS{fs},
+		LockSystem: noLockSystem{},
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				httpserver.Log(r.Header.Get(httpserver.HeaderRequestID), "webdav:", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	h.ServeHTTP(&updateOnSuccess{
+		ResponseWriter: w,
+		update: func() error {
+			if !fs.Modified() {
+				return nil
+			}
+			mText, err := fs.MarshalManifest(r.Context())
+			if err != nil {
+				return err
+			}
+			err = arv.UpdateContext(r.Context(), "collections", uuid, arvadosclient.Dict{
+				"collection": arvadosclient.Dict{"manifest_text": mText},
+			}, &collection)
+			if err != nil {
+				return err
+			}
+			saved(collection)
+			return nil
+		},
+	}, r)
+}
+
+// updateOnSuccess calls update before sending a 2xx or 3xx response
+// header. If update fails, the response status reflects the error
+// instead, and the body that would have accompanied a successful
+// response is discarded.
+type updateOnSuccess struct {
+	http.ResponseWriter
+	update     func() error
+	sentHeader bool
+	err        error
+}
+
+func (uos *updateOnSuccess) Write(p []byte) (int, error) {
+	if !uos.sentHeader {
+		uos.WriteHeader(http.StatusOK)
+	}
+	if uos.err != nil {
+		return 0, uos.err
+	}
+	return uos.ResponseWriter.Write(p)
+}
+
+func (uos *updateOnSuccess) WriteHeader(code int) {
+	if uos.sentHeader {
+		return
+	}
+	uos.sentHeader = true
+	if code >= 200 && code < 400 {
+		if uos.err = uos.update(); uos.err != nil {
+			code = http.StatusBadGateway
+			if srvErr, ok := uos.err.(arvadosclient.APIServerError); ok {
+				switch srvErr.HttpStatusCode {
+				case 401, 403:
+					code = http.StatusForbidden
+				case 404:
+					code = http.StatusNotFound
+				case 409, 422:
+					code = http.StatusConflict
+				}
+			}
+			uos.ResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			uos.ResponseWriter.WriteHeader(code)
+			fmt.Fprintln(uos.ResponseWriter, uos.err.Error())
+			return
+		}
+	}
+	uos.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func webdavTestRequest(method, host, path, token string, hdr http.Header, body string) *http.Request {
+	u := mustParseURL("http://" + host + path)
+	if hdr == nil {
+		hdr = http.Header{}
+	}
+	hdr.Set("Authorization", "OAuth2 "+token)
+	return &http.Request{
+		Method:     method,
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header:     hdr,
+		Body:       &nopCloser{strings.NewReader(body)},
+	}
+}
+
+type nopCloser struct {
+	*strings.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (s *IntegrationSuite) TestWebDAVPropfind(c *check.C) {
+	resp := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, webdavTestRequest("PROPFIND", arvadostest.FooCollection+".example.com", "/", arvadostest.ActiveToken, http.Header{"Depth": {"1"}}, ""))
+	c.Check(resp.Code, check.Equals, http.StatusMultiStatus)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*<D:href>/foo</D:href>.*<D:getcontentlength>3</D:getcontentlength>.*`)
+
+	resp = httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, webdavTestRequest("PROPFIND", arvadostest.FooCollection+".example.com", "/nonexistent", arvadostest.ActiveToken, nil, ""))
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *IntegrationSuite) TestWebDAVReadOnly(c *check.C) {
+	for _, trial := range []struct {
+		host  string
+		token string
+	}{
+		// Content addressed collections are immutable.
+		{strings.Replace(arvadostest.FooPdh, "+", "-", 1) + ".example.com", arvadostest.ActiveToken},
+		// The anonymous user can read, but not write, a
+		// public collection.
+		{arvadostest.HelloWorldCollection + ".example.com", arvadostest.AnonymousToken},
+	} {
+		resp := httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, webdavTestRequest("PUT", trial.host, "/newfile", trial.token, nil, "bar"))
+		c.Check(resp.Code, check.Equals, http.StatusForbidden, check.Commentf("%s", trial.host))
+	}
+}
+
+func (s *IntegrationSuite) TestWebDAVWrite(c *check.C) {
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, check.IsNil)
+	arv.ApiToken = arvadostest.ActiveToken
+	var coll map[string]interface{}
+	err = arv.Create("collections", arvadosclient.Dict{
+		"collection": arvadosclient.Dict{"name": "keep-web webdav test"},
+	}, &coll)
+	c.Assert(err, check.IsNil)
+	uuid := coll["uuid"].(string)
+	defer arv.Delete("collections", uuid, nil, nil)
+
+	for _, trial := range []struct {
+		method string
+		path   string
+		hdr    http.Header
+		body   string
+		status int
+	}{
+		{"PUT", "/foo", nil, "foo", http.StatusCreated},
+		{"MKCOL", "/dir", nil, "", http.StatusCreated},
+		{"MKCOL", "/dir", nil, "", http.StatusMethodNotAllowed},
+		{"MKCOL", "/missing/dir", nil, "", http.StatusConflict},
+		{"PUT", "/missing/bar", nil, "bar", http.StatusConflict},
+		{"PUT", "/dir/bar", nil, "bar", http.StatusCreated},
+		{"COPY", "/foo", http.Header{"Destination": {"http://" + uuid + ".example.com/dir/foo"}}, "", http.StatusCreated},
+		{"MOVE", "/dir/bar", http.Header{"Destination": {"http://" + uuid + ".example.com/baz"}}, "", http.StatusCreated},
+		{"DELETE", "/foo", nil, "", http.StatusNoContent},
+		{"DELETE", "/foo", nil, "", http.StatusNotFound},
+	} {
+		resp := httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, webdavTestRequest(trial.method, uuid+".example.com", trial.path, arv.ApiToken, trial.hdr, trial.body))
+		c.Check(resp.Code, check.Equals, trial.status, check.Commentf("%s %s: %s", trial.method, trial.path, resp.Body.String()))
+	}
+
+	coll = nil
+	err = arv.Get("collections", uuid, nil, &coll)
+	c.Assert(err, check.IsNil)
+	mText := regexp.MustCompile(`\+A[^ ]*`).ReplaceAllString(coll["manifest_text"].(string), "")
+	c.Check(mText, check.Equals, ""+
+		". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:baz\n"+
+		"./dir acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n")
+}
+
+func (s *UnitSuite) TestUpdateOnSuccess(c *check.C) {
+	for _, trial := range []struct {
+		status    int
+		updateErr error
+		expect    int
+	}{
+		{http.StatusCreated, nil, http.StatusCreated},
+		{http.StatusNotFound, errors.New("not called"), http.StatusNotFound},
+		{http.StatusNoContent, errors.New("network error"), http.StatusBadGateway},
+		{http.StatusCreated, arvadosclient.APIServerError{HttpStatusCode: 403}, http.StatusForbidden},
+		{http.StatusCreated, arvadosclient.APIServerError{HttpStatusCode: 422}, http.StatusConflict},
+	} {
+		called := false
+		resp := httptest.NewRecorder()
+		uos := &updateOnSuccess{
+			ResponseWriter: resp,
+			update: func() error {
+				called = true
+				return trial.updateErr
+			},
+		}
+		uos.WriteHeader(trial.status)
+		uos.Write([]byte("ok"))
+		c.Check(resp.Code, check.Equals, trial.expect)
+		c.Check(called, check.Equals, trial.status < 400)
+		if trial.status == trial.expect {
+			c.Check(resp.Body.String(), check.Equals, "ok")
+		} else {
+			c.Check(resp.Body.String(), check.Not(check.Equals), "ok")
+		}
+	}
+}
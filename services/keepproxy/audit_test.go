@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/auditlog"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&AuditSuite{})
+
+// Tests of the audit log, using the stub servers from CacheSuite
+type AuditSuite struct {
+	stubs CacheSuite
+}
+
+func (s *AuditSuite) SetUpTest(c *C) {
+	s.stubs.SetUpTest(c)
+}
+
+func (s *AuditSuite) TearDownTest(c *C) {
+	audit.Close()
+	audit = nil
+	s.stubs.TearDownTest(c)
+}
+
+func (s *AuditSuite) TestLogBlockAccess(c *C) {
+	path := filepath.Join(s.stubs.dir, "audit.log")
+	var err error
+	audit, err = (&auditlog.Config{File: path, BufferSize: 10}).NewLogger(nil)
+	c.Assert(err, IsNil)
+
+	resp := s.stubs.do(c, "PUT", "/"+cacheTestHash("foo"), nil, "foo")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	locator := s.stubs.sign("foo")
+	resp = s.stubs.do(c, "GET", "/"+locator, map[string]string{"Range": "bytes=0-1", "User-Agent": "audit-test"}, "")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(audit.Close(), IsNil)
+	audit = nil
+
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	var events []auditlog.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev auditlog.Event
+		c.Check(json.Unmarshal(scanner.Bytes(), &ev), IsNil)
+		events = append(events, ev)
+	}
+	c.Assert(events, HasLen, 2)
+	for _, ev := range events {
+		c.Check(ev.Service, Equals, "keepproxy")
+		c.Check(ev.Status, Equals, http.StatusOK)
+		c.Check(ev.UserUUID, Equals, "zzzzz-tpzed-000000000000001")
+		c.Check(ev.Bytes, Equals, int64(3))
+	}
+	c.Check(events[0].Method, Equals, "PUT")
+	c.Check(events[0].Locator, Equals, cacheTestHash("foo")+"+3+Asignedupstream@12345678")
+	c.Check(events[1].Method, Equals, "GET")
+	c.Check(events[1].Locator, Equals, locator)
+	c.Check(events[1].Range, Equals, "bytes=0-1")
+	c.Check(events[1].UserAgent, Equals, "audit-test")
+}
+
+type failingSink struct{}
+
+func (failingSink) Write([]auditlog.Event) (int, error) {
+	return 0, errors.New("failingSink")
+}
+
+func (s *AuditSuite) TestFailClosed(c *C) {
+	audit = auditlog.NewLogger(failingSink{}, 1, true)
+	audit.Log(auditlog.Event{})
+	for deadline := time.Now().Add(5 * time.Second); audit.Ready() == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	for _, method := range []string{"GET", "PUT", "GET"} {
+		resp := s.stubs.do(c, method, "/"+cacheTestHash("foo"), nil, "foo")
+		c.Check(resp.Code, Equals, http.StatusServiceUnavailable)
+	}
+	_, ok := s.stubs.upstream(cacheTestHash("foo"))
+	c.Check(ok, Equals, false)
+	// Refused requests are not logged, so they don't fill the
+	// buffer (which has room for only one event).
+	c.Check(audit.Dropped(), Equals, int64(0))
+}
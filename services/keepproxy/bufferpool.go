@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+)
+
+// DefaultMaxBuffers is the default number of block buffers that can
+// be in use at once. Override with -max-buffers.
+const DefaultMaxBuffers = 32
+
+// bufs is the pool of buffers used to hold PUT blocks while they are
+// written upstream.
+var bufs = newBufferPool(DefaultMaxBuffers, keepclient.BLOCKSIZE)
+
+var ClientDisconnectError = errors.New("Client disconnected")
+
+type bufferPool struct {
+	// limiter has a "true" placeholder for each in-use buffer.
+	limiter chan bool
+	// allocated is the number of bytes currently allocated to buffers.
+	allocated uint64
+	// Pool has unused buffers.
+	sync.Pool
+}
+
+func newBufferPool(count int, bufSize int) *bufferPool {
+	p := bufferPool{}
+	p.New = func() interface{} {
+		atomic.AddUint64(&p.allocated, uint64(bufSize))
+		return make([]byte, bufSize)
+	}
+	p.limiter = make(chan bool, count)
+	return &p
+}
+
+func (p *bufferPool) Get(size int) []byte {
+	select {
+	case p.limiter <- true:
+	default:
+		t0 := time.Now()
+		log.Printf("reached max buffers (%d), waiting", cap(p.limiter))
+		p.limiter <- true
+		log.Printf("waited %v for a buffer", time.Since(t0))
+	}
+	buf := p.Pool.Get().([]byte)
+	if cap(buf) < size {
+		log.Fatalf("bufferPool Get(size=%d) but max=%d", size, cap(buf))
+	}
+	return buf[:size]
+}
+
+// TryGet is like Get, but returns false instead of waiting if the
+// maximum number of buffers are already in use.
+func (p *bufferPool) TryGet(size int) ([]byte, bool) {
+	select {
+	case p.limiter <- true:
+	default:
+		return nil, false
+	}
+	buf := p.Pool.Get().([]byte)
+	if cap(buf) < size {
+		log.Fatalf("bufferPool TryGet(size=%d) but max=%d", size, cap(buf))
+	}
+	return buf[:size], true
+}
+
+func (p *bufferPool) Put(buf []byte) {
+	p.Pool.Put(buf)
+	<-p.limiter
+}
+
+// Alloc returns the number of bytes allocated to buffers.
+func (p *bufferPool) Alloc() uint64 {
+	return atomic.LoadUint64(&p.allocated)
+}
+
+// Cap returns the maximum number of buffers allowed.
+func (p *bufferPool) Cap() int {
+	return cap(p.limiter)
+}
+
+// Len returns the number of buffers in use right now.
+func (p *bufferPool) Len() int {
+	return len(p.limiter)
+}
+
+// Get a buffer from the pool -- but give up and return a non-nil
+// error if resp implements http.CloseNotifier and tells us that the
+// client has disconnected before we get a buffer.
+func getBufferForResponseWriter(resp http.ResponseWriter, bufs *bufferPool, bufSize int) ([]byte, error) {
+	var closeNotifier <-chan bool
+	if resp, ok := resp.(http.CloseNotifier); ok {
+		closeNotifier = resp.CloseNotify()
+	}
+	var buf []byte
+	bufReady := make(chan []byte)
+	go func() {
+		bufReady <- bufs.Get(bufSize)
+		close(bufReady)
+	}()
+	select {
+	case buf = <-bufReady:
+		return buf, nil
+	case <-closeNotifier:
+		go func() {
+			// Even if closeNotifier happened first, we
+			// need to keep waiting for our buf so we can
+			// return it to the pool.
+			bufs.Put(<-bufReady)
+		}()
+		return nil, ClientDisconnectError
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&BufferPoolSuite{})
+
+type BufferPoolSuite struct{}
+
+// Restore sane default after bufferpool's own tests
+func (s *BufferPoolSuite) TearDownTest(c *C) {
+	bufs = newBufferPool(DefaultMaxBuffers, keepclient.BLOCKSIZE)
+}
+
+func (s *BufferPoolSuite) TestBufferPoolBufSize(c *C) {
+	bufs := newBufferPool(2, 10)
+	b1 := bufs.Get(1)
+	bufs.Get(2)
+	bufs.Put(b1)
+	b3 := bufs.Get(3)
+	c.Check(len(b3), Equals, 3)
+}
+
+func (s *BufferPoolSuite) TestBufferPoolAtLimit(c *C) {
+	bufs := newBufferPool(2, 10)
+	b1 := bufs.Get(10)
+	bufs.Get(10)
+	race := make(chan string)
+	go func() {
+		bufs.Get(10)
+		time.Sleep(time.Millisecond)
+		race <- "Get"
+	}()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		bufs.Put(b1)
+		race <- "Put"
+	}()
+	c.Check(<-race, Equals, "Put")
+	c.Check(<-race, Equals, "Get")
+}
+
+func (s *BufferPoolSuite) TestTryGet(c *C) {
+	bufs := newBufferPool(1, 10)
+	b1, ok := bufs.TryGet(5)
+	c.Check(ok, Equals, true)
+	c.Check(len(b1), Equals, 5)
+	_, ok = bufs.TryGet(5)
+	c.Check(ok, Equals, false)
+	bufs.Put(b1)
+	_, ok = bufs.TryGet(10)
+	c.Check(ok, Equals, true)
+}
+
+type closeNotifyingRecorder struct {
+	*httptest.ResponseRecorder
+	closed chan bool
+}
+
+func (r closeNotifyingRecorder) CloseNotify() <-chan bool {
+	return r.closed
+}
+
+func (s *BufferPoolSuite) TestGiveUpWhenClientDisconnects(c *C) {
+	bufs := newBufferPool(1, 10)
+	b1 := bufs.Get(10)
+	resp := closeNotifyingRecorder{httptest.NewRecorder(), make(chan bool, 1)}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		resp.closed <- true
+	}()
+	_, err := getBufferForResponseWriter(resp, bufs, 10)
+	c.Check(err, Equals, ClientDisconnectError)
+
+	// The abandoned buffer goes back to the pool once it's
+	// available.
+	bufs.Put(b1)
+	for deadline := time.Now().Add(time.Second); bufs.Len() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(bufs.Len(), Equals, 0)
+}
+
+func (s *BufferPoolSuite) TestStatus(c *C) {
+	bufs = newBufferPool(3, 10)
+	bufs.Get(10)
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/status.json", nil)
+	MakeRESTRouter(true, true, nil, nil, nil, nil).ServeHTTP(resp, req)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	var st ProxyStatus
+	c.Check(json.Unmarshal(resp.Body.Bytes(), &st), IsNil)
+	c.Check(st.BufferPool, DeepEquals, PoolStatus{Alloc: 10, Cap: 3, Len: 1})
+	c.Check(st.Memory.Alloc, Not(Equals), uint64(0))
+}
+
+func (s *BufferPoolSuite) TestLimitPuts(c *C) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	h := limitPuts(1, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	do := func(method string) int {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/", nil)
+		h.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	done := make(chan int)
+	go func() { done <- do("PUT") }()
+	<-started
+	for _, method := range []string{"PUT", "POST", "PATCH"} {
+		c.Check(do(method), Equals, http.StatusServiceUnavailable)
+	}
+
+	// GETs are still served while the PUT limit is reached.
+	go func() { done <- do("GET") }()
+	<-started
+	release <- struct{}{}
+	release <- struct{}{}
+	c.Check(<-done, Equals, http.StatusOK)
+	c.Check(<-done, Equals, http.StatusOK)
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/keeplocator"
+)
+
+// Edge cache
+//
+// When keepproxy runs at a site with a slow link to the cluster, a
+// BlockCache keeps recently used blocks on local disk, so repeated
+// GETs are served locally. PUT blocks are written to the cache
+// before being forwarded upstream; if forwarding fails, the block
+// stays in the cache (and is not evicted) while a background
+// goroutine retries.
+//
+// Blocks are forwarded with the proxy's own token, not the token of
+// the client that sent them, so clients' tokens are never written to
+// disk. (The client already has its response, so the locator
+// returned by the upstream service is only used for logging.)
+//
+// By default, a PUT response still reports only the replicas
+// confirmed by the upstream Keep services. A client that sends
+// "X-Keep-Proxy-Ack: local" gets a response as soon as the block is
+// safely on the proxy's disk, with a locator signed by the proxy
+// itself and an "X-Keep-Upstream-Pending: true" header. This
+// requires the cluster's blob signing key (see SetSigningKey).
+
+// CacheFullError means the cache has no room for a block, because it
+// is full of blocks waiting to be forwarded upstream.
+var CacheFullError = errors.New("Cache is full of blocks waiting to be forwarded upstream")
+
+const (
+	XKeepProxyAck        = "X-Keep-Proxy-Ack"
+	XKeepUpstreamPending = "X-Keep-Upstream-Pending"
+)
+
+// A BlockCache is a size-limited LRU cache of blocks on local disk,
+// plus a persistent queue of blocks to forward upstream.
+type BlockCache struct {
+	dir          string
+	maxBytes     int64
+	kc           *keepclient.KeepClient
+	signingKey   []byte
+	signatureTTL time.Duration
+
+	// Interval between scans of the forwarding queue, and delays
+	// between attempts to forward a block.
+	forwardInterval time.Duration
+	retryPolicy     arvados.RetryPolicy
+
+	mtx         sync.Mutex
+	lru         *list.List // of *cachedBlock, most recently used first
+	blocks      map[string]*list.Element
+	size        int64
+	pinnedBytes int64
+	pending     map[string]*pendingPut
+	wake        chan struct{}
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+type cachedBlock struct {
+	hash   string
+	size   int64
+	pinned bool
+}
+
+// A pendingPut is a block waiting to be forwarded upstream. It is
+// saved as JSON in the cache's "pending" directory.
+type pendingPut struct {
+	Hash        string
+	Size        int64
+	Replicas    int
+	Attempts    int
+	NextAttempt time.Time
+
+	busy bool
+}
+
+// NewBlockCache returns a BlockCache that stores up to maxBytes of
+// blocks in dir, and forwards PUT blocks using kc (and its API
+// token). Blocks and pending PUTs left in dir by a previous process
+// are picked up again.
+func NewBlockCache(dir string, maxBytes int64, kc *keepclient.KeepClient) (*BlockCache, error) {
+	bc := &BlockCache{
+		dir:             dir,
+		maxBytes:        maxBytes,
+		kc:              kc,
+		forwardInterval: time.Second,
+		retryPolicy:     arvados.RetryPolicy{BaseDelay: 10 * time.Second, MaxDelay: 10 * time.Minute},
+		lru:             list.New(),
+		blocks:          make(map[string]*list.Element),
+		pending:         make(map[string]*pendingPut),
+		wake:            make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
+	for _, sub := range []string{"blocks", "pending"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := bc.loadBlocks(); err != nil {
+		return nil, err
+	}
+	if err := bc.loadPending(); err != nil {
+		return nil, err
+	}
+	bc.mtx.Lock()
+	bc.evict()
+	bc.mtx.Unlock()
+	go bc.forwardLoop()
+	return bc, nil
+}
+
+// SetSigningKey enables "X-Keep-Proxy-Ack: local" PUTs, and lets
+// GETs be served from the cache after checking the permission
+// signature locally, instead of asking upstream.
+func (bc *BlockCache) SetSigningKey(key []byte, ttl time.Duration) {
+	bc.signingKey = key
+	bc.signatureTTL = ttl
+}
+
+// Close stops forwarding blocks upstream.
+func (bc *BlockCache) Close() {
+	close(bc.stop)
+	<-bc.stopped
+}
+
+type fileInfoByTime []os.FileInfo
+
+func (s fileInfoByTime) Len() int           { return len(s) }
+func (s fileInfoByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s fileInfoByTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+
+func (bc *BlockCache) loadBlocks() error {
+	var found []os.FileInfo
+	err := filepath.Walk(filepath.Join(bc.dir, "blocks"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if !keeplocator.IsHash(fi.Name()) {
+			// Leftover temp file
+			os.Remove(path)
+			return nil
+		}
+		found = append(found, fi)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Sort(fileInfoByTime(found))
+	for _, fi := range found {
+		bc.blocks[fi.Name()] = bc.lru.PushFront(&cachedBlock{hash: fi.Name(), size: fi.Size()})
+		bc.size += fi.Size()
+	}
+	return nil
+}
+
+func (bc *BlockCache) loadPending() error {
+	paths, err := filepath.Glob(filepath.Join(bc.dir, "pending", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		var p pendingPut
+		buf, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(buf, &p)
+		}
+		if err != nil {
+			log.Printf("Error loading pending PUT %q: %v", path, err)
+			continue
+		}
+		e, ok := bc.blocks[p.Hash]
+		if !ok || filepath.Base(path) != p.Hash+".json" {
+			log.Printf("Discarding pending PUT %q: block is not in cache", path)
+			os.Remove(path)
+			continue
+		}
+		bc.pin(e.Value.(*cachedBlock))
+		bc.pending[p.Hash] = &p
+	}
+	return nil
+}
+
+func (bc *BlockCache) blockPath(hash string) string {
+	return filepath.Join(bc.dir, "blocks", hash[:3], hash)
+}
+
+func (bc *BlockCache) pendingPath(hash string) string {
+	return filepath.Join(bc.dir, "pending", hash+".json")
+}
+
+var errCachedBlockCorrupt = errors.New("hash mismatch")
+
+// Get returns the content of the given block, if it is in the cache
+// and its content matches its hash.
+func (bc *BlockCache) Get(hash string) ([]byte, bool) {
+	data, err := bc.get(hash)
+	return data, err == nil
+}
+
+// get returns the content of the given block. A block that turns out
+// to be missing or corrupt is discarded. Other errors (like EMFILE or
+// EIO) might be temporary, so the block, and any pending PUT, are
+// left alone.
+func (bc *BlockCache) get(hash string) ([]byte, error) {
+	bc.mtx.Lock()
+	e, ok := bc.blocks[hash]
+	if ok {
+		bc.lru.MoveToFront(e)
+	}
+	bc.mtx.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(bc.blockPath(hash))
+	if err == nil && fmt.Sprintf("%x", md5.Sum(data)) != hash {
+		err = errCachedBlockCorrupt
+	}
+	if err == errCachedBlockCorrupt || os.IsNotExist(err) {
+		log.Printf("Discarding cached block %s: %v", hash, err)
+		bc.discard(hash)
+		return nil, err
+	} else if err != nil {
+		log.Printf("Error reading cached block %s: %v", hash, err)
+		return nil, err
+	}
+	now := time.Now()
+	os.Chtimes(bc.blockPath(hash), now, now)
+	return data, nil
+}
+
+// Put stores a block in the cache. If pin is true, the block is not
+// evicted until Complete is called, and Put returns CacheFullError if
+// the cache does not have room.
+func (bc *BlockCache) Put(hash string, data []byte, pin bool) error {
+	size := int64(len(data))
+	if pin {
+		// Reserve space before writing, so concurrent
+		// pinned PUTs can't add up to more than maxBytes.
+		bc.mtx.Lock()
+		full := bc.pinnedBytes+size > bc.maxBytes
+		if !full {
+			bc.pinnedBytes += size
+		}
+		bc.mtx.Unlock()
+		if full {
+			return CacheFullError
+		}
+	} else if size > bc.maxBytes {
+		return nil
+	}
+	err := bc.writeBlock(hash, data)
+
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	if pin {
+		// Release the reservation. If the block is stored,
+		// pin adds it back.
+		bc.pinnedBytes -= size
+	}
+	if err != nil {
+		return err
+	}
+	e, ok := bc.blocks[hash]
+	if ok {
+		bc.lru.MoveToFront(e)
+	} else {
+		e = bc.lru.PushFront(&cachedBlock{hash: hash, size: size})
+		bc.blocks[hash] = e
+		bc.size += size
+	}
+	if pin {
+		bc.pin(e.Value.(*cachedBlock))
+	}
+	bc.evict()
+	return nil
+}
+
+// writeBlock writes a block file and syncs it to disk.
+func (bc *BlockCache) writeBlock(hash string, data []byte) error {
+	dir := filepath.Dir(bc.blockPath(hash))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), bc.blockPath(hash))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// pin prevents a block from being evicted. Caller must have lock.
+func (bc *BlockCache) pin(b *cachedBlock) {
+	if !b.pinned {
+		b.pinned = true
+		bc.pinnedBytes += b.size
+	}
+}
+
+// evict deletes least recently used blocks until the cache fits in
+// maxBytes. Caller must have lock.
+func (bc *BlockCache) evict() {
+	for e := bc.lru.Back(); e != nil && bc.size > bc.maxBytes; {
+		b := e.Value.(*cachedBlock)
+		prev := e.Prev()
+		if !b.pinned {
+			bc.lru.Remove(e)
+			delete(bc.blocks, b.hash)
+			bc.size -= b.size
+			os.Remove(bc.blockPath(b.hash))
+		}
+		e = prev
+	}
+}
+
+// discard removes a corrupt or missing block from the cache, along
+// with any pending PUT.
+func (bc *BlockCache) discard(hash string) {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	if e, ok := bc.blocks[hash]; ok {
+		b := e.Value.(*cachedBlock)
+		if b.pinned {
+			bc.pinnedBytes -= b.size
+		}
+		bc.lru.Remove(e)
+		delete(bc.blocks, hash)
+		bc.size -= b.size
+	}
+	os.Remove(bc.blockPath(hash))
+	if _, ok := bc.pending[hash]; ok {
+		log.Printf("Block %s was lost before it could be forwarded upstream", hash)
+		delete(bc.pending, hash)
+		os.Remove(bc.pendingPath(hash))
+	}
+}
+
+// Enqueue arranges for a (pinned) cached block to be forwarded
+// upstream. The request is saved to disk before Enqueue returns.
+func (bc *BlockCache) Enqueue(hash string, size int64, replicas int) error {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	if _, ok := bc.pending[hash]; ok {
+		return nil
+	}
+	p := &pendingPut{Hash: hash, Size: size, Replicas: replicas}
+	if err := bc.savePending(p); err != nil {
+		return err
+	}
+	bc.pending[hash] = p
+	select {
+	case bc.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (bc *BlockCache) savePending(p *pendingPut) error {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := bc.pendingPath(p.Hash) + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bc.pendingPath(p.Hash))
+}
+
+// Complete records that a block has been stored upstream, so it no
+// longer needs to be forwarded and can be evicted.
+func (bc *BlockCache) Complete(hash string) {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	if _, ok := bc.pending[hash]; ok {
+		delete(bc.pending, hash)
+		os.Remove(bc.pendingPath(hash))
+	}
+	if e, ok := bc.blocks[hash]; ok {
+		if b := e.Value.(*cachedBlock); b.pinned {
+			b.pinned = false
+			bc.pinnedBytes -= b.size
+		}
+	}
+	bc.evict()
+}
+
+// Pending returns the number of blocks waiting to be forwarded
+// upstream.
+func (bc *BlockCache) Pending() int {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	return len(bc.pending)
+}
+
+func (bc *BlockCache) forwardLoop() {
+	defer close(bc.stopped)
+	ticker := time.NewTicker(bc.forwardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bc.stop:
+			return
+		case <-bc.wake:
+		case <-ticker.C:
+		}
+		for _, p := range bc.duePending() {
+			bc.forward(p)
+		}
+	}
+}
+
+// duePending returns the pending PUTs that should be attempted now,
+// and marks them busy.
+func (bc *BlockCache) duePending() []*pendingPut {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	now := time.Now()
+	var due []*pendingPut
+	for _, p := range bc.pending {
+		if !p.busy && !p.NextAttempt.After(now) {
+			p.busy = true
+			due = append(due, p)
+		}
+	}
+	return due
+}
+
+// forward tries to write a pending block upstream.
+func (bc *BlockCache) forward(p *pendingPut) {
+	data, err := bc.get(p.Hash)
+	if err == nil {
+		kc := bc.kc.Clone(bc.kc.Arvados)
+		kc.Want_replicas = p.Replicas
+		var locator string
+		var replicas int
+		locator, replicas, err = kc.PutHB(p.Hash, data)
+		if replicas > 0 {
+			log.Printf("forwarded cached block %s upstream: %s, %d replicas", p.Hash, locator, replicas)
+			bc.Complete(p.Hash)
+			return
+		}
+	}
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	p.busy = false
+	if _, ok := bc.pending[p.Hash]; !ok {
+		// Corrupt or missing; get already discarded it.
+		return
+	}
+	p.Attempts++
+	p.NextAttempt = time.Now().Add(bc.retryPolicy.Delay(p.Attempts))
+	log.Printf("error forwarding cached block %s upstream (attempt %d, next at %v): %v", p.Hash, p.Attempts, p.NextAttempt, err)
+	if err := bc.savePending(p); err != nil {
+		log.Printf("error saving pending PUT %s: %v", p.Hash, err)
+	}
+}
+
+// CanSign returns true if the cache can sign locators for PUTs
+// acknowledged after the local write only.
+func (bc *BlockCache) CanSign() bool {
+	return len(bc.signingKey) > 0
+}
+
+// Sign returns a locator for the given block, signed for the given
+// token.
+func (bc *BlockCache) Sign(hash string, size int64, token string) string {
+	return keeplocator.SignLocator(fmt.Sprintf("%s+%d", hash, size), token, time.Now().Add(bc.signatureTTL), bc.signatureTTL, bc.signingKey)
+}
+
+// Permitted returns true if the client using kc (with the client's
+// token) is allowed to read the given locator. If the cache has the
+// signing key, this is checked locally; otherwise, upstream.
+func (bc *BlockCache) Permitted(ctx context.Context, kc *keepclient.KeepClient, locator string) bool {
+	if bc.CanSign() && !strings.Contains(locator, "+R") {
+		return keeplocator.VerifySignature(locator, kc.Arvados.ApiToken, bc.signatureTTL, bc.signingKey) == nil
+	}
+	_, _, err := kc.AskContext(ctx, locator)
+	return err == nil
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/keeplocator"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&CacheSuite{})
+
+// Tests that use a BlockCache with stub API and Keep servers
+type CacheSuite struct {
+	dir      string
+	apiStub  *httptest.Server
+	keepStub *httptest.Server
+	kc       *keepclient.KeepClient
+	bc       *BlockCache
+	router   http.Handler
+	mtx      sync.Mutex
+	blocks   map[string][]byte
+	gets     int
+	keepDown bool
+
+	// X-Request-Id headers received by the stub Keep server
+	requestIDs []string
+	// Tokens used for PUT requests received by the stub Keep
+	// server
+	putTokens []string
+}
+
+var cacheTestKey = []byte("cache-test-signing-key")
+
+func (s *CacheSuite) SetUpTest(c *C) {
+	var err error
+	s.dir, err = ioutil.TempDir("", "keepproxy-cache")
+	c.Assert(err, IsNil)
+	s.blocks = make(map[string][]byte)
+	s.gets = 0
+	s.keepDown = false
+	s.requestIDs = nil
+	s.putTokens = nil
+	s.bc = nil
+
+	s.apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var tok string
+		fmt.Sscanf(req.Header.Get("Authorization"), "OAuth2 %s", &tok)
+		if tok != "token1" || req.URL.Path != "/arvados/v1/users/current" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"uuid":"zzzzz-tpzed-000000000000001"}`))
+	}))
+	s.keepStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		if s.keepDown {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		s.requestIDs = append(s.requestIDs, req.Header.Get("X-Request-Id"))
+		hash := req.URL.Path[1:33]
+		switch req.Method {
+		case "GET", "HEAD":
+			s.gets++
+			data, ok := s.blocks[hash]
+			if !ok {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			if req.Method == "GET" {
+				w.Write(data)
+			}
+		case "PUT":
+			s.putTokens = append(s.putTokens, req.Header.Get("Authorization"))
+			body, err := ioutil.ReadAll(req.Body)
+			c.Check(err, IsNil)
+			c.Check(fmt.Sprintf("%x", md5.Sum(body)), Equals, hash)
+			s.blocks[hash] = body
+			w.Header().Set(keepclient.X_Keep_Replicas_Stored, "1")
+			fmt.Fprintf(w, "%s+%d+Asignedupstream@12345678", hash, len(body))
+		}
+	}))
+
+	s.kc = &keepclient.KeepClient{
+		Arvados: &arvadosclient.ArvadosClient{
+			Scheme:    "http",
+			ApiServer: strings.TrimPrefix(s.apiStub.URL, "http://"),
+			ApiToken:  "proxytoken",
+			Client:    &http.Client{Transport: &http.Transport{}},
+		},
+		Want_replicas: 1,
+		Client:        &http.Client{},
+	}
+	roots := map[string]string{"zzzzz-bi6l4-000000000000000": s.keepStub.URL}
+	s.kc.SetServiceRoots(roots, roots, nil)
+	s.restart(c, 1<<20)
+}
+
+func (s *CacheSuite) TearDownTest(c *C) {
+	s.bc.Close()
+	s.apiStub.Close()
+	s.keepStub.Close()
+	os.RemoveAll(s.dir)
+}
+
+// restart replaces the BlockCache and router with new ones, as if
+// keepproxy had restarted.
+func (s *CacheSuite) restart(c *C, maxBytes int64) {
+	if s.bc != nil {
+		s.bc.Close()
+	}
+	var err error
+	s.bc, err = NewBlockCache(s.dir, maxBytes, s.kc)
+	c.Assert(err, IsNil)
+	s.bc.SetSigningKey(cacheTestKey, time.Hour)
+	s.bc.mtx.Lock()
+	s.bc.retryPolicy.BaseDelay = time.Millisecond
+	s.bc.mtx.Unlock()
+	s.router = MakeRESTRouter(true, true, s.kc, nil, nil, s.bc)
+}
+
+func (s *CacheSuite) do(c *C, method, path string, hdr map[string]string, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://keep.example"+path, bytes.NewBufferString(body))
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", "OAuth2 token1")
+	req.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *CacheSuite) upstream(hash string) ([]byte, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	data, ok := s.blocks[hash]
+	return data, ok
+}
+
+func (s *CacheSuite) setKeepDown(down bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keepDown = down
+}
+
+func (s *CacheSuite) sign(data string) string {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+	return keeplocator.SignLocator(fmt.Sprintf("%s+%d", hash, len(data)), "token1", time.Now().Add(time.Hour), time.Hour, cacheTestKey)
+}
+
+func cacheTestHash(data string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(data)))
+}
+
+func (s *CacheSuite) TestEvictLeastRecentlyUsed(c *C) {
+	s.restart(c, 10)
+	for _, data := range []string{"aaaa", "bbbb"} {
+		c.Check(s.bc.Put(cacheTestHash(data), []byte(data), false), IsNil)
+	}
+	_, ok := s.bc.Get(cacheTestHash("aaaa"))
+	c.Check(ok, Equals, true)
+	c.Check(s.bc.Put(cacheTestHash("cccc"), []byte("cccc"), false), IsNil)
+
+	_, ok = s.bc.Get(cacheTestHash("bbbb"))
+	c.Check(ok, Equals, false)
+	_, err := os.Stat(s.bc.blockPath(cacheTestHash("bbbb")))
+	c.Check(os.IsNotExist(err), Equals, true)
+	for _, data := range []string{"aaaa", "cccc"} {
+		got, ok := s.bc.Get(cacheTestHash(data))
+		c.Check(ok, Equals, true)
+		c.Check(string(got), Equals, data)
+	}
+
+	// Blocks larger than the whole cache are not stored.
+	c.Check(s.bc.Put(cacheTestHash("too big to cache"), []byte("too big to cache"), false), IsNil)
+	_, ok = s.bc.Get(cacheTestHash("too big to cache"))
+	c.Check(ok, Equals, false)
+}
+
+func (s *CacheSuite) TestPinnedBlocksNotEvicted(c *C) {
+	s.restart(c, 10)
+	c.Check(s.bc.Put(cacheTestHash("aaaa"), []byte("aaaa"), true), IsNil)
+	c.Check(s.bc.Put(cacheTestHash("bbbb"), []byte("bbbb"), true), IsNil)
+	c.Check(s.bc.Put(cacheTestHash("cccc"), []byte("cccc"), true), Equals, CacheFullError)
+	c.Check(s.bc.Put(cacheTestHash("dddd"), []byte("dddd"), false), IsNil)
+	for _, data := range []string{"aaaa", "bbbb"} {
+		_, ok := s.bc.Get(cacheTestHash(data))
+		c.Check(ok, Equals, true)
+	}
+
+	s.bc.Complete(cacheTestHash("aaaa"))
+	c.Check(s.bc.Put(cacheTestHash("cccc"), []byte("cccc"), true), IsNil)
+	_, ok := s.bc.Get(cacheTestHash("aaaa"))
+	c.Check(ok, Equals, false)
+}
+
+func (s *CacheSuite) TestConcurrentPinnedPuts(c *C) {
+	s.restart(c, 10)
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	stored := 0
+	for i := 0; i < 8; i++ {
+		data := fmt.Sprintf("%04d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.bc.Put(cacheTestHash(data), []byte(data), true) == nil {
+				mtx.Lock()
+				stored++
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	c.Check(stored, Equals, 2)
+	s.bc.mtx.Lock()
+	c.Check(s.bc.pinnedBytes, Equals, int64(8))
+	s.bc.mtx.Unlock()
+
+	// A failed write releases its reservation.
+	s.restart(c, 10)
+	c.Assert(ioutil.WriteFile(filepath.Dir(s.bc.blockPath(cacheTestHash("aaaa"))), nil, 0600), IsNil)
+	c.Check(s.bc.Put(cacheTestHash("aaaa"), []byte("aaaa"), true), NotNil)
+	s.bc.mtx.Lock()
+	c.Check(s.bc.pinnedBytes, Equals, int64(0))
+	s.bc.mtx.Unlock()
+}
+
+func (s *CacheSuite) TestReloadAndVerify(c *C) {
+	for _, data := range []string{"aaaa", "bbbb"} {
+		c.Check(s.bc.Put(cacheTestHash(data), []byte(data), false), IsNil)
+	}
+	s.restart(c, 1<<20)
+	got, ok := s.bc.Get(cacheTestHash("aaaa"))
+	c.Check(ok, Equals, true)
+	c.Check(string(got), Equals, "aaaa")
+
+	// A corrupt block is a cache miss, and is removed.
+	c.Assert(ioutil.WriteFile(s.bc.blockPath(cacheTestHash("bbbb")), []byte("bbbx"), 0600), IsNil)
+	_, ok = s.bc.Get(cacheTestHash("bbbb"))
+	c.Check(ok, Equals, false)
+	_, err := os.Stat(s.bc.blockPath(cacheTestHash("bbbb")))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// Leftover temp files are cleaned up.
+	tmp := filepath.Join(filepath.Dir(s.bc.blockPath(cacheTestHash("aaaa"))), "tmp123")
+	c.Assert(ioutil.WriteFile(tmp, []byte("aa"), 0600), IsNil)
+	s.restart(c, 1<<20)
+	_, err = os.Stat(tmp)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *CacheSuite) TestReadErrorKeepsPendingPut(c *C) {
+	s.setKeepDown(true)
+	resp := s.do(c, "PUT", "/"+cacheTestHash("foo"), map[string]string{XKeepProxyAck: "local"}, "foo")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(s.bc.Pending(), Equals, 1)
+
+	// Stop the forwarding goroutine, so it doesn't see the
+	// block file while it is being swapped out.
+	bc := s.bc
+	bc.Close()
+	s.bc = nil
+
+	// Make reads fail with something other than ENOENT.
+	path := bc.blockPath(cacheTestHash("foo"))
+	saved := filepath.Join(s.dir, "saved")
+	c.Assert(os.Rename(path, saved), IsNil)
+	c.Assert(os.Mkdir(path, 0700), IsNil)
+	_, ok := bc.Get(cacheTestHash("foo"))
+	c.Check(ok, Equals, false)
+	c.Check(bc.Pending(), Equals, 1)
+	_, err := os.Stat(bc.pendingPath(cacheTestHash("foo")))
+	c.Check(err, IsNil)
+
+	// The block is forwarded once it can be read again.
+	c.Assert(os.Remove(path), IsNil)
+	c.Assert(os.Rename(saved, path), IsNil)
+	s.restart(c, 1<<20)
+	s.setKeepDown(false)
+	s.waitForwarded(c, "foo")
+}
+
+func (s *CacheSuite) TestGetThroughCache(c *C) {
+	s.blocks[cacheTestHash("foo")] = []byte("foo")
+	locator := s.sign("foo")
+
+	resp := s.do(c, "GET", "/"+locator, nil, "")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, "foo")
+	c.Check(s.gets, Equals, 1)
+
+	for _, method := range []string{"GET", "HEAD"} {
+		resp = s.do(c, method, "/"+locator, nil, "")
+		c.Check(resp.Code, Equals, http.StatusOK)
+		c.Check(resp.Header().Get("Content-Length"), Equals, "3")
+		c.Check(s.gets, Equals, 1)
+	}
+	c.Check(s.do(c, "GET", "/"+locator, nil, "").Body.String(), Equals, "foo")
+
+	// A bad signature isn't accepted by the cache; the request
+	// goes upstream.
+	resp = s.do(c, "GET", "/"+cacheTestHash("foo")+"+3+Abadbadbad@12345678", nil, "")
+	c.Check(s.gets, Equals, 2)
+
+	// Without a signing key, the cache asks upstream whether the
+	// client has permission.
+	s.bc.signingKey = nil
+	resp = s.do(c, "GET", "/"+locator, nil, "")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, "foo")
+	c.Check(s.gets, Equals, 3)
+}
+
+func (s *CacheSuite) TestPutWriteThrough(c *C) {
+	resp := s.do(c, "PUT", "/"+cacheTestHash("foo"), nil, "foo")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, cacheTestHash("foo")+"+3+Asignedupstream@12345678")
+	c.Check(resp.Header().Get(keepclient.X_Keep_Replicas_Stored), Equals, "1")
+	c.Check(resp.Header().Get(XKeepUpstreamPending), Equals, "")
+	data, ok := s.upstream(cacheTestHash("foo"))
+	c.Check(ok, Equals, true)
+	c.Check(string(data), Equals, "foo")
+	c.Check(s.bc.Pending(), Equals, 0)
+
+	// The block is now cached.
+	resp = s.do(c, "GET", "/"+s.sign("foo"), nil, "")
+	c.Check(resp.Body.String(), Equals, "foo")
+	c.Check(s.gets, Equals, 0)
+
+	resp = s.do(c, "PUT", "/"+cacheTestHash("foo"), nil, "bar")
+	c.Check(resp.Code, Equals, http.StatusBadGateway)
+}
+
+func (s *CacheSuite) TestPutShortBody(c *C) {
+	req, err := http.NewRequest("PUT", "http://keep.example/"+cacheTestHash("foo"), bytes.NewBufferString("fo"))
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", "OAuth2 token1")
+	req.Header.Set("Content-Length", "3")
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	c.Check(resp.Code, Equals, http.StatusBadRequest)
+	c.Check(s.bc.Pending(), Equals, 0)
+}
+
+func (s *CacheSuite) TestPutUpstreamDown(c *C) {
+	s.setKeepDown(true)
+	resp := s.do(c, "PUT", "/"+cacheTestHash("foo"), nil, "foo")
+	c.Check(resp.Code, Not(Equals), http.StatusOK)
+	c.Check(resp.Header().Get(keepclient.X_Keep_Replicas_Stored), Equals, "0")
+	c.Check(s.bc.Pending(), Equals, 1)
+
+	// The client's token is not saved in the queue.
+	buf, err := ioutil.ReadFile(s.bc.pendingPath(cacheTestHash("foo")))
+	c.Check(err, IsNil)
+	c.Check(strings.Contains(string(buf), "token1"), Equals, false)
+
+	// The block is forwarded, using the proxy's own token, when
+	// the upstream service comes back, even after a restart.
+	s.restart(c, 1<<20)
+	c.Check(s.bc.Pending(), Equals, 1)
+	s.setKeepDown(false)
+	s.waitForwarded(c, "foo")
+	s.mtx.Lock()
+	c.Check(s.putTokens, DeepEquals, []string{"OAuth2 proxytoken"})
+	s.mtx.Unlock()
+}
+
+func (s *CacheSuite) TestPutLocalAck(c *C) {
+	s.setKeepDown(true)
+	resp := s.do(c, "PUT", "/"+cacheTestHash("foo"), map[string]string{XKeepProxyAck: "local"}, "foo")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Header().Get(XKeepUpstreamPending), Equals, "true")
+	c.Check(resp.Header().Get(keepclient.X_Keep_Replicas_Stored), Equals, "1")
+	locator := resp.Body.String()
+	c.Check(keeplocator.VerifySignature(locator, "token1", time.Hour, cacheTestKey), IsNil)
+	c.Check(s.bc.Pending(), Equals, 1)
+
+	// The block can be read back from the cache right away.
+	resp = s.do(c, "GET", "/"+locator, nil, "")
+	c.Check(resp.Body.String(), Equals, "foo")
+
+	s.setKeepDown(false)
+	s.waitForwarded(c, "foo")
+}
+
+func (s *CacheSuite) waitForwarded(c *C, data string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for s.bc.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(s.bc.Pending(), Equals, 0)
+	got, ok := s.upstream(cacheTestHash(data))
+	c.Check(ok, Equals, true)
+	c.Check(string(got), Equals, data)
+	_, err := os.Stat(s.bc.pendingPath(cacheTestHash(data)))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *CacheSuite) TestRequestIDForwarded(c *C) {
+	s.router = httpserver.AddRequestIDs(s.router)
+	resp := s.do(c, "PUT", "/"+cacheTestHash("foo"), map[string]string{"X-Request-Id": "req-keepproxytest1"}, "foo")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Header().Get("X-Request-Id"), Equals, "req-keepproxytest1")
+
+	s.mtx.Lock()
+	s.blocks[cacheTestHash("bar")] = []byte("bar")
+	s.mtx.Unlock()
+	resp = s.do(c, "GET", "/"+s.sign("bar"), map[string]string{"X-Request-Id": "req-keepproxytest2"}, "")
+	c.Check(resp.Code, Equals, http.StatusOK)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c.Check(s.requestIDs, DeepEquals, []string{"req-keepproxytest1", "req-keepproxytest2"})
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
 	"errors"
 	"flag"
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/auditlog"
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
 	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/keeplocator"
 	"github.com/gorilla/mux"
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"os"
-	"os/signal"
 	"regexp"
 	"sync"
 	"syscall"
@@ -24,7 +28,15 @@ import (
 // Override with -listen.
 const DefaultAddr = ":25107"
 
-var listener net.Listener
+// HealthCheckPath reports whether keepproxy is running normally or
+// draining (shutting down).
+const HealthCheckPath = "/_health/ping"
+
+var server *httpserver.Server
+
+// audit records block reads and writes and resumable upload
+// requests, if enabled with the -audit-log-* flags.
+var audit *auditlog.Logger
 
 func main() {
 	var (
@@ -34,6 +46,19 @@ func main() {
 		default_replicas int
 		timeout          int64
 		pidfile          string
+		quotaConfig      string
+		tlsConfig        httpserver.TLSConfig
+		uploadDir        string
+		drainDelay       time.Duration
+		drainTimeout     time.Duration
+		remoteClusters   string
+		cacheDir         string
+		cacheSize        int64
+		signingKeyFile   string
+		signatureTTL     int
+		maxBuffers       int
+		maxRequests      int
+		auditConfig      auditlog.Config
 	)
 
 	flagset := flag.NewFlagSet("keepproxy", flag.ExitOnError)
@@ -76,8 +101,103 @@ func main() {
 		"",
 		"Path to write pid file")
 
+	flagset.StringVar(
+		&quotaConfig,
+		"quota-config",
+		"",
+		"Path to JSON file with per-token and per-user usage limits. If not given, usage is not limited.")
+
+	flagset.StringVar(
+		&uploadDir,
+		"upload-dir",
+		"",
+		"Directory where resumable upload state is kept. If not given, resumable uploads are disabled.")
+
+	flagset.DurationVar(
+		&drainDelay,
+		"drain-delay",
+		0,
+		"On SIGTERM, report \"DRAINING\" at "+HealthCheckPath+" for this long before closing the listening socket, so load balancers stop sending new requests.")
+
+	flagset.DurationVar(
+		&drainTimeout,
+		"drain-timeout",
+		30*time.Second,
+		"On SIGTERM, wait this long for requests in progress to finish before exiting.")
+
+	flagset.StringVar(
+		&remoteClusters,
+		"remote-clusters",
+		"",
+		"Path to JSON file mapping remote cluster IDs to their Keep proxy URIs and API tokens, used to retrieve blocks with +R hints.")
+
+	flagset.StringVar(
+		&cacheDir,
+		"cache-dir",
+		"",
+		"Directory where blocks are cached, and PUT blocks are kept until they are written upstream. If not given, blocks are not cached.")
+
+	flagset.Int64Var(
+		&cacheSize,
+		"cache-size",
+		10<<30,
+		"Maximum size of the block cache, in bytes.")
+
+	flagset.StringVar(
+		&signingKeyFile,
+		"blob-signing-key-file",
+		"",
+		"File containing the cluster's blob signing key. If given along with -cache-dir, cached blocks are served after checking permission signatures locally, and clients can send \"X-Keep-Proxy-Ack: local\" to have PUTs acknowledged once the block is stored in the cache.")
+
+	flagset.IntVar(
+		&signatureTTL,
+		"blob-signature-ttl",
+		2*7*24*3600,
+		"Lifetime of blob permission signatures, in seconds. Must match the cluster's blob_signature_ttl.")
+
+	flagset.IntVar(
+		&maxBuffers,
+		"max-buffers",
+		DefaultMaxBuffers,
+		fmt.Sprintf("Maximum RAM to use for PUT buffers, given in multiples of block size (%d MiB). When this limit is reached, PUT requests wait for buffer space to be released.", keepclient.BLOCKSIZE>>20))
+
+	flagset.IntVar(
+		&maxRequests,
+		"max-requests",
+		0,
+		"Maximum concurrent PUT and upload requests. When this limit is reached, new PUT and upload requests will receive 503 responses. GET requests are not limited. (default 2 * max-buffers)")
+
+	tlsConfig.AddFlags(flagset, "tls-")
+	auditConfig.AddFlags(flagset, "audit-log-")
+
 	flagset.Parse(os.Args[1:])
 
+	if maxBuffers <= 0 {
+		log.Fatal("-max-buffers must be greater than zero.")
+	}
+	bufs = newBufferPool(maxBuffers, keepclient.BLOCKSIZE)
+	if maxRequests <= 0 {
+		maxRequests = maxBuffers * 2
+	}
+
+	var quotas *QuotaTracker
+	if quotaConfig != "" {
+		config, err := LoadQuotaConfig(quotaConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		quotas = NewQuotaTracker(config)
+	}
+
+	var uploads *UploadManager
+	if uploadDir != "" && !no_put {
+		var err error
+		uploads, err = NewUploadManager(uploadDir)
+		if err != nil {
+			log.Fatalf("Error setting up resumable uploads: %v", err)
+		}
+	}
+
 	arv, err := arvadosclient.MakeArvadosClient()
 	if err != nil {
 		log.Fatalf("Error setting up arvados client %s", err.Error())
@@ -90,62 +210,119 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error setting up keep client %s", err.Error())
 	}
-
-	if pidfile != "" {
-		f, err := os.Create(pidfile)
+	if remoteClusters != "" {
+		kc.RemoteClusters, err = keepclient.LoadRemoteClusters(remoteClusters)
 		if err != nil {
-			log.Fatalf("Error writing pid file (%s): %s", pidfile, err.Error())
+			log.Fatal(err)
 		}
-		fmt.Fprint(f, os.Getpid())
-		f.Close()
-		defer os.Remove(pidfile)
 	}
 
 	kc.Want_replicas = default_replicas
 	kc.Client.Timeout = time.Duration(timeout) * time.Second
 	go kc.RefreshServices(5*time.Minute, 3*time.Second)
 
-	listener, err = net.Listen("tcp", listen)
+	audit, err = auditConfig.NewLogger(arvados.NewClientFromEnv())
 	if err != nil {
-		log.Fatalf("Could not listen on %v", listen)
+		log.Fatalf("Error setting up audit log: %v", err)
 	}
-	log.Printf("Arvados Keep proxy started listening on %v", listener.Addr())
+	defer audit.Close()
 
-	// Shut down the server gracefully (by closing the listener)
-	// if SIGTERM is received.
-	term := make(chan os.Signal, 1)
-	go func(sig <-chan os.Signal) {
-		s := <-sig
-		log.Println("caught signal:", s)
-		listener.Close()
-	}(term)
-	signal.Notify(term, syscall.SIGTERM)
-	signal.Notify(term, syscall.SIGINT)
+	var cache *BlockCache
+	if cacheDir != "" {
+		cache, err = NewBlockCache(cacheDir, cacheSize, kc)
+		if err != nil {
+			log.Fatalf("Error setting up block cache: %v", err)
+		}
+		defer cache.Close()
+		if signingKeyFile != "" {
+			key, err := ioutil.ReadFile(signingKeyFile)
+			if err != nil {
+				log.Fatalf("Error reading blob signing key: %v", err)
+			}
+			cache.SetSigningKey(bytes.TrimSpace(key), time.Duration(signatureTTL)*time.Second)
+		}
+	}
+
+	srv := &httpserver.Server{
+		Server: http.Server{
+			Handler: httpserver.LogRequests(
+				limitPuts(maxRequests,
+					MakeRESTRouter(!no_get, !no_put, kc, quotas, uploads, cache))),
+		},
+		Addr:            listen,
+		TLS:             &tlsConfig,
+		HealthCheckPath: HealthCheckPath,
+	}
+	if err := srv.Start(); err != nil {
+		log.Fatalf("Could not listen on %v: %v", listen, err)
+	}
+	server = srv
+	log.Printf("Arvados Keep proxy started listening on %v", srv.Addr)
+
+	if pidfile != "" {
+		if err := writePidfile(pidfile); err != nil {
+			srv.Close()
+			log.Fatalf("Error writing pid file (%s): %s", pidfile, err)
+		}
+		defer os.Remove(pidfile)
+	}
 
-	// Start serving requests.
-	http.Serve(listener, MakeRESTRouter(!no_get, !no_put, kc))
+	// Shut down the server gracefully if SIGTERM is received:
+	// stop accepting new requests, and let those in progress
+	// finish.
+	srv.DrainOnSignal(drainDelay, drainTimeout, syscall.SIGTERM, syscall.SIGINT)
+
+	if err := srv.Wait(); err != nil {
+		log.Printf("server error: %v", err)
+	}
 
 	log.Println("shutting down")
 }
 
+// writePidfile writes the current process ID to the given file.
+func writePidfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprint(f, os.Getpid()); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
 type ApiTokenCache struct {
 	tokens     map[string]int64
+	users      map[string]string
 	lock       sync.Mutex
 	expireTime int64
 }
 
-// Cache the token and set an expire time.  If we already have an expire time
-// on the token, it is not updated.
-func (this *ApiTokenCache) RememberToken(token string) {
+// Cache the token and the UUID of the user it belongs to, and set an
+// expire time.  If we already have an expire time on the token, it
+// is not updated.
+func (this *ApiTokenCache) RememberToken(token, userUUID string) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
 	now := time.Now().Unix()
 	if this.tokens[token] == 0 {
 		this.tokens[token] = now + this.expireTime
+		this.users[token] = userUUID
 	}
 }
 
+// Return the UUID of the user a cached token belongs to, or "" if
+// the token is not in the cache.
+func (this *ApiTokenCache) RecallUser(token string) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.users[token]
+}
+
 // Check if the cached token is known and still believed to be valid.
 func (this *ApiTokenCache) RecallToken(token string) bool {
 	this.lock.Lock()
@@ -161,6 +338,7 @@ func (this *ApiTokenCache) RecallToken(token string) bool {
 	} else {
 		// Token is expired
 		this.tokens[token] = 0
+		delete(this.users, token)
 		return false
 	}
 }
@@ -191,13 +369,14 @@ func CheckAuthorizationHeader(kc *keepclient.KeepClient, cache *ApiTokenCache, r
 
 	arv := *kc.Arvados
 	arv.ApiToken = tok
-	if err := arv.Call("HEAD", "users", "", "current", nil, nil); err != nil {
+	var user arvados.User
+	if err := arv.Call("GET", "users", "", "current", nil, &user); err != nil {
 		log.Printf("%s: CheckAuthorizationHeader error: %v", GetRemoteAddress(req), err)
 		return false, ""
 	}
 
 	// Success!  Update cache
-	cache.RememberToken(tok)
+	cache.RememberToken(tok, user.UUID)
 
 	return true, tok
 }
@@ -205,11 +384,15 @@ func CheckAuthorizationHeader(kc *keepclient.KeepClient, cache *ApiTokenCache, r
 type GetBlockHandler struct {
 	*keepclient.KeepClient
 	*ApiTokenCache
+	*QuotaTracker
+	*BlockCache
 }
 
 type PutBlockHandler struct {
 	*keepclient.KeepClient
 	*ApiTokenCache
+	*QuotaTracker
+	*BlockCache
 }
 
 type IndexHandler struct {
@@ -223,21 +406,34 @@ type OptionsHandler struct{}
 
 // MakeRESTRouter
 //     Returns a mux.Router that passes GET and PUT requests to the
-//     appropriate handlers.
+//     appropriate handlers. If quotas is not nil, GET and PUT
+//     requests are subject to its limits, and its usage report is
+//     available at /usage.json. If uploads is not nil (and PUT is
+//     enabled), resumable uploads are available at /uploads. If
+//     cache is not nil, blocks are cached on local disk, and PUT
+//     blocks are forwarded upstream through the cache. Buffer
+//     usage is reported at /status.json.
 //
 func MakeRESTRouter(
 	enable_get bool,
 	enable_put bool,
-	kc *keepclient.KeepClient) *mux.Router {
-
-	t := &ApiTokenCache{tokens: make(map[string]int64), expireTime: 300}
+	kc *keepclient.KeepClient,
+	quotas *QuotaTracker,
+	uploads *UploadManager,
+	cache *BlockCache) *mux.Router {
+
+	t := &ApiTokenCache{
+		tokens:     make(map[string]int64),
+		users:      make(map[string]string),
+		expireTime: 300,
+	}
 
 	rest := mux.NewRouter()
 
 	if enable_get {
 		rest.Handle(`/{locator:[0-9a-f]{32}\+.*}`,
-			GetBlockHandler{kc, t}).Methods("GET", "HEAD")
-		rest.Handle(`/{locator:[0-9a-f]{32}}`, GetBlockHandler{kc, t}).Methods("GET", "HEAD")
+			GetBlockHandler{kc, t, quotas, cache}).Methods("GET", "HEAD")
+		rest.Handle(`/{locator:[0-9a-f]{32}}`, GetBlockHandler{kc, t, quotas, cache}).Methods("GET", "HEAD")
 
 		// List all blocks
 		rest.Handle(`/index`, IndexHandler{kc, t}).Methods("GET")
@@ -247,11 +443,24 @@ func MakeRESTRouter(
 	}
 
 	if enable_put {
-		rest.Handle(`/{locator:[0-9a-f]{32}\+.*}`, PutBlockHandler{kc, t}).Methods("PUT")
-		rest.Handle(`/{locator:[0-9a-f]{32}}`, PutBlockHandler{kc, t}).Methods("PUT")
-		rest.Handle(`/`, PutBlockHandler{kc, t}).Methods("POST")
+		rest.Handle(`/{locator:[0-9a-f]{32}\+.*}`, PutBlockHandler{kc, t, quotas, cache}).Methods("PUT")
+		rest.Handle(`/{locator:[0-9a-f]{32}}`, PutBlockHandler{kc, t, quotas, cache}).Methods("PUT")
+		rest.Handle(`/`, PutBlockHandler{kc, t, quotas, cache}).Methods("POST")
 		rest.Handle(`/{any}`, OptionsHandler{}).Methods("OPTIONS")
 		rest.Handle(`/`, OptionsHandler{}).Methods("OPTIONS")
+
+		if uploads != nil {
+			uh := UploadHandler{kc, t, quotas, uploads}
+			rest.Handle(`/uploads`, uh).Methods("POST")
+			rest.Handle(`/uploads/{id:[0-9a-f]{32}}`, uh).Methods("HEAD", "PATCH", "DELETE")
+			rest.Handle(`/uploads/{id:[0-9a-f]{32}}/{action:finish}`, uh).Methods("POST")
+		}
+	}
+
+	rest.HandleFunc(`/status.json`, StatusHandler).Methods("GET", "HEAD")
+
+	if quotas != nil {
+		rest.Handle(`/usage.json`, UsageHandler{quotas}).Methods("GET")
 	}
 
 	rest.NotFoundHandler = InvalidPathHandler{}
@@ -259,20 +468,33 @@ func MakeRESTRouter(
 	return rest
 }
 
+// limitPuts returns a handler that passes at most maxRequests
+// concurrent PUT and upload requests (which wait for buffers) to h,
+// and responds 503 to the rest. Other requests are not limited.
+func limitPuts(maxRequests int, h http.Handler) http.Handler {
+	limited := httpserver.NewRequestLimiter(maxRequests, h)
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "PUT", "POST", "PATCH":
+			limited.ServeHTTP(resp, req)
+		default:
+			h.ServeHTTP(resp, req)
+		}
+	})
+}
+
 func SetCorsHeaders(resp http.ResponseWriter) {
 	resp.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, OPTIONS")
 	resp.Header().Set("Access-Control-Allow-Origin", "*")
-	resp.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas")
+	resp.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas, X-Keep-Proxy-Ack")
 	resp.Header().Set("Access-Control-Max-Age", "86486400")
 }
 
 func (this InvalidPathHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	log.Printf("%s: %s %s unroutable", GetRemoteAddress(req), req.Method, req.URL.Path)
 	http.Error(resp, "Bad request", http.StatusBadRequest)
 }
 
 func (this OptionsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	log.Printf("%s: %s %s", GetRemoteAddress(req), req.Method, req.URL.Path)
 	SetCorsHeaders(resp)
 }
 
@@ -291,39 +513,105 @@ func (this GetBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 	var expectLength, responseLength int64
 	var proxiedURI = "-"
 
+	var pass bool
+	var tok string
+	// Set if the request is refused because the audit log is not
+	// working, in which case the request is not logged there.
+	var auditUnavailable bool
+
 	defer func() {
-		log.Println(GetRemoteAddress(req), req.Method, req.URL.Path, status, expectLength, responseLength, proxiedURI, err)
+		httpserver.LogDetail(req.Context(), "proxied_uri", proxiedURI)
+		httpserver.LogDetail(req.Context(), "expect_length", expectLength)
+		if err != nil && status == http.StatusOK {
+			// Errors after the response header is sent
+			// don't appear in the response body.
+			httpserver.LogDetail(req.Context(), "error", err.Error())
+		}
 		if status != http.StatusOK {
 			http.Error(resp, err.Error(), status)
 		}
+		if auditUnavailable {
+			return
+		}
+		audit.Log(auditlog.Event{
+			Service:    "keepproxy",
+			Method:     req.Method,
+			Status:     status,
+			UserUUID:   this.ApiTokenCache.RecallUser(tok),
+			Locator:    locator,
+			Range:      req.Header.Get("Range"),
+			Bytes:      responseLength,
+			RemoteAddr: GetRemoteAddress(req),
+			UserAgent:  req.UserAgent(),
+		})
 	}()
 
 	kc := *this.KeepClient
 
-	var pass bool
-	var tok string
 	if pass, tok = CheckAuthorizationHeader(&kc, this.ApiTokenCache, req); !pass {
 		status, err = http.StatusForbidden, BadAuthorizationHeader
 		return
 	}
 
+	if err = audit.Ready(); err != nil {
+		status = http.StatusServiceUnavailable
+		auditUnavailable = true
+		return
+	}
+
+	usage, wait := this.QuotaTracker.Admit(tok, this.ApiTokenCache.RecallUser(tok), 0)
+	if wait > 0 {
+		setRetryAfter(resp, wait)
+		status, err = http.StatusTooManyRequests, QuotaExceededError
+		return
+	}
+	defer func() { usage.Sent(responseLength) }()
+
 	// Copy ArvadosClient struct and use the client's API token
 	arvclient := *kc.Arvados
 	arvclient.ApiToken = tok
 	kc.Arvados = &arvclient
 
 	var reader io.ReadCloser
+	var cached *bytes.Buffer
 
 	locator = removeHint.ReplaceAllString(locator, "$1")
 
+	if this.BlockCache != nil && (req.Method == "GET" || req.Method == "HEAD") {
+		if data, ok := this.BlockCache.Get(locator[:32]); ok && this.BlockCache.Permitted(req.Context(), &kc, locator) {
+			proxiedURI = "cache"
+			status = http.StatusOK
+			expectLength = int64(len(data))
+			resp.Header().Set("Content-Length", fmt.Sprint(expectLength))
+			if req.Method == "GET" {
+				var n int
+				n, err = resp.Write(data)
+				responseLength = int64(n)
+			}
+			return
+		}
+	}
+
 	switch req.Method {
 	case "HEAD":
-		expectLength, proxiedURI, err = kc.Ask(locator)
+		expectLength, proxiedURI, err = kc.AskContext(req.Context(), locator)
 	case "GET":
-		reader, expectLength, proxiedURI, err = kc.Get(locator)
+		reader, expectLength, proxiedURI, err = kc.GetContext(req.Context(), locator)
 		if reader != nil {
 			defer reader.Close()
 		}
+		if err == nil && this.BlockCache != nil && expectLength >= 0 && expectLength <= keepclient.BLOCKSIZE {
+			// Keep a copy of the block as it is sent to
+			// the client, and add it to the cache once
+			// the reader has checked its hash. If no
+			// buffer is free, don't wait for one: just
+			// skip caching.
+			if buf, ok := bufs.TryGet(int(expectLength)); ok {
+				defer bufs.Put(buf)
+				cached = bytes.NewBuffer(buf[:0])
+				reader = ioutil.NopCloser(io.TeeReader(reader, cached))
+			}
+		}
 	default:
 		status, err = http.StatusNotImplemented, MethodNotSupported
 		return
@@ -345,6 +633,11 @@ func (this GetBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 			if err == nil && expectLength > -1 && responseLength != expectLength {
 				err = ContentLengthMismatch
 			}
+			if err == nil && cached != nil && int64(cached.Len()) == expectLength {
+				if cerr := this.BlockCache.Put(locator[:32], cached.Bytes(), false); cerr != nil {
+					log.Printf("error caching block %s: %v", locator[:32], cerr)
+				}
+			}
 		}
 	case keepclient.Error:
 		if respErr == keepclient.BlockNotFound {
@@ -361,6 +654,7 @@ func (this GetBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 
 var LengthRequiredError = errors.New(http.StatusText(http.StatusLengthRequired))
 var LengthMismatchError = errors.New("Locator size hint does not match Content-Length header")
+var RequestHashError = errors.New("Hash mismatch in request")
 
 func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	SetCorsHeaders(resp)
@@ -372,15 +666,43 @@ func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 	var wroteReplicas int
 	var locatorOut string = "-"
 
+	var pass bool
+	var tok string
+	// Set if the request is refused because the audit log is not
+	// working, in which case the request is not logged there.
+	var auditUnavailable bool
+	locatorIn := mux.Vars(req)["locator"]
+
 	defer func() {
-		log.Println(GetRemoteAddress(req), req.Method, req.URL.Path, status, expectLength, kc.Want_replicas, wroteReplicas, locatorOut, err)
+		httpserver.LogDetail(req.Context(), "expect_length", expectLength)
+		httpserver.LogDetail(req.Context(), "want_replicas", kc.Want_replicas)
+		httpserver.LogDetail(req.Context(), "wrote_replicas", wroteReplicas)
+		httpserver.LogDetail(req.Context(), "locator", locatorOut)
+		if err != nil && status == http.StatusOK {
+			// Errors after the response header is sent
+			// don't appear in the response body.
+			httpserver.LogDetail(req.Context(), "error", err.Error())
+		}
 		if status != http.StatusOK {
 			http.Error(resp, err.Error(), status)
 		}
+		ev := auditlog.Event{
+			Service:    "keepproxy",
+			Method:     req.Method,
+			Status:     status,
+			UserUUID:   this.ApiTokenCache.RecallUser(tok),
+			Locator:    locatorIn,
+			RemoteAddr: GetRemoteAddress(req),
+			UserAgent:  req.UserAgent(),
+		}
+		if status == http.StatusOK {
+			ev.Locator, ev.Bytes = locatorOut, expectLength
+		}
+		if !auditUnavailable {
+			audit.Log(ev)
+		}
 	}()
 
-	locatorIn := mux.Vars(req)["locator"]
-
 	_, err = fmt.Sscanf(req.Header.Get("Content-Length"), "%d", &expectLength)
 	if err != nil || expectLength < 0 {
 		err = LengthRequiredError
@@ -389,8 +711,8 @@ func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 	}
 
 	if locatorIn != "" {
-		var loc *keepclient.Locator
-		if loc, err = keepclient.MakeLocator(locatorIn); err != nil {
+		var loc keeplocator.Locator
+		if loc, err = keeplocator.Parse(locatorIn); err != nil {
 			status = http.StatusBadRequest
 			return
 		} else if loc.Size > 0 && int64(loc.Size) != expectLength {
@@ -400,14 +722,31 @@ func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 		}
 	}
 
-	var pass bool
-	var tok string
 	if pass, tok = CheckAuthorizationHeader(&kc, this.ApiTokenCache, req); !pass {
 		err = BadAuthorizationHeader
 		status = http.StatusForbidden
 		return
 	}
 
+	if err = audit.Ready(); err != nil {
+		status = http.StatusServiceUnavailable
+		auditUnavailable = true
+		return
+	}
+
+	usage, wait := this.QuotaTracker.Admit(tok, this.ApiTokenCache.RecallUser(tok), expectLength)
+	if wait > 0 {
+		setRetryAfter(resp, wait)
+		err = QuotaExceededError
+		status = http.StatusTooManyRequests
+		return
+	}
+	defer func() {
+		if wroteReplicas == 0 {
+			usage.PutFailed(expectLength)
+		}
+	}()
+
 	// Copy ArvadosClient struct and use the client's API token
 	arvclient := *kc.Arvados
 	arvclient.ApiToken = tok
@@ -422,17 +761,48 @@ func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 		}
 	}
 
+	if expectLength > keepclient.BLOCKSIZE {
+		err = keepclient.OversizeBlockError
+		status = http.StatusRequestEntityTooLarge
+		return
+	}
+
+	// Read the block into a buffer from the shared pool, waiting
+	// if all buffers are in use. The same buffer is used to write
+	// each replica.
+	buf, err := getBufferForResponseWriter(resp, bufs, int(expectLength))
+	if err != nil {
+		status = http.StatusServiceUnavailable
+		return
+	}
+	defer bufs.Put(buf)
+	if _, err = io.ReadFull(req.Body, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+		// The client sent less than Content-Length.
+		err = fmt.Errorf("Error reading request body: %s", err)
+		status = http.StatusBadRequest
+		return
+	} else if err != nil {
+		err = fmt.Errorf("Error reading request body: %s", err)
+		status = http.StatusInternalServerError
+		return
+	}
+	hash := fmt.Sprintf("%x", md5.Sum(buf))
+	if locatorIn != "" && locatorIn[:32] != hash {
+		// Same status as when the hash mismatch was
+		// detected by the upstream Keep service.
+		err = RequestHashError
+		status = http.StatusBadGateway
+		return
+	}
+
 	// Now try to put the block through
-	if locatorIn == "" {
-		if bytes, err := ioutil.ReadAll(req.Body); err != nil {
-			err = errors.New(fmt.Sprintf("Error reading request body: %s", err))
-			status = http.StatusInternalServerError
+	if this.BlockCache != nil {
+		var ok bool
+		if locatorOut, wroteReplicas, status, err, ok = this.putCached(&kc, resp, req, hash, buf, tok); !ok {
 			return
-		} else {
-			locatorOut, wroteReplicas, err = kc.PutB(bytes)
 		}
 	} else {
-		locatorOut, wroteReplicas, err = kc.PutHR(locatorIn, req.Body, expectLength)
+		locatorOut, wroteReplicas, err = kc.PutHBContext(req.Context(), hash, buf)
 	}
 
 	// Tell the client how many successful PUTs we accomplished
@@ -463,6 +833,37 @@ func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 	}
 }
 
+// putCached stores a PUT block in the cache, then writes it
+// upstream -- or, if the client asked for acknowledgment after the
+// local write only, queues it to be written upstream later. If ok is
+// false, the request has failed with the given status and err;
+// otherwise the results are those of the upstream write.
+func (this PutBlockHandler) putCached(kc *keepclient.KeepClient, resp http.ResponseWriter, req *http.Request, hash string, data []byte, tok string) (locatorOut string, wroteReplicas int, status int, err error, ok bool) {
+	expectLength := int64(len(data))
+	if err = this.BlockCache.Put(hash, data, true); err == CacheFullError {
+		return "-", 0, http.StatusServiceUnavailable, err, false
+	} else if err != nil {
+		return "-", 0, http.StatusInternalServerError, err, false
+	}
+
+	if req.Header.Get(XKeepProxyAck) == "local" && this.BlockCache.CanSign() {
+		if err = this.BlockCache.Enqueue(hash, expectLength, kc.Want_replicas); err != nil {
+			return "-", 0, http.StatusInternalServerError, err, false
+		}
+		resp.Header().Set(XKeepUpstreamPending, "true")
+		return this.BlockCache.Sign(hash, expectLength, tok), kc.Want_replicas, http.StatusOK, nil, true
+	}
+
+	locatorOut, wroteReplicas, err = kc.PutHBContext(req.Context(), hash, data)
+	if wroteReplicas > 0 {
+		this.BlockCache.Complete(hash)
+	} else if qerr := this.BlockCache.Enqueue(hash, expectLength, kc.Want_replicas); qerr != nil {
+		log.Printf("error queueing block %s to forward upstream: %v", hash, qerr)
+		this.BlockCache.Complete(hash)
+	}
+	return locatorOut, wroteReplicas, status, err, true
+}
+
 // ServeHTTP implementation for IndexHandler
 // Supports only GET requests for /index/{prefix:[0-9a-f]{0,32}}
 // For each keep server found in LocalRoots:
@@ -505,7 +906,7 @@ func (handler IndexHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 	// Get index from all LocalRoots and write to resp
 	var reader io.Reader
 	for uuid := range kc.LocalRoots() {
-		reader, err = kc.GetIndex(uuid, prefix)
+		reader, err = kc.GetIndexContext(req.Context(), uuid, prefix)
 		if err != nil {
 			status = http.StatusBadGateway
 			return
@@ -45,17 +45,17 @@ func waitForListener() {
 	const (
 		ms = 5
 	)
-	for i := 0; listener == nil && i < 10000; i += ms {
+	for i := 0; server == nil && i < 10000; i += ms {
 		time.Sleep(ms * time.Millisecond)
 	}
-	if listener == nil {
+	if server == nil {
 		log.Fatalf("Timed out waiting for listener to start")
 	}
 }
 
 func closeListener() {
-	if listener != nil {
-		listener.Close()
+	if server != nil {
+		server.Close()
 	}
 }
 
@@ -92,7 +92,7 @@ func (s *NoKeepServerSuite) TearDownSuite(c *C) {
 func runProxy(c *C, args []string, bogusClientToken bool) *keepclient.KeepClient {
 	args = append([]string{"keepproxy"}, args...)
 	os.Args = append(args, "-listen=:0")
-	listener = nil
+	server = nil
 	go main()
 	waitForListener()
 
@@ -103,7 +103,7 @@ func runProxy(c *C, args []string, bogusClientToken bool) *keepclient.KeepClient
 	}
 	kc := keepclient.New(&arv)
 	sr := map[string]string{
-		TestProxyUUID: "http://" + listener.Addr().String(),
+		TestProxyUUID: "http://" + server.Addr,
 	}
 	kc.SetServiceRoots(sr, sr, sr)
 	kc.Arvados.External = true
@@ -140,7 +140,7 @@ func (s *ServerRequiredSuite) TestPutWrongContentLength(c *C) {
 	// fixes the invalid Content-Length header. In order to test
 	// our server behavior, we have to call the handler directly
 	// using an httptest.ResponseRecorder.
-	rtr := MakeRESTRouter(true, true, kc)
+	rtr := MakeRESTRouter(true, true, kc, nil, nil, nil)
 
 	type testcase struct {
 		sendLength   string
@@ -154,7 +154,7 @@ func (s *ServerRequiredSuite) TestPutWrongContentLength(c *C) {
 		{"abcdef", http.StatusLengthRequired},
 	} {
 		req, err := http.NewRequest("PUT",
-			fmt.Sprintf("http://%s/%s+%d", listener.Addr().String(), hash, len(content)),
+			fmt.Sprintf("http://%s/%s+%d", server.Addr, hash, len(content)),
 			bytes.NewReader(content))
 		c.Assert(err, IsNil)
 		req.Header.Set("Content-Length", t.sendLength)
@@ -341,7 +341,7 @@ func (s *ServerRequiredSuite) TestCorsHeaders(c *C) {
 	{
 		client := http.Client{}
 		req, err := http.NewRequest("OPTIONS",
-			fmt.Sprintf("http://%s/%x+3", listener.Addr().String(), md5.Sum([]byte("foo"))),
+			fmt.Sprintf("http://%s/%x+3", server.Addr, md5.Sum([]byte("foo"))),
 			nil)
 		req.Header.Add("Access-Control-Request-Method", "PUT")
 		req.Header.Add("Access-Control-Request-Headers", "Authorization, X-Keep-Desired-Replicas")
@@ -356,9 +356,9 @@ func (s *ServerRequiredSuite) TestCorsHeaders(c *C) {
 
 	{
 		resp, err := http.Get(
-			fmt.Sprintf("http://%s/%x+3", listener.Addr().String(), md5.Sum([]byte("foo"))))
+			fmt.Sprintf("http://%s/%x+3", server.Addr, md5.Sum([]byte("foo"))))
 		c.Check(err, Equals, nil)
-		c.Check(resp.Header.Get("Access-Control-Allow-Headers"), Equals, "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas")
+		c.Check(resp.Header.Get("Access-Control-Allow-Headers"), Equals, "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas, X-Keep-Proxy-Ack")
 		c.Check(resp.Header.Get("Access-Control-Allow-Origin"), Equals, "*")
 	}
 }
@@ -370,7 +370,7 @@ func (s *ServerRequiredSuite) TestPostWithoutHash(c *C) {
 	{
 		client := http.Client{}
 		req, err := http.NewRequest("POST",
-			"http://"+listener.Addr().String()+"/",
+			"http://"+server.Addr+"/",
 			strings.NewReader("qux"))
 		req.Header.Add("Authorization", "OAuth2 4axaw8zxe0qm22wa6urpp5nskcne8z88cvbupv653y1njyi05h")
 		req.Header.Add("Content-Type", "application/octet-stream")
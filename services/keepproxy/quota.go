@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// QuotaLimits are the usage limits for a single token (or user, see
+// QuotaConfig.PerUser). A zero value means no limit.
+type QuotaLimits struct {
+	// Average number of GET, HEAD, and PUT requests per second.
+	RequestsPerSecond float64
+
+	// Number of requests allowed in a burst above
+	// RequestsPerSecond. Default is RequestsPerSecond, rounded up.
+	RequestBurst int
+
+	// Average number of bytes per second sent and received in
+	// GET and PUT requests.
+	BytesPerSecond int64
+
+	// Number of bytes that can be written by PUT requests during
+	// each UTC day.
+	DailyPutBytes int64
+}
+
+// QuotaConfig is loaded from the JSON file given with the
+// -quota-config flag. For example:
+//
+//	{
+//	  "Default": {"RequestsPerSecond": 20, "BytesPerSecond": 50000000},
+//	  "PerUser": true,
+//	  "Users": {
+//	    "zzzzz-tpzed-xurymjxw79nv3jz": {"DailyPutBytes": 1000000000000}
+//	  },
+//	  "UsageReportToken": "xyzzy"
+//	}
+type QuotaConfig struct {
+	// Limits for tokens/users without an override.
+	Default QuotaLimits
+
+	// If true, all tokens belonging to the same user share a
+	// single set of limits. Otherwise, each token has its own.
+	PerUser bool
+
+	// Per-user overrides, keyed by user UUID. An override
+	// replaces the Default limits entirely.
+	Users map[string]QuotaLimits
+
+	// Token that can be used to retrieve the usage report at
+	// /usage.json. If empty, the report is not available.
+	UsageReportToken string
+}
+
+// QuotaExceededError is returned to clients whose request would
+// exceed their quota.
+var QuotaExceededError = errors.New("Quota exceeded")
+
+// Usage records for tokens/users that have been idle this long are
+// discarded.
+const quotaIdleTime = 24 * time.Hour
+
+// A QuotaTracker enforces QuotaLimits. A nil *QuotaTracker imposes
+// no limits.
+type QuotaTracker struct {
+	config    QuotaConfig
+	now       func() time.Time
+	mtx       sync.Mutex
+	usage     map[string]*quotaUsage
+	lastPrune time.Time
+}
+
+// quotaUsage tracks a single token's (or user's) usage. The request
+// and bandwidth limits are token buckets: each request or byte takes
+// a token, and tokens are replenished at a constant rate. The
+// bandwidth bucket can go into debt, because the size of a GET
+// response isn't known until it has been sent.
+type quotaUsage struct {
+	UserUUID    string      `json:"user_uuid"`
+	Limits      QuotaLimits `json:"limits"`
+	Requests    int64       `json:"requests"`
+	Rejected    int64       `json:"rejected"`
+	Bytes       int64       `json:"bytes"`
+	Day         string      `json:"day"`
+	DayPutBytes int64       `json:"day_put_bytes"`
+	LastUsed    time.Time   `json:"last_used"`
+
+	tracker    *QuotaTracker
+	reqBucket  float64
+	byteBucket float64
+	lastRefill time.Time
+}
+
+// NewQuotaTracker returns a QuotaTracker that enforces the given
+// limits.
+func NewQuotaTracker(config QuotaConfig) *QuotaTracker {
+	return &QuotaTracker{
+		config: config,
+		now:    time.Now,
+		usage:  make(map[string]*quotaUsage),
+	}
+}
+
+// LoadQuotaConfig reads a QuotaConfig from a JSON file.
+func LoadQuotaConfig(path string) (config QuotaConfig, err error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("Error reading quota config %q: %v", path, err)
+	} else if err = json.Unmarshal(buf, &config); err != nil {
+		err = fmt.Errorf("Error decoding quota config %q: %v", path, err)
+	}
+	return
+}
+
+// Admit starts a request from the given token, belonging to the given
+// user. putBytes is the size of the block being written, or 0 for a
+// GET or HEAD request.
+//
+// If the request is allowed, Admit returns a *quotaUsage, which the
+// caller should use to record the number of bytes sent. Otherwise,
+// it returns the time the client should wait before trying again.
+func (qt *QuotaTracker) Admit(token, userUUID string, putBytes int64) (*quotaUsage, time.Duration) {
+	if qt == nil {
+		return nil, 0
+	}
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	now := qt.now()
+	qt.prune(now)
+	u := qt.getUsage(token, userUUID, now)
+	u.LastUsed = now
+	u.Requests++
+
+	var wait time.Duration
+	lim := u.Limits
+	if lim.RequestsPerSecond > 0 && u.reqBucket < 1 {
+		wait = maxDuration(wait, durationFor(1-u.reqBucket, lim.RequestsPerSecond))
+	}
+	if lim.BytesPerSecond > 0 && u.byteBucket < 0 {
+		wait = maxDuration(wait, durationFor(-u.byteBucket, float64(lim.BytesPerSecond)))
+	}
+	if lim.DailyPutBytes > 0 && putBytes > 0 && u.DayPutBytes+putBytes > lim.DailyPutBytes {
+		t := now.UTC()
+		midnight := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		wait = maxDuration(wait, midnight.Sub(t))
+	}
+	if wait > 0 {
+		u.Rejected++
+		return nil, wait
+	}
+	u.reqBucket--
+	u.byteBucket -= float64(putBytes)
+	u.Bytes += putBytes
+	u.DayPutBytes += putBytes
+	return u, 0
+}
+
+// Sent records the number of bytes sent in response to a GET
+// request.
+func (u *quotaUsage) Sent(n int64) {
+	if u == nil || n <= 0 {
+		return
+	}
+	u.tracker.mtx.Lock()
+	defer u.tracker.mtx.Unlock()
+	u.byteBucket -= float64(n)
+	u.Bytes += n
+}
+
+// PutFailed refunds the daily PUT allowance reserved by Admit, if
+// the block could not be written.
+func (u *quotaUsage) PutFailed(putBytes int64) {
+	if u == nil || putBytes <= 0 {
+		return
+	}
+	u.tracker.mtx.Lock()
+	defer u.tracker.mtx.Unlock()
+	u.DayPutBytes -= putBytes
+	if u.DayPutBytes < 0 {
+		u.DayPutBytes = 0
+	}
+}
+
+// getUsage returns the (refilled) usage record for the given
+// token/user. Caller must have lock.
+func (qt *QuotaTracker) getUsage(token, userUUID string, now time.Time) *quotaUsage {
+	key := userUUID
+	if !qt.config.PerUser || userUUID == "" {
+		key = userUUID + "/" + tokenDigest(token)
+	}
+	u, ok := qt.usage[key]
+	if !ok {
+		lim, ok := qt.config.Users[userUUID]
+		if !ok {
+			lim = qt.config.Default
+		}
+		if lim.RequestBurst <= 0 {
+			lim.RequestBurst = int(math.Ceil(lim.RequestsPerSecond))
+		}
+		u = &quotaUsage{
+			UserUUID:   userUUID,
+			Limits:     lim,
+			tracker:    qt,
+			reqBucket:  float64(lim.RequestBurst),
+			byteBucket: float64(lim.BytesPerSecond),
+			lastRefill: now,
+		}
+		qt.usage[key] = u
+	}
+	elapsed := now.Sub(u.lastRefill).Seconds()
+	if elapsed > 0 {
+		u.reqBucket = math.Min(u.reqBucket+elapsed*u.Limits.RequestsPerSecond, float64(u.Limits.RequestBurst))
+		u.byteBucket = math.Min(u.byteBucket+elapsed*float64(u.Limits.BytesPerSecond), float64(u.Limits.BytesPerSecond))
+		u.lastRefill = now
+	}
+	if day := now.UTC().Format("2006-01-02"); day != u.Day {
+		u.Day = day
+		u.DayPutBytes = 0
+	}
+	return u
+}
+
+// prune discards usage records that have been idle for a long
+// time. Caller must have lock.
+func (qt *QuotaTracker) prune(now time.Time) {
+	if now.Sub(qt.lastPrune) < time.Hour {
+		return
+	}
+	qt.lastPrune = now
+	for key, u := range qt.usage {
+		if now.Sub(u.LastUsed) > quotaIdleTime {
+			delete(qt.usage, key)
+		}
+	}
+}
+
+// Report returns a copy of the current usage records, keyed by user
+// UUID (if limits are per user) or by user UUID and a digest of the
+// token.
+func (qt *QuotaTracker) Report() map[string]quotaUsage {
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	report := make(map[string]quotaUsage, len(qt.usage))
+	for key, u := range qt.usage {
+		report[key] = *u
+	}
+	return report
+}
+
+// UsageHandler serves the usage report of a QuotaTracker as JSON.
+type UsageHandler struct {
+	*QuotaTracker
+}
+
+func (h UsageHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var tok string
+	fmt.Sscanf(req.Header.Get("Authorization"), "OAuth2 %s", &tok)
+	if h.config.UsageReportToken == "" || subtle.ConstantTimeCompare([]byte(tok), []byte(h.config.UsageReportToken)) != 1 {
+		http.Error(resp, BadAuthorizationHeader.Error(), http.StatusForbidden)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(h.Report())
+}
+
+// setRetryAfter adds a Retry-After header telling the client how many
+// seconds to wait.
+func setRetryAfter(resp http.ResponseWriter, wait time.Duration) {
+	resp.Header().Set("Retry-After", fmt.Sprintf("%d", int64(math.Ceil(wait.Seconds()))))
+}
+
+// tokenDigest identifies a token in usage records without revealing
+// it.
+func tokenDigest(token string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(token)))[:10]
+}
+
+// durationFor returns the time it takes to accumulate n units at the
+// given rate per second.
+func durationFor(n, rate float64) time.Duration {
+	return time.Duration(n / rate * float64(time.Second))
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&QuotaSuite{})
+
+// Tests that use a QuotaTracker without any Arvados services
+type QuotaSuite struct {
+	now time.Time
+}
+
+const (
+	quotaTestUser  = "zzzzz-tpzed-xurymjxw79nv3jz"
+	quotaTestToken = "4axaw8zxe0qm22wa6urpp5nskcne8z88cvbupv653y1njyi05h"
+)
+
+func (s *QuotaSuite) SetUpTest(c *C) {
+	s.now = time.Date(2016, 10, 19, 12, 0, 0, 0, time.UTC)
+}
+
+func (s *QuotaSuite) tracker(config QuotaConfig) *QuotaTracker {
+	qt := NewQuotaTracker(config)
+	qt.now = func() time.Time { return s.now }
+	return qt
+}
+
+func (s *QuotaSuite) TestNilTracker(c *C) {
+	var qt *QuotaTracker
+	u, wait := qt.Admit(quotaTestToken, quotaTestUser, 1000)
+	c.Check(wait, Equals, time.Duration(0))
+	u.Sent(1000)
+	u.PutFailed(1000)
+}
+
+func (s *QuotaSuite) TestRequestRate(c *C) {
+	qt := s.tracker(QuotaConfig{Default: QuotaLimits{RequestsPerSecond: 2}})
+	for i := 0; i < 2; i++ {
+		_, wait := qt.Admit(quotaTestToken, quotaTestUser, 0)
+		c.Check(wait, Equals, time.Duration(0))
+	}
+	_, wait := qt.Admit(quotaTestToken, quotaTestUser, 0)
+	c.Check(wait, Equals, 500*time.Millisecond)
+
+	// Other tokens are not affected.
+	_, wait = qt.Admit("othertoken", quotaTestUser, 0)
+	c.Check(wait, Equals, time.Duration(0))
+
+	s.now = s.now.Add(500 * time.Millisecond)
+	_, wait = qt.Admit(quotaTestToken, quotaTestUser, 0)
+	c.Check(wait, Equals, time.Duration(0))
+}
+
+func (s *QuotaSuite) TestBandwidth(c *C) {
+	qt := s.tracker(QuotaConfig{Default: QuotaLimits{BytesPerSecond: 1000}})
+	u, wait := qt.Admit(quotaTestToken, quotaTestUser, 0)
+	c.Assert(wait, Equals, time.Duration(0))
+	u.Sent(3000)
+
+	_, wait = qt.Admit(quotaTestToken, quotaTestUser, 0)
+	c.Check(wait, Equals, 2*time.Second)
+
+	s.now = s.now.Add(2 * time.Second)
+	_, wait = qt.Admit(quotaTestToken, quotaTestUser, 5000)
+	c.Check(wait, Equals, time.Duration(0))
+	_, wait = qt.Admit(quotaTestToken, quotaTestUser, 0)
+	c.Check(wait, Equals, 5*time.Second)
+}
+
+func (s *QuotaSuite) TestDailyPutBytes(c *C) {
+	qt := s.tracker(QuotaConfig{Default: QuotaLimits{DailyPutBytes: 100}})
+	_, wait := qt.Admit(quotaTestToken, quotaTestUser, 60)
+	c.Check(wait, Equals, time.Duration(0))
+
+	// GET requests are still allowed when the PUT quota is used up.
+	_, wait = qt.Admit(quotaTestToken, quotaTestUser, 0)
+	c.Check(wait, Equals, time.Duration(0))
+
+	u, wait := qt.Admit(quotaTestToken, quotaTestUser, 40)
+	c.Check(wait, Equals, time.Duration(0))
+	_, wait = qt.Admit(quotaTestToken, quotaTestUser, 1)
+	c.Check(wait, Equals, 12*time.Hour)
+
+	u.PutFailed(40)
+	_, wait = qt.Admit(quotaTestToken, quotaTestUser, 40)
+	c.Check(wait, Equals, time.Duration(0))
+
+	s.now = s.now.Add(12 * time.Hour)
+	_, wait = qt.Admit(quotaTestToken, quotaTestUser, 100)
+	c.Check(wait, Equals, time.Duration(0))
+}
+
+func (s *QuotaSuite) TestPerUserAndOverrides(c *C) {
+	qt := s.tracker(QuotaConfig{
+		Default: QuotaLimits{RequestsPerSecond: 1},
+		PerUser: true,
+		Users: map[string]QuotaLimits{
+			quotaTestUser: {RequestsPerSecond: 1, RequestBurst: 3},
+		},
+	})
+	// Tokens belonging to the same user share the user's limit.
+	for _, tok := range []string{"token1", "token2", "token3"} {
+		_, wait := qt.Admit(tok, quotaTestUser, 0)
+		c.Check(wait, Equals, time.Duration(0))
+	}
+	_, wait := qt.Admit("token4", quotaTestUser, 0)
+	c.Check(wait, Not(Equals), time.Duration(0))
+
+	// Other users get the default limits.
+	_, wait = qt.Admit("token5", "zzzzz-tpzed-000000000000000", 0)
+	c.Check(wait, Equals, time.Duration(0))
+	_, wait = qt.Admit("token6", "zzzzz-tpzed-000000000000000", 0)
+	c.Check(wait, Equals, time.Second)
+
+	report := qt.Report()
+	c.Check(report, HasLen, 2)
+	c.Check(report[quotaTestUser].Requests, Equals, int64(4))
+	c.Check(report[quotaTestUser].Rejected, Equals, int64(1))
+	c.Check(report[quotaTestUser].Limits.RequestBurst, Equals, 3)
+}
+
+func (s *QuotaSuite) TestPrune(c *C) {
+	qt := s.tracker(QuotaConfig{})
+	qt.Admit(quotaTestToken, quotaTestUser, 0)
+	s.now = s.now.Add(quotaIdleTime / 2)
+	qt.Admit("othertoken", quotaTestUser, 0)
+	c.Check(qt.Report(), HasLen, 2)
+	s.now = s.now.Add(quotaIdleTime * 3 / 4)
+	qt.Admit("othertoken", quotaTestUser, 0)
+	c.Check(qt.Report(), HasLen, 1)
+}
+
+func (s *QuotaSuite) TestHandlersReturn429(c *C) {
+	qt := s.tracker(QuotaConfig{Default: QuotaLimits{RequestsPerSecond: 0.5}})
+	cache := &ApiTokenCache{
+		tokens:     make(map[string]int64),
+		users:      make(map[string]string),
+		expireTime: 300,
+	}
+	cache.RememberToken(quotaTestToken, quotaTestUser)
+	_, wait := qt.Admit(quotaTestToken, quotaTestUser, 0)
+	c.Assert(wait, Equals, time.Duration(0))
+
+	kc := &keepclient.KeepClient{}
+	for _, trial := range []struct {
+		method  string
+		handler http.Handler
+	}{
+		{"GET", GetBlockHandler{kc, cache, qt, nil}},
+		{"PUT", PutBlockHandler{kc, cache, qt, nil}},
+	} {
+		req, err := http.NewRequest(trial.method, "http://keep.example/acbd18db4cc2f85cedef654fccc4a4d8+3", nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "OAuth2 "+quotaTestToken)
+		req.Header.Set("Content-Length", "3")
+		resp := httptest.NewRecorder()
+		trial.handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, Equals, http.StatusTooManyRequests)
+		c.Check(resp.Header().Get("Retry-After"), Equals, "2")
+	}
+}
+
+func (s *QuotaSuite) TestUsageHandler(c *C) {
+	qt := s.tracker(QuotaConfig{UsageReportToken: "reporttoken"})
+	qt.Admit(quotaTestToken, quotaTestUser, 1234)
+	h := UsageHandler{qt}
+	for _, auth := range []string{"", "OAuth2 wrongtoken", "OAuth2 " + quotaTestToken} {
+		req, _ := http.NewRequest("GET", "http://keep.example/usage.json", nil)
+		req.Header.Set("Authorization", auth)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		c.Check(resp.Code, Equals, http.StatusForbidden)
+	}
+
+	req, _ := http.NewRequest("GET", "http://keep.example/usage.json", nil)
+	req.Header.Set("Authorization", "OAuth2 reporttoken")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	var report map[string]struct {
+		UserUUID    string `json:"user_uuid"`
+		DayPutBytes int64  `json:"day_put_bytes"`
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&report), IsNil)
+	c.Assert(report, HasLen, 1)
+	for key, u := range report {
+		c.Check(key, Matches, quotaTestUser+`/[0-9a-f]{10}`)
+		c.Check(key, Not(Matches), `.*`+quotaTestToken+`.*`)
+		c.Check(u.UserUUID, Equals, quotaTestUser)
+		c.Check(u.DayPutBytes, Equals, int64(1234))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+)
+
+// PoolStatus reports the usage of the shared block buffer pool.
+type PoolStatus struct {
+	Alloc uint64 `json:"BytesAllocated"`
+	Cap   int    `json:"BuffersMax"`
+	Len   int    `json:"BuffersInUse"`
+}
+
+// ProxyStatus is the response to a /status.json request.
+type ProxyStatus struct {
+	BufferPool PoolStatus
+	Memory     runtime.MemStats
+}
+
+var st ProxyStatus
+var stLock sync.Mutex
+
+// StatusHandler addresses /status.json requests.
+func StatusHandler(resp http.ResponseWriter, req *http.Request) {
+	stLock.Lock()
+	readProxyStatus(&st)
+	jstat, err := json.Marshal(&st)
+	stLock.Unlock()
+	if err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(jstat)
+	} else {
+		log.Printf("json.Marshal: %s", err)
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// populate the given ProxyStatus struct with current values.
+func readProxyStatus(st *ProxyStatus) {
+	st.BufferPool.Alloc = bufs.Alloc()
+	st.BufferPool.Cap = bufs.Cap()
+	st.BufferPool.Len = bufs.Len()
+	runtime.ReadMemStats(&st.Memory)
+}
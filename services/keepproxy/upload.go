@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/auditlog"
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads
+//
+// A client that cannot reliably send a whole block in one request
+// can instead upload a file in arbitrarily sized pieces. Keepproxy
+// assembles the pieces into blocks, writes each block to Keep as soon
+// as it is full, and remembers how much of the file it has received,
+// so an interrupted upload can be resumed from where it left off --
+// even after keepproxy restarts.
+//
+//	POST /uploads
+//		Start an upload. Optional headers: "Upload-Length"
+//		(total size of the file, if known), "Upload-Filename"
+//		(name of the file in the resulting manifest, default
+//		"upload"), and "X-Keep-Desired-Replicas". Responds 201
+//		with the upload's URL in the Location header.
+//
+//	HEAD /uploads/{id}
+//		Responds with the number of bytes received so far in
+//		the "Upload-Offset" header.
+//
+//	PATCH /uploads/{id}
+//		Append the request body to the file. The request must
+//		have a Content-Length header; otherwise the response is
+//		411. The "Upload-Offset" header must match the number of
+//		bytes received so far; otherwise the response is 409.
+//		Responds 204 with the new offset in "Upload-Offset". If
+//		the connection breaks, the bytes received before the
+//		break are kept.
+//
+//	POST /uploads/{id}/finish
+//		Write the last (partial) block and respond with JSON
+//		{"manifest_text": "..."}. If the "create_collection"
+//		parameter is "true", also create a collection (with the
+//		given "name" and "owner_uuid", if any) and include its
+//		"collection_uuid" in the response.
+//
+//	DELETE /uploads/{id}
+//		Abandon the upload.
+//
+// An upload can only be continued, finished, or abandoned with the
+// token that started it. The blocks written so far are signed for
+// that token, so a manifest that uses them is only valid for that
+// token.
+
+// Uploads that have not been touched for this long are discarded.
+const uploadIdleTime = 7 * 24 * time.Hour
+
+var (
+	UploadNotFoundError    = errors.New("Upload not found")
+	UploadBusyError        = errors.New("Upload is busy with another request")
+	UploadOffsetError      = errors.New("Upload-Offset does not match the number of bytes received")
+	UploadTooLongError     = errors.New("Upload would exceed Upload-Length")
+	UploadIncompleteError  = errors.New("Upload is shorter than Upload-Length")
+	UploadBadFilenameError = errors.New("Invalid Upload-Filename")
+)
+
+// An UploadManager keeps track of resumable uploads. The state of
+// each upload is saved in a directory (as {id}.json, plus {id}.data
+// for bytes that have not yet been written to Keep) so uploads
+// survive restarts.
+type UploadManager struct {
+	dir       string
+	blockSize int64
+	now       func() time.Time
+	mtx       sync.Mutex
+	uploads   map[string]*upload
+	lastPrune time.Time
+}
+
+type upload struct {
+	ID string
+	// Digest of the token that started the upload (see
+	// uploadOwner).
+	Owner    string
+	Filename string
+	// Total size, or -1 if not given.
+	Length   int64
+	Replicas int
+	// Number of bytes received.
+	Offset int64
+	// Locators of the blocks written so far, and their total
+	// size.
+	Locators   []string
+	BlockBytes int64
+	LastUsed   time.Time
+
+	busy bool
+}
+
+// NewUploadManager returns an UploadManager that stores its state in
+// dir, after loading any uploads left there by a previous process.
+func NewUploadManager(dir string) (*UploadManager, error) {
+	um := &UploadManager{
+		dir:       dir,
+		blockSize: keepclient.BLOCKSIZE,
+		now:       time.Now,
+		uploads:   make(map[string]*upload),
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		up, err := um.load(path)
+		if err != nil {
+			log.Printf("Error loading upload state %q: %v", path, err)
+			continue
+		}
+		um.uploads[up.ID] = up
+	}
+	return um, nil
+}
+
+// load reads an upload's state, and reconciles its offset with the
+// size of its data file, which may be out of step if the previous
+// process was interrupted.
+func (um *UploadManager) load(path string) (*upload, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var up upload
+	if err = json.Unmarshal(buf, &up); err != nil {
+		return nil, err
+	}
+	if filepath.Base(path) != up.ID+".json" {
+		return nil, fmt.Errorf("ID %q does not match file name", up.ID)
+	}
+	var size int64
+	if fi, err := os.Stat(um.dataPath(up.ID)); err == nil {
+		size = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if expect := up.Offset - up.BlockBytes; size > expect {
+		// Bytes that were never acknowledged, or a block
+		// that was written to Keep just before exiting.
+		if err = os.Truncate(um.dataPath(up.ID), expect); err != nil {
+			return nil, err
+		}
+	} else if size < expect {
+		up.Offset = up.BlockBytes + size
+	}
+	return &up, nil
+}
+
+func (um *UploadManager) statePath(id string) string {
+	return filepath.Join(um.dir, id+".json")
+}
+
+func (um *UploadManager) dataPath(id string) string {
+	return filepath.Join(um.dir, id+".data")
+}
+
+// save writes the upload's state. The caller must have reserved
+// the upload with acquire.
+func (um *UploadManager) save(up *upload) error {
+	buf, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	tmp := um.statePath(up.ID) + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, um.statePath(up.ID))
+}
+
+func (um *UploadManager) remove(id string) {
+	um.mtx.Lock()
+	delete(um.uploads, id)
+	um.mtx.Unlock()
+	os.Remove(um.statePath(id))
+	os.Remove(um.dataPath(id))
+}
+
+// create starts a new upload.
+func (um *UploadManager) create(owner, filename string, length int64, replicas int) (*upload, error) {
+	var rnd [16]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return nil, err
+	}
+	up := &upload{
+		ID:       fmt.Sprintf("%x", rnd),
+		Owner:    owner,
+		Filename: filename,
+		Length:   length,
+		Replicas: replicas,
+		LastUsed: um.now(),
+		busy:     true,
+	}
+	if err := um.save(up); err != nil {
+		return nil, err
+	}
+	um.mtx.Lock()
+	defer um.mtx.Unlock()
+	um.prune()
+	um.uploads[up.ID] = up
+	return up, nil
+}
+
+// acquire returns the given upload, reserved for the caller until
+// release is called.
+func (um *UploadManager) acquire(id, owner string) (*upload, error) {
+	um.mtx.Lock()
+	defer um.mtx.Unlock()
+	up, ok := um.uploads[id]
+	if !ok || up.Owner != owner {
+		return nil, UploadNotFoundError
+	}
+	if up.busy {
+		return nil, UploadBusyError
+	}
+	up.busy = true
+	up.LastUsed = um.now()
+	return up, nil
+}
+
+func (um *UploadManager) release(up *upload) {
+	um.mtx.Lock()
+	defer um.mtx.Unlock()
+	up.busy = false
+}
+
+// prune discards idle uploads. Caller must have lock.
+func (um *UploadManager) prune() {
+	now := um.now()
+	if now.Sub(um.lastPrune) < time.Hour {
+		return
+	}
+	um.lastPrune = now
+	for id, up := range um.uploads {
+		if !up.busy && now.Sub(up.LastUsed) > uploadIdleTime {
+			delete(um.uploads, id)
+			os.Remove(um.statePath(id))
+			os.Remove(um.dataPath(id))
+		}
+	}
+}
+
+// appendData adds data from r to the upload, writing blocks to Keep
+// as they fill up. It returns the number of bytes added, which is
+// reflected in the saved state even if an error occurs.
+func (um *UploadManager) appendData(ctx context.Context, kc *keepclient.KeepClient, up *upload, r io.Reader) (n int64, err error) {
+	f, err := os.OpenFile(um.dataPath(up.ID), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	defer func() {
+		if err2 := um.save(up); err == nil {
+			err = err2
+		}
+	}()
+	for {
+		pending := up.Offset - up.BlockBytes
+		if pending >= um.blockSize {
+			if err = um.writeBlock(ctx, kc, up, f); err != nil {
+				return
+			}
+			continue
+		}
+		if _, err = f.Seek(pending, os.SEEK_SET); err != nil {
+			return
+		}
+		var copied int64
+		copied, err = io.CopyN(f, r, um.blockSize-pending)
+		n += copied
+		up.Offset += copied
+		if err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+	}
+}
+
+// writeBlock writes the upload's pending data (if any, or if there
+// are no blocks yet) to Keep, and truncates the data file f.
+func (um *UploadManager) writeBlock(ctx context.Context, kc *keepclient.KeepClient, up *upload, f *os.File) error {
+	pending := up.Offset - up.BlockBytes
+	if pending == 0 && len(up.Locators) > 0 {
+		return nil
+	}
+	data := bufs.Get(int(pending))
+	defer bufs.Put(data)
+	if _, err := f.ReadAt(data, 0); err != nil && !(err == io.EOF && pending == 0) {
+		return err
+	}
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	kc.Want_replicas = up.Replicas
+	locator, replicas, err := kc.PutHRContext(ctx, hash, bytes.NewReader(data), pending)
+	if err == keepclient.InsufficientReplicasError && replicas > 0 {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	up.Locators = append(up.Locators, locator)
+	up.BlockBytes += pending
+	if err = um.save(up); err != nil {
+		return err
+	}
+	return f.Truncate(0)
+}
+
+// finish writes the last block and returns a manifest for the
+// uploaded file. The upload's state is left in place until the
+// caller removes it, in case the caller fails to deliver the result.
+func (um *UploadManager) finish(ctx context.Context, kc *keepclient.KeepClient, up *upload) (string, error) {
+	if up.Length >= 0 && up.Offset != up.Length {
+		return "", UploadIncompleteError
+	}
+	f, err := os.OpenFile(um.dataPath(up.ID), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err = um.writeBlock(ctx, kc, up, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(". %s 0:%d:%s\n", strings.Join(up.Locators, " "), up.Offset, manifestEscape(up.Filename)), nil
+}
+
+// manifestEscape escapes characters that cannot appear literally in
+// a manifest file name.
+func manifestEscape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c == '\\' || c == ':' || c == 0177 {
+			fmt.Fprintf(&buf, "\\%03o", c)
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// UploadHandler serves the resumable upload API.
+type UploadHandler struct {
+	*keepclient.KeepClient
+	*ApiTokenCache
+	*QuotaTracker
+	*UploadManager
+}
+
+func (h UploadHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	SetCorsHeaders(resp)
+
+	id := mux.Vars(req)["id"]
+	action := mux.Vars(req)["action"]
+	var err error
+	var status = http.StatusInternalServerError
+	var n int64
+	var tok string
+	// Set if the request is refused because the audit log is not
+	// working, in which case the request is not logged there.
+	var auditUnavailable bool
+
+	defer func() {
+		httpserver.LogDetail(req.Context(), "bytes_received", n)
+		if err != nil && status >= 400 {
+			http.Error(resp, err.Error(), status)
+		}
+		if !auditUnavailable {
+			audit.Log(auditlog.Event{
+				Service:    "keepproxy",
+				Method:     req.Method,
+				Status:     status,
+				UserUUID:   h.ApiTokenCache.RecallUser(tok),
+				Path:       req.URL.Path,
+				Bytes:      n,
+				RemoteAddr: GetRemoteAddress(req),
+				UserAgent:  req.UserAgent(),
+			})
+		}
+	}()
+
+	var pass bool
+	if pass, tok = CheckAuthorizationHeader(h.KeepClient, h.ApiTokenCache, req); !pass {
+		status, err = http.StatusForbidden, BadAuthorizationHeader
+		return
+	}
+	if err = audit.Ready(); err != nil {
+		status = http.StatusServiceUnavailable
+		auditUnavailable = true
+		return
+	}
+	userUUID := h.ApiTokenCache.RecallUser(tok)
+	owner := uploadOwner(tok)
+
+	var putBytes int64
+	if req.Method == "PATCH" {
+		// The quota is charged before the body is read, so the
+		// size has to be known up front.
+		if req.ContentLength < 0 {
+			status, err = http.StatusLengthRequired, LengthRequiredError
+			return
+		}
+		putBytes = req.ContentLength
+	}
+	usage, wait := h.QuotaTracker.Admit(tok, userUUID, putBytes)
+	if wait > 0 {
+		setRetryAfter(resp, wait)
+		status, err = http.StatusTooManyRequests, QuotaExceededError
+		return
+	}
+	defer func() { usage.PutFailed(putBytes - n) }()
+
+	// Copy ArvadosClient struct and use the client's API token
+	arvclient := *h.KeepClient.Arvados
+	arvclient.ApiToken = tok
+	kc := h.KeepClient.Clone(&arvclient)
+
+	if id == "" {
+		status, err = h.create(resp, req, owner)
+		return
+	}
+
+	var up *upload
+	if up, err = h.acquire(id, owner); err == UploadNotFoundError {
+		status = http.StatusNotFound
+		return
+	} else if err == UploadBusyError {
+		status = http.StatusConflict
+		return
+	} else if err != nil {
+		return
+	}
+	defer h.release(up)
+
+	switch {
+	case req.Method == "HEAD":
+		setUploadHeaders(resp, up)
+		resp.Header().Set("Cache-Control", "no-store")
+		status = http.StatusOK
+	case req.Method == "PATCH":
+		var offset int64
+		if offset, err = strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64); err != nil || offset != up.Offset {
+			setUploadHeaders(resp, up)
+			status, err = http.StatusConflict, UploadOffsetError
+			return
+		}
+		// Content-Length is known at this point, and the body
+		// can't be longer, so an oversized body is refused
+		// before any of it is stored.
+		if up.Length >= 0 && req.ContentLength > up.Length-up.Offset {
+			setUploadHeaders(resp, up)
+			status, err = http.StatusRequestEntityTooLarge, UploadTooLongError
+			return
+		}
+		n, err = h.appendData(req.Context(), kc, up, req.Body)
+		setUploadHeaders(resp, up)
+		if err != nil {
+			status = http.StatusBadGateway
+			return
+		}
+		status = http.StatusNoContent
+		resp.WriteHeader(status)
+	case req.Method == "POST" && action == "finish":
+		status, err = h.finishUpload(resp, req, kc, up)
+	case req.Method == "DELETE":
+		h.remove(up.ID)
+		status = http.StatusNoContent
+		resp.WriteHeader(status)
+	default:
+		status, err = http.StatusNotImplemented, MethodNotSupported
+	}
+}
+
+func (h UploadHandler) create(resp http.ResponseWriter, req *http.Request, owner string) (int, error) {
+	length := int64(-1)
+	if s := req.Header.Get("Upload-Length"); s != "" {
+		var err error
+		if length, err = strconv.ParseInt(s, 10, 64); err != nil || length < 0 {
+			return http.StatusBadRequest, errors.New("Invalid Upload-Length")
+		}
+	}
+	filename := req.Header.Get("Upload-Filename")
+	if filename == "" {
+		filename = "upload"
+	} else if filename == "." || filename == ".." || strings.ContainsAny(filename, "/\x00") {
+		return http.StatusBadRequest, UploadBadFilenameError
+	}
+	replicas := h.KeepClient.Want_replicas
+	if r, err := strconv.Atoi(req.Header.Get(keepclient.X_Keep_Desired_Replicas)); err == nil && r > 0 {
+		replicas = r
+	}
+	up, err := h.UploadManager.create(owner, filename, length, replicas)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer h.release(up)
+	resp.Header().Set("Location", "/uploads/"+up.ID)
+	setUploadHeaders(resp, up)
+	resp.WriteHeader(http.StatusCreated)
+	return http.StatusCreated, nil
+}
+
+func (h UploadHandler) finishUpload(resp http.ResponseWriter, req *http.Request, kc *keepclient.KeepClient, up *upload) (int, error) {
+	manifest, err := h.finish(req.Context(), kc, up)
+	if err == UploadIncompleteError {
+		setUploadHeaders(resp, up)
+		return http.StatusConflict, err
+	} else if err != nil {
+		return http.StatusBadGateway, err
+	}
+	result := map[string]string{"manifest_text": manifest}
+	if req.FormValue("create_collection") == "true" {
+		attrs := arvadosclient.Dict{"manifest_text": manifest}
+		if name := req.FormValue("name"); name != "" {
+			attrs["name"] = name
+		}
+		if owner := req.FormValue("owner_uuid"); owner != "" {
+			attrs["owner_uuid"] = owner
+		}
+		var coll struct {
+			UUID string `json:"uuid"`
+		}
+		if err = kc.Arvados.Create("collections", arvadosclient.Dict{"collection": attrs}, &coll); err != nil {
+			return http.StatusBadGateway, fmt.Errorf("Error creating collection: %v", err)
+		}
+		result["collection_uuid"] = coll.UUID
+	}
+	h.remove(up.ID)
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	return http.StatusOK, json.NewEncoder(resp).Encode(result)
+}
+
+// uploadOwner returns a digest of token that identifies the uploads
+// it can use, without saving the token itself on disk.
+func uploadOwner(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+func setUploadHeaders(resp http.ResponseWriter, up *upload) {
+	resp.Header().Set("Upload-Offset", fmt.Sprintf("%d", up.Offset))
+	if up.Length >= 0 {
+		resp.Header().Set("Upload-Length", fmt.Sprintf("%d", up.Length))
+	}
+}
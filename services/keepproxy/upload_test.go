@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/auditlog"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&UploadSuite{})
+
+// Tests that use stub API and Keep servers
+type UploadSuite struct {
+	dir       string
+	apiStub   *httptest.Server
+	keepStub  *httptest.Server
+	kc        *keepclient.KeepClient
+	um        *UploadManager
+	router    http.Handler
+	mtx       sync.Mutex
+	blocks    map[string][]byte
+	manifests []string
+}
+
+var uploadTestTokens = map[string]string{
+	"token1": "zzzzz-tpzed-000000000000001",
+	"token2": "zzzzz-tpzed-000000000000001",
+	"token3": "zzzzz-tpzed-000000000000003",
+}
+
+func (s *UploadSuite) SetUpTest(c *C) {
+	var err error
+	s.dir, err = ioutil.TempDir("", "keepproxy-upload")
+	c.Assert(err, IsNil)
+	s.blocks = make(map[string][]byte)
+	s.manifests = nil
+
+	s.apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var tok string
+		fmt.Sscanf(req.Header.Get("Authorization"), "OAuth2 %s", &tok)
+		userUUID, ok := uploadTestTokens[tok]
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/arvados/v1/users/current":
+			json.NewEncoder(w).Encode(map[string]string{"uuid": userUUID})
+		case req.Method == "POST" && req.URL.Path == "/arvados/v1/collections":
+			var attrs map[string]string
+			c.Check(json.Unmarshal([]byte(req.FormValue("collection")), &attrs), IsNil)
+			s.mtx.Lock()
+			s.manifests = append(s.manifests, attrs["manifest_text"])
+			s.mtx.Unlock()
+			json.NewEncoder(w).Encode(map[string]string{"uuid": "zzzzz-4zz18-000000000000001", "name": attrs["name"]})
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}))
+	s.keepStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		c.Check(err, IsNil)
+		hash := fmt.Sprintf("%x", md5.Sum(body))
+		c.Check(req.URL.Path, Equals, "/"+hash)
+		s.mtx.Lock()
+		s.blocks[hash] = body
+		s.mtx.Unlock()
+		w.Header().Set(keepclient.X_Keep_Replicas_Stored, "1")
+		fmt.Fprintf(w, "%s+%d", hash, len(body))
+	}))
+
+	s.kc = &keepclient.KeepClient{
+		Arvados: &arvadosclient.ArvadosClient{
+			Scheme:    "http",
+			ApiServer: strings.TrimPrefix(s.apiStub.URL, "http://"),
+			Client:    &http.Client{Transport: &http.Transport{}},
+		},
+		Want_replicas: 1,
+		Client:        &http.Client{},
+	}
+	roots := map[string]string{"zzzzz-bi6l4-000000000000000": s.keepStub.URL}
+	s.kc.SetServiceRoots(roots, roots, nil)
+	s.restart(c)
+}
+
+func (s *UploadSuite) TearDownTest(c *C) {
+	s.apiStub.Close()
+	s.keepStub.Close()
+	os.RemoveAll(s.dir)
+}
+
+// restart replaces the UploadManager and router with new ones, as if
+// keepproxy had restarted.
+func (s *UploadSuite) restart(c *C) {
+	var err error
+	s.um, err = NewUploadManager(s.dir)
+	c.Assert(err, IsNil)
+	s.um.blockSize = 8
+	s.router = MakeRESTRouter(false, true, s.kc, nil, s.um, nil)
+}
+
+func (s *UploadSuite) do(c *C, method, path, token string, hdr map[string]string, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://keep.example"+path, bytes.NewBufferString(body))
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", "OAuth2 "+token)
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *UploadSuite) start(c *C, hdr map[string]string) string {
+	resp := s.do(c, "POST", "/uploads", "token1", hdr, "")
+	c.Assert(resp.Code, Equals, http.StatusCreated)
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "0")
+	path := resp.Header().Get("Location")
+	c.Assert(path, Matches, `/uploads/[0-9a-f]{32}`)
+	return path
+}
+
+func (s *UploadSuite) patch(c *C, path string, offset int, data string) *httptest.ResponseRecorder {
+	return s.do(c, "PATCH", path, "token1", map[string]string{"Upload-Offset": fmt.Sprintf("%d", offset)}, data)
+}
+
+// content reassembles a file from the blocks in a manifest.
+func (s *UploadSuite) content(c *C, manifest string) string {
+	fields := strings.Fields(manifest)
+	c.Assert(len(fields) >= 3, Equals, true)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var content []byte
+	for _, loc := range fields[1 : len(fields)-1] {
+		content = append(content, s.blocks[loc[:32]]...)
+	}
+	return string(content)
+}
+
+func (s *UploadSuite) TestUpload(c *C) {
+	path := s.start(c, map[string]string{"Upload-Length": "25", "Upload-Filename": "my file:1"})
+
+	resp := s.patch(c, path, 0, "0123456789")
+	c.Check(resp.Code, Equals, http.StatusNoContent)
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "10")
+
+	resp = s.do(c, "HEAD", path, "token1", nil, "")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "10")
+	c.Check(resp.Header().Get("Upload-Length"), Equals, "25")
+
+	// Wrong offset
+	resp = s.patch(c, path, 8, "89abcdef")
+	c.Check(resp.Code, Equals, http.StatusConflict)
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "10")
+
+	// Not finished yet
+	resp = s.do(c, "POST", path+"/finish", "token1", nil, "")
+	c.Check(resp.Code, Equals, http.StatusConflict)
+
+	resp = s.patch(c, path, 10, "abcdefghijklmno")
+	c.Check(resp.Code, Equals, http.StatusNoContent)
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "25")
+
+	resp = s.do(c, "POST", path+"/finish?create_collection=true&name=foo", "token1", nil, "")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	var result map[string]string
+	c.Assert(json.NewDecoder(resp.Body).Decode(&result), IsNil)
+	c.Check(result["collection_uuid"], Equals, "zzzzz-4zz18-000000000000001")
+	c.Check(result["manifest_text"], Matches, `\. ([0-9a-f]{32}\+8 ){3}[0-9a-f]{32}\+1 0:25:my\\040file\\0721\n`)
+	c.Check(s.manifests, DeepEquals, []string{result["manifest_text"]})
+	c.Check(s.content(c, result["manifest_text"]), Equals, "0123456789abcdefghijklmno")
+
+	// The upload is gone.
+	resp = s.do(c, "HEAD", path, "token1", nil, "")
+	c.Check(resp.Code, Equals, http.StatusNotFound)
+	files, _ := filepath.Glob(filepath.Join(s.dir, "*"))
+	c.Check(files, HasLen, 0)
+}
+
+func (s *UploadSuite) TestResumeAfterRestart(c *C) {
+	path := s.start(c, nil)
+	resp := s.patch(c, path, 0, "0123456789ab")
+	c.Check(resp.Code, Equals, http.StatusNoContent)
+
+	s.restart(c)
+
+	resp = s.do(c, "HEAD", path, "token1", nil, "")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "12")
+	c.Check(resp.Header().Get("Upload-Length"), Equals, "")
+
+	resp = s.patch(c, path, 12, "cdef")
+	c.Check(resp.Code, Equals, http.StatusNoContent)
+	resp = s.do(c, "POST", path+"/finish", "token1", nil, "")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	var result map[string]string
+	c.Assert(json.NewDecoder(resp.Body).Decode(&result), IsNil)
+	c.Check(result["manifest_text"], Matches, `\. [0-9a-f]{32}\+8 [0-9a-f]{32}\+8 0:16:upload\n`)
+	c.Check(s.content(c, result["manifest_text"]), Equals, "0123456789abcdef")
+	c.Check(s.manifests, HasLen, 0)
+}
+
+// After a crash, the data file can be longer or shorter than the
+// saved offset says.
+func (s *UploadSuite) TestRestartReconcilesOffset(c *C) {
+	for _, trial := range []struct {
+		sent   string
+		extra  string
+		offset string
+	}{
+		{"0123", "45", "4"},
+		{"01234567abc", "", "11"},
+		{"01234567abc", "de", "11"},
+	} {
+		path := s.start(c, nil)
+		c.Check(s.patch(c, path, 0, trial.sent).Code, Equals, http.StatusNoContent)
+		f, err := os.OpenFile(s.um.dataPath(path[9:]), os.O_WRONLY|os.O_APPEND, 0)
+		c.Assert(err, IsNil)
+		f.Write([]byte(trial.extra))
+		f.Close()
+		s.restart(c)
+		resp := s.do(c, "HEAD", path, "token1", nil, "")
+		c.Check(resp.Header().Get("Upload-Offset"), Equals, trial.offset)
+	}
+
+	// Data file is missing
+	path := s.start(c, nil)
+	c.Check(s.patch(c, path, 0, "0123456789").Code, Equals, http.StatusNoContent)
+	c.Assert(os.Remove(s.um.dataPath(path[9:])), IsNil)
+	s.restart(c)
+	resp := s.do(c, "HEAD", path, "token1", nil, "")
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "8")
+}
+
+func (s *UploadSuite) TestOtherUser(c *C) {
+	path := s.start(c, nil)
+	for _, method := range []string{"HEAD", "PATCH", "DELETE"} {
+		resp := s.do(c, method, path, "token3", map[string]string{"Upload-Offset": "0"}, "foo")
+		c.Check(resp.Code, Equals, http.StatusNotFound)
+	}
+	resp := s.do(c, "POST", path+"/finish", "token3", nil, "")
+	c.Check(resp.Code, Equals, http.StatusNotFound)
+	resp = s.do(c, "HEAD", path, "bogustoken", nil, "")
+	c.Check(resp.Code, Equals, http.StatusForbidden)
+
+	// The blocks already written are signed for token1, so
+	// another token belonging to the same user can't continue
+	// the upload.
+	resp = s.do(c, "PATCH", path, "token2", map[string]string{"Upload-Offset": "0"}, "foo")
+	c.Check(resp.Code, Equals, http.StatusNotFound)
+	resp = s.do(c, "DELETE", path, "token2", nil, "")
+	c.Check(resp.Code, Equals, http.StatusNotFound)
+
+	resp = s.do(c, "DELETE", path, "token1", nil, "")
+	c.Check(resp.Code, Equals, http.StatusNoContent)
+	resp = s.do(c, "HEAD", path, "token1", nil, "")
+	c.Check(resp.Code, Equals, http.StatusNotFound)
+}
+
+func (s *UploadSuite) TestInvalidRequests(c *C) {
+	path := s.start(c, map[string]string{"Upload-Length": "5"})
+	resp := s.patch(c, path, 0, "012345")
+	c.Check(resp.Code, Equals, http.StatusRequestEntityTooLarge)
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "0")
+	resp = s.patch(c, path, 0, "012")
+	c.Check(resp.Code, Equals, http.StatusNoContent)
+	resp = s.patch(c, path, 3, "345")
+	c.Check(resp.Code, Equals, http.StatusRequestEntityTooLarge)
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "3")
+	resp = s.patch(c, path, 3, "34")
+	c.Check(resp.Code, Equals, http.StatusNoContent)
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "5")
+
+	for _, hdr := range []map[string]string{
+		{"Upload-Length": "-1"},
+		{"Upload-Length": "foo"},
+		{"Upload-Filename": "foo/bar"},
+		{"Upload-Filename": ".."},
+	} {
+		resp = s.do(c, "POST", "/uploads", "token1", hdr, "")
+		c.Check(resp.Code, Equals, http.StatusBadRequest)
+	}
+}
+
+func (s *UploadSuite) TestChunkedPatch(c *C) {
+	path := s.start(c, nil)
+	req, err := http.NewRequest("PATCH", "http://keep.example"+path, ioutil.NopCloser(strings.NewReader("foo")))
+	c.Assert(err, IsNil)
+	c.Assert(req.ContentLength, Equals, int64(0))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	req.Header.Set("Authorization", "OAuth2 token1")
+	req.Header.Set("Upload-Offset", "0")
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	c.Check(resp.Code, Equals, http.StatusLengthRequired)
+
+	resp = s.do(c, "HEAD", path, "token1", nil, "")
+	c.Check(resp.Header().Get("Upload-Offset"), Equals, "0")
+}
+
+func (s *UploadSuite) TestEmptyFile(c *C) {
+	path := s.start(c, map[string]string{"Upload-Length": "0"})
+	resp := s.do(c, "POST", path+"/finish", "token1", nil, "")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	var result map[string]string
+	c.Assert(json.NewDecoder(resp.Body).Decode(&result), IsNil)
+	c.Check(result["manifest_text"], Equals, ". d41d8cd98f00b204e9800998ecf8427e+0 0:0:upload\n")
+}
+
+func (s *UploadSuite) TestAuditLog(c *C) {
+	logPath := filepath.Join(s.dir, "audit.log")
+	var err error
+	audit, err = (&auditlog.Config{File: logPath, BufferSize: 10}).NewLogger(nil)
+	c.Assert(err, IsNil)
+	defer func() { audit = nil }()
+
+	path := s.start(c, nil)
+	resp := s.patch(c, path, 0, "foobar")
+	c.Check(resp.Code, Equals, http.StatusNoContent)
+	resp = s.do(c, "POST", path+"/finish", "token1", nil, "")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(audit.Close(), IsNil)
+
+	buf, err := ioutil.ReadFile(logPath)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	c.Assert(lines, HasLen, 3)
+	var events []auditlog.Event
+	for _, line := range lines {
+		var ev auditlog.Event
+		c.Check(json.Unmarshal([]byte(line), &ev), IsNil)
+		c.Check(ev.Service, Equals, "keepproxy")
+		c.Check(ev.UserUUID, Equals, "zzzzz-tpzed-000000000000001")
+		events = append(events, ev)
+	}
+	c.Check(events[0].Method, Equals, "POST")
+	c.Check(events[0].Status, Equals, http.StatusCreated)
+	c.Check(events[0].Path, Equals, "/uploads")
+	c.Check(events[1].Method, Equals, "PATCH")
+	c.Check(events[1].Status, Equals, http.StatusNoContent)
+	c.Check(events[1].Path, Equals, path)
+	c.Check(events[1].Bytes, Equals, int64(6))
+	c.Check(events[2].Method, Equals, "POST")
+	c.Check(events[2].Status, Equals, http.StatusOK)
+	c.Check(events[2].Path, Equals, path+"/finish")
+}
+
+func (s *UploadSuite) TestAuditFailClosed(c *C) {
+	path := s.start(c, nil)
+	audit = auditlog.NewLogger(failingSink{}, 1, true)
+	defer func() {
+		audit.Close()
+		audit = nil
+	}()
+	audit.Log(auditlog.Event{})
+	for deadline := time.Now().Add(5 * time.Second); audit.Ready() == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	resp := s.do(c, "POST", "/uploads", "token1", nil, "")
+	c.Check(resp.Code, Equals, http.StatusServiceUnavailable)
+	resp = s.patch(c, path, 0, "foo")
+	c.Check(resp.Code, Equals, http.StatusServiceUnavailable)
+	resp = s.do(c, "HEAD", path, "token1", nil, "")
+	c.Check(resp.Code, Equals, http.StatusServiceUnavailable)
+	c.Check(audit.Dropped(), Equals, int64(0))
+}
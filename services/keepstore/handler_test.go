@@ -18,8 +18,12 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"git.curoverse.com/arvados.git/sdk/go/trace"
 )
 
 // A RequestTester represents the parameters for an HTTP request to
@@ -955,7 +959,7 @@ func TestGetHandlerClientDisconnect(t *testing.T) {
 	ok := make(chan struct{})
 	go func() {
 		req, _ := http.NewRequest("GET", fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)), nil)
-		(&LoggingRESTRouter{MakeRESTRouter()}).ServeHTTP(resp, req)
+		httpserver.LogRequests(MakeRESTRouter()).ServeHTTP(resp, req)
 		ok <- struct{}{}
 	}()
 
@@ -1133,3 +1137,69 @@ func TestUntrashHandlerWithNoWritableVolumes(t *testing.T) {
 		http.StatusNotFound,
 		response)
 }
+
+// traceExporter keeps spans in memory.
+type traceExporter struct {
+	sync.Mutex
+	spans []trace.SpanData
+}
+
+func (te *traceExporter) Export(span trace.SpanData) {
+	te.Lock()
+	defer te.Unlock()
+	te.spans = append(te.spans, span)
+}
+
+func TestHandlerTrace(t *testing.T) {
+	defer teardown()
+	te := &traceExporter{}
+	trace.SetExporter(te)
+	defer trace.SetExporter(nil)
+
+	KeepVM = MakeTestVolumeManager(2)
+	defer KeepVM.Close()
+	rtr := trace.Handler("keepstore", MakeRESTRouter())
+	parent := "00-0123456789abcdef0123456789abcdef-0123456789abcdef-01"
+
+	for _, method := range []string{"PUT", "GET"} {
+		req, _ := http.NewRequest(method, "/"+TestHash, bytes.NewReader(TestBlock))
+		if method == "GET" {
+			req.Body = nil
+		}
+		req.Header.Set("Traceparent", parent)
+		resp := httptest.NewRecorder()
+		rtr.ServeHTTP(resp, req)
+		ExpectStatusCode(t, method, http.StatusOK, resp)
+	}
+
+	te.Lock()
+	defer te.Unlock()
+	handlerSpans := map[string]trace.SpanData{}
+	for _, span := range te.spans {
+		if span.TraceID != "0123456789abcdef0123456789abcdef" {
+			t.Errorf("span %+v has wrong trace ID", span)
+		}
+		if span.Name == "keepstore" {
+			if span.ParentID != "0123456789abcdef" {
+				t.Errorf("handler span %+v has wrong parent", span)
+			}
+			handlerSpans[span.Attributes["http.method"].(string)] = span
+		}
+	}
+	var names []string
+	for _, span := range te.spans {
+		if span.Name == "keepstore" {
+			continue
+		}
+		names = append(names, span.Name)
+		if span.ParentID != handlerSpans["PUT"].SpanID && span.ParentID != handlerSpans["GET"].SpanID {
+			t.Errorf("span %+v has wrong parent", span)
+		}
+	}
+	// PUT: wait for buffer, look for existing copies on both
+	// volumes, write to one volume. GET: wait for buffer, read
+	// from the volume that has the block.
+	if got := strings.Join(names, ","); !regexp.MustCompile(`^keepstore\.bufferWait,keepstore\.volume\.Compare,keepstore\.volume\.Compare,keepstore\.volume\.Put,keepstore\.bufferWait,(keepstore\.volume\.Get,){1,2}$`).MatchString(got + ",") {
+		t.Errorf("unexpected spans %s", got)
+	}
+}
@@ -9,9 +9,12 @@ package main
 
 import (
 	"container/list"
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/keeplocator"
+	"git.curoverse.com/arvados.git/sdk/go/trace"
 	"github.com/gorilla/mux"
 	"io"
 	"log"
@@ -86,14 +89,14 @@ func GetBlockHandler(resp http.ResponseWriter, req *http.Request) {
 	// isn't here, we can return 404 now instead of waiting for a
 	// buffer.
 
-	buf, err := getBufferForResponseWriter(resp, bufs, BlockSize)
+	buf, err := getBufferForResponseWriter(req.Context(), resp, bufs, BlockSize)
 	if err != nil {
 		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 	defer bufs.Put(buf)
 
-	size, err := GetBlock(mux.Vars(req)["hash"], buf, resp)
+	size, err := GetBlockContext(req.Context(), mux.Vars(req)["hash"], buf, resp)
 	if err != nil {
 		code := http.StatusInternalServerError
 		if err, ok := err.(*KeepError); ok {
@@ -111,7 +114,9 @@ func GetBlockHandler(resp http.ResponseWriter, req *http.Request) {
 // Get a buffer from the pool -- but give up and return a non-nil
 // error if resp implements http.CloseNotifier and tells us that the
 // client has disconnected before we get a buffer.
-func getBufferForResponseWriter(resp http.ResponseWriter, bufs *bufferPool, bufSize int) ([]byte, error) {
+func getBufferForResponseWriter(ctx context.Context, resp http.ResponseWriter, bufs *bufferPool, bufSize int) ([]byte, error) {
+	_, span := trace.StartChild(ctx, "keepstore.bufferWait")
+	defer span.End()
 	var closeNotifier <-chan bool
 	if resp, ok := resp.(http.CloseNotifier); ok {
 		closeNotifier = resp.CloseNotify()
@@ -126,6 +131,7 @@ func getBufferForResponseWriter(resp http.ResponseWriter, bufs *bufferPool, bufS
 	case buf = <-bufReady:
 		return buf, nil
 	case <-closeNotifier:
+		span.SetError(ErrClientDisconnect)
 		go func() {
 			// Even if closeNotifier happened first, we
 			// need to keep waiting for our buf so we can
@@ -159,7 +165,7 @@ func PutBlockHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	buf, err := getBufferForResponseWriter(resp, bufs, int(req.ContentLength))
+	buf, err := getBufferForResponseWriter(req.Context(), resp, bufs, int(req.ContentLength))
 	if err != nil {
 		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
 		return
@@ -172,7 +178,7 @@ func PutBlockHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	replication, err := PutBlock(buf, hash)
+	replication, err := PutBlockContext(req.Context(), buf, hash)
 	bufs.Put(buf)
 
 	if err != nil {
@@ -549,11 +555,22 @@ func UntrashHandler(resp http.ResponseWriter, req *http.Request) {
 // DiskHashError.
 //
 func GetBlock(hash string, buf []byte, resp http.ResponseWriter) (int, error) {
+	return GetBlockContext(context.Background(), hash, buf, resp)
+}
+
+// GetBlockContext is like GetBlock, but if ctx carries a trace span,
+// each volume read is recorded as a child span.
+func GetBlockContext(ctx context.Context, hash string, buf []byte, resp http.ResponseWriter) (int, error) {
 	// Attempt to read the requested hash from a keep volume.
 	errorToCaller := NotFoundError
 
 	for _, vol := range KeepVM.AllReadable() {
+		span := volumeSpan(ctx, "Get", vol)
 		size, err := vol.Get(hash, buf)
+		if !os.IsNotExist(err) {
+			span.SetError(err)
+		}
+		span.End()
 		if err != nil {
 			// IsNotExist is an expected error and may be
 			// ignored. All other errors are logged. In
@@ -613,6 +630,12 @@ func GetBlock(hash string, buf []byte, resp http.ResponseWriter) (int, error) {
 //          provide as much detail as possible.
 //
 func PutBlock(block []byte, hash string) (int, error) {
+	return PutBlockContext(context.Background(), block, hash)
+}
+
+// PutBlockContext is like PutBlock, but if ctx carries a trace span,
+// each volume operation is recorded as a child span.
+func PutBlockContext(ctx context.Context, block []byte, hash string) (int, error) {
 	// Check that BLOCK's checksum matches HASH.
 	blockhash := fmt.Sprintf("%x", md5.Sum(block))
 	if blockhash != hash {
@@ -623,14 +646,14 @@ func PutBlock(block []byte, hash string) (int, error) {
 	// If we already have this data, it's intact on disk, and we
 	// can update its timestamp, return success. If we have
 	// different data with the same hash, return failure.
-	if n, err := CompareAndTouch(hash, block); err == nil || err == CollisionError {
+	if n, err := CompareAndTouch(ctx, hash, block); err == nil || err == CollisionError {
 		return n, err
 	}
 
 	// Choose a Keep volume to write to.
 	// If this volume fails, try all of the volumes in order.
 	if vol := KeepVM.NextWritable(); vol != nil {
-		if err := vol.Put(hash, block); err == nil {
+		if err := putToVolume(ctx, vol, hash, block); err == nil {
 			return vol.Replication(), nil // success!
 		}
 	}
@@ -643,7 +666,7 @@ func PutBlock(block []byte, hash string) (int, error) {
 
 	allFull := true
 	for _, vol := range writables {
-		err := vol.Put(hash, block)
+		err := putToVolume(ctx, vol, hash, block)
 		if err == nil {
 			return vol.Replication(), nil // success!
 		}
@@ -669,10 +692,16 @@ func PutBlock(block []byte, hash string) (int, error) {
 // the relevant block's modification time in order to protect it from
 // premature garbage collection. Otherwise, it returns a non-nil
 // error.
-func CompareAndTouch(hash string, buf []byte) (int, error) {
+func CompareAndTouch(ctx context.Context, hash string, buf []byte) (int, error) {
 	var bestErr error = NotFoundError
 	for _, vol := range KeepVM.AllWritable() {
-		if err := vol.Compare(hash, buf); err == CollisionError {
+		span := volumeSpan(ctx, "Compare", vol)
+		err := vol.Compare(hash, buf)
+		if err != nil && !os.IsNotExist(err) {
+			span.SetError(err)
+		}
+		span.End()
+		if err == CollisionError {
 			// Stop if we have a block with same hash but
 			// different content. (It will be impossible
 			// to tell which one is wanted if we have
@@ -702,14 +731,30 @@ func CompareAndTouch(hash string, buf []byte) (int, error) {
 	return 0, bestErr
 }
 
-var validLocatorRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+// putToVolume writes a block to vol, recording a trace span if ctx
+// carries one.
+func putToVolume(ctx context.Context, vol Volume, hash string, block []byte) error {
+	span := volumeSpan(ctx, "Put", vol)
+	defer span.End()
+	err := vol.Put(hash, block)
+	span.SetError(err)
+	return err
+}
+
+// volumeSpan starts a span for an operation on vol, if ctx carries a
+// trace span.
+func volumeSpan(ctx context.Context, op string, vol Volume) *trace.Span {
+	_, span := trace.StartChild(ctx, "keepstore.volume."+op)
+	span.SetAttribute("volume", vol.String())
+	return span
+}
 
 // IsValidLocator returns true if the specified string is a valid Keep locator.
 //   When Keep is extended to support hash types other than MD5,
-//   this should be updated to cover those as well.
+//   keeplocator.IsHash should be updated to cover those as well.
 //
 func IsValidLocator(loc string) bool {
-	return validLocatorRe.MatchString(loc)
+	return keeplocator.IsHash(loc)
 }
 
 var authRe = regexp.MustCompile(`^OAuth2\s+(.*)`)
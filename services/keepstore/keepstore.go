@@ -7,6 +7,7 @@ import (
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/httpserver"
 	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/trace"
 	"io/ioutil"
 	"log"
 	"net"
@@ -316,14 +317,18 @@ func main() {
 		log.Printf("-max-requests <1 or not specified; defaulting to maxBuffers * 2 == %d", maxRequests)
 	}
 
+	if err := trace.ConfigureFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+
 	// Start a round-robin VolumeManager with the volumes we have found.
 	KeepVM = MakeRRVolumeManager(volumes)
 
-	// Middleware stack: logger, maxRequests limiter, method handlers
-	http.Handle("/", &LoggingRESTRouter{
-		httpserver.NewRequestLimiter(maxRequests,
-			MakeRESTRouter()),
-	})
+	// Middleware stack: logger, tracer, maxRequests limiter, method handlers
+	http.Handle("/", httpserver.LogRequests(
+		trace.Handler("keepstore",
+			httpserver.NewRequestLimiter(maxRequests,
+				MakeRESTRouter()))))
 
 	// Set up a TCP listener.
 	listener, err := net.Listen("tcp", listen)
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/keeplocator"
 	"time"
 )
 
@@ -13,7 +13,7 @@ var PermissionSecret []byte
 // SignLocator takes a blobLocator, an apiToken and an expiry time, and
 // returns a signed locator string.
 func SignLocator(blobLocator, apiToken string, expiry time.Time) string {
-	return keepclient.SignLocator(blobLocator, apiToken, expiry, blobSignatureTTL, PermissionSecret)
+	return keeplocator.SignLocator(blobLocator, apiToken, expiry, blobSignatureTTL, PermissionSecret)
 }
 
 // VerifySignature returns nil if the signature on the signedLocator
@@ -22,8 +22,8 @@ func SignLocator(blobLocator, apiToken string, expiry time.Time) string {
 // something the client could have figured out independently) or
 // PermissionError.
 func VerifySignature(signedLocator, apiToken string) error {
-	err := keepclient.VerifySignature(signedLocator, apiToken, blobSignatureTTL, PermissionSecret)
-	if err == keepclient.ErrSignatureExpired {
+	err := keeplocator.VerifySignature(signedLocator, apiToken, blobSignatureTTL, PermissionSecret)
+	if err == keeplocator.ErrSignatureExpired {
 		return ExpiredError
 	} else if err != nil {
 		return PermissionError